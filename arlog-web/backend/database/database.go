@@ -78,6 +78,8 @@ func Migrate() error {
 	err := DB.AutoMigrate(
 		&models.Team{},
 		&models.Permission{},
+		&models.ArchiveSegment{},
+		&models.AlertRule{},
 	)
 
 	if err != nil {
@@ -0,0 +1,131 @@
+package handlers
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+
+	"arlog/backend/database"
+	"arlog/backend/middleware"
+	"arlog/backend/models"
+)
+
+var (
+	// errNotAuthenticated is returned when a request carries no user
+	errNotAuthenticated = errors.New("authentication required")
+	// errForbidden is returned when the user's teams have no permission for a namespace
+	errForbidden = errors.New("you do not have access to this namespace")
+	// errNotAdmin is returned when the user is in none of the ADMIN_GROUPS
+	errNotAdmin = errors.New("administrator access required")
+)
+
+// defaultClusterName names the cluster the backend's Kubernetes client points at
+const defaultClusterName = "dev-cluster"
+
+// clusterName returns the name under which permissions for the connected cluster are stored
+func clusterName() string {
+	if name := os.Getenv("CLUSTER_NAME"); name != "" {
+		return name
+	}
+	return defaultClusterName
+}
+
+// resolveCluster validates a requested cluster name; an empty name means the connected cluster
+func resolveCluster(requested string) (string, error) {
+	cluster := clusterName()
+	if requested != "" && requested != cluster {
+		return "", fmt.Errorf("unknown cluster: %q", requested)
+	}
+	return cluster, nil
+}
+
+// namespaceAccess records who was granted access to a namespace, and through which team
+type namespaceAccess struct {
+	User *middleware.UserInfo
+	// Team is the team whose permission grants access; with several, the first by name
+	Team string
+}
+
+// authorizeNamespace checks that the user making the request belongs to a team with permission
+// to read logs in namespace of cluster
+func authorizeNamespace(r *http.Request, cluster, namespace string) (*namespaceAccess, error) {
+	user, ok := middleware.GetUserFromContext(r.Context())
+	if !ok {
+		return nil, errNotAuthenticated
+	}
+	if len(user.Groups) == 0 {
+		return nil, errForbidden
+	}
+
+	var teams []string
+	result := database.DB.Model(&models.Permission{}).
+		Joins("JOIN teams ON teams.id = permissions.team_id AND teams.deleted_at IS NULL").
+		Where("teams.okta_group_id IN ? AND permissions.cluster_name = ? AND permissions.namespace = ?",
+			user.Groups, cluster, namespace).
+		Order("teams.team_name").
+		Distinct().
+		Pluck("teams.team_name", &teams)
+	if result.Error != nil {
+		return nil, fmt.Errorf("failed to check permissions: %w", result.Error)
+	}
+	if len(teams) == 0 {
+		return nil, errForbidden
+	}
+	return &namespaceAccess{User: user, Team: teams[0]}, nil
+}
+
+// authorizedNamespaces returns the namespaces of cluster that the user making the request may read logs in,
+// through any of their teams, in name order
+func authorizedNamespaces(r *http.Request, cluster string) ([]string, error) {
+	user, ok := middleware.GetUserFromContext(r.Context())
+	if !ok {
+		return nil, errNotAuthenticated
+	}
+	if len(user.Groups) == 0 {
+		return nil, errForbidden
+	}
+
+	var namespaces []string
+	result := database.DB.Model(&models.Permission{}).
+		Joins("JOIN teams ON teams.id = permissions.team_id AND teams.deleted_at IS NULL").
+		Where("teams.okta_group_id IN ? AND permissions.cluster_name = ?", user.Groups, cluster).
+		Order("permissions.namespace").
+		Distinct().
+		Pluck("permissions.namespace", &namespaces)
+	if result.Error != nil {
+		return nil, fmt.Errorf("failed to check permissions: %w", result.Error)
+	}
+	if len(namespaces) == 0 {
+		return nil, errForbidden
+	}
+	return namespaces, nil
+}
+
+// authorizeAdmin checks that the user making the request belongs to one of the Okta groups listed,
+// comma-separated, in ADMIN_GROUPS
+func authorizeAdmin(r *http.Request) (*middleware.UserInfo, error) {
+	user, ok := middleware.GetUserFromContext(r.Context())
+	if !ok {
+		return nil, errNotAuthenticated
+	}
+	for _, group := range strings.Split(os.Getenv("ADMIN_GROUPS"), ",") {
+		if group = strings.TrimSpace(group); group != "" && containsString(user.Groups, group) {
+			return user, nil
+		}
+	}
+	return nil, errNotAdmin
+}
+
+// accessErrorStatus maps an authorization error to an HTTP status code
+func accessErrorStatus(err error) int {
+	switch {
+	case errors.Is(err, errNotAuthenticated):
+		return http.StatusUnauthorized
+	case errors.Is(err, errForbidden), errors.Is(err, errNotAdmin):
+		return http.StatusForbidden
+	default:
+		return http.StatusInternalServerError
+	}
+}
@@ -0,0 +1,566 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"arlog/backend/database"
+	"arlog/backend/middleware"
+	"arlog/backend/models"
+	"arlog/backend/services"
+
+	"gorm.io/gorm"
+)
+
+// Alert settings used when the environment does not set them
+const defaultAlertRefreshSeconds = int(services.DefaultAlertRefreshInterval / time.Second)
+
+var (
+	// errAlertNotFound is returned when a rule does not exist or belongs to none of the user's teams
+	errAlertNotFound = errors.New("alert rule not found")
+	// errInvalidAlertID is returned when the id of a rule is not a number
+	errInvalidAlertID = errors.New("invalid id parameter")
+)
+
+// StartAlertWatcher starts evaluating the alert rules of the connected cluster in the background
+// until ctx is cancelled
+func StartAlertWatcher(ctx context.Context) error {
+	k8sService, err := services.NewKubernetesService()
+	if err != nil {
+		return fmt.Errorf("failed to connect to Kubernetes cluster: %w", err)
+	}
+
+	watcher := services.NewAlertWatcher(services.AlertConfig{
+		Cluster:         clusterName(),
+		RefreshInterval: time.Duration(envLimit("ALERT_REFRESH_SECONDS", defaultAlertRefreshSeconds)) * time.Second,
+		MaxStreams:      envLimit("ALERT_MAX_STREAMS", services.DefaultAlertMaxStreams),
+	}, alertStore{})
+	go watcher.Run(ctx, k8sService)
+	return nil
+}
+
+// alertStore keeps the alert rules in the database
+type alertStore struct{}
+
+// AlertRules implements services.AlertStore
+// Rules of deleted teams, and rules whose team lost its permission for the namespace, are left out
+func (alertStore) AlertRules(cluster string) ([]services.AlertRule, error) {
+	var rules []models.AlertRule
+	result := database.DB.Preload("Team").
+		Joins("JOIN teams ON teams.id = alert_rules.team_id AND teams.deleted_at IS NULL").
+		Where("alert_rules.cluster_name = ? AND alert_rules.enabled", cluster).
+		Where("EXISTS (SELECT 1 FROM permissions WHERE permissions.team_id = alert_rules.team_id AND " +
+			"permissions.cluster_name = alert_rules.cluster_name AND permissions.namespace = alert_rules.namespace AND " +
+			"permissions.deleted_at IS NULL)").
+		Order("alert_rules.id").
+		Find(&rules)
+	if result.Error != nil {
+		return nil, result.Error
+	}
+
+	compiled := make([]services.AlertRule, 0, len(rules))
+	for i := range rules {
+		rule, err := compileAlertRule(&rules[i])
+		if err != nil {
+			log.Printf("Skipping invalid alert rule %d: %v", rules[i].ID, err)
+			continue
+		}
+		compiled = append(compiled, rule)
+	}
+	return compiled, nil
+}
+
+// RecordFiring implements services.AlertStore
+// The update leaves updated_at alone, so the watcher does not take the firing for an edit of the rule
+func (alertStore) RecordFiring(ruleID uint, firedAt time.Time, deliveryErr error) error {
+	lastError := ""
+	if deliveryErr != nil {
+		lastError = deliveryErr.Error()
+	}
+	return database.DB.Model(&models.AlertRule{ID: ruleID}).
+		UpdateColumns(map[string]interface{}{"last_fired_at": firedAt, "last_error": lastError}).Error
+}
+
+// compileAlertRule validates a stored rule and compiles it for the watcher
+func compileAlertRule(rule *models.AlertRule) (services.AlertRule, error) {
+	query, err := services.ParseLogQuery(rule.Query)
+	if err != nil {
+		return services.AlertRule{}, fmt.Errorf("invalid query: %w", err)
+	}
+	if err := validateWebhookURL(rule.WebhookURL); err != nil {
+		return services.AlertRule{}, err
+	}
+
+	compiled := services.AlertRule{
+		ID:            rule.ID,
+		Name:          rule.Name,
+		Namespace:     rule.Namespace,
+		Selector:      rule.Selector,
+		Container:     rule.Container,
+		Query:         query,
+		Threshold:     rule.Threshold,
+		Window:        time.Duration(rule.WindowSeconds) * time.Second,
+		Cooldown:      time.Duration(rule.CooldownSeconds) * time.Second,
+		WebhookURL:    rule.WebhookURL,
+		WebhookSecret: rule.WebhookSecret,
+		Version:       rule.UpdatedAt,
+	}
+	if rule.Team != nil {
+		compiled.TeamName = rule.Team.TeamName
+	}
+	if rule.LastFiredAt != nil {
+		compiled.LastFired = *rule.LastFiredAt
+	}
+	return compiled, compiled.Validate()
+}
+
+// validateWebhookURL checks that a webhook is an absolute http or https URL on a public host
+func validateWebhookURL(value string) error {
+	parsed, err := url.Parse(value)
+	if err != nil || (parsed.Scheme != "http" && parsed.Scheme != "https") || parsed.Hostname() == "" {
+		return fmt.Errorf("webhookUrl must be an absolute http or https URL")
+	}
+	if err := services.ValidateWebhookHost(parsed.Hostname()); err != nil {
+		return fmt.Errorf("invalid webhookUrl: %w", err)
+	}
+	return nil
+}
+
+// AlertRulesResponse represents the response for the alert rules of the user's teams
+type AlertRulesResponse struct {
+	Success bool               `json:"success"`
+	Rules   []models.AlertRule `json:"rules,omitempty"`
+	Message string             `json:"message,omitempty"`
+}
+
+// ListAlertRules lists the alert rules of the user's teams
+// Query parameters:
+//   - namespace: Only list the rules of this namespace (optional)
+//   - cluster: The cluster name (optional, defaults to the connected cluster)
+func ListAlertRules(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	query := r.URL.Query()
+	cluster, err := resolveCluster(query.Get("cluster"))
+	if err != nil {
+		writeAlertRulesError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	user, ok := middleware.GetUserFromContext(r.Context())
+	if !ok {
+		writeAlertRulesError(w, http.StatusUnauthorized, errNotAuthenticated.Error())
+		return
+	}
+
+	rules := []models.AlertRule{}
+	db := database.DB.Preload("Team").
+		Joins("JOIN teams ON teams.id = alert_rules.team_id AND teams.deleted_at IS NULL").
+		Where("teams.okta_group_id IN ? AND alert_rules.cluster_name = ?", user.Groups, cluster)
+	if namespace := query.Get("namespace"); namespace != "" {
+		db = db.Where("alert_rules.namespace = ?", namespace)
+	}
+	if len(user.Groups) > 0 {
+		if err := db.Order("alert_rules.namespace, alert_rules.name").Find(&rules).Error; err != nil {
+			log.Printf("Error listing alert rules: %v", err)
+			writeAlertRulesError(w, http.StatusInternalServerError, "Failed to list alert rules")
+			return
+		}
+	}
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(AlertRulesResponse{Success: true, Rules: rules})
+}
+
+// writeAlertRulesError writes a failed AlertRulesResponse
+func writeAlertRulesError(w http.ResponseWriter, status int, message string) {
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(AlertRulesResponse{Success: false, Message: message})
+}
+
+// AlertRuleResponse represents the response for creating or changing an alert rule
+// WebhookSecret is only returned when the secret was generated, on creation or rotation
+type AlertRuleResponse struct {
+	Success       bool              `json:"success"`
+	Rule          *models.AlertRule `json:"rule,omitempty"`
+	WebhookSecret string            `json:"webhookSecret,omitempty"`
+	Message       string            `json:"message,omitempty"`
+}
+
+// CreateAlertRule creates an alert rule for one of the user's teams
+// Query parameters:
+//   - namespace: The Kubernetes namespace whose logs are watched (required)
+//   - name: The rule name (required)
+//   - q: The condition, a query as for SearchLogs, e.g. `OutOfMemoryError` or `level:error status:5*` (required)
+//   - webhookUrl: The http or https URL notifications are posted to (required); it must resolve to a
+//     public address, and redirects are not followed
+//   - threshold: Matching lines within the window that fire the rule (default: 1)
+//   - windowSeconds: The window matches are counted over (default: 300, between 10 and 86400)
+//   - cooldownSeconds: How long the rule stays silent after firing (default: 900, at most 604800)
+//   - selector: Only watch pods matching this label selector (optional)
+//   - container: Only watch containers with this name (optional)
+//   - enabled: Whether the rule is evaluated (default: true)
+//   - teamId: The owning team (optional, defaults to the first team by name with access to the namespace)
+//   - cluster: The cluster name (optional, defaults to the connected cluster)
+//
+// The webhook secret is generated and returned in the response; it cannot be read back later
+func CreateAlertRule(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	query := r.URL.Query()
+	namespace := query.Get("namespace")
+	if namespace == "" {
+		writeAlertRuleError(w, http.StatusBadRequest, "namespace query parameter is required")
+		return
+	}
+
+	cluster, err := resolveCluster(query.Get("cluster"))
+	if err != nil {
+		writeAlertRuleError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	access, err := authorizeNamespace(r, cluster, namespace)
+	if err != nil {
+		if status := accessErrorStatus(err); status == http.StatusInternalServerError {
+			log.Printf("Error authorizing alert rule for namespace %s: %v", namespace, err)
+		}
+		writeAlertRuleError(w, accessErrorStatus(err), err.Error())
+		return
+	}
+
+	// The owning team must be one of the user's teams with a permission for the namespace
+	team := database.DB.Model(&models.Team{}).
+		Joins("JOIN permissions ON permissions.team_id = teams.id AND permissions.deleted_at IS NULL").
+		Where("teams.okta_group_id IN ? AND permissions.cluster_name = ? AND permissions.namespace = ?",
+			access.User.Groups, cluster, namespace)
+	if value := query.Get("teamId"); value != "" {
+		teamID, err := strconv.ParseUint(value, 10, 64)
+		if err != nil {
+			writeAlertRuleError(w, http.StatusBadRequest, fmt.Sprintf("invalid teamId parameter: %q", value))
+			return
+		}
+		team = team.Where("teams.id = ?", teamID)
+	} else {
+		team = team.Where("teams.team_name = ?", access.Team)
+	}
+	var owner models.Team
+	if err := team.First(&owner).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			writeAlertRuleError(w, http.StatusForbidden, "the team has no access to this namespace")
+			return
+		}
+		log.Printf("Error finding the team of an alert rule: %v", err)
+		writeAlertRuleError(w, http.StatusInternalServerError, "Failed to create alert rule")
+		return
+	}
+
+	secret, err := services.GenerateWebhookSecret()
+	if err != nil {
+		log.Printf("Error generating webhook secret: %v", err)
+		writeAlertRuleError(w, http.StatusInternalServerError, "Failed to create alert rule")
+		return
+	}
+	rule := models.AlertRule{
+		TeamID:          owner.ID,
+		Team:            &owner,
+		ClusterName:     cluster,
+		Namespace:       namespace,
+		Threshold:       1,
+		WindowSeconds:   int(services.DefaultAlertWindow / time.Second),
+		CooldownSeconds: int(services.DefaultAlertCooldown / time.Second),
+		WebhookSecret:   secret,
+		Enabled:         true,
+	}
+	if err := applyAlertRuleParams(query, &rule); err != nil {
+		writeAlertRuleError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	if err := database.DB.Omit("Team").Create(&rule).Error; err != nil {
+		log.Printf("Error creating alert rule: %v", err)
+		writeAlertRuleError(w, http.StatusInternalServerError, "Failed to create alert rule")
+		return
+	}
+
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(AlertRuleResponse{Success: true, Rule: &rule, WebhookSecret: secret})
+}
+
+// UpdateAlertRule changes an alert rule of one of the user's teams
+// Query parameters:
+//   - id: The rule (required)
+//   - name, q, webhookUrl, threshold, windowSeconds, cooldownSeconds, selector, container, enabled:
+//     As for CreateAlertRule; parameters that are not given keep their value
+//   - rotateSecret: Generate a new webhook secret, returned in the response
+//
+// The watcher restarts the rule's evaluation within ALERT_REFRESH_SECONDS
+func UpdateAlertRule(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	query := r.URL.Query()
+	rule, err := authorizeAlertRule(r, query.Get("id"))
+	if err != nil {
+		writeAlertRuleError(w, alertErrorStatus(err), err.Error())
+		return
+	}
+
+	original := *rule
+	if err := applyAlertRuleParams(query, rule); err != nil {
+		writeAlertRuleError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	secret := ""
+	if value := query.Get("rotateSecret"); value != "" {
+		rotate, err := strconv.ParseBool(value)
+		if err != nil {
+			writeAlertRuleError(w, http.StatusBadRequest, fmt.Sprintf("invalid rotateSecret parameter: %q", value))
+			return
+		}
+		if rotate {
+			if secret, err = services.GenerateWebhookSecret(); err != nil {
+				log.Printf("Error generating webhook secret: %v", err)
+				writeAlertRuleError(w, http.StatusInternalServerError, "Failed to update alert rule")
+				return
+			}
+			rule.WebhookSecret = secret
+		}
+	}
+
+	// Only the changed columns are written, so a firing recorded meanwhile is not overwritten
+	updates := alertRuleChanges(&original, rule)
+	if len(updates) > 0 {
+		err := database.DB.Model(&models.AlertRule{ID: rule.ID}).Updates(updates).Error
+		if err == nil {
+			err = database.DB.Preload("Team").First(rule, rule.ID).Error
+		}
+		if err != nil {
+			log.Printf("Error updating alert rule %d: %v", rule.ID, err)
+			writeAlertRuleError(w, http.StatusInternalServerError, "Failed to update alert rule")
+			return
+		}
+	}
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(AlertRuleResponse{Success: true, Rule: rule, WebhookSecret: secret})
+}
+
+// alertRuleChanges returns the columns of the editable fields that differ between before and after
+func alertRuleChanges(before, after *models.AlertRule) map[string]interface{} {
+	changes := make(map[string]interface{})
+	for column, values := range map[string][2]interface{}{
+		"name":             {before.Name, after.Name},
+		"query":            {before.Query, after.Query},
+		"webhook_url":      {before.WebhookURL, after.WebhookURL},
+		"webhook_secret":   {before.WebhookSecret, after.WebhookSecret},
+		"selector":         {before.Selector, after.Selector},
+		"container":        {before.Container, after.Container},
+		"threshold":        {before.Threshold, after.Threshold},
+		"window_seconds":   {before.WindowSeconds, after.WindowSeconds},
+		"cooldown_seconds": {before.CooldownSeconds, after.CooldownSeconds},
+		"enabled":          {before.Enabled, after.Enabled},
+	} {
+		if values[0] != values[1] {
+			changes[column] = values[1]
+		}
+	}
+	return changes
+}
+
+// DeleteAlertRule deletes an alert rule of one of the user's teams
+// Query parameters:
+//   - id: The rule (required)
+func DeleteAlertRule(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	rule, err := authorizeAlertRule(r, r.URL.Query().Get("id"))
+	if err != nil {
+		writeAlertRuleError(w, alertErrorStatus(err), err.Error())
+		return
+	}
+
+	if err := database.DB.Delete(rule).Error; err != nil {
+		log.Printf("Error deleting alert rule %d: %v", rule.ID, err)
+		writeAlertRuleError(w, http.StatusInternalServerError, "Failed to delete alert rule")
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(AlertRuleResponse{Success: true, Rule: rule})
+}
+
+// writeAlertRuleError writes a failed AlertRuleResponse
+func writeAlertRuleError(w http.ResponseWriter, status int, message string) {
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(AlertRuleResponse{Success: false, Message: message})
+}
+
+// applyAlertRuleParams sets the fields of rule given in query and validates the result
+func applyAlertRuleParams(query url.Values, rule *models.AlertRule) error {
+	for name, target := range map[string]*string{
+		"name":       &rule.Name,
+		"q":          &rule.Query,
+		"webhookUrl": &rule.WebhookURL,
+	} {
+		if value := query.Get(name); value != "" {
+			*target = value
+		}
+	}
+	// An empty selector or container widens the scope again
+	if query.Has("selector") {
+		rule.Selector = query.Get("selector")
+	}
+	if query.Has("container") {
+		rule.Container = query.Get("container")
+	}
+
+	for name, target := range map[string]*int{
+		"threshold":       &rule.Threshold,
+		"windowSeconds":   &rule.WindowSeconds,
+		"cooldownSeconds": &rule.CooldownSeconds,
+	} {
+		if value := query.Get(name); value != "" {
+			parsed, err := strconv.Atoi(value)
+			if err != nil {
+				return fmt.Errorf("invalid %s parameter: %q", name, value)
+			}
+			*target = parsed
+		}
+	}
+	if value := query.Get("enabled"); value != "" {
+		enabled, err := strconv.ParseBool(value)
+		if err != nil {
+			return fmt.Errorf("invalid enabled parameter: %q", value)
+		}
+		rule.Enabled = enabled
+	}
+
+	if rule.Query == "" {
+		return fmt.Errorf("q query parameter is required")
+	}
+	if rule.WebhookURL == "" {
+		return fmt.Errorf("webhookUrl query parameter is required")
+	}
+	_, err := compileAlertRule(rule)
+	return err
+}
+
+// authorizeAlertRule loads a rule and checks that it belongs to one of the user's teams and that the
+// user may still read the logs of its namespace
+func authorizeAlertRule(r *http.Request, id string) (*models.AlertRule, error) {
+	ruleID, err := strconv.ParseUint(id, 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %q", errInvalidAlertID, id)
+	}
+	user, ok := middleware.GetUserFromContext(r.Context())
+	if !ok {
+		return nil, errNotAuthenticated
+	}
+
+	var rule models.AlertRule
+	err = database.DB.Preload("Team").
+		Joins("JOIN teams ON teams.id = alert_rules.team_id AND teams.deleted_at IS NULL").
+		Where("teams.okta_group_id IN ?", user.Groups).
+		First(&rule, "alert_rules.id = ?", ruleID).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) || (err == nil && len(user.Groups) == 0) {
+		return nil, errAlertNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to load alert rule: %w", err)
+	}
+
+	if _, err := authorizeNamespace(r, rule.ClusterName, rule.Namespace); err != nil {
+		return nil, err
+	}
+	return &rule, nil
+}
+
+// alertErrorStatus maps an error of authorizeAlertRule to an HTTP status code
+func alertErrorStatus(err error) int {
+	switch {
+	case errors.Is(err, errAlertNotFound):
+		return http.StatusNotFound
+	case errors.Is(err, errNotAuthenticated), errors.Is(err, errForbidden):
+		return accessErrorStatus(err)
+	case errors.Is(err, errInvalidAlertID):
+		return http.StatusBadRequest
+	default:
+		log.Printf("Error authorizing alert rule: %v", err)
+		return http.StatusInternalServerError
+	}
+}
+
+// AlertEvaluationResponse represents the response for replaying logs through an alert rule
+type AlertEvaluationResponse struct {
+	Success    bool                      `json:"success"`
+	Evaluation *services.AlertEvaluation `json:"evaluation,omitempty"`
+	Message    string                    `json:"message,omitempty"`
+}
+
+// TestAlertRule replays a window of past logs through an alert rule and returns the notifications it
+// would have sent, without sending them
+// Query parameters:
+//   - id: The rule (required)
+//   - sinceSeconds, sinceTime, untilTime: The time window, as for GetLogStats (default: the last hour)
+//
+// The replay gives up after searchTimeout and returns the firings found so far, flagged as partial
+func TestAlertRule(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	query := r.URL.Query()
+	rule, err := authorizeAlertRule(r, query.Get("id"))
+	if err != nil {
+		writeAlertEvaluationError(w, alertErrorStatus(err), err.Error())
+		return
+	}
+	since, until, err := parseLogWindow(query)
+	if err != nil {
+		writeAlertEvaluationError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	compiled, err := compileAlertRule(rule)
+	if err != nil {
+		writeAlertEvaluationError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	// A replay counts as one stream against the caps, like a search
+	user, _ := middleware.GetUserFromContext(r.Context())
+	lease, err := streamQuota.acquire(user.Sub, compiled.TeamName, rule.ClusterName)
+	if err != nil {
+		writeAlertEvaluationError(w, http.StatusTooManyRequests, err.Error())
+		return
+	}
+	defer lease.release()
+
+	k8sService, err := services.NewKubernetesService()
+	if err != nil {
+		log.Printf("Error creating Kubernetes service: %v", err)
+		writeAlertEvaluationError(w, http.StatusInternalServerError, "Failed to connect to Kubernetes cluster")
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), searchTimeout)
+	defer cancel()
+
+	evaluation, err := k8sService.EvaluateAlertRule(ctx, rule.ClusterName, compiled, since, until)
+	if err != nil {
+		log.Printf("Error evaluating alert rule %d: %v", rule.ID, err)
+		writeAlertEvaluationError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(AlertEvaluationResponse{Success: true, Evaluation: evaluation})
+}
+
+// writeAlertEvaluationError writes a failed AlertEvaluationResponse
+func writeAlertEvaluationError(w http.ResponseWriter, status int, message string) {
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(AlertEvaluationResponse{Success: false, Message: message})
+}
@@ -0,0 +1,318 @@
+package handlers
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+
+	"arlog/backend/database"
+	"arlog/backend/models"
+	"arlog/backend/services"
+)
+
+// Archive settings used when the environment does not set them
+const (
+	defaultArchiveSegmentMinutes = int(services.DefaultArchiveSegmentDuration / time.Minute)
+	defaultArchiveSegmentMB      = int(services.DefaultArchiveSegmentBytes / (1024 * 1024))
+	defaultArchiveRefreshSeconds = int(services.DefaultArchiveRefreshInterval / time.Second)
+	defaultCompactionMinutes     = int(services.DefaultCompactionInterval / time.Minute)
+	defaultRetentionDays         = 30
+)
+
+// logArchive keeps the logs of opted-in namespaces after their pods are gone; it is nil when archiving is disabled
+var logArchive *services.LogArchive
+
+// StartLogArchive starts archiving the logs of opted-in namespaces when ARCHIVE_DIR is set
+// The collector and the compaction that enforces retention run in the background until ctx is cancelled
+func StartLogArchive(ctx context.Context) error {
+	dir := os.Getenv("ARCHIVE_DIR")
+	if dir == "" {
+		return nil
+	}
+
+	archive, err := services.NewLogArchive(services.ArchiveConfig{
+		Dir:                dir,
+		Cluster:            clusterName(),
+		SegmentDuration:    time.Duration(envLimit("ARCHIVE_SEGMENT_MINUTES", defaultArchiveSegmentMinutes)) * time.Minute,
+		SegmentBytes:       int64(envLimit("ARCHIVE_SEGMENT_MAX_MB", defaultArchiveSegmentMB)) * 1024 * 1024,
+		RefreshInterval:    time.Duration(envLimit("ARCHIVE_REFRESH_SECONDS", defaultArchiveRefreshSeconds)) * time.Second,
+		MaxStreams:         envLimit("ARCHIVE_MAX_STREAMS", services.DefaultArchiveMaxStreams),
+		CompactionInterval: time.Duration(envLimit("ARCHIVE_COMPACTION_MINUTES", defaultCompactionMinutes)) * time.Minute,
+		RetentionDays:      envLimit("ARCHIVE_RETENTION_DAYS", defaultRetentionDays),
+		RetentionMaxBytes:  int64(envLimit("ARCHIVE_RETENTION_MAX_GB", 0)) * 1024 * 1024 * 1024,
+	}, archiveIndex{})
+	if err != nil {
+		return err
+	}
+
+	k8sService, err := services.NewKubernetesService()
+	if err != nil {
+		return fmt.Errorf("failed to connect to Kubernetes cluster: %w", err)
+	}
+
+	logArchive = archive
+	go archive.Collect(ctx, k8sService)
+	go archive.RunCompaction(ctx)
+	return nil
+}
+
+// archiveIndex keeps the index of the log archive in the database
+type archiveIndex struct{}
+
+// ArchiveNamespaces implements services.ArchiveIndex
+// A namespace opted in by several teams is owned by the one created first
+func (archiveIndex) ArchiveNamespaces(cluster string) ([]services.ArchiveNamespace, error) {
+	var namespaces []services.ArchiveNamespace
+	result := database.DB.Model(&models.Permission{}).
+		Select("permissions.namespace, MIN(permissions.team_id) AS team_id").
+		Joins("JOIN teams ON teams.id = permissions.team_id AND teams.deleted_at IS NULL").
+		Where("permissions.cluster_name = ? AND permissions.archive_logs", cluster).
+		Group("permissions.namespace").
+		Scan(&namespaces)
+	return namespaces, result.Error
+}
+
+// AddSegment implements services.ArchiveIndex
+func (archiveIndex) AddSegment(segment *models.ArchiveSegment) error {
+	return database.DB.Create(segment).Error
+}
+
+// FindSegments implements services.ArchiveIndex
+func (archiveIndex) FindSegments(cluster, namespace, podName, container string) ([]models.ArchiveSegment, error) {
+	query := database.DB.Where("cluster_name = ? AND namespace = ? AND pod_name = ?", cluster, namespace, podName)
+	if container != "" {
+		query = query.Where("container_name = ?", container)
+	}
+
+	var segments []models.ArchiveSegment
+	result := query.Order("start_time, id").Find(&segments)
+	return segments, result.Error
+}
+
+// LastArchived implements services.ArchiveIndex
+func (archiveIndex) LastArchived(cluster, namespace, podName, container string) (time.Time, error) {
+	var last sql.NullTime
+	err := database.DB.Model(&models.ArchiveSegment{}).
+		Select("MAX(end_time)").
+		Where("cluster_name = ? AND namespace = ? AND pod_name = ? AND container_name = ?", cluster, namespace, podName, container).
+		Row().
+		Scan(&last)
+	return last.Time, err
+}
+
+// ArchivedContainers implements services.ArchiveIndex
+func (archiveIndex) ArchivedContainers(cluster, namespace string) ([]services.ArchivedContainer, error) {
+	containers := []services.ArchivedContainer{}
+	result := database.DB.Model(&models.ArchiveSegment{}).
+		Select("pod_name AS pod, container_name AS container, MIN(start_time) AS since, MAX(end_time) AS until, "+
+			"COUNT(*) AS segments, SUM(lines) AS lines, SUM(bytes) AS bytes").
+		Where("cluster_name = ? AND namespace = ?", cluster, namespace).
+		Group("pod_name, container_name").
+		Order("pod_name, container_name").
+		Scan(&containers)
+	return containers, result.Error
+}
+
+// WindowSegments implements services.ArchiveIndex
+func (archiveIndex) WindowSegments(window services.SegmentWindow) ([]models.ArchiveSegment, error) {
+	query := database.DB.Where("cluster_name = ? AND namespace IN ? AND end_time >= ? AND start_time <= ?",
+		window.Cluster, window.Namespaces, window.Since, window.Until)
+	if window.PodName != "" {
+		query = query.Where("pod_name = ?", window.PodName)
+	}
+	if window.Container != "" {
+		query = query.Where("container_name = ?", window.Container)
+	}
+
+	var segments []models.ArchiveSegment
+	result := query.Order("start_time, id").Find(&segments)
+	return segments, result.Error
+}
+
+// RetentionPolicies implements services.ArchiveIndex
+// Deleted teams are included so that their segments still expire
+func (archiveIndex) RetentionPolicies() ([]services.RetentionPolicy, error) {
+	var teams []models.Team
+	if err := database.DB.Unscoped().Order("id").Find(&teams).Error; err != nil {
+		return nil, err
+	}
+
+	policies := make([]services.RetentionPolicy, len(teams))
+	for i, team := range teams {
+		policies[i] = services.RetentionPolicy{
+			TeamID:     team.ID,
+			TeamName:   team.TeamName,
+			MaxAgeDays: team.RetentionDays,
+			MaxBytes:   team.RetentionMaxBytes,
+			LegalHold:  team.LegalHold,
+		}
+	}
+	return policies, nil
+}
+
+// TeamUsage implements services.ArchiveIndex
+func (archiveIndex) TeamUsage(cluster string, teamID uint) (services.ArchiveUsage, error) {
+	var usage services.ArchiveUsage
+	var oldest sql.NullTime
+	err := database.DB.Model(&models.ArchiveSegment{}).
+		Select("COUNT(*), COALESCE(SUM(bytes), 0), COALESCE(SUM(raw_bytes), 0), MIN(start_time)").
+		Where("cluster_name = ? AND team_id = ?", cluster, teamID).
+		Row().
+		Scan(&usage.Segments, &usage.Bytes, &usage.RawBytes, &oldest)
+	if oldest.Valid {
+		usage.Oldest = &oldest.Time
+	}
+	return usage, err
+}
+
+// OldestSegments implements services.ArchiveIndex
+func (archiveIndex) OldestSegments(query services.SegmentQuery) ([]models.ArchiveSegment, error) {
+	db := database.DB.Where("cluster_name = ? AND team_id = ?", query.Cluster, query.TeamID)
+	if !query.EndedBefore.IsZero() {
+		db = db.Where("end_time < ?", query.EndedBefore)
+	}
+	if query.SkipDownsampled {
+		db = db.Where("NOT downsampled")
+	}
+
+	var segments []models.ArchiveSegment
+	result := db.Order("end_time, id").Limit(query.Limit).Find(&segments)
+	return segments, result.Error
+}
+
+// UpdateSegment implements services.ArchiveIndex
+func (archiveIndex) UpdateSegment(segment *models.ArchiveSegment) error {
+	return database.DB.Save(segment).Error
+}
+
+// DeleteSegment implements services.ArchiveIndex
+func (archiveIndex) DeleteSegment(segment *models.ArchiveSegment) error {
+	return database.DB.Delete(segment).Error
+}
+
+// ArchivedPodsResponse represents the response for the archived containers of a namespace
+type ArchivedPodsResponse struct {
+	Success    bool                         `json:"success"`
+	Containers []services.ArchivedContainer `json:"containers,omitempty"`
+	Message    string                       `json:"message,omitempty"`
+}
+
+// GetArchivedPods lists the containers of a namespace that have archived logs, including those of
+// pods that no longer exist
+// Query parameters:
+//   - namespace: The Kubernetes namespace (required)
+//   - cluster: The cluster name (optional, defaults to the connected cluster)
+func GetArchivedPods(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	query := r.URL.Query()
+	namespace := query.Get("namespace")
+	if namespace == "" {
+		writeArchivedPodsError(w, http.StatusBadRequest, "namespace query parameter is required")
+		return
+	}
+	if logArchive == nil {
+		writeArchivedPodsError(w, http.StatusNotFound, "log archiving is not enabled on this server")
+		return
+	}
+
+	cluster, err := resolveCluster(query.Get("cluster"))
+	if err != nil {
+		writeArchivedPodsError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if _, err := authorizeNamespace(r, cluster, namespace); err != nil {
+		if status := accessErrorStatus(err); status == http.StatusInternalServerError {
+			log.Printf("Error authorizing archive listing for namespace %s: %v", namespace, err)
+		}
+		writeArchivedPodsError(w, accessErrorStatus(err), err.Error())
+		return
+	}
+
+	containers, err := logArchive.ArchivedContainers(namespace)
+	if err != nil {
+		log.Printf("Error listing archived logs of namespace %s: %v", namespace, err)
+		writeArchivedPodsError(w, http.StatusInternalServerError, "Failed to list archived logs")
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(ArchivedPodsResponse{Success: true, Containers: containers})
+}
+
+// writeArchivedPodsError writes a failed ArchivedPodsResponse
+func writeArchivedPodsError(w http.ResponseWriter, status int, message string) {
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(ArchivedPodsResponse{Success: false, Message: message})
+}
+
+// ArchiveSettingResponse represents the response for changing whether a namespace is archived
+type ArchiveSettingResponse struct {
+	Success   bool   `json:"success"`
+	Namespace string `json:"namespace,omitempty"`
+	Enabled   bool   `json:"enabled"`
+	Message   string `json:"message,omitempty"`
+}
+
+// SetNamespaceArchiving opts the user's teams in or out of archiving the logs of a namespace
+// Query parameters:
+//   - namespace: The Kubernetes namespace (required)
+//   - enabled: Whether to archive the namespace's logs (required)
+//   - cluster: The cluster name (optional, defaults to the connected cluster)
+//
+// The collector picks the change up within ARCHIVE_REFRESH_SECONDS. A namespace stays archived while
+// any team with access to it has opted in
+func SetNamespaceArchiving(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	query := r.URL.Query()
+	namespace := query.Get("namespace")
+	if namespace == "" {
+		writeArchiveSettingError(w, http.StatusBadRequest, "namespace query parameter is required")
+		return
+	}
+	enabled, err := strconv.ParseBool(query.Get("enabled"))
+	if err != nil {
+		writeArchiveSettingError(w, http.StatusBadRequest, fmt.Sprintf("invalid enabled parameter: %q", query.Get("enabled")))
+		return
+	}
+
+	cluster, err := resolveCluster(query.Get("cluster"))
+	if err != nil {
+		writeArchiveSettingError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	access, err := authorizeNamespace(r, cluster, namespace)
+	if err != nil {
+		if status := accessErrorStatus(err); status == http.StatusInternalServerError {
+			log.Printf("Error authorizing archive setting for namespace %s: %v", namespace, err)
+		}
+		writeArchiveSettingError(w, accessErrorStatus(err), err.Error())
+		return
+	}
+
+	teams := database.DB.Model(&models.Team{}).Select("id").Where("okta_group_id IN ?", access.User.Groups)
+	result := database.DB.Model(&models.Permission{}).
+		Where("cluster_name = ? AND namespace = ? AND team_id IN (?)", cluster, namespace, teams).
+		Update("archive_logs", enabled)
+	if result.Error != nil {
+		log.Printf("Error updating archive setting for namespace %s: %v", namespace, result.Error)
+		writeArchiveSettingError(w, http.StatusInternalServerError, "Failed to update archive setting")
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(ArchiveSettingResponse{Success: true, Namespace: namespace, Enabled: enabled})
+}
+
+// writeArchiveSettingError writes a failed ArchiveSettingResponse
+func writeArchiveSettingError(w http.ResponseWriter, status int, message string) {
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(ArchiveSettingResponse{Success: false, Message: message})
+}
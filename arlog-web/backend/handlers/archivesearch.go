@@ -0,0 +1,186 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"arlog/backend/services"
+)
+
+// ArchiveSearchResponse represents the response for a search of archived logs
+type ArchiveSearchResponse struct {
+	Success bool                          `json:"success"`
+	Result  *services.ArchiveSearchResult `json:"result,omitempty"`
+	Message string                        `json:"message,omitempty"`
+}
+
+// SearchArchive searches the archived logs of one or more namespaces through their full-text index
+// Query parameters:
+//   - q: The query (required), as for SearchLogs
+//   - namespace: The namespaces to search, comma-separated (optional, defaults to every namespace the
+//     user's teams have a permission for)
+//   - podName, container: Only search the archived logs of this pod or container (optional)
+//   - cluster: The cluster name (optional, defaults to the connected cluster)
+//   - sinceSeconds, sinceTime, untilTime: The time window, as for GetLogStats (default: the last hour),
+//     except that it may reach back as far as the longest team retention
+//   - offset, limit: Paging, as for SearchLogs
+//
+// Permissions are checked on every request, so a namespace is no longer searchable once the user's teams
+// lose access to it. Matches are returned oldest first, each with its namespace
+func SearchArchive(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	if logArchive == nil {
+		writeArchiveSearchError(w, http.StatusNotFound, "log archiving is not enabled on this server")
+		return
+	}
+
+	retention, err := logArchive.Retention()
+	if err != nil {
+		log.Printf("Error loading archive retention: %v", err)
+		writeArchiveSearchError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	query := r.URL.Query()
+	opts, err := parseArchiveSearchOptions(query, retention)
+	if err != nil {
+		writeArchiveSearchError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	cluster, err := resolveCluster(query.Get("cluster"))
+	if err != nil {
+		writeArchiveSearchError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	var namespaces []string
+	if value := query.Get("namespace"); value != "" {
+		for _, namespace := range strings.Split(value, ",") {
+			if namespace = strings.TrimSpace(namespace); namespace == "" || containsString(namespaces, namespace) {
+				continue
+			}
+			if _, err := authorizeNamespace(r, cluster, namespace); err != nil {
+				if status := accessErrorStatus(err); status == http.StatusInternalServerError {
+					log.Printf("Error authorizing archive search for namespace %s: %v", namespace, err)
+				}
+				writeArchiveSearchError(w, accessErrorStatus(err), err.Error())
+				return
+			}
+			namespaces = append(namespaces, namespace)
+		}
+	} else {
+		namespaces, err = authorizedNamespaces(r, cluster)
+		if err != nil {
+			if status := accessErrorStatus(err); status == http.StatusInternalServerError {
+				log.Printf("Error authorizing archive search: %v", err)
+			}
+			writeArchiveSearchError(w, accessErrorStatus(err), err.Error())
+			return
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), searchTimeout)
+	defer cancel()
+
+	result, err := logArchive.Search(ctx, namespaces, opts)
+	if err != nil {
+		log.Printf("Error searching archived logs: %v", err)
+		writeArchiveSearchError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(ArchiveSearchResponse{Success: true, Result: result})
+}
+
+// parseArchiveSearchOptions reads the query, scope, window and paging parameters
+// The window may start at most retention ago, or at any time if retention is 0
+func parseArchiveSearchOptions(query url.Values, retention time.Duration) (services.ArchiveSearchOptions, error) {
+	opts := services.ArchiveSearchOptions{
+		PodName:   query.Get("podName"),
+		Container: query.Get("container"),
+		Limit:     services.DefaultSearchLimit,
+	}
+
+	q := query.Get("q")
+	if q == "" {
+		return opts, fmt.Errorf("q query parameter is required")
+	}
+	compiled, err := services.ParseLogQuery(q)
+	if err != nil {
+		return opts, fmt.Errorf("invalid query: %w", err)
+	}
+	opts.Query = compiled
+
+	if opts.Since, opts.Until, err = parseArchiveWindow(query, retention); err != nil {
+		return opts, err
+	}
+
+	for name, target := range map[string]*int{"offset": &opts.Offset, "limit": &opts.Limit} {
+		if value := query.Get(name); value != "" {
+			if *target, err = strconv.Atoi(value); err != nil {
+				return opts, fmt.Errorf("invalid %s parameter: %q", name, value)
+			}
+		}
+	}
+
+	return opts, opts.Validate()
+}
+
+// parseArchiveWindow reads the time window of an archive search like parseLogWindow, but bounds its start
+// by retention instead of the look-back of live logs
+func parseArchiveWindow(query url.Values, retention time.Duration) (since, until time.Time, err error) {
+	now := time.Now().UTC()
+	until = now
+	if value := query.Get("untilTime"); value != "" {
+		parsed, err := time.Parse(time.RFC3339, value)
+		if err != nil {
+			return since, until, fmt.Errorf("invalid untilTime parameter: %q (expected RFC3339)", value)
+		}
+		if parsed.Before(until) {
+			until = parsed
+		}
+	}
+
+	sinceSeconds, sinceTime := query.Get("sinceSeconds"), query.Get("sinceTime")
+	switch {
+	case sinceSeconds != "" && sinceTime != "":
+		return since, until, fmt.Errorf("only one of sinceSeconds and sinceTime may be specified")
+	case sinceSeconds != "":
+		seconds, err := strconv.ParseInt(sinceSeconds, 10, 64)
+		if err != nil || seconds < 1 || seconds > math.MaxInt64/int64(time.Second) {
+			return since, until, fmt.Errorf("invalid sinceSeconds parameter: %q", sinceSeconds)
+		}
+		since = now.Add(-time.Duration(seconds) * time.Second)
+	case sinceTime != "":
+		if since, err = time.Parse(time.RFC3339, sinceTime); err != nil {
+			return since, until, fmt.Errorf("invalid sinceTime parameter: %q (expected RFC3339)", sinceTime)
+		}
+	default:
+		since = until.Add(-services.DefaultStatsWindow)
+	}
+
+	if !until.After(since) {
+		return since, until, fmt.Errorf("untilTime must be after the start of the window")
+	}
+	if retention > 0 && now.Sub(since) > retention {
+		return since, until, fmt.Errorf("the window must not start more than %d seconds ago, the longest archive retention", int64(retention/time.Second))
+	}
+	return since, until, nil
+}
+
+// writeArchiveSearchError writes a failed ArchiveSearchResponse
+func writeArchiveSearchError(w http.ResponseWriter, status int, message string) {
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(ArchiveSearchResponse{Success: false, Message: message})
+}
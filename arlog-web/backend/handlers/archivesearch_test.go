@@ -0,0 +1,49 @@
+package handlers
+
+import (
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseArchiveWindow(t *testing.T) {
+	day := 24 * time.Hour
+	tests := []struct {
+		name      string
+		query     string
+		retention time.Duration
+		// since is how long before now the window must start, or 0 when an error is expected
+		since time.Duration
+		err   string
+	}{
+		{name: "default", query: "", retention: 30 * day, since: time.Hour},
+		{name: "past the live look-back", query: "sinceSeconds=2592000", retention: 31 * day, since: 30 * day},
+		{name: "past retention", query: "sinceSeconds=2592000", retention: 7 * day, err: "longest archive retention"},
+		{name: "unlimited retention", query: "sinceSeconds=31536000", since: 365 * day},
+		{name: "sinceTime", query: "sinceTime=" + time.Now().Add(-10*day).UTC().Format(time.RFC3339), retention: 30 * day, since: 10 * day},
+		{name: "both starts", query: "sinceSeconds=60&sinceTime=2024-01-02T15:04:05Z", err: "only one of"},
+		{name: "zero sinceSeconds", query: "sinceSeconds=0", err: "invalid sinceSeconds"},
+		{name: "overflowing sinceSeconds", query: "sinceSeconds=9223372036854775807", err: "invalid sinceSeconds"},
+		{name: "until before since", query: "sinceSeconds=60&untilTime=2024-01-02T15:04:05Z", err: "untilTime must be after"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			query, _ := url.ParseQuery(tt.query)
+			since, _, err := parseArchiveWindow(query, tt.retention)
+			if tt.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.err) {
+					t.Fatalf("parseArchiveWindow(%q) = %v, want an error containing %q", tt.query, err, tt.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("parseArchiveWindow(%q): %v", tt.query, err)
+			}
+			if ago := time.Since(since); ago < tt.since-time.Minute || ago > tt.since+time.Minute {
+				t.Errorf("window of %q starts %s ago, want %s", tt.query, ago, tt.since)
+			}
+		})
+	}
+}
@@ -0,0 +1,254 @@
+package handlers
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"arlog/backend/services"
+
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+)
+
+// Download output formats
+const (
+	downloadFormatText   = "text"
+	downloadFormatNDJSON = "ndjson"
+)
+
+// DownloadLogs streams a container's logs to the client as a file
+// Query parameters:
+//   - namespace: The Kubernetes namespace (required)
+//   - podName: The name of the pod (required)
+//   - container: The container name (optional, uses first container if not specified)
+//   - cluster: The cluster name (optional, defaults to the connected cluster)
+//   - format: "text" for the raw log or "ndjson" for one JSON object per line with its parsed timestamp (default: text)
+//   - gzip: Compress the file with gzip (default: false)
+//   - tailLines, sinceSeconds, sinceTime, limitBytes, previous, timestamps: As for StreamLogs
+//   - untilTime: Only return logs up to this RFC3339 timestamp (optional)
+//   - parse, formatHint: Add structured fields to NDJSON lines, as for StreamLogs
+//
+// Lines are written as they are read from the API server; the log is never held in memory. Logs of a
+// pod that no longer exists are read from the log archive, if its namespace was archived
+func DownloadLogs(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	namespace := query.Get("namespace")
+	podName := query.Get("podName")
+	if namespace == "" || podName == "" {
+		http.Error(w, "namespace and podName query parameters are required", http.StatusBadRequest)
+		return
+	}
+
+	format := query.Get("format")
+	switch format {
+	case "":
+		format = downloadFormatText
+	case downloadFormatText, downloadFormatNDJSON:
+	default:
+		http.Error(w, fmt.Sprintf("invalid format parameter: %q (expected text or ndjson)", format), http.StatusBadRequest)
+		return
+	}
+
+	compress := false
+	if value := query.Get("gzip"); value != "" {
+		parsed, err := strconv.ParseBool(value)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("invalid gzip parameter: %q", value), http.StatusBadRequest)
+			return
+		}
+		compress = parsed
+	}
+
+	opts, err := parseLogOptions(query)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	// NDJSON carries the timestamp in its own field
+	if format == downloadFormatNDJSON {
+		opts.Timestamps = false
+	}
+
+	// Parsed fields are only carried by the NDJSON format
+	hints, err := parseFormatHints(query)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	var until *time.Time
+	if value := query.Get("untilTime"); value != "" {
+		parsed, err := time.Parse(time.RFC3339, value)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("invalid untilTime parameter: %q (expected RFC3339)", value), http.StatusBadRequest)
+			return
+		}
+		if opts.SinceTime != nil && parsed.Before(*opts.SinceTime) {
+			http.Error(w, "untilTime must not be before sinceTime", http.StatusBadRequest)
+			return
+		}
+		until = &parsed
+	}
+
+	cluster, err := resolveCluster(query.Get("cluster"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	access, err := authorizeNamespace(r, cluster, namespace)
+	if err != nil {
+		if status := accessErrorStatus(err); status == http.StatusInternalServerError {
+			log.Printf("Error authorizing log download for %s/%s: %v", namespace, podName, err)
+		}
+		http.Error(w, err.Error(), accessErrorStatus(err))
+		return
+	}
+
+	// A download holds an API server stream just like a live stream
+	lease, err := streamQuota.acquire(access.User.Sub, access.Team, cluster)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusTooManyRequests)
+		return
+	}
+	defer lease.release()
+
+	k8sService, err := services.NewKubernetesService()
+	if err != nil {
+		log.Printf("Error creating Kubernetes service: %v", err)
+		http.Error(w, "Failed to connect to Kubernetes cluster", http.StatusInternalServerError)
+		return
+	}
+
+	sink := &downloadSink{w: w, format: format, compress: compress}
+	var lineSink services.LogSink = sink
+	if hints != nil {
+		lineSink = services.NewParseSink(hints, sink)
+	}
+	container, err := k8sService.GetPodLogs(r.Context(), namespace, podName, query.Get("container"), opts, until, lineSink)
+	if apierrors.IsNotFound(err) && logArchive != nil && !sink.started {
+		// The pod is gone; serve what the archive kept of it instead
+		archived, archiveErr := logArchive.ReadLogs(r.Context(), namespace, podName, query.Get("container"), opts, until, lineSink)
+		if !errors.Is(archiveErr, services.ErrNotArchived) {
+			container, err = archived, archiveErr
+		}
+	}
+	if err != nil {
+		log.Printf("Error downloading logs for pod %s/%s: %v", namespace, podName, err)
+		if !sink.started {
+			status := http.StatusBadGateway
+			if apierrors.IsNotFound(err) {
+				status = http.StatusNotFound
+			}
+			http.Error(w, err.Error(), status)
+			return
+		}
+		// The status is already sent; end the file with the error so it is not mistaken for complete
+		if data, encodeErr := encodeDownloadError(format, err.Error()); encodeErr == nil {
+			sink.writer().Write(data)
+		}
+	}
+
+	// An empty log still produces a (possibly empty) file
+	sink.start(podName, container)
+	if err := sink.close(); err != nil {
+		log.Printf("Error finishing log download for pod %s/%s: %v", namespace, podName, err)
+	}
+}
+
+// downloadSink writes log lines to an HTTP response in a download format
+// The response headers are sent with the first line, so errors before it can still set the status
+type downloadSink struct {
+	w        http.ResponseWriter
+	format   string
+	compress bool
+
+	started bool
+	gz      *gzip.Writer
+}
+
+// start sends the response headers naming the file after the pod and container
+func (s *downloadSink) start(podName, container string) {
+	if s.started {
+		return
+	}
+	s.started = true
+
+	contentType, extension := "text/plain; charset=utf-8", ".log"
+	if s.format == downloadFormatNDJSON {
+		contentType, extension = "application/x-ndjson", ".ndjson"
+	}
+	if s.compress {
+		contentType, extension = "application/gzip", extension+".gz"
+		s.gz = gzip.NewWriter(s.w)
+	}
+
+	filename := fmt.Sprintf("%s_%s_%s%s", podName, container, time.Now().UTC().Format("20060102T150405Z"), extension)
+	s.w.Header().Set("Content-Type", contentType)
+	s.w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", filename))
+	s.w.WriteHeader(http.StatusOK)
+}
+
+// writer returns where the file content goes
+func (s *downloadSink) writer() io.Writer {
+	if s.gz != nil {
+		return s.gz
+	}
+	return s.w
+}
+
+// close flushes the compressed stream, if any
+func (s *downloadSink) close() error {
+	if s.gz != nil {
+		return s.gz.Close()
+	}
+	return nil
+}
+
+// WriteLine implements services.LogSink
+func (s *downloadSink) WriteLine(line services.LogLine) error {
+	s.start(line.Pod, line.Container)
+
+	var data []byte
+	if s.format == downloadFormatNDJSON {
+		message := logLineMessage(line)
+		message.Line = string(bytes.TrimRight(line.Content, "\r\n"))
+		encoded, err := json.Marshal(message)
+		if err != nil {
+			return err
+		}
+		data = append(encoded, '\n')
+	} else {
+		data = line.Content
+		if len(data) == 0 || data[len(data)-1] != '\n' {
+			data = append(data, '\n')
+		}
+	}
+
+	_, err := s.writer().Write(data)
+	return err
+}
+
+// WriteEvent implements services.LogSink; downloads carry no stream events
+func (s *downloadSink) WriteEvent(event services.StreamEvent) error {
+	return nil
+}
+
+// encodeDownloadError encodes a trailing error for the download format
+func encodeDownloadError(format, message string) ([]byte, error) {
+	encodeFormat := logFormatText
+	if format == downloadFormatNDJSON {
+		encodeFormat = logFormatJSON
+	}
+	data, err := encodeError(encodeFormat, message)
+	if err != nil {
+		return nil, err
+	}
+	return append(data, '\n'), nil
+}
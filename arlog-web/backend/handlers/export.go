@@ -0,0 +1,176 @@
+package handlers
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"arlog/backend/services"
+
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+)
+
+// maxExportBytes is the largest bundle size cap a client may request (1 GiB)
+const maxExportBytes int64 = 1024 * 1024 * 1024
+
+// ExportLogs streams a tar.gz or zip bundle of the logs of every container of a set of pods
+// Query parameters:
+//   - namespace: The Kubernetes namespace (required)
+//   - selector: A label selector narrowing down the pods (optional)
+//   - workload: A kind/name reference such as deployment/api whose pods are exported (optional)
+//   - cluster: The cluster name (optional, defaults to the connected cluster)
+//   - format: "tar.gz" or "zip" (default: tar.gz)
+//   - previous: Also export the previous instance of restarted containers (default: false)
+//   - tailLines, sinceSeconds, sinceTime, limitBytes, timestamps: As for StreamLogs, per container
+//   - untilTime: Only export logs up to this RFC3339 timestamp (optional)
+//   - maxBytes: Cap on the total size of the exported logs (default: 256 MiB, max: 1 GiB)
+//
+// The bundle holds <pod>/<container>.log files and a manifest.json describing the pods, their
+// containers, the time window and any logs that were cut short or could not be fetched
+func ExportLogs(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	namespace := query.Get("namespace")
+	if namespace == "" {
+		http.Error(w, "namespace query parameter is required", http.StatusBadRequest)
+		return
+	}
+
+	opts := services.ExportOptions{
+		Selector:    query.Get("selector"),
+		Concurrency: services.DefaultExportConcurrency,
+		MaxBytes:    services.DefaultExportMaxBytes,
+	}
+	if value := query.Get("workload"); value != "" {
+		if opts.Selector != "" {
+			http.Error(w, "selector and workload query parameters are mutually exclusive", http.StatusBadRequest)
+			return
+		}
+		workload, err := services.ParseWorkloadRef(value)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("invalid workload parameter: %v", err), http.StatusBadRequest)
+			return
+		}
+		opts.Workload = &workload
+	}
+
+	format := query.Get("format")
+	switch format {
+	case "":
+		format = services.BundleFormatTarGz
+	case services.BundleFormatTarGz, services.BundleFormatZip:
+	default:
+		http.Error(w, fmt.Sprintf("invalid format parameter: %q (expected tar.gz or zip)", format), http.StatusBadRequest)
+		return
+	}
+
+	if value := query.Get("previous"); value != "" {
+		previous, err := strconv.ParseBool(value)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("invalid previous parameter: %q", value), http.StatusBadRequest)
+			return
+		}
+		opts.Previous = previous
+	}
+	// previous selects extra files here rather than replacing the current instance
+	logQuery := make(url.Values, len(query))
+	for key, values := range query {
+		if key != "previous" {
+			logQuery[key] = values
+		}
+	}
+	logOptions, err := parseLogOptions(logQuery)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	opts.Logs = logOptions
+
+	if value := query.Get("untilTime"); value != "" {
+		until, err := time.Parse(time.RFC3339, value)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("invalid untilTime parameter: %q (expected RFC3339)", value), http.StatusBadRequest)
+			return
+		}
+		opts.Until = &until
+	}
+
+	if value := query.Get("maxBytes"); value != "" {
+		maxBytes, err := strconv.ParseInt(value, 10, 64)
+		if err != nil || maxBytes < 1 || maxBytes > maxExportBytes {
+			http.Error(w, fmt.Sprintf("invalid maxBytes parameter: %q (expected 1 to %d)", value, maxExportBytes), http.StatusBadRequest)
+			return
+		}
+		opts.MaxBytes = maxBytes
+	}
+
+	cluster, err := resolveCluster(query.Get("cluster"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	access, err := authorizeNamespace(r, cluster, namespace)
+	if err != nil {
+		if status := accessErrorStatus(err); status == http.StatusInternalServerError {
+			log.Printf("Error authorizing log export for namespace %s: %v", namespace, err)
+		}
+		http.Error(w, err.Error(), accessErrorStatus(err))
+		return
+	}
+
+	// An export counts as one stream against the caps; its fetches are bounded by opts.Concurrency
+	lease, err := streamQuota.acquire(access.User.Sub, access.Team, cluster)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusTooManyRequests)
+		return
+	}
+	defer lease.release()
+
+	k8sService, err := services.NewKubernetesService()
+	if err != nil {
+		log.Printf("Error creating Kubernetes service: %v", err)
+		http.Error(w, "Failed to connect to Kubernetes cluster", http.StatusInternalServerError)
+		return
+	}
+
+	pods, err := k8sService.ListExportPods(r.Context(), namespace, opts)
+	if err != nil {
+		status := http.StatusBadRequest
+		if apierrors.IsNotFound(err) {
+			status = http.StatusNotFound
+		}
+		http.Error(w, err.Error(), status)
+		return
+	}
+
+	name := fmt.Sprintf("%s-logs-%s", namespace, time.Now().UTC().Format("20060102T150405Z"))
+	contentType := "application/gzip"
+	if format == services.BundleFormatZip {
+		contentType = "application/zip"
+	}
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", name+"."+format))
+	w.WriteHeader(http.StatusOK)
+
+	bundle, err := services.NewBundleWriter(format, w)
+	if err != nil {
+		log.Printf("Error creating log bundle: %v", err)
+		return
+	}
+
+	manifest, err := k8sService.ExportLogs(r.Context(), namespace, pods, opts, name, bundle)
+	if err != nil {
+		// The client sees a broken archive
+		log.Printf("Error exporting logs for namespace %s: %v", namespace, err)
+		return
+	}
+	if err := bundle.Close(); err != nil {
+		log.Printf("Error finishing log bundle for namespace %s: %v", namespace, err)
+		return
+	}
+
+	log.Printf("Exported %d bytes of logs from %d pods in namespace %s (truncated: %t)",
+		manifest.TotalBytes, len(manifest.Pods), namespace, manifest.Truncated)
+}
@@ -0,0 +1,386 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"arlog/backend/services"
+)
+
+// Commands a client can send on the log WebSocket
+const (
+	commandPause           = "pause"
+	commandResume          = "resume"
+	commandSetFilter       = "setFilter"
+	commandSwitchContainer = "switchContainer"
+	commandFetchOlder      = "fetchOlder"
+)
+
+// defaultFetchOlderLines is the number of lines returned by fetchOlder when the command does not say
+const defaultFetchOlderLines = 100
+
+// LogStreamCommand is a control message sent by the client over the log WebSocket
+type LogStreamCommand struct {
+	ID        string         `json:"id,omitempty"`
+	Command   string         `json:"command"`
+	Filter    *LogFilterSpec `json:"filter,omitempty"`
+	Pod       string         `json:"pod,omitempty"`
+	Container string         `json:"container,omitempty"`
+	Lines     int            `json:"lines,omitempty"`
+	Before    string         `json:"before,omitempty"`
+}
+
+// LogFilterSpec is the JSON representation of a line filter
+type LogFilterSpec struct {
+	Include  []string `json:"include,omitempty"`
+	Exclude  []string `json:"exclude,omitempty"`
+	Contains []string `json:"contains,omitempty"`
+	MinLevel string   `json:"minLevel,omitempty"`
+	Before   int      `json:"before,omitempty"`
+	After    int      `json:"after,omitempty"`
+}
+
+// build compiles the spec into a filter
+func (spec *LogFilterSpec) build() (*services.LogFilter, error) {
+	config := services.LogFilterConfig{
+		Include:  spec.Include,
+		Exclude:  spec.Exclude,
+		Contains: spec.Contains,
+		Before:   spec.Before,
+		After:    spec.After,
+	}
+
+	if spec.MinLevel != "" {
+		level, err := services.ParseLogLevel(spec.MinLevel)
+		if err != nil {
+			return nil, err
+		}
+		config.MinLevel = level
+	}
+
+	return services.NewLogFilter(config)
+}
+
+// CommandAck acknowledges a client command
+type CommandAck struct {
+	Type    string `json:"type"`
+	ID      string `json:"id,omitempty"`
+	Command string `json:"command"`
+	OK      bool   `json:"ok"`
+	Message string `json:"message,omitempty"`
+}
+
+// logStreamController runs a log stream and applies client commands to it
+// Lines flow from the stream through the controller (which remembers the oldest line per container
+// for fetchOlder), the multiline sink if enabled, the filter sink and, if enabled, the parse sink into
+// sink. Commands are answered on the connection they came from
+type logStreamController struct {
+	ctx        context.Context
+	k8sService *services.KubernetesService
+	filter     *services.FilterSink
+	// multiline groups continuation lines ahead of the filter, so matches keep whole stack traces
+	multiline *services.MultilineSink
+
+	mu           sync.Mutex
+	req          logStreamRequest
+	cancelStream context.CancelFunc
+	restart      bool
+	oldest       map[string]time.Time
+}
+
+// newLogStreamController creates a controller for the given request
+func newLogStreamController(ctx context.Context, req *logStreamRequest, k8sService *services.KubernetesService, sink services.LogSink) *logStreamController {
+	// Only lines that pass the filter are parsed
+	if req.FormatHints != nil {
+		sink = services.NewParseSink(req.FormatHints, sink)
+	}
+	c := &logStreamController{
+		ctx:        ctx,
+		k8sService: k8sService,
+		filter:     services.NewFilterSink(req.Filter, sink),
+		req:        *req,
+		oldest:     make(map[string]time.Time),
+	}
+	if req.Multiline != nil {
+		c.multiline = services.NewMultilineSink(req.Multiline, c.filter)
+	}
+	return c
+}
+
+// run streams logs until the stream ends or the context is cancelled
+// The stream is restarted in place when the client switches containers
+func (c *logStreamController) run() error {
+	for {
+		c.mu.Lock()
+		req := c.req
+		streamCtx, cancel := context.WithCancel(c.ctx)
+		c.cancelStream = cancel
+		c.restart = false
+		c.mu.Unlock()
+
+		err := req.stream(streamCtx, c.k8sService, c)
+		cancel()
+
+		// Send the events still waiting for continuation lines, then the final suppressed-lines count,
+		// before the stream ends or restarts
+		if c.multiline != nil {
+			if flushErr := c.multiline.Flush(); err == nil {
+				err = flushErr
+			}
+		}
+		if flushErr := c.filter.Flush(); err == nil {
+			err = flushErr
+		}
+
+		c.mu.Lock()
+		restart := c.restart
+		c.mu.Unlock()
+
+		if !restart || c.ctx.Err() != nil {
+			return err
+		}
+	}
+}
+
+// WriteLine implements services.LogSink
+func (c *logStreamController) WriteLine(line services.LogLine) error {
+	if !line.Timestamp.IsZero() {
+		key := sourceKey(line.Pod, line.Container)
+		c.mu.Lock()
+		if _, seen := c.oldest[key]; !seen {
+			c.oldest[key] = line.Timestamp
+		}
+		c.mu.Unlock()
+	}
+	if c.multiline != nil {
+		return c.multiline.WriteLine(line)
+	}
+	return c.filter.WriteLine(line)
+}
+
+// WriteEvent implements services.LogSink
+func (c *logStreamController) WriteEvent(event services.StreamEvent) error {
+	if c.multiline != nil {
+		return c.multiline.WriteEvent(event)
+	}
+	return c.filter.WriteEvent(event)
+}
+
+// handleCommand decodes and applies a command received on the connection of w
+// It runs on the read pump; commands that call the Kubernetes API are handled in their own goroutine
+func (c *logStreamController) handleCommand(w *LogWriter, data []byte) {
+	var cmd LogStreamCommand
+	if err := json.Unmarshal(data, &cmd); err != nil {
+		c.ack(w, cmd, "", fmt.Errorf("invalid command: %w", err))
+		return
+	}
+
+	switch cmd.Command {
+	case commandPause:
+		w.Pause()
+		c.ack(w, cmd, "stream paused", nil)
+
+	case commandResume:
+		w.Resume()
+		c.ack(w, cmd, "stream resumed", nil)
+
+	case commandSetFilter:
+		var filter *services.LogFilter
+		if cmd.Filter != nil {
+			var err error
+			if filter, err = cmd.Filter.build(); err != nil {
+				c.ack(w, cmd, "", fmt.Errorf("invalid filter: %w", err))
+				return
+			}
+		}
+		c.filter.SetFilter(filter)
+		c.ack(w, cmd, "filter updated", nil)
+
+	case commandSwitchContainer:
+		go c.switchContainer(w, cmd)
+
+	case commandFetchOlder:
+		go c.fetchOlder(w, cmd)
+
+	default:
+		c.ack(w, cmd, "", fmt.Errorf("unknown command: %q", cmd.Command))
+	}
+}
+
+// switchContainer restarts a single-container stream on another container of the same pod
+func (c *logStreamController) switchContainer(w *LogWriter, cmd LogStreamCommand) {
+	c.mu.Lock()
+	req := c.req
+	c.mu.Unlock()
+
+	if req.PodName == "" || req.AllContainers {
+		c.ack(w, cmd, "", fmt.Errorf("switchContainer is only supported on single-container pod streams"))
+		return
+	}
+	if cmd.Container == "" {
+		c.ack(w, cmd, "", fmt.Errorf("container is required"))
+		return
+	}
+
+	names, err := c.k8sService.GetPodContainerNames(c.ctx, req.Namespace, req.PodName)
+	if err != nil {
+		c.ack(w, cmd, "", err)
+		return
+	}
+	if !containsString(names, cmd.Container) {
+		c.ack(w, cmd, "", fmt.Errorf("pod %s has no container %q", req.PodName, cmd.Container))
+		return
+	}
+
+	c.mu.Lock()
+	c.req.Container = cmd.Container
+	c.restart = true
+	if c.cancelStream != nil {
+		c.cancelStream()
+	}
+	c.mu.Unlock()
+
+	c.ack(w, cmd, "switched to container "+cmd.Container, nil)
+}
+
+// fetchOlder sends lines logged before the oldest line the client has seen (or before cmd.Before)
+func (c *logStreamController) fetchOlder(w *LogWriter, cmd LogStreamCommand) {
+	c.mu.Lock()
+	req := c.req
+	c.mu.Unlock()
+
+	podName := cmd.Pod
+	if podName == "" {
+		podName = req.PodName
+	}
+	if podName == "" {
+		c.ack(w, cmd, "", fmt.Errorf("pod is required"))
+		return
+	}
+
+	container := cmd.Container
+	if container == "" {
+		container = c.onlyContainerSeen(podName)
+	}
+	if container == "" {
+		c.ack(w, cmd, "", fmt.Errorf("container is required"))
+		return
+	}
+
+	lines := cmd.Lines
+	if lines == 0 {
+		lines = defaultFetchOlderLines
+	}
+
+	key := sourceKey(podName, container)
+	before := time.Now()
+	if cmd.Before != "" {
+		parsed, err := time.Parse(time.RFC3339Nano, cmd.Before)
+		if err != nil {
+			c.ack(w, cmd, "", fmt.Errorf("invalid before timestamp: %q (expected RFC3339)", cmd.Before))
+			return
+		}
+		before = parsed
+	} else {
+		c.mu.Lock()
+		if oldest, seen := c.oldest[key]; seen {
+			before = oldest
+		}
+		c.mu.Unlock()
+	}
+
+	history, err := c.k8sService.FetchLogsBefore(c.ctx, req.Namespace, podName, container, before, lines, req.Options)
+	if err != nil {
+		c.ack(w, cmd, "", err)
+		return
+	}
+
+	// Remember how far back the client now is, so repeated fetches page backwards
+	if len(history) > 0 {
+		c.mu.Lock()
+		c.oldest[key] = history[0].Timestamp
+		c.mu.Unlock()
+	}
+
+	// History is grouped, filtered and parsed like the live stream, without context lines
+	// An event cut by the start of the fetched range stays split
+	if req.Multiline != nil {
+		history = req.Multiline.Group(history)
+	}
+	if filter := c.filter.Filter(); filter != nil {
+		kept := history[:0]
+		for _, line := range history {
+			if filter.Match(line.Content) {
+				kept = append(kept, line)
+			}
+		}
+		history = kept
+	}
+	if req.FormatHints != nil {
+		for i := range history {
+			history[i].Parsed = services.ParseLine(history[i].Content, req.FormatHints.For(history[i].Container))
+		}
+	}
+
+	if err := w.WriteHistory(cmd.ID, history); err != nil {
+		log.Printf("Error sending history for %s: %v", &req, err)
+		return
+	}
+	c.ack(w, cmd, fmt.Sprintf("%d lines", len(history)), nil)
+}
+
+// onlyContainerSeen returns the container of podName the stream has delivered lines from,
+// or "" if there are none or several
+func (c *logStreamController) onlyContainerSeen(podName string) string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	prefix := podName + "/"
+	container := ""
+	for key := range c.oldest {
+		if len(key) > len(prefix) && key[:len(prefix)] == prefix {
+			if container != "" {
+				return ""
+			}
+			container = key[len(prefix):]
+		}
+	}
+	return container
+}
+
+// ack acknowledges a command on w, reporting err if it failed
+func (c *logStreamController) ack(w *LogWriter, cmd LogStreamCommand, message string, err error) {
+	ack := CommandAck{
+		Type:    "ack",
+		ID:      cmd.ID,
+		Command: cmd.Command,
+		OK:      err == nil,
+		Message: message,
+	}
+	if err != nil {
+		ack.Message = err.Error()
+	}
+
+	if writeErr := w.writeImmediate(ack); writeErr != nil {
+		log.Printf("Error acknowledging %s command: %v", cmd.Command, writeErr)
+	}
+}
+
+// sourceKey identifies a container within a stream
+func sourceKey(podName, container string) string {
+	return podName + "/" + container
+}
+
+// containsString reports whether values contains value
+func containsString(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,503 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"arlog/backend/services"
+
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+)
+
+// Log stream output formats
+const (
+	logFormatText = "text"
+	logFormatJSON = "json"
+)
+
+// logHub shares followed single-container streams between all connections viewing them
+var logHub = services.NewLogHub()
+
+// logStreamRequest describes which logs a client wants to stream and how
+type logStreamRequest struct {
+	Cluster   string
+	Namespace string
+	PodName   string
+	Selector  string
+	Workload  *services.WorkloadRef
+	Container string
+	Format    string
+	Options   services.LogOptions
+	Filter    *services.LogFilter
+
+	// AllContainers streams every container of PodName, including init and ephemeral containers
+	AllContainers bool
+
+	// Overflow is the policy applied when the client falls behind by QueueSize messages
+	Overflow  string
+	QueueSize int
+
+	// FlushInterval, when non-zero, coalesces messages into frames of up to BatchBytes
+	FlushInterval time.Duration
+	BatchBytes    int
+	// Compress enables permessage-deflate when the client negotiated it
+	Compress bool
+
+	// FormatHints, when set, parses lines into structured fields in the JSON format
+	FormatHints services.FormatHints
+	// Multiline, when set, groups continuation lines such as stack traces into single events
+	Multiline *services.Multiline
+}
+
+// String describes the stream target for log messages
+func (req *logStreamRequest) String() string {
+	if req.Workload != nil {
+		return fmt.Sprintf("%s in namespace %s", req.Workload, req.Namespace)
+	}
+	if req.Selector != "" {
+		return fmt.Sprintf("selector %q in namespace %s", req.Selector, req.Namespace)
+	}
+	return fmt.Sprintf("pod: %s/%s", req.Namespace, req.PodName)
+}
+
+// tagged reports whether the stream carries lines from more than one container
+func (req *logStreamRequest) tagged() bool {
+	return req.Selector != "" || req.Workload != nil || req.AllContainers
+}
+
+// hubOverflow returns the policy the log hub applies when the client falls behind a shared stream
+func (req *logStreamRequest) hubOverflow() services.HubOverflow {
+	switch req.Overflow {
+	case overflowDropOldest:
+		return services.HubDropOldest
+	case overflowDisconnect:
+		return services.HubDisconnect
+	}
+	return services.HubBlock
+}
+
+// stream runs the log stream described by the request, writing to sink until it ends or ctx is cancelled
+// The request's filter is not applied here; callers wrap sink in a services.FilterSink
+// A single container of a pod that no longer exists is replayed from the log archive, if it was archived
+func (req *logStreamRequest) stream(ctx context.Context, k8sService *services.KubernetesService, sink services.LogSink) error {
+	if req.Workload != nil {
+		return k8sService.StreamWorkloadLogs(ctx, req.Namespace, *req.Workload, req.Container, req.Options, sink)
+	}
+	if req.Selector != "" {
+		return k8sService.StreamSelectorLogs(ctx, req.Namespace, req.Selector, req.Container, req.Options, sink)
+	}
+	if req.AllContainers {
+		return k8sService.StreamAllContainerLogs(ctx, req.Namespace, req.PodName, req.Options, sink)
+	}
+
+	var err error
+	if req.Options.Follow {
+		// Viewers following the same container share one upstream stream
+		err = logHub.StreamLogs(ctx, k8sService, req.Cluster, req.Namespace, req.PodName, req.Container, req.Options, req.hubOverflow(), sink)
+	} else {
+		err = k8sService.StreamLogs(ctx, req.Namespace, req.PodName, req.Container, req.Options, sink)
+	}
+	if apierrors.IsNotFound(err) && logArchive != nil {
+		// The pod is gone; replay what the archive kept of it, after which the stream ends
+		if _, archiveErr := logArchive.ReadLogs(ctx, req.Namespace, req.PodName, req.Container, req.Options, nil, sink); !errors.Is(archiveErr, services.ErrNotArchived) {
+			return archiveErr
+		}
+	}
+	return err
+}
+
+// parseLogStreamRequest builds and validates a stream request from query parameters
+func parseLogStreamRequest(query url.Values) (*logStreamRequest, error) {
+	req := &logStreamRequest{
+		Namespace: query.Get("namespace"),
+		PodName:   query.Get("podName"),
+		Selector:  query.Get("selector"),
+		Container: query.Get("container"),
+		Format:    query.Get("format"),
+	}
+
+	cluster, err := resolveCluster(query.Get("cluster"))
+	if err != nil {
+		return nil, err
+	}
+	req.Cluster = cluster
+
+	if value := query.Get("workload"); value != "" {
+		workload, err := services.ParseWorkloadRef(value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid workload parameter: %w", err)
+		}
+		req.Workload = &workload
+	}
+
+	// Validate required parameters: exactly one stream target must be given
+	targets := 0
+	for _, set := range []bool{req.PodName != "", req.Selector != "", req.Workload != nil} {
+		if set {
+			targets++
+		}
+	}
+	if req.Namespace == "" || targets == 0 {
+		return nil, fmt.Errorf("namespace and one of podName, selector or workload query parameters are required")
+	}
+	if targets > 1 {
+		return nil, fmt.Errorf("podName, selector and workload query parameters are mutually exclusive")
+	}
+
+	if value := query.Get("allContainers"); value != "" {
+		allContainers, err := strconv.ParseBool(value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid allContainers parameter: %q", value)
+		}
+		req.AllContainers = allContainers
+	}
+	if req.AllContainers && (req.PodName == "" || req.Container != "") {
+		return nil, fmt.Errorf("allContainers requires podName and cannot be combined with container")
+	}
+
+	switch req.Format {
+	case "":
+		req.Format = logFormatText
+	case logFormatText, logFormatJSON:
+	default:
+		return nil, fmt.Errorf("invalid format parameter: %q (expected text or json)", req.Format)
+	}
+
+	req.Overflow = query.Get("overflow")
+	switch req.Overflow {
+	case "":
+		req.Overflow = overflowBlock
+	case overflowBlock, overflowDropOldest, overflowDisconnect:
+	default:
+		return nil, fmt.Errorf("invalid overflow parameter: %q (expected block, dropOldest or disconnect)", req.Overflow)
+	}
+
+	req.QueueSize = defaultQueueSize
+	if value := query.Get("queueSize"); value != "" {
+		queueSize, err := strconv.Atoi(value)
+		if err != nil || queueSize < 1 || queueSize > maxQueueSize {
+			return nil, fmt.Errorf("invalid queueSize parameter: %q (expected 1 to %d)", value, maxQueueSize)
+		}
+		req.QueueSize = queueSize
+	}
+
+	if err := parseFraming(query, req); err != nil {
+		return nil, err
+	}
+
+	opts, err := parseLogOptions(query)
+	if err != nil {
+		return nil, err
+	}
+	req.Options = opts
+
+	filter, err := parseLogFilter(query)
+	if err != nil {
+		return nil, err
+	}
+	if !filter.IsEmpty() {
+		req.Filter = filter
+	}
+
+	if req.FormatHints, err = parseFormatHints(query); err != nil {
+		return nil, err
+	}
+
+	if req.Multiline, err = parseMultiline(query); err != nil {
+		return nil, err
+	}
+
+	return req, nil
+}
+
+// parseFormatHints reads the structured parsing parameters
+// parse enables parsing with format detection; each formatHint, either "format" or
+// "container=format", fixes the format instead and implies parse. Nil is returned when parsing is off
+func parseFormatHints(query url.Values) (services.FormatHints, error) {
+	parse := false
+	if value := query.Get("parse"); value != "" {
+		parsed, err := strconv.ParseBool(value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid parse parameter: %q", value)
+		}
+		parse = parsed
+	}
+
+	hints := services.FormatHints{}
+	for _, value := range query["formatHint"] {
+		container, name, found := strings.Cut(value, "=")
+		if !found {
+			container, name = "", value
+		}
+		format, err := services.ParseLogFormat(name)
+		if err != nil {
+			return nil, fmt.Errorf("invalid formatHint parameter: %w", err)
+		}
+		hints[container] = format
+	}
+
+	if !parse && len(hints) == 0 {
+		return nil, nil
+	}
+	return hints, nil
+}
+
+// parseMultiline reads the multiline grouping parameters
+// multiline names presets (repeatable or comma-separated) and multilineStart gives start-of-event
+// patterns (repeatable). Nil is returned when neither is set
+func parseMultiline(query url.Values) (*services.Multiline, error) {
+	config := services.MultilineConfig{Start: query["multilineStart"]}
+	for _, value := range query["multiline"] {
+		for _, name := range strings.Split(value, ",") {
+			if name = strings.TrimSpace(name); name != "" {
+				config.Presets = append(config.Presets, name)
+			}
+		}
+	}
+
+	if value := query.Get("multilineTimeout"); value != "" {
+		milliseconds, err := strconv.Atoi(value)
+		if err != nil || milliseconds < 1 || time.Duration(milliseconds)*time.Millisecond > services.MaxMultilineTimeout {
+			return nil, fmt.Errorf("invalid multilineTimeout parameter: %q (expected 1 to %d milliseconds)", value, services.MaxMultilineTimeout.Milliseconds())
+		}
+		config.Timeout = time.Duration(milliseconds) * time.Millisecond
+	}
+
+	if len(config.Presets) == 0 && len(config.Start) == 0 {
+		return nil, nil
+	}
+	return services.NewMultiline(config)
+}
+
+// parseFraming reads the batching and compression parameters into req
+func parseFraming(query url.Values, req *logStreamRequest) error {
+	if value := query.Get("flushInterval"); value != "" {
+		milliseconds, err := strconv.Atoi(value)
+		if err != nil || milliseconds < 0 || time.Duration(milliseconds)*time.Millisecond > maxFlushInterval {
+			return fmt.Errorf("invalid flushInterval parameter: %q (expected 0 to %d milliseconds)", value, maxFlushInterval.Milliseconds())
+		}
+		req.FlushInterval = time.Duration(milliseconds) * time.Millisecond
+	}
+
+	req.BatchBytes = defaultBatchBytes
+	if value := query.Get("batchSize"); value != "" {
+		batchBytes, err := strconv.Atoi(value)
+		if err != nil || batchBytes < 1 || batchBytes > maxBatchBytes {
+			return fmt.Errorf("invalid batchSize parameter: %q (expected 1 to %d bytes)", value, maxBatchBytes)
+		}
+		req.BatchBytes = batchBytes
+	}
+
+	req.Compress = true
+	if value := query.Get("compress"); value != "" {
+		compress, err := strconv.ParseBool(value)
+		if err != nil {
+			return fmt.Errorf("invalid compress parameter: %q", value)
+		}
+		req.Compress = compress
+	}
+
+	return nil
+}
+
+// parseLogFilter builds a line filter from query parameters
+// include, exclude and contains may be repeated; context sets both before and after
+func parseLogFilter(query url.Values) (*services.LogFilter, error) {
+	config := services.LogFilterConfig{
+		Include:  query["include"],
+		Exclude:  query["exclude"],
+		Contains: query["contains"],
+	}
+
+	if value := query.Get("minLevel"); value != "" {
+		level, err := services.ParseLogLevel(value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid minLevel parameter: %w", err)
+		}
+		config.MinLevel = level
+	}
+
+	intParams := map[string][]*int{
+		"context": {&config.Before, &config.After},
+		"before":  {&config.Before},
+		"after":   {&config.After},
+	}
+	// context is applied first so before and after can override it
+	for _, name := range []string{"context", "before", "after"} {
+		if value := query.Get(name); value != "" {
+			parsed, err := strconv.Atoi(value)
+			if err != nil {
+				return nil, fmt.Errorf("invalid %s parameter: %q", name, value)
+			}
+			for _, target := range intParams[name] {
+				*target = parsed
+			}
+		}
+	}
+
+	return services.NewLogFilter(config)
+}
+
+// parseLogOptions builds log options from query parameters, starting from the defaults
+func parseLogOptions(query url.Values) (services.LogOptions, error) {
+	opts := services.DefaultLogOptions()
+
+	boolParams := map[string]*bool{
+		"follow":     &opts.Follow,
+		"previous":   &opts.Previous,
+		"timestamps": &opts.Timestamps,
+	}
+	for name, target := range boolParams {
+		if value := query.Get(name); value != "" {
+			parsed, err := strconv.ParseBool(value)
+			if err != nil {
+				return opts, fmt.Errorf("invalid %s parameter: %q", name, value)
+			}
+			*target = parsed
+		}
+	}
+
+	intParams := map[string]**int64{
+		"tailLines":    &opts.TailLines,
+		"sinceSeconds": &opts.SinceSeconds,
+		"limitBytes":   &opts.LimitBytes,
+		"previousTail": &opts.PreviousTail,
+	}
+	for name, target := range intParams {
+		if value := query.Get(name); value != "" {
+			parsed, err := strconv.ParseInt(value, 10, 64)
+			if err != nil {
+				return opts, fmt.Errorf("invalid %s parameter: %q", name, value)
+			}
+			*target = &parsed
+		}
+	}
+
+	if value := query.Get("sinceTime"); value != "" {
+		parsed, err := time.Parse(time.RFC3339, value)
+		if err != nil {
+			return opts, fmt.Errorf("invalid sinceTime parameter: %q (expected RFC3339)", value)
+		}
+		opts.SinceTime = &parsed
+	}
+
+	// A time window replaces the default tail unless tailLines was given explicitly
+	if (opts.SinceSeconds != nil || opts.SinceTime != nil) && query.Get("tailLines") == "" {
+		opts.TailLines = nil
+	}
+
+	if err := opts.Validate(); err != nil {
+		return opts, err
+	}
+
+	return opts, nil
+}
+
+// LogMessage is the JSON representation of a log stream message
+type LogMessage struct {
+	Type      string       `json:"type"`
+	Seq       int64        `json:"seq,omitempty"`
+	ID        string       `json:"id,omitempty"`
+	Namespace string       `json:"namespace,omitempty"`
+	Pod       string       `json:"pod,omitempty"`
+	Container string       `json:"container,omitempty"`
+	Timestamp string       `json:"timestamp,omitempty"`
+	Line      string       `json:"line,omitempty"`
+	Context   bool         `json:"context,omitempty"`
+	Message   string       `json:"message,omitempty"`
+	Count     int64        `json:"count,omitempty"`
+	ExitCode  *int32       `json:"exitCode,omitempty"`
+	Reason    string       `json:"reason,omitempty"`
+	Lines     []LogMessage `json:"lines,omitempty"`
+	// Parsed holds the structured fields of a log line when parsing is enabled
+	Parsed *services.ParsedLine `json:"parsed,omitempty"`
+}
+
+// encodeLogLine encodes a log line for the given format
+// In text format, tagged lines are prefixed with their pod and container, stern-style
+// A non-zero seq is included in JSON messages
+func encodeLogLine(format string, tagged bool, line services.LogLine, seq int64) ([]byte, error) {
+	if format == logFormatJSON {
+		message := logLineMessage(line)
+		message.Seq = seq
+		return json.Marshal(message)
+	}
+
+	if !tagged {
+		return line.Content, nil
+	}
+	prefix := fmt.Sprintf("[%s/%s] ", line.Pod, line.Container)
+	return append([]byte(prefix), line.Content...), nil
+}
+
+// logLineMessage converts a log line to its JSON representation
+func logLineMessage(line services.LogLine) LogMessage {
+	message := LogMessage{
+		Type:      "log",
+		Namespace: line.Namespace,
+		Pod:       line.Pod,
+		Container: line.Container,
+		Line:      string(line.Content),
+		Context:   line.Context,
+		Parsed:    line.Parsed,
+	}
+	if !line.Timestamp.IsZero() {
+		message.Timestamp = line.Timestamp.Format(time.RFC3339Nano)
+	}
+	// Grouped events say how many lines they hold
+	if line.Lines > 1 {
+		message.Count = int64(line.Lines)
+	}
+	return message
+}
+
+// encodeHistory encodes lines fetched for a fetchOlder command
+// History is always sent as JSON so clients can tell it apart from the live stream
+func encodeHistory(id string, lines []services.LogLine) ([]byte, error) {
+	messages := make([]LogMessage, 0, len(lines))
+	for _, line := range lines {
+		messages = append(messages, logLineMessage(line))
+	}
+	return json.Marshal(LogMessage{Type: "history", ID: id, Count: int64(len(lines)), Lines: messages})
+}
+
+// encodeStreamEvent encodes a stream event for the given format
+// A non-zero seq is included in JSON messages
+func encodeStreamEvent(format string, event services.StreamEvent, seq int64) ([]byte, error) {
+	if format == logFormatJSON {
+		return json.Marshal(LogMessage{
+			Type:      string(event.Type),
+			Seq:       seq,
+			Namespace: event.Namespace,
+			Pod:       event.Pod,
+			Container: event.Container,
+			Message:   event.Message,
+			Count:     event.Count,
+			ExitCode:  event.ExitCode,
+			Reason:    event.Reason,
+		})
+	}
+
+	if event.Pod == "" {
+		return []byte("Info: " + event.Message), nil
+	}
+	text := fmt.Sprintf("Info: %s %s/%s", event.Type, event.Pod, event.Container)
+	if event.Message != "" {
+		text += ": " + event.Message
+	}
+	return []byte(text), nil
+}
+
+// encodeError encodes an error message for the given format
+func encodeError(format, message string) ([]byte, error) {
+	if format == logFormatJSON {
+		return json.Marshal(LogMessage{Type: "error", Message: message})
+	}
+	return []byte("Error: " + message), nil
+}
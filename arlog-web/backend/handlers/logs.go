@@ -1,10 +1,12 @@
 package handlers
 
 import (
+	"context"
+	"errors"
 	"log"
 	"net/http"
-
-	"arlog/backend/services"
+	"sync/atomic"
+	"time"
 
 	"github.com/gorilla/websocket"
 )
@@ -13,78 +15,193 @@ import (
 var upgrader = websocket.Upgrader{
 	ReadBufferSize:  1024,
 	WriteBufferSize: 1024,
+	// Negotiate permessage-deflate; whether it is used is decided per connection
+	EnableCompression: true,
 	// Allow all origins for development (should be restricted in production)
 	CheckOrigin: func(r *http.Request) bool {
 		return true
 	},
 }
 
+// WebSocket connection timing
+const (
+	// writeWait is the time allowed to write a message to the client
+	writeWait = 10 * time.Second
+	// pongWait is the time allowed to read the next pong message from the client
+	pongWait = 60 * time.Second
+	// pingPeriod is how often pings are sent; it must be less than pongWait
+	pingPeriod = (pongWait * 9) / 10
+	// maxMessageSize is the largest message accepted from the client; control commands carry filters
+	maxMessageSize = 64 * 1024
+)
+
 // StreamLogs handles WebSocket connections for streaming pod logs
 // Query parameters:
 //   - namespace: The Kubernetes namespace (required)
-//   - podName: The name of the pod (required)
-//   - container: The container name (optional, uses first container if not specified)
+//   - podName: The name of the pod (required unless selector or workload is given)
+//   - selector: A label selector; all matching pods are streamed together (optional)
+//   - workload: A kind/name reference such as deployment/api; all of its pods are streamed together (optional)
+//   - container: The container name (optional, uses first container if not specified;
+//     with a selector, only containers with this name are streamed)
+//   - allContainers: Stream every container of the pod, including init and ephemeral containers (default: false)
+//   - format: "text" for plain text frames or "json" for tagged JSON messages (default: text)
 //   - follow: Whether to follow logs (default: true)
-//   - tailLines: Number of lines to show from the end (default: 100)
+//   - tailLines: Number of lines to show from the end (default: 100 unless a since option is given)
+//   - sinceSeconds: Only return logs newer than this many seconds (optional)
+//   - sinceTime: Only return logs after this RFC3339 timestamp (optional)
+//   - limitBytes: Maximum number of bytes to return (optional)
+//   - previous: Return logs of the previous terminated container instance (default: false)
+//   - timestamps: Prefix each line with its RFC3339 timestamp (default: true)
+//   - previousTail: Lines of the previous instance to send first if the container has restarted (optional)
+//   - include, exclude: Regular expressions lines must (any of) or must not match; may be repeated (optional)
+//   - contains: Substring every line must contain; may be repeated (optional)
+//   - minLevel: Drop lines below this detected level, e.g. warn or error (optional)
+//   - before, after, context: Lines of context to send around each match (default: 0)
+//   - parse: Add the structured fields of JSON, logfmt and klog lines to JSON messages (default: false)
+//   - formatHint: "format" or "container=format" (json, logfmt, klog or plain) to skip detection; may be repeated and implies parse
+//   - multiline: Presets grouping stack traces into single messages (java, python, go); may be repeated or comma-separated
+//   - multilineStart: Regular expression matching the first line of an event; other lines continue the event (repeatable)
+//   - multilineTimeout: Milliseconds to wait for more lines before sending an event (default: 1000, max: 10000)
+//   - overflow: What to do when the client falls behind: block, dropOldest or disconnect (default: block)
+//   - queueSize: Messages queued for the client before the overflow policy applies (default: 1000)
+//   - flushInterval: Milliseconds to coalesce messages into newline-delimited frames; 0 sends one per frame (default: 0)
+//   - batchSize: Bytes per coalesced frame; a full batch is sent without waiting (default: 65536)
+//   - compress: Compress frames with permessage-deflate if the client supports it (default: true)
+//
+// Every connection starts with a session message carrying the session ID. A client whose connection
+// drops can reconnect with session=<id>&lastSeq=<seq of the last message received> within
+// sessionGracePeriod to receive the missed messages and continue; all other parameters are then ignored
+//
+// Clients may send JSON commands on the open connection, e.g. {"id":"1","command":"pause"}:
+//   - pause, resume: Hold messages on the server (up to maxPausedMessages) and flush them on resume
+//   - setFilter: Replace the filter; "filter" takes include, exclude, contains, minLevel, before and after
+//   - switchContainer: Restart a single-container stream on "container"
+//   - fetchOlder: Send up to "lines" lines logged before the oldest line seen (or "before") as a history message
+//
+// Every command is answered with an ack message carrying its id and whether it succeeded
 func StreamLogs(w http.ResponseWriter, r *http.Request) {
-	// Get query parameters
-	namespace := r.URL.Query().Get("namespace")
-	podName := r.URL.Query().Get("podName")
-	container := r.URL.Query().Get("container")
-
-	// Validate required parameters
-	if namespace == "" || podName == "" {
-		http.Error(w, "namespace and podName query parameters are required", http.StatusBadRequest)
+	// Resume an existing session, or parse and validate a new stream request
+	query := r.URL.Query()
+	target, ok := resolveLogStream(w, r, query.Get("session"), query.Get("lastSeq"))
+	if !ok {
 		return
 	}
-
-	// TODO: In Task 4.5, validate that the user has permission to access this namespace
+	req := target.req
 
 	// Upgrade HTTP connection to WebSocket
 	conn, err := upgrader.Upgrade(w, r, nil)
 	if err != nil {
 		log.Printf("Error upgrading connection to WebSocket: %v", err)
+		target.release()
 		return
 	}
 	defer conn.Close()
 
-	log.Printf("WebSocket connection established for pod: %s/%s", namespace, podName)
+	// A no-op if the client did not negotiate compression
+	conn.EnableWriteCompression(req.Compress)
 
-	// Get Kubernetes service
-	k8sService, err := services.NewKubernetesService()
-	if err != nil {
-		log.Printf("Error creating Kubernetes service: %v", err)
-		conn.WriteMessage(websocket.TextMessage, []byte("Error: Failed to connect to Kubernetes cluster"))
+	log.Printf("WebSocket connection established for %s", req)
+
+	// The connection context ends when the client goes away; the stream itself belongs to the session
+	ctx, cancel := context.WithCancel(r.Context())
+	defer cancel()
+
+	// Create a custom writer that queues data for the WebSocket
+	wsWriter := newLogWriter(ctx, cancel, newWebSocketTransport(conn), req)
+
+	if err := target.start(); err != nil {
+		go readPump(conn, cancel, nil)
+		wsWriter.WriteError(err.Error())
+		wsWriter.Close()
 		return
 	}
+	session := target.session
 
-	// Create a custom writer that sends data to the WebSocket
-	wsWriter := &WebSocketWriter{
-		conn: conn,
+	if err := session.attach(wsWriter, target.lastSeq); err != nil {
+		go readPump(conn, cancel, nil)
+		wsWriter.WriteError(err.Error())
+		wsWriter.Close()
+		return
 	}
 
-	// Stream logs to the WebSocket
-	err = k8sService.StreamLogs(namespace, podName, container, wsWriter)
+	// A client that closes the connection deliberately will not resume the session
+	var closedByClient atomic.Bool
+	closeHandler := conn.CloseHandler()
+	conn.SetCloseHandler(func(code int, text string) error {
+		closedByClient.Store(code == websocket.CloseNormalClosure)
+		return closeHandler(code, text)
+	})
+
+	go readPump(conn, cancel, func(data []byte) {
+		session.controller.handleCommand(wsWriter, data)
+	})
+	go pingLoop(ctx, conn, cancel)
+
+	ended, err := runLogSession(ctx, session, wsWriter, closedByClient.Load)
+	if !ended {
+		if errors.Is(err, errSlowConsumer) {
+			log.Printf("Disconnecting slow WebSocket client from %s", req)
+			conn.WriteControl(websocket.CloseMessage,
+				websocket.FormatCloseMessage(websocket.ClosePolicyViolation, "client too slow"),
+				time.Now().Add(writeWait))
+			return
+		}
+		log.Printf("WebSocket client disconnected from %s", req)
+		return
+	}
 	if err != nil {
-		log.Printf("Error streaming logs for pod %s/%s: %v", namespace, podName, err)
-		conn.WriteMessage(websocket.TextMessage, []byte("Error: "+err.Error()))
 		return
 	}
 
-	log.Printf("WebSocket connection closed for pod: %s/%s", namespace, podName)
-}
+	// The stream ended on its own (e.g. follow=false); close the connection cleanly
+	conn.WriteControl(websocket.CloseMessage,
+		websocket.FormatCloseMessage(websocket.CloseNormalClosure, "log stream ended"),
+		time.Now().Add(writeWait))
 
-// WebSocketWriter is an io.Writer that writes to a WebSocket connection
-type WebSocketWriter struct {
-	conn *websocket.Conn
+	log.Printf("WebSocket connection closed for %s", req)
 }
 
-// Write implements the io.Writer interface for WebSocket
-func (w *WebSocketWriter) Write(p []byte) (n int, err error) {
-	err = w.conn.WriteMessage(websocket.TextMessage, p)
-	if err != nil {
-		return 0, err
+// readPump reads from the connection until the client goes away, passing each message to handle
+// Reading is required to process pong and close control messages; when the read fails
+// (client closed the socket or stopped answering pings) the stream context is cancelled
+func readPump(conn *websocket.Conn, cancel context.CancelFunc, handle func([]byte)) {
+	defer cancel()
+
+	conn.SetReadLimit(maxMessageSize)
+	conn.SetReadDeadline(time.Now().Add(pongWait))
+	conn.SetPongHandler(func(string) error {
+		return conn.SetReadDeadline(time.Now().Add(pongWait))
+	})
+
+	for {
+		_, data, err := conn.ReadMessage()
+		if err != nil {
+			if websocket.IsUnexpectedCloseError(err, websocket.CloseGoingAway, websocket.CloseNormalClosure) {
+				log.Printf("WebSocket read error: %v", err)
+			}
+			return
+		}
+		if handle != nil {
+			handle(data)
+		}
 	}
-	return len(p), nil
 }
 
+// pingLoop sends periodic pings so dead connections are detected even when the pod is quiet
+func pingLoop(ctx context.Context, conn *websocket.Conn, cancel context.CancelFunc) {
+	ticker := time.NewTicker(pingPeriod)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			// WriteControl is safe to call concurrently with WriteMessage
+			if err := conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(writeWait)); err != nil {
+				cancel()
+				return
+			}
+		}
+	}
+}
@@ -0,0 +1,152 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+
+	"arlog/backend/services"
+)
+
+// logStreamTarget is what a log stream connection attaches to, once the request has been authorized
+// Either session is an existing session to resume from lastSeq, or lease holds the slot for a new one
+// owner is the subject of the authorized user
+type logStreamTarget struct {
+	req     *logStreamRequest
+	owner   string
+	session *logSession
+	lastSeq int64
+	lease   *streamLease
+}
+
+// resolveLogStream finds the session to resume, or parses a new stream request, and authorizes it
+// It is shared by the WebSocket and Server-Sent Events endpoints. On failure the HTTP error has
+// been written and false is returned
+func resolveLogStream(w http.ResponseWriter, r *http.Request, sessionID, lastSeqValue string) (*logStreamTarget, bool) {
+	target := &logStreamTarget{}
+
+	// Resume an existing session, or parse and validate a new stream request
+	if sessionID != "" {
+		if target.session = sessions.get(sessionID); target.session == nil {
+			http.Error(w, "session not found or expired", http.StatusNotFound)
+			return nil, false
+		}
+		if lastSeqValue != "" {
+			lastSeq, err := strconv.ParseInt(lastSeqValue, 10, 64)
+			if err != nil {
+				http.Error(w, fmt.Sprintf("invalid lastSeq parameter: %q", lastSeqValue), http.StatusBadRequest)
+				return nil, false
+			}
+			target.lastSeq = lastSeq
+		}
+		target.req = target.session.req
+	} else {
+		req, err := parseLogStreamRequest(r.URL.Query())
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return nil, false
+		}
+		target.req = req
+	}
+	req := target.req
+
+	// Every connection is authorized, including one resuming a session or joining a shared stream
+	access, err := authorizeNamespace(r, req.Cluster, req.Namespace)
+	if err != nil {
+		if status := accessErrorStatus(err); status == http.StatusInternalServerError {
+			log.Printf("Error authorizing log stream for %s: %v", req, err)
+		}
+		http.Error(w, err.Error(), accessErrorStatus(err))
+		return nil, false
+	}
+	target.owner = access.User.Sub
+
+	// A session can only be resumed by the user who started it; to anyone else it does not exist
+	if target.session != nil && target.session.owner != target.owner {
+		http.Error(w, "session not found or expired", http.StatusNotFound)
+		return nil, false
+	}
+
+	// A new stream counts against the concurrency caps until its session closes;
+	// a resumed session keeps the slot it already holds
+	if target.session == nil {
+		if target.lease, err = streamQuota.acquire(access.User.Sub, access.Team, req.Cluster); err != nil {
+			log.Printf("Rejecting log stream for %s: %v", req, err)
+			http.Error(w, err.Error(), http.StatusTooManyRequests)
+			return nil, false
+		}
+	}
+
+	return target, true
+}
+
+// release gives up the target's concurrency slot if it never became a session
+func (t *logStreamTarget) release() {
+	if t.session == nil && t.lease != nil {
+		t.lease.release()
+	}
+}
+
+// start creates the session for a new stream; resumed targets already have one
+// The returned error is suitable for the client
+func (t *logStreamTarget) start() error {
+	if t.session != nil {
+		return nil
+	}
+
+	// Get Kubernetes service
+	k8sService, err := services.NewKubernetesService()
+	if err != nil {
+		log.Printf("Error creating Kubernetes service: %v", err)
+		t.lease.release()
+		return errors.New("Failed to connect to Kubernetes cluster")
+	}
+
+	session, err := newLogSession(t.req, t.owner, k8sService, t.lease)
+	if err != nil {
+		log.Printf("Error creating log session: %v", err)
+		t.lease.release()
+		return err
+	}
+	t.session = session
+	return nil
+}
+
+// runLogSession delivers the session's messages through writer until the stream ends or ctx is
+// cancelled because the client went away. It reports whether the stream ended, and the error that
+// failed the writer, if any
+//
+// When the client goes away the session is kept for resuming, unless closedByClient reports that
+// the client closed the stream deliberately
+func runLogSession(ctx context.Context, session *logSession, writer *LogWriter, closedByClient func() bool) (bool, error) {
+	// Stream logs to the client until the stream ends or the client goes away
+	select {
+	case <-session.done:
+	case <-ctx.Done():
+	}
+
+	finished, err := session.finished()
+	if !finished || ctx.Err() != nil {
+		// Keep the session around so the client can resume it
+		if closedByClient() {
+			session.close()
+		} else {
+			session.detach(writer)
+		}
+		return false, writer.Close()
+	}
+
+	// The stream is over; nothing is left to resume
+	session.close()
+
+	if err != nil && !errors.Is(err, context.Canceled) {
+		log.Printf("Error streaming logs for %s: %v", session.req, err)
+		writer.WriteError(err.Error())
+	}
+
+	// Flush whatever is still queued before closing
+	return true, writer.Close()
+}
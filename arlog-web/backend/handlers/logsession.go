@@ -0,0 +1,299 @@
+package handlers
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"arlog/backend/services"
+)
+
+// Resumable session limits
+const (
+	// sessionBufferSize is the number of recent messages kept per session for replay
+	sessionBufferSize = 10000
+	// sessionGracePeriod is how long a session outlives its connection, waiting for the client to resume it
+	sessionGracePeriod = 2 * time.Minute
+)
+
+// sessions holds the live resumable sessions by ID
+var sessions = &sessionRegistry{sessions: make(map[string]*logSession)}
+
+// sessionRegistry is a concurrency-safe set of sessions
+type sessionRegistry struct {
+	mu       sync.Mutex
+	sessions map[string]*logSession
+}
+
+func (r *sessionRegistry) add(s *logSession) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.sessions[s.id] = s
+}
+
+func (r *sessionRegistry) get(id string) *logSession {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.sessions[id]
+}
+
+func (r *sessionRegistry) remove(s *logSession) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.sessions[s.id] == s {
+		delete(r.sessions, s.id)
+	}
+}
+
+// SessionMessage is sent first on every connection and tells the client how to resume the stream
+// Seq is the sequence number of the last message sent before the connection attached
+type SessionMessage struct {
+	Type     string `json:"type"`
+	ID       string `json:"id"`
+	Seq      int64  `json:"seq"`
+	Replayed int    `json:"replayed,omitempty"`
+}
+
+// sessionEntry is a message kept for replay
+type sessionEntry struct {
+	seq  int64
+	data []byte
+}
+
+// logSession owns a log stream independently of the WebSocket connection reading it
+// Every line and event is numbered and kept in a ring buffer, so a client whose connection drops
+// can reconnect within sessionGracePeriod and receive exactly the messages it missed
+type logSession struct {
+	id string
+	// owner is the subject of the user who started the session; only they may resume it
+	owner      string
+	req        *logStreamRequest
+	controller *logStreamController
+	cancel     context.CancelFunc
+	done       chan struct{}
+	// lease holds the session's slot in the stream concurrency caps
+	lease *streamLease
+
+	// sendMu is held by the sink while it sends a message, so messages reach the connection in sequence
+	// order without mu being held while a blocking enqueue waits for the client
+	sendMu sync.Mutex
+
+	mu     sync.Mutex
+	seq    int64
+	ring   []sessionEntry
+	next   int
+	writer *LogWriter
+	// generation changes on every attach so grace timers of earlier connections are ignored
+	generation int
+	result     error
+}
+
+// newLogSession registers a session for req, owned by the user with subject owner, and starts its stream
+// The session releases lease when it closes
+func newLogSession(req *logStreamRequest, owner string, k8sService *services.KubernetesService, lease *streamLease) (*logSession, error) {
+	id, err := newSessionID()
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	s := &logSession{
+		id:     id,
+		owner:  owner,
+		req:    req,
+		cancel: cancel,
+		lease:  lease,
+		done:   make(chan struct{}),
+		ring:   make([]sessionEntry, 0, sessionBufferSize),
+	}
+	s.controller = newLogStreamController(ctx, req, k8sService, s)
+
+	sessions.add(s)
+	go s.run()
+	return s, nil
+}
+
+// newSessionID returns a random, unguessable session ID
+func newSessionID() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", fmt.Errorf("failed to generate session ID: %w", err)
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// run streams until the stream ends or the session is closed
+func (s *logSession) run() {
+	err := s.controller.run()
+
+	s.mu.Lock()
+	s.result = err
+	s.mu.Unlock()
+	close(s.done)
+}
+
+// finished reports whether the stream has ended, and how
+func (s *logSession) finished() (bool, error) {
+	select {
+	case <-s.done:
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		return true, s.result
+	default:
+		return false, nil
+	}
+}
+
+// attach makes w the session's connection and replays the messages after lastSeq
+// A connection already attached to the session is disconnected
+func (s *logSession) attach(w *LogWriter, lastSeq int64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if lastSeq < 0 || lastSeq > s.seq {
+		return fmt.Errorf("lastSeq must be between 0 and %d", s.seq)
+	}
+
+	if s.writer != nil && s.writer != w {
+		s.writer.cancel()
+	}
+	s.writer = w
+	s.generation++
+
+	replayed := len(s.ring)
+	if unseen := s.seq - lastSeq; unseen < int64(replayed) {
+		replayed = int(unseen)
+	}
+	if err := w.writeImmediate(SessionMessage{Type: "session", ID: s.id, Seq: lastSeq, Replayed: replayed}); err != nil {
+		return err
+	}
+
+	// The missed messages skip the overflow policy: they are all delivered, and queueing them never
+	// blocks the live stream
+	messages := make([]outboundMessage, 0, replayed+1)
+
+	// Messages that fell out of the ring buffer cannot be replayed; say how many
+	oldest := s.seq - int64(len(s.ring)) + 1
+	if missed := oldest - 1 - lastSeq; missed > 0 {
+		data, err := encodeStreamEvent(s.req.Format, services.StreamEvent{
+			Type:    services.StreamEventDropped,
+			Count:   missed,
+			Message: fmt.Sprintf("%d lines are no longer available", missed),
+		}, 0)
+		if err != nil {
+			return err
+		}
+		messages = append(messages, outboundMessage{data: data})
+	}
+
+	for i := 0; i < len(s.ring); i++ {
+		entry := s.ring[(s.next+i)%len(s.ring)]
+		if entry.seq > lastSeq {
+			messages = append(messages, outboundMessage{seq: entry.seq, data: entry.data})
+		}
+	}
+	return w.replay(messages)
+}
+
+// detach releases w, and closes the session unless a client resumes it within the grace period
+func (s *logSession) detach(w *LogWriter) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.writer == w {
+		s.writer = nil
+	}
+	if s.writer != nil {
+		return
+	}
+
+	generation := s.generation
+	time.AfterFunc(sessionGracePeriod, func() {
+		s.mu.Lock()
+		expired := s.generation == generation && s.writer == nil
+		s.mu.Unlock()
+
+		if expired {
+			log.Printf("Log session %s expired for %s", s.id, s.req)
+			s.close()
+		}
+	})
+}
+
+// close stops the stream and forgets the session
+func (s *logSession) close() {
+	s.cancel()
+	sessions.remove(s)
+	s.lease.release()
+}
+
+// WriteLine implements services.LogSink
+func (s *logSession) WriteLine(line services.LogLine) error {
+	s.sendMu.Lock()
+	defer s.sendMu.Unlock()
+
+	s.mu.Lock()
+	data, err := encodeLogLine(s.req.Format, s.req.tagged(), line, s.seq+1)
+	if err != nil {
+		s.mu.Unlock()
+		return err
+	}
+	writer, seq := s.keepLocked(data)
+	s.mu.Unlock()
+
+	s.send(writer, seq, data)
+	return nil
+}
+
+// WriteEvent implements services.LogSink
+func (s *logSession) WriteEvent(event services.StreamEvent) error {
+	s.sendMu.Lock()
+	defer s.sendMu.Unlock()
+
+	s.mu.Lock()
+	data, err := encodeStreamEvent(s.req.Format, event, s.seq+1)
+	if err != nil {
+		s.mu.Unlock()
+		return err
+	}
+	writer, seq := s.keepLocked(data)
+	s.mu.Unlock()
+
+	s.send(writer, seq, data)
+	return nil
+}
+
+// keepLocked numbers a message and keeps it for replay, returning its number and the connection to send
+// it to, if one is attached
+// The caller must hold s.mu
+func (s *logSession) keepLocked(data []byte) (*LogWriter, int64) {
+	s.seq++
+	entry := sessionEntry{seq: s.seq, data: data}
+	if len(s.ring) < sessionBufferSize {
+		s.ring = append(s.ring, entry)
+	} else {
+		s.ring[s.next] = entry
+		s.next = (s.next + 1) % sessionBufferSize
+	}
+	return s.writer, s.seq
+}
+
+// send queues a kept message on writer, outside s.mu, so that attaching a new connection is not held
+// up by a slow one. A failing connection is detached rather than failing the stream, so the client can
+// resume; a connection attached meanwhile got the message from the replay
+func (s *logSession) send(writer *LogWriter, seq int64, data []byte) {
+	if writer == nil {
+		return
+	}
+	if err := writer.enqueue(seq, data); err != nil {
+		s.mu.Lock()
+		if s.writer == writer {
+			s.writer = nil
+		}
+		s.mu.Unlock()
+	}
+}
@@ -0,0 +1,202 @@
+package handlers
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"arlog/backend/services"
+)
+
+// recordingTransport records the messages written to it, holding the write pump back until released
+type recordingTransport struct {
+	release chan struct{}
+
+	mu       sync.Mutex
+	messages []string
+	seqs     []int64
+}
+
+func (t *recordingTransport) writeMessage(seq int64, p []byte) error {
+	<-t.release
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.messages = append(t.messages, string(p))
+	if seq > 0 {
+		t.seqs = append(t.seqs, seq)
+	}
+	return nil
+}
+
+// testLogSession builds a session for req that is not connected to a stream
+func testLogSession(req *logStreamRequest) *logSession {
+	return &logSession{
+		id:     "test",
+		req:    req,
+		cancel: func() {},
+		done:   make(chan struct{}),
+		ring:   make([]sessionEntry, 0, sessionBufferSize),
+	}
+}
+
+// TestLogSessionResumeReplaysEveryMissedLine resumes a session that missed more lines than the client's
+// queue holds, while the client is not reading yet, and checks that every missed and live line arrives
+// in order under each overflow policy
+func TestLogSessionResumeReplaysEveryMissedLine(t *testing.T) {
+	const (
+		queueSize = 10
+		missed    = 5 * queueSize
+		live      = queueSize / 2
+	)
+
+	for _, policy := range []string{overflowBlock, overflowDropOldest, overflowDisconnect} {
+		t.Run(policy, func(t *testing.T) {
+			req, err := parseLogStreamRequest(url.Values{
+				"namespace": {"default"},
+				"podName":   {"api"},
+				"overflow":  {policy},
+				"queueSize": {strconv.Itoa(queueSize)},
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			session := testLogSession(req)
+			line := func(i int) services.LogLine {
+				return services.LogLine{Namespace: "default", Pod: "api", Container: "api", Content: []byte(fmt.Sprintf("line %d\n", i))}
+			}
+			for i := 1; i <= missed; i++ {
+				session.WriteLine(line(i))
+			}
+
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			transport := &recordingTransport{release: make(chan struct{})}
+			writer := newLogWriter(ctx, cancel, transport, req)
+
+			// Resuming and live lines must not block, even though the client reads nothing yet
+			done := make(chan error, 1)
+			go func() {
+				if err := session.attach(writer, 0); err != nil {
+					done <- err
+					return
+				}
+				for i := missed + 1; i <= missed+live; i++ {
+					if err := session.WriteLine(line(i)); err != nil {
+						done <- err
+						return
+					}
+				}
+				done <- nil
+			}()
+			select {
+			case err := <-done:
+				if err != nil {
+					t.Fatalf("resuming failed: %v", err)
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatal("resuming blocked while the client was not reading")
+			}
+			if session.writer != writer {
+				t.Fatal("the writer was detached from the session")
+			}
+
+			close(transport.release)
+			if err := writer.Close(); err != nil {
+				t.Fatalf("writer failed: %v", err)
+			}
+
+			transport.mu.Lock()
+			defer transport.mu.Unlock()
+			if len(transport.seqs) != missed+live {
+				t.Fatalf("received %d numbered messages, want %d", len(transport.seqs), missed+live)
+			}
+			for i, seq := range transport.seqs {
+				if seq != int64(i+1) {
+					t.Fatalf("message %d has seq %d, want %d", i, seq, i+1)
+				}
+			}
+			for _, message := range transport.messages {
+				if strings.Contains(message, "dropped") {
+					t.Errorf("unexpected message %q", message)
+				}
+			}
+		})
+	}
+}
+
+// TestLogSessionAttachWhileBlocked resumes a session on a new connection while the stream is blocked on
+// a connection that stopped reading under the block policy, and checks that the new connection gets every
+// line in order
+func TestLogSessionAttachWhileBlocked(t *testing.T) {
+	const lines = 30
+	req, err := parseLogStreamRequest(url.Values{
+		"namespace": {"default"},
+		"podName":   {"api"},
+		"overflow":  {overflowBlock},
+		"queueSize": {"10"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	session := testLogSession(req)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	stalled := &recordingTransport{release: make(chan struct{})}
+	if err := session.attach(newLogWriter(ctx, cancel, stalled, req), 0); err != nil {
+		t.Fatal(err)
+	}
+
+	written := make(chan error, 1)
+	go func() {
+		for i := 1; i <= lines; i++ {
+			if err := session.WriteLine(services.LogLine{Namespace: "default", Pod: "api", Container: "api", Content: []byte(fmt.Sprintf("line %d\n", i))}); err != nil {
+				written <- err
+				return
+			}
+		}
+		written <- nil
+	}()
+	// Let the stream fill the stalled connection's queue and block
+	time.Sleep(100 * time.Millisecond)
+
+	resumedCtx, resumedCancel := context.WithCancel(context.Background())
+	defer resumedCancel()
+	resumed := &recordingTransport{release: make(chan struct{})}
+	writer := newLogWriter(resumedCtx, resumedCancel, resumed, req)
+	attached := make(chan error, 1)
+	go func() { attached <- session.attach(writer, 0) }()
+	select {
+	case err := <-attached:
+		if err != nil {
+			t.Fatalf("resuming failed: %v", err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("resuming blocked behind the stalled connection")
+	}
+
+	close(stalled.release)
+	close(resumed.release)
+	if err := <-written; err != nil {
+		t.Fatalf("stream failed: %v", err)
+	}
+	if err := writer.Close(); err != nil {
+		t.Fatalf("writer failed: %v", err)
+	}
+
+	resumed.mu.Lock()
+	defer resumed.mu.Unlock()
+	if len(resumed.seqs) != lines {
+		t.Fatalf("received %d numbered messages, want %d", len(resumed.seqs), lines)
+	}
+	for i, seq := range resumed.seqs {
+		if seq != int64(i+1) {
+			t.Fatalf("message %d has seq %d, want %d", i, seq, i+1)
+		}
+	}
+}
@@ -0,0 +1,111 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// SSE connection timing
+const (
+	// sseKeepAlivePeriod is how often a comment is sent on an idle stream so proxies keep it open
+	sseKeepAlivePeriod = 15 * time.Second
+	// sseRetry is the reconnection delay suggested to clients
+	sseRetry = 2 * time.Second
+)
+
+// StreamLogsSSE streams pod logs as Server-Sent Events, for clients that cannot use WebSockets
+// It takes the same query parameters as StreamLogs and sends the same messages, one per event;
+// only flushInterval and batchSize are ignored, since every event carries its own ID.
+// Commands are not supported
+//
+// Numbered events have the ID <session>:<seq>. A client reconnecting with a Last-Event-ID header
+// (as browsers' EventSource does) resumes the session after that event; session and lastSeq
+// query parameters work as for StreamLogs
+func StreamLogsSSE(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	sessionID, lastSeq := query.Get("session"), query.Get("lastSeq")
+	if value := r.Header.Get("Last-Event-ID"); value != "" {
+		id, seq, ok := strings.Cut(value, ":")
+		if !ok {
+			http.Error(w, fmt.Sprintf("invalid Last-Event-ID header: %q", value), http.StatusBadRequest)
+			return
+		}
+		sessionID, lastSeq = id, seq
+	}
+
+	target, ok := resolveLogStream(w, r, sessionID, lastSeq)
+	if !ok {
+		return
+	}
+	if err := target.start(); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	session := target.session
+
+	// Messages are never coalesced, so that every event has its own ID
+	req := *session.req
+	req.FlushInterval = 0
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	// Stop reverse proxies such as nginx from buffering the stream
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+
+	transport := newSSETransport(w)
+	transport.setSession(session.id)
+	// A failed write surfaces again on the first message
+	transport.setRetry(sseRetry)
+
+	log.Printf("SSE connection established for %s", &req)
+
+	// The connection context ends when the client goes away; the stream itself belongs to the session
+	ctx, cancel := context.WithCancel(r.Context())
+	defer cancel()
+
+	writer := newLogWriter(ctx, cancel, transport, &req)
+
+	if err := session.attach(writer, target.lastSeq); err != nil {
+		writer.WriteError(err.Error())
+		writer.Close()
+		return
+	}
+
+	go keepAliveLoop(ctx, transport, cancel)
+
+	// An event stream cannot tell a deliberate close from a dropped connection, so the session is
+	// always kept for the client to resume
+	ended, err := runLogSession(ctx, session, writer, func() bool { return false })
+	switch {
+	case !ended && errors.Is(err, errSlowConsumer):
+		log.Printf("Disconnecting slow SSE client from %s", &req)
+	case !ended:
+		log.Printf("SSE client disconnected from %s", &req)
+	default:
+		log.Printf("SSE connection closed for %s", &req)
+	}
+}
+
+// keepAliveLoop sends periodic comments so proxies do not close a quiet stream
+func keepAliveLoop(ctx context.Context, transport *sseTransport, cancel context.CancelFunc) {
+	ticker := time.NewTicker(sseKeepAlivePeriod)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := transport.keepAlive(); err != nil {
+				cancel()
+				return
+			}
+		}
+	}
+}
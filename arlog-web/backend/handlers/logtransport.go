@@ -0,0 +1,102 @@
+package handlers
+
+import (
+	"bytes"
+	"errors"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// messageTransport delivers the messages of a LogWriter to the client
+// writeMessage is only called by the writer's write pump
+type messageTransport interface {
+	// writeMessage sends one message; seq is its session sequence number, or 0 if it has none
+	writeMessage(seq int64, p []byte) error
+}
+
+// webSocketTransport sends each message as a WebSocket text frame
+type webSocketTransport struct {
+	conn *websocket.Conn
+}
+
+func newWebSocketTransport(conn *websocket.Conn) *webSocketTransport {
+	return &webSocketTransport{conn: conn}
+}
+
+// writeMessage writes a single message; the sequence number is carried in the message itself
+// Each write must complete within writeWait so a stalled client cannot hold the connection forever
+func (t *webSocketTransport) writeMessage(seq int64, p []byte) error {
+	t.conn.SetWriteDeadline(time.Now().Add(writeWait))
+	return t.conn.WriteMessage(websocket.TextMessage, p)
+}
+
+// sseTransport sends each message as a Server-Sent Event
+// Numbered messages carry the event ID <session>:<seq>, which browsers send back in the
+// Last-Event-ID header when they reconnect
+type sseTransport struct {
+	w          http.ResponseWriter
+	controller *http.ResponseController
+
+	// mu serializes the write pump and keep-alive comments
+	mu        sync.Mutex
+	sessionID string
+}
+
+func newSSETransport(w http.ResponseWriter) *sseTransport {
+	return &sseTransport{w: w, controller: http.NewResponseController(w)}
+}
+
+// setSession sets the session whose ID prefixes the event IDs
+func (t *sseTransport) setSession(id string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.sessionID = id
+}
+
+// writeMessage writes p as an event, one data field per line
+func (t *sseTransport) writeMessage(seq int64, p []byte) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	var event bytes.Buffer
+	if seq > 0 && t.sessionID != "" {
+		event.WriteString("id: " + t.sessionID + ":" + strconv.FormatInt(seq, 10) + "\n")
+	}
+	for _, line := range bytes.Split(bytes.TrimSuffix(p, []byte("\n")), []byte("\n")) {
+		event.WriteString("data: ")
+		event.Write(bytes.TrimSuffix(line, []byte("\r")))
+		event.WriteByte('\n')
+	}
+	event.WriteByte('\n')
+
+	return t.write(event.Bytes())
+}
+
+// setRetry tells the client how long to wait before reconnecting
+func (t *sseTransport) setRetry(d time.Duration) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.write([]byte("retry: " + strconv.FormatInt(d.Milliseconds(), 10) + "\n\n"))
+}
+
+// keepAlive writes a comment, which clients ignore, so proxies do not time out an idle stream
+func (t *sseTransport) keepAlive() error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.write([]byte(": keep-alive\n\n"))
+}
+
+// write sends and flushes p within writeWait; the caller must hold t.mu
+func (t *sseTransport) write(p []byte) error {
+	if err := t.controller.SetWriteDeadline(time.Now().Add(writeWait)); err != nil && !errors.Is(err, http.ErrNotSupported) {
+		return err
+	}
+	if _, err := t.w.Write(p); err != nil {
+		return err
+	}
+	return t.controller.Flush()
+}
@@ -0,0 +1,464 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"arlog/backend/services"
+)
+
+// Policies applied when a client falls behind and its outbound queue is full
+const (
+	// overflowBlock stops reading upstream logs until the client catches up
+	overflowBlock = "block"
+	// overflowDropOldest discards the oldest queued messages and tells the client how many were lost
+	overflowDropOldest = "dropOldest"
+	// overflowDisconnect closes the connection of a client that cannot keep up
+	overflowDisconnect = "disconnect"
+)
+
+// Outbound queue limits, in messages
+const (
+	defaultQueueSize = 1000
+	maxQueueSize     = 10000
+)
+
+// Frame batching limits
+const (
+	// maxFlushInterval is the longest time lines may be held back to fill a frame
+	maxFlushInterval = time.Second
+	// defaultBatchBytes is the frame size at which a batch is sent without waiting for the interval
+	defaultBatchBytes = 64 * 1024
+	// maxBatchBytes is the largest batch size a client may request
+	maxBatchBytes = 1024 * 1024
+)
+
+// maxPausedMessages is the number of messages buffered while a client has paused the stream
+// Once the buffer is full the oldest messages are dropped and reported when the stream resumes
+const maxPausedMessages = 10000
+
+var (
+	// errSlowConsumer is returned when a client is disconnected by the overflowDisconnect policy
+	errSlowConsumer = errors.New("client is not reading messages fast enough")
+	// errWriterClosed is returned by writes after the writer has been closed
+	errWriterClosed = errors.New("log writer closed")
+)
+
+// LogWriter is an io.Writer that writes log stream messages to a client over a messageTransport
+// It also implements services.LogSink, encoding lines and events according to the stream format
+//
+// Messages are queued and sent by a single write pump goroutine, so a slow client never holds up
+// the upstream log stream for longer than its overflow policy allows. Each message must be written
+// within writeWait. While paused, messages are buffered (dropping the oldest) instead of sent.
+// Acknowledgements, history and errors skip both the queue limit and the pause
+//
+// With a flush interval, queued messages are coalesced into newline-delimited frames of up to
+// batchBytes, sent when the interval has passed since the first of them was queued or as soon as
+// batchBytes are waiting. Acknowledgements, history and errors are always sent in their own frames
+type LogWriter struct {
+	transport     messageTransport
+	format        string
+	tagged        bool
+	policy        string
+	queueSize     int
+	flushInterval time.Duration
+	batchBytes    int
+	cancel        context.CancelFunc
+
+	mu          sync.Mutex
+	space       *sync.Cond
+	queue       []outboundMessage
+	queuedBytes int
+	// replaying is the number of replayed messages at the head of the queue; they do not count
+	// against the queue limit and are never dropped
+	replaying   int
+	firstQueued time.Time
+	urgent      [][]byte
+	dropped     int64
+	paused      bool
+	closing     bool
+	err         error
+
+	// wake signals the write pump that there is work; done is closed when the pump exits
+	wake chan struct{}
+	done chan struct{}
+}
+
+// outboundMessage is a queued message and its session sequence number (0 if it has none)
+type outboundMessage struct {
+	seq  int64
+	data []byte
+}
+
+// newLogWriter creates a writer for the transport and starts its write pump
+// A write failure cancels the connection context through cancel
+func newLogWriter(ctx context.Context, cancel context.CancelFunc, transport messageTransport, req *logStreamRequest) *LogWriter {
+	w := &LogWriter{
+		transport:     transport,
+		format:        req.Format,
+		tagged:        req.tagged(),
+		policy:        req.Overflow,
+		queueSize:     req.QueueSize,
+		flushInterval: req.FlushInterval,
+		batchBytes:    req.BatchBytes,
+		cancel:        cancel,
+		wake:          make(chan struct{}, 1),
+		done:          make(chan struct{}),
+	}
+	w.space = sync.NewCond(&w.mu)
+
+	go w.writePump(ctx)
+	return w
+}
+
+// Write implements the io.Writer interface for WebSocket
+// The message is queued according to the overflow policy and sent asynchronously
+func (w *LogWriter) Write(p []byte) (n int, err error) {
+	if err := w.enqueue(0, append([]byte(nil), p...)); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// WriteLine implements services.LogSink
+func (w *LogWriter) WriteLine(line services.LogLine) error {
+	data, err := encodeLogLine(w.format, w.tagged, line, 0)
+	if err != nil {
+		return err
+	}
+	return w.enqueue(0, data)
+}
+
+// WriteEvent implements services.LogSink
+func (w *LogWriter) WriteEvent(event services.StreamEvent) error {
+	data, err := encodeStreamEvent(w.format, event, 0)
+	if err != nil {
+		return err
+	}
+	return w.enqueue(0, data)
+}
+
+// WriteHistory sends lines fetched for a fetchOlder command
+func (w *LogWriter) WriteHistory(id string, lines []services.LogLine) error {
+	data, err := encodeHistory(id, lines)
+	if err != nil {
+		return err
+	}
+	return w.enqueueUrgent(data)
+}
+
+// WriteError sends an error message to the client
+func (w *LogWriter) WriteError(message string) error {
+	data, err := encodeError(w.format, message)
+	if err != nil {
+		return err
+	}
+	return w.enqueueUrgent(data)
+}
+
+// writeImmediate sends v as JSON
+func (w *LogWriter) writeImmediate(v interface{}) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return w.enqueueUrgent(data)
+}
+
+// Pause holds back messages until Resume is called
+func (w *LogWriter) Pause() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.paused = true
+}
+
+// Resume sends the messages buffered while paused, preceded by a notice if any were dropped
+func (w *LogWriter) Resume() {
+	w.mu.Lock()
+	w.paused = false
+	w.mu.Unlock()
+
+	w.signal()
+}
+
+// Close sends whatever is still queued, stops the write pump and returns the error that
+// failed the writer, if any
+func (w *LogWriter) Close() error {
+	w.mu.Lock()
+	w.closing = true
+	w.space.Broadcast()
+	w.mu.Unlock()
+
+	w.signal()
+	<-w.done
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.err
+}
+
+// enqueue adds a message with sequence number seq to the outbound queue, applying the overflow
+// policy when it is full
+func (w *LogWriter) enqueue(seq int64, p []byte) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	for {
+		if w.err != nil {
+			return w.err
+		}
+		if w.closing {
+			return errWriterClosed
+		}
+
+		limit, policy := w.queueSize, w.policy
+		if w.paused {
+			limit, policy = maxPausedMessages, overflowDropOldest
+		}
+		if len(w.queue)-w.replaying < limit {
+			break
+		}
+
+		switch policy {
+		case overflowDropOldest:
+			// Drop the oldest live message, keeping the replayed ones ahead of it
+			oldest := w.replaying
+			w.queuedBytes -= len(w.queue[oldest].data)
+			if oldest == 0 {
+				w.queue[0] = outboundMessage{}
+				w.queue = w.queue[1:]
+			} else {
+				copy(w.queue[oldest:], w.queue[oldest+1:])
+				w.queue[len(w.queue)-1] = outboundMessage{}
+				w.queue = w.queue[:len(w.queue)-1]
+			}
+			w.dropped++
+		case overflowDisconnect:
+			w.failLocked(errSlowConsumer)
+			return w.err
+		default:
+			w.space.Wait()
+		}
+	}
+
+	if len(w.queue) == 0 {
+		w.firstQueued = time.Now()
+	}
+	w.queue = append(w.queue, outboundMessage{seq: seq, data: p})
+	w.queuedBytes += len(p)
+	w.signal()
+	return nil
+}
+
+// replay queues the messages a resumed session missed ahead of the live messages
+// Replayed messages bypass the overflow policy, so the client receives every one of them without
+// the caller ever blocking; their number is bounded by the session buffer
+func (w *LogWriter) replay(messages []outboundMessage) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.err != nil {
+		return w.err
+	}
+	if w.closing {
+		return errWriterClosed
+	}
+	if len(messages) == 0 {
+		return nil
+	}
+
+	if len(w.queue) == 0 {
+		w.firstQueued = time.Now()
+	}
+	queue := make([]outboundMessage, 0, len(w.queue)+len(messages))
+	queue = append(queue, w.queue[:w.replaying]...)
+	queue = append(queue, messages...)
+	queue = append(queue, w.queue[w.replaying:]...)
+	w.queue = queue
+	w.replaying += len(messages)
+	for _, m := range messages {
+		w.queuedBytes += len(m.data)
+	}
+	w.signal()
+	return nil
+}
+
+// enqueueUrgent queues a message that is sent ahead of queued log lines, even while paused
+func (w *LogWriter) enqueueUrgent(p []byte) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.err != nil {
+		return w.err
+	}
+	if len(w.urgent) >= maxQueueSize {
+		w.failLocked(errSlowConsumer)
+		return w.err
+	}
+
+	w.urgent = append(w.urgent, p)
+	w.signal()
+	return nil
+}
+
+// signal wakes the write pump without blocking
+func (w *LogWriter) signal() {
+	select {
+	case w.wake <- struct{}{}:
+	default:
+	}
+}
+
+// failLocked records the first error, releases blocked writers and cancels the connection
+// The caller must hold w.mu
+func (w *LogWriter) failLocked(err error) {
+	if w.err == nil {
+		w.err = err
+	}
+	w.space.Broadcast()
+	w.cancel()
+	w.signal()
+}
+
+// writePump sends queued messages until the writer is closed or fails
+// Urgent messages go first, then a dropped-lines notice if any were discarded, then log lines
+func (w *LogWriter) writePump(ctx context.Context) {
+	defer close(w.done)
+
+	timer := time.NewTimer(0)
+	defer timer.Stop()
+
+	for {
+		w.mu.Lock()
+		if w.err != nil {
+			w.mu.Unlock()
+			return
+		}
+
+		// Give a partial batch until the flush interval to fill up, unless something must go out now
+		if wait := w.batchWaitLocked(); wait > 0 {
+			w.mu.Unlock()
+
+			if !timer.Stop() {
+				select {
+				case <-timer.C:
+				default:
+				}
+			}
+			timer.Reset(wait)
+
+			select {
+			case <-w.wake:
+			case <-timer.C:
+			case <-ctx.Done():
+				w.mu.Lock()
+				w.failLocked(ctx.Err())
+				w.mu.Unlock()
+				return
+			}
+			continue
+		}
+
+		urgent := w.urgent
+		w.urgent = nil
+
+		var (
+			batch   []outboundMessage
+			dropped int64
+		)
+		// The remaining lines are flushed on close even if the client paused the stream
+		if !w.paused || w.closing {
+			batch, dropped = w.queue, w.dropped
+			w.queue, w.queuedBytes, w.replaying, w.dropped = nil, 0, 0, 0
+		}
+		closing := w.closing
+		w.space.Broadcast()
+		w.mu.Unlock()
+
+		if len(urgent) == 0 && len(batch) == 0 && dropped == 0 {
+			if closing {
+				return
+			}
+			select {
+			case <-w.wake:
+			case <-ctx.Done():
+				w.mu.Lock()
+				w.failLocked(ctx.Err())
+				w.mu.Unlock()
+				return
+			}
+			continue
+		}
+
+		if err := w.send(urgent, dropped, batch); err != nil {
+			w.mu.Lock()
+			w.failLocked(err)
+			w.mu.Unlock()
+			return
+		}
+	}
+}
+
+// batchWaitLocked returns how long the write pump should wait for more lines before sending
+// The caller must hold w.mu
+func (w *LogWriter) batchWaitLocked() time.Duration {
+	if w.flushInterval <= 0 || w.closing || w.paused || len(w.urgent) > 0 || len(w.queue) == 0 ||
+		w.queuedBytes >= w.batchBytes || len(w.queue) >= w.queueSize {
+		return 0
+	}
+	return time.Until(w.firstQueued.Add(w.flushInterval))
+}
+
+// send writes a round of messages to the transport; it must only be called by the write pump
+func (w *LogWriter) send(urgent [][]byte, dropped int64, batch []outboundMessage) error {
+	for _, p := range urgent {
+		if err := w.transport.writeMessage(0, p); err != nil {
+			return err
+		}
+	}
+
+	if dropped > 0 {
+		data, err := encodeStreamEvent(w.format, services.StreamEvent{
+			Type:    services.StreamEventDropped,
+			Count:   dropped,
+			Message: fmt.Sprintf("%d lines dropped", dropped),
+		}, 0)
+		if err != nil {
+			return err
+		}
+		batch = append([]outboundMessage{{data: data}}, batch...)
+	}
+
+	if w.flushInterval <= 0 {
+		for _, m := range batch {
+			if err := w.transport.writeMessage(m.seq, m.data); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	// Coalesce messages into newline-delimited frames of up to batchBytes
+	frame := make([]byte, 0, w.batchBytes)
+	for _, m := range batch {
+		p := m.data
+		if len(frame) > 0 && len(frame)+len(p)+1 > w.batchBytes {
+			if err := w.transport.writeMessage(0, frame); err != nil {
+				return err
+			}
+			frame = frame[:0]
+		}
+		frame = append(frame, p...)
+		if len(p) == 0 || p[len(p)-1] != '\n' {
+			frame = append(frame, '\n')
+		}
+	}
+	if len(frame) > 0 {
+		return w.transport.writeMessage(0, frame)
+	}
+	return nil
+}
@@ -0,0 +1,132 @@
+package handlers
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"arlog/backend/services"
+
+	"github.com/gorilla/websocket"
+)
+
+// fakeLogSource produces log lines resembling a busy application
+type fakeLogSource struct {
+	next int
+}
+
+func (s *fakeLogSource) line() services.LogLine {
+	s.next++
+	return services.LogLine{
+		Namespace: "default",
+		Pod:       "api-7d4b9c-x2x9k",
+		Container: "api",
+		Timestamp: time.Now(),
+		Content: []byte(fmt.Sprintf(`{"level":"info","ts":"2024-01-02T15:04:05.000Z","msg":"handled request","method":"GET","path":"/api/items/%d","status":200,"duration_ms":%d}`+"\n",
+			s.next, s.next%250)),
+	}
+}
+
+// countingConn counts the bytes read from the wire
+type countingConn struct {
+	net.Conn
+	read *int64
+}
+
+func (c countingConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	atomic.AddInt64(c.read, int64(n))
+	return n, err
+}
+
+// benchmarkWriter streams b.N fake lines through a LogWriter to a real client and reports
+// throughput, frames and wire bytes per line
+func benchmarkWriter(b *testing.B, query string) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		req, err := parseLogStreamRequest(r.URL.Query())
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		conn.EnableWriteCompression(req.Compress)
+
+		ctx, cancel := context.WithCancel(r.Context())
+		defer cancel()
+
+		writer := newLogWriter(ctx, cancel, newWebSocketTransport(conn), req)
+		source := &fakeLogSource{}
+		for i := 0; i < b.N; i++ {
+			if err := writer.WriteLine(source.line()); err != nil {
+				b.Error(err)
+				break
+			}
+		}
+		writer.Close()
+		conn.WriteControl(websocket.CloseMessage,
+			websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""), time.Now().Add(writeWait))
+	}))
+	defer server.Close()
+
+	var wireBytes int64
+	dialer := websocket.Dialer{
+		EnableCompression: true,
+		NetDialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			conn, err := (&net.Dialer{}).DialContext(ctx, network, addr)
+			if err != nil {
+				return nil, err
+			}
+			return countingConn{Conn: conn, read: &wireBytes}, nil
+		},
+	}
+
+	url := "ws" + strings.TrimPrefix(server.URL, "http") + "/?namespace=default&podName=api&overflow=block&" + query
+
+	b.ResetTimer()
+	conn, _, err := dialer.Dial(url, nil)
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer conn.Close()
+
+	frames, lines := 0, 0
+	for {
+		_, data, err := conn.ReadMessage()
+		if err != nil {
+			break
+		}
+		frames++
+		lines += strings.Count(string(data), "\n")
+	}
+	b.StopTimer()
+
+	if lines != b.N {
+		b.Fatalf("received %d lines, want %d", lines, b.N)
+	}
+	b.ReportMetric(float64(b.N)/b.Elapsed().Seconds(), "lines/s")
+	b.ReportMetric(float64(frames)/float64(b.N), "frames/line")
+	b.ReportMetric(float64(wireBytes)/float64(b.N), "wireB/line")
+}
+
+func BenchmarkWebSocketWriterPerLine(b *testing.B) {
+	benchmarkWriter(b, "compress=false")
+}
+
+func BenchmarkWebSocketWriterBatched(b *testing.B) {
+	benchmarkWriter(b, "compress=false&flushInterval=50")
+}
+
+func BenchmarkWebSocketWriterBatchedCompressed(b *testing.B) {
+	benchmarkWriter(b, "compress=true&flushInterval=50")
+}
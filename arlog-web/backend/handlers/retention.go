@@ -0,0 +1,193 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+
+	"arlog/backend/database"
+	"arlog/backend/models"
+	"arlog/backend/services"
+
+	"gorm.io/gorm"
+)
+
+// ArchiveUsageResponse represents the response for the archive usage of all teams
+type ArchiveUsageResponse struct {
+	Success        bool                        `json:"success"`
+	Teams          []services.TeamArchiveUsage `json:"teams,omitempty"`
+	LastCompaction *services.CompactionReport  `json:"lastCompaction,omitempty"`
+	Message        string                      `json:"message,omitempty"`
+}
+
+// GetArchiveUsage returns every team's retention policy and current archive usage, along with the
+// report of the last compaction run and the space it reclaimed
+// Only members of ADMIN_GROUPS may call it
+func GetArchiveUsage(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	if !authorizeArchiveAdmin(w, r, writeArchiveUsageError) {
+		return
+	}
+
+	teams, err := logArchive.Usage()
+	if err != nil {
+		log.Printf("Error measuring archive usage: %v", err)
+		writeArchiveUsageError(w, http.StatusInternalServerError, "Failed to measure archive usage")
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(ArchiveUsageResponse{Success: true, Teams: teams, LastCompaction: logArchive.LastCompaction()})
+}
+
+// writeArchiveUsageError writes a failed ArchiveUsageResponse
+func writeArchiveUsageError(w http.ResponseWriter, status int, message string) {
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(ArchiveUsageResponse{Success: false, Message: message})
+}
+
+// CompactionResponse represents the response for a compaction run
+type CompactionResponse struct {
+	Success bool                       `json:"success"`
+	Report  *services.CompactionReport `json:"report,omitempty"`
+	Message string                     `json:"message,omitempty"`
+}
+
+// CompactArchive enforces the retention policies right away instead of waiting for the next scheduled run
+// Only members of ADMIN_GROUPS may call it
+func CompactArchive(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	if !authorizeArchiveAdmin(w, r, writeCompactionError) {
+		return
+	}
+
+	report, err := logArchive.Compact(r.Context())
+	if err != nil {
+		log.Printf("Error compacting the log archive: %v", err)
+		writeCompactionError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(CompactionResponse{Success: true, Report: report})
+}
+
+// writeCompactionError writes a failed CompactionResponse
+func writeCompactionError(w http.ResponseWriter, status int, message string) {
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(CompactionResponse{Success: false, Message: message})
+}
+
+// TeamRetentionResponse represents the response for changing a team's retention settings
+type TeamRetentionResponse struct {
+	Success bool                      `json:"success"`
+	Policy  *services.RetentionPolicy `json:"policy,omitempty"`
+	Message string                    `json:"message,omitempty"`
+}
+
+// SetTeamRetention changes the retention settings of a team's archived logs
+// Query parameters:
+//   - teamId: The team (required)
+//   - maxAgeDays: Days to keep segments after their last line (0: server default, -1: no limit)
+//   - maxBytes: Cap on the compressed size of the team's segments (0: server default, -1: no cap)
+//   - legalHold: Suspend deleting and downsampling the team's segments
+//
+// Parameters that are not given keep their value; the policy stored for the team is returned
+// Only members of ADMIN_GROUPS may call it
+func SetTeamRetention(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	if _, err := authorizeAdmin(r); err != nil {
+		writeTeamRetentionError(w, accessErrorStatus(err), err.Error())
+		return
+	}
+
+	query := r.URL.Query()
+	teamID, err := strconv.ParseUint(query.Get("teamId"), 10, 64)
+	if err != nil {
+		writeTeamRetentionError(w, http.StatusBadRequest, fmt.Sprintf("invalid teamId parameter: %q", query.Get("teamId")))
+		return
+	}
+
+	updates := make(map[string]interface{})
+	if value := query.Get("maxAgeDays"); value != "" {
+		days, err := strconv.Atoi(value)
+		if err != nil || days < services.RetentionUnlimited {
+			writeTeamRetentionError(w, http.StatusBadRequest, fmt.Sprintf("invalid maxAgeDays parameter: %q", value))
+			return
+		}
+		updates["retention_days"] = days
+	}
+	if value := query.Get("maxBytes"); value != "" {
+		maxBytes, err := strconv.ParseInt(value, 10, 64)
+		if err != nil || maxBytes < services.RetentionUnlimited {
+			writeTeamRetentionError(w, http.StatusBadRequest, fmt.Sprintf("invalid maxBytes parameter: %q", value))
+			return
+		}
+		updates["retention_max_bytes"] = maxBytes
+	}
+	if value := query.Get("legalHold"); value != "" {
+		hold, err := strconv.ParseBool(value)
+		if err != nil {
+			writeTeamRetentionError(w, http.StatusBadRequest, fmt.Sprintf("invalid legalHold parameter: %q", value))
+			return
+		}
+		updates["legal_hold"] = hold
+	}
+
+	var team models.Team
+	if err := database.DB.First(&team, teamID).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			writeTeamRetentionError(w, http.StatusNotFound, "team not found")
+			return
+		}
+		log.Printf("Error fetching team %d: %v", teamID, err)
+		writeTeamRetentionError(w, http.StatusInternalServerError, "Failed to fetch team")
+		return
+	}
+	if len(updates) > 0 {
+		err := database.DB.Model(&team).Updates(updates).Error
+		if err == nil {
+			err = database.DB.First(&team, teamID).Error
+		}
+		if err != nil {
+			log.Printf("Error updating retention of team %d: %v", teamID, err)
+			writeTeamRetentionError(w, http.StatusInternalServerError, "Failed to update retention settings")
+			return
+		}
+	}
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(TeamRetentionResponse{Success: true, Policy: &services.RetentionPolicy{
+		TeamID:     team.ID,
+		TeamName:   team.TeamName,
+		MaxAgeDays: team.RetentionDays,
+		MaxBytes:   team.RetentionMaxBytes,
+		LegalHold:  team.LegalHold,
+	}})
+}
+
+// writeTeamRetentionError writes a failed TeamRetentionResponse
+func writeTeamRetentionError(w http.ResponseWriter, status int, message string) {
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(TeamRetentionResponse{Success: false, Message: message})
+}
+
+// authorizeArchiveAdmin checks that archiving is enabled and the user is an administrator, writing
+// the error response with writeError if not
+func authorizeArchiveAdmin(w http.ResponseWriter, r *http.Request, writeError func(http.ResponseWriter, int, string)) bool {
+	if _, err := authorizeAdmin(r); err != nil {
+		writeError(w, accessErrorStatus(err), err.Error())
+		return false
+	}
+	if logArchive == nil {
+		writeError(w, http.StatusNotFound, "log archiving is not enabled on this server")
+		return false
+	}
+	return true
+}
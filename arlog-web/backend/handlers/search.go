@@ -0,0 +1,169 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"arlog/backend/services"
+)
+
+// searchTimeout bounds the time a search may spend scanning logs; matches found by then are returned
+const searchTimeout = 60 * time.Second
+
+// LogSearchResponse represents the response for a log search
+type LogSearchResponse struct {
+	Success bool                   `json:"success"`
+	Result  *services.SearchResult `json:"result,omitempty"`
+	Message string                 `json:"message,omitempty"`
+}
+
+// SearchLogs searches the logs of a pod, selector or workload over a time window
+// Query parameters:
+//   - namespace: The Kubernetes namespace (required)
+//   - q: The query (required), e.g. `level:error "connection refused" -healthz` (see services.LogQuery)
+//   - podName, selector, workload, container: The containers to search, as for GetLogStats
+//   - cluster: The cluster name (optional, defaults to the connected cluster)
+//   - sinceSeconds, sinceTime, untilTime: The time window, as for GetLogStats (default: the last hour)
+//   - offset: Number of matches to skip (default: 0)
+//   - limit: Matches per page (default: 100, max: 1000); offset+limit may not exceed 10000
+//   - before, after, context: Lines of context around each match (default: 0, max: 20)
+//   - parse, formatHint: Add the parsed fields of each match, as for StreamLogs
+//
+// Matches are returned oldest first. The search gives up after searchTimeout and returns what it found,
+// flagged as partial
+func SearchLogs(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	query := r.URL.Query()
+	namespace := query.Get("namespace")
+	if namespace == "" {
+		writeLogSearchError(w, http.StatusBadRequest, "namespace query parameter is required")
+		return
+	}
+
+	scope, err := parseScanScope(query)
+	if err != nil {
+		writeLogSearchError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	opts, err := parseSearchOptions(query)
+	if err != nil {
+		writeLogSearchError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	cluster, err := resolveCluster(query.Get("cluster"))
+	if err != nil {
+		writeLogSearchError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	access, err := authorizeNamespace(r, cluster, namespace)
+	if err != nil {
+		if status := accessErrorStatus(err); status == http.StatusInternalServerError {
+			log.Printf("Error authorizing log search for namespace %s: %v", namespace, err)
+		}
+		writeLogSearchError(w, accessErrorStatus(err), err.Error())
+		return
+	}
+
+	// A search counts as one stream against the caps; its fetches are bounded by opts.Concurrency
+	lease, err := streamQuota.acquire(access.User.Sub, access.Team, cluster)
+	if err != nil {
+		writeLogSearchError(w, http.StatusTooManyRequests, err.Error())
+		return
+	}
+	defer lease.release()
+
+	k8sService, err := services.NewKubernetesService()
+	if err != nil {
+		log.Printf("Error creating Kubernetes service: %v", err)
+		writeLogSearchError(w, http.StatusInternalServerError, "Failed to connect to Kubernetes cluster")
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), searchTimeout)
+	defer cancel()
+
+	targets, status, err := scope.targets(ctx, k8sService, namespace)
+	if err != nil {
+		writeLogSearchError(w, status, err.Error())
+		return
+	}
+
+	result, err := k8sService.SearchLogs(ctx, namespace, targets, opts)
+	if err != nil {
+		log.Printf("Error searching logs in namespace %s: %v", namespace, err)
+		writeLogSearchError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	// A single pod that could not be read is an error rather than an empty result
+	if scope.podName != "" && len(result.Containers) == 1 && result.Containers[0].Error != "" && len(result.Matches) == 0 {
+		writeLogSearchError(w, http.StatusBadGateway, result.Containers[0].Error)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(LogSearchResponse{Success: true, Result: result})
+}
+
+// parseSearchOptions reads the query, window, paging, context and parsing parameters
+func parseSearchOptions(query url.Values) (services.SearchOptions, error) {
+	opts := services.SearchOptions{
+		Limit:       services.DefaultSearchLimit,
+		Concurrency: services.DefaultScanConcurrency,
+	}
+
+	q := query.Get("q")
+	if q == "" {
+		return opts, fmt.Errorf("q query parameter is required")
+	}
+	compiled, err := services.ParseLogQuery(q)
+	if err != nil {
+		return opts, fmt.Errorf("invalid query: %w", err)
+	}
+	opts.Query = compiled
+
+	if opts.Since, opts.Until, err = parseLogWindow(query); err != nil {
+		return opts, err
+	}
+
+	intParams := map[string][]*int{
+		"offset":  {&opts.Offset},
+		"limit":   {&opts.Limit},
+		"context": {&opts.Before, &opts.After},
+		"before":  {&opts.Before},
+		"after":   {&opts.After},
+	}
+	// context is applied first so before and after can override it
+	for _, name := range []string{"offset", "limit", "context", "before", "after"} {
+		if value := query.Get(name); value != "" {
+			parsed, err := strconv.Atoi(value)
+			if err != nil {
+				return opts, fmt.Errorf("invalid %s parameter: %q", name, value)
+			}
+			for _, target := range intParams[name] {
+				*target = parsed
+			}
+		}
+	}
+
+	if opts.FormatHints, err = parseFormatHints(query); err != nil {
+		return opts, err
+	}
+
+	return opts, opts.Validate()
+}
+
+// writeLogSearchError writes a failed LogSearchResponse
+func writeLogSearchError(w http.ResponseWriter, status int, message string) {
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(LogSearchResponse{Success: false, Message: message})
+}
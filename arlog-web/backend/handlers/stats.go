@@ -0,0 +1,259 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"arlog/backend/services"
+
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+)
+
+// LogStatsResponse represents the response for log level statistics
+type LogStatsResponse struct {
+	Success bool               `json:"success"`
+	Stats   *services.LogStats `json:"stats,omitempty"`
+	Message string             `json:"message,omitempty"`
+}
+
+// GetLogStats counts the log lines of each detected level over a time window
+// Query parameters:
+//   - namespace: The Kubernetes namespace (required)
+//   - podName: The pod whose container is scanned (one of podName, selector or workload is required)
+//   - selector: A label selector; every container of the matching pods is scanned
+//   - workload: A kind/name reference such as deployment/api; every container of its pods is scanned
+//   - container: The container name (optional; with a pod, defaults to the first container, otherwise
+//     only containers with this name are scanned)
+//   - cluster: The cluster name (optional, defaults to the connected cluster)
+//   - sinceSeconds, sinceTime: Start of the window (default: one hour before its end)
+//   - untilTime: End of the window as an RFC3339 timestamp (default: now)
+//   - interval: Width of a histogram bucket as a duration such as 30s or 5m (default: 5m)
+//   - top: Number of recurring error messages to return (default: 10, max: 100)
+//
+// Levels are detected as for the minLevel stream filter; lines without a detectable level count as unknown
+func GetLogStats(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	query := r.URL.Query()
+	namespace := query.Get("namespace")
+	if namespace == "" {
+		writeLogStatsError(w, http.StatusBadRequest, "namespace query parameter is required")
+		return
+	}
+
+	scope, err := parseScanScope(query)
+	if err != nil {
+		writeLogStatsError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	opts, err := parseLogStatsOptions(query)
+	if err != nil {
+		writeLogStatsError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	cluster, err := resolveCluster(query.Get("cluster"))
+	if err != nil {
+		writeLogStatsError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	access, err := authorizeNamespace(r, cluster, namespace)
+	if err != nil {
+		if status := accessErrorStatus(err); status == http.StatusInternalServerError {
+			log.Printf("Error authorizing log stats for namespace %s: %v", namespace, err)
+		}
+		writeLogStatsError(w, accessErrorStatus(err), err.Error())
+		return
+	}
+
+	// A scan counts as one stream against the caps; its fetches are bounded by opts.Concurrency
+	lease, err := streamQuota.acquire(access.User.Sub, access.Team, cluster)
+	if err != nil {
+		writeLogStatsError(w, http.StatusTooManyRequests, err.Error())
+		return
+	}
+	defer lease.release()
+
+	k8sService, err := services.NewKubernetesService()
+	if err != nil {
+		log.Printf("Error creating Kubernetes service: %v", err)
+		writeLogStatsError(w, http.StatusInternalServerError, "Failed to connect to Kubernetes cluster")
+		return
+	}
+
+	targets, status, err := scope.targets(r.Context(), k8sService, namespace)
+	if err != nil {
+		writeLogStatsError(w, status, err.Error())
+		return
+	}
+
+	stats, err := k8sService.ScanLogStats(r.Context(), namespace, targets, opts)
+	if err != nil {
+		log.Printf("Error scanning log stats for namespace %s: %v", namespace, err)
+		writeLogStatsError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	// A single pod that could not be read is an error rather than an empty histogram
+	if scope.podName != "" && len(stats.Containers) == 1 && stats.Containers[0].Error != "" && stats.Total == 0 {
+		writeLogStatsError(w, http.StatusBadGateway, stats.Containers[0].Error)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(LogStatsResponse{Success: true, Stats: stats})
+}
+
+// scanScope is the set of containers a scan reads: a pod, or the pods of a selector or workload
+type scanScope struct {
+	podName   string
+	selector  string
+	workload  *services.WorkloadRef
+	container string
+}
+
+// parseScanScope reads the podName, selector, workload and container parameters
+// Exactly one of podName, selector and workload must be given
+func parseScanScope(query url.Values) (scanScope, error) {
+	scope := scanScope{
+		podName:   query.Get("podName"),
+		selector:  query.Get("selector"),
+		container: query.Get("container"),
+	}
+	if value := query.Get("workload"); value != "" {
+		workload, err := services.ParseWorkloadRef(value)
+		if err != nil {
+			return scope, fmt.Errorf("invalid workload parameter: %v", err)
+		}
+		scope.workload = &workload
+	}
+
+	given := 0
+	for _, set := range []bool{scope.podName != "", scope.selector != "", scope.workload != nil} {
+		if set {
+			given++
+		}
+	}
+	if given != 1 {
+		return scope, fmt.Errorf("exactly one of the podName, selector and workload query parameters is required")
+	}
+	return scope, nil
+}
+
+// targets lists the container logs of the scope, along with the HTTP status to report if that fails
+// A pod without a container scans its first container; selectors and workloads scan every container
+// of their pods, or only those named container
+func (s scanScope) targets(ctx context.Context, k8sService *services.KubernetesService, namespace string) ([]services.ScanTarget, int, error) {
+	if s.podName != "" {
+		return []services.ScanTarget{{Pod: s.podName, Container: s.container}}, http.StatusOK, nil
+	}
+
+	pods, err := k8sService.ListExportPods(ctx, namespace, services.ExportOptions{Selector: s.selector, Workload: s.workload})
+	if err != nil {
+		status := http.StatusBadRequest
+		if apierrors.IsNotFound(err) {
+			status = http.StatusNotFound
+		}
+		return nil, status, err
+	}
+	return services.ScanTargets(pods, s.container), http.StatusOK, nil
+}
+
+// parseLogStatsOptions reads the window, interval and top parameters
+func parseLogStatsOptions(query url.Values) (services.LogStatsOptions, error) {
+	opts := services.LogStatsOptions{
+		Interval:    services.DefaultStatsInterval,
+		TopErrors:   services.DefaultStatsTopErrors,
+		Concurrency: services.DefaultScanConcurrency,
+	}
+
+	var err error
+	if opts.Since, opts.Until, err = parseLogWindow(query); err != nil {
+		return opts, err
+	}
+
+	if value := query.Get("interval"); value != "" {
+		interval, err := time.ParseDuration(value)
+		if err != nil || interval < time.Second {
+			return opts, fmt.Errorf("invalid interval parameter: %q (expected a duration of at least 1s, such as 5m)", value)
+		}
+		opts.Interval = interval
+	}
+	if buckets := (opts.Until.Sub(opts.Since) + opts.Interval - 1) / opts.Interval; buckets > services.MaxStatsBuckets {
+		return opts, fmt.Errorf("interval %s splits the window into %d buckets; at most %d are allowed", opts.Interval, buckets, services.MaxStatsBuckets)
+	}
+
+	if value := query.Get("top"); value != "" {
+		top, err := strconv.Atoi(value)
+		if err != nil || top < 1 || top > services.MaxStatsTopErrors {
+			return opts, fmt.Errorf("invalid top parameter: %q (expected 1 to %d)", value, services.MaxStatsTopErrors)
+		}
+		opts.TopErrors = top
+	}
+
+	return opts, nil
+}
+
+// parseLogWindow reads the time window of a scan: sinceSeconds or sinceTime for its start (default:
+// services.DefaultStatsWindow before its end) and untilTime for its end (default: now)
+func parseLogWindow(query url.Values) (since, until time.Time, err error) {
+	until = time.Now().UTC()
+	if value := query.Get("untilTime"); value != "" {
+		parsed, err := time.Parse(time.RFC3339, value)
+		if err != nil {
+			return since, until, fmt.Errorf("invalid untilTime parameter: %q (expected RFC3339)", value)
+		}
+		if parsed.Before(until) {
+			until = parsed
+		}
+	}
+
+	// The since options are validated like those of a stream
+	window := services.LogOptions{}
+	if value := query.Get("sinceSeconds"); value != "" {
+		seconds, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			return since, until, fmt.Errorf("invalid sinceSeconds parameter: %q", value)
+		}
+		window.SinceSeconds = &seconds
+	}
+	if value := query.Get("sinceTime"); value != "" {
+		parsed, err := time.Parse(time.RFC3339, value)
+		if err != nil {
+			return since, until, fmt.Errorf("invalid sinceTime parameter: %q (expected RFC3339)", value)
+		}
+		window.SinceTime = &parsed
+	}
+	if err := window.Validate(); err != nil {
+		return since, until, err
+	}
+
+	switch {
+	case window.SinceSeconds != nil:
+		since = time.Now().UTC().Add(-time.Duration(*window.SinceSeconds) * time.Second)
+	case window.SinceTime != nil:
+		since = *window.SinceTime
+	default:
+		since = until.Add(-services.DefaultStatsWindow)
+	}
+	if !until.After(since) {
+		return since, until, fmt.Errorf("untilTime must be after the start of the window")
+	}
+	if time.Since(since) > time.Duration(services.MaxSinceSeconds)*time.Second {
+		return since, until, fmt.Errorf("the window must not start more than %d seconds ago", services.MaxSinceSeconds)
+	}
+	return since, until, nil
+}
+
+// writeLogStatsError writes a failed LogStatsResponse
+func writeLogStatsError(w http.ResponseWriter, status int, message string) {
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(LogStatsResponse{Success: false, Message: message})
+}
@@ -0,0 +1,256 @@
+package handlers
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"arlog/backend/database"
+	"arlog/backend/middleware"
+	"arlog/backend/models"
+)
+
+// Default caps on concurrent log streams; 0 disables a cap
+const (
+	defaultUserStreamLimit    = 10
+	defaultTeamStreamLimit    = 50
+	defaultClusterStreamLimit = 200
+	defaultGlobalStreamLimit  = 500
+)
+
+// Scopes a stream limit applies to
+const (
+	limitScopeUser    = "user"
+	limitScopeTeam    = "team"
+	limitScopeCluster = "cluster"
+	limitScopeGlobal  = "global"
+)
+
+// streamLimits holds the caps on concurrent log streams
+type streamLimits struct {
+	User    int `json:"user"`
+	Team    int `json:"team"`
+	Cluster int `json:"cluster"`
+	Global  int `json:"global"`
+}
+
+// loadStreamLimits reads the caps from the environment, falling back to the defaults
+func loadStreamLimits() streamLimits {
+	return streamLimits{
+		User:    envLimit("STREAM_LIMIT_PER_USER", defaultUserStreamLimit),
+		Team:    envLimit("STREAM_LIMIT_PER_TEAM", defaultTeamStreamLimit),
+		Cluster: envLimit("STREAM_LIMIT_PER_CLUSTER", defaultClusterStreamLimit),
+		Global:  envLimit("STREAM_LIMIT_GLOBAL", defaultGlobalStreamLimit),
+	}
+}
+
+// envLimit reads a non-negative limit from the environment variable name
+func envLimit(name string, fallback int) int {
+	value := os.Getenv(name)
+	if value == "" {
+		return fallback
+	}
+	limit, err := strconv.Atoi(value)
+	if err != nil || limit < 0 {
+		log.Printf("Invalid %s value %q, using %d", name, value, fallback)
+		return fallback
+	}
+	return limit
+}
+
+// streamLimitError is returned when opening a stream would exceed a cap
+type streamLimitError struct {
+	Scope string
+	Name  string
+	Limit int
+}
+
+func (e *streamLimitError) Error() string {
+	if e.Scope == limitScopeGlobal {
+		return fmt.Sprintf("too many concurrent log streams on the server (limit %d)", e.Limit)
+	}
+	return fmt.Sprintf("too many concurrent log streams for %s %s (limit %d)", e.Scope, e.Name, e.Limit)
+}
+
+// streamUsage counts the open log streams per user, team and cluster
+type streamUsage struct {
+	mu       sync.Mutex
+	limits   streamLimits
+	users    map[string]int
+	teams    map[string]int
+	clusters map[string]int
+	global   int
+}
+
+// streamQuota tracks all log streams of the server
+var streamQuota = newStreamUsage(loadStreamLimits())
+
+func newStreamUsage(limits streamLimits) *streamUsage {
+	return &streamUsage{
+		limits:   limits,
+		users:    make(map[string]int),
+		teams:    make(map[string]int),
+		clusters: make(map[string]int),
+	}
+}
+
+// streamLease is one counted stream; releasing it frees the slot
+type streamLease struct {
+	usage   *streamUsage
+	user    string
+	team    string
+	cluster string
+	once    sync.Once
+}
+
+// acquire counts a new stream for user, team and cluster, or fails if any cap is reached
+func (u *streamUsage) acquire(user, team, cluster string) (*streamLease, error) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	checks := []struct {
+		scope, name  string
+		count, limit int
+	}{
+		{limitScopeUser, user, u.users[user], u.limits.User},
+		{limitScopeTeam, team, u.teams[team], u.limits.Team},
+		{limitScopeCluster, cluster, u.clusters[cluster], u.limits.Cluster},
+		{limitScopeGlobal, "", u.global, u.limits.Global},
+	}
+	for _, check := range checks {
+		if check.limit > 0 && check.count >= check.limit {
+			return nil, &streamLimitError{Scope: check.scope, Name: check.name, Limit: check.limit}
+		}
+	}
+
+	u.users[user]++
+	u.teams[team]++
+	u.clusters[cluster]++
+	u.global++
+	return &streamLease{usage: u, user: user, team: team, cluster: cluster}, nil
+}
+
+// release frees the lease's slot; it is safe to call more than once
+func (l *streamLease) release() {
+	l.once.Do(func() {
+		u := l.usage
+		u.mu.Lock()
+		defer u.mu.Unlock()
+
+		decrement(u.users, l.user)
+		decrement(u.teams, l.team)
+		decrement(u.clusters, l.cluster)
+		u.global--
+	})
+}
+
+// decrement lowers a counter, removing it when it reaches zero
+func decrement(counts map[string]int, key string) {
+	if counts[key] <= 1 {
+		delete(counts, key)
+		return
+	}
+	counts[key]--
+}
+
+// StreamUsage is the number of open streams in a scope and its cap (0 means unlimited)
+type StreamUsage struct {
+	Name   string `json:"name,omitempty"`
+	Active int    `json:"active"`
+	Limit  int    `json:"limit"`
+}
+
+// StreamUsageResponse represents the response for stream usage
+type StreamUsageResponse struct {
+	Success bool          `json:"success"`
+	User    *StreamUsage  `json:"user,omitempty"`
+	Teams   []StreamUsage `json:"teams,omitempty"`
+	Cluster *StreamUsage  `json:"cluster,omitempty"`
+	Global  *StreamUsage  `json:"global,omitempty"`
+	Message string        `json:"message,omitempty"`
+}
+
+// snapshot returns the usage of user, each of teams and cluster, and the global usage
+func (u *streamUsage) snapshot(user string, teams []string, cluster string) StreamUsageResponse {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	response := StreamUsageResponse{
+		Success: true,
+		User:    &StreamUsage{Name: user, Active: u.users[user], Limit: u.limits.User},
+		Teams:   make([]StreamUsage, 0, len(teams)),
+		Cluster: &StreamUsage{Name: cluster, Active: u.clusters[cluster], Limit: u.limits.Cluster},
+		Global:  &StreamUsage{Active: u.global, Limit: u.limits.Global},
+	}
+	for _, team := range teams {
+		response.Teams = append(response.Teams, StreamUsage{Name: team, Active: u.teams[team], Limit: u.limits.Team})
+	}
+	return response
+}
+
+// GetStreamUsage returns the authenticated user's open log streams and those of their teams,
+// the connected cluster and the server, along with the configured caps
+func GetStreamUsage(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	user, ok := middleware.GetUserFromContext(r.Context())
+	if !ok {
+		w.WriteHeader(http.StatusUnauthorized)
+		json.NewEncoder(w).Encode(StreamUsageResponse{Success: false, Message: errNotAuthenticated.Error()})
+		return
+	}
+
+	var teams []string
+	if len(user.Groups) > 0 {
+		result := database.DB.Model(&models.Team{}).
+			Where("okta_group_id IN ?", user.Groups).
+			Order("team_name").
+			Pluck("team_name", &teams)
+		if result.Error != nil {
+			log.Printf("Error fetching teams: %v", result.Error)
+			w.WriteHeader(http.StatusInternalServerError)
+			json.NewEncoder(w).Encode(StreamUsageResponse{Success: false, Message: "Failed to fetch user teams"})
+			return
+		}
+	}
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(streamQuota.snapshot(user.Sub, teams, clusterName()))
+}
+
+// StreamTicketResponse represents the response for a stream ticket
+type StreamTicketResponse struct {
+	Success   bool       `json:"success"`
+	Ticket    string     `json:"ticket,omitempty"`
+	ExpiresAt *time.Time `json:"expiresAt,omitempty"`
+	Message   string     `json:"message,omitempty"`
+}
+
+// IssueStreamTicket returns a short-lived, single-use ticket that authenticates the user on one
+// WebSocket or Server-Sent Events log stream
+func IssueStreamTicket(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	user, ok := middleware.GetUserFromContext(r.Context())
+	if !ok {
+		w.WriteHeader(http.StatusUnauthorized)
+		json.NewEncoder(w).Encode(StreamTicketResponse{Success: false, Message: errNotAuthenticated.Error()})
+		return
+	}
+
+	ticket, expiresAt, err := middleware.IssueStreamTicket(user)
+	if err != nil {
+		log.Printf("Error issuing stream ticket: %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(StreamTicketResponse{Success: false, Message: "Failed to issue stream ticket"})
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(StreamTicketResponse{Success: true, Ticket: ticket, ExpiresAt: &expiresAt})
+}
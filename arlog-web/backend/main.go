@@ -1,12 +1,14 @@
 package main
 
 import (
+	"context"
 	"log"
 	"net/http"
 	"os"
 
 	"arlog/backend/database"
 	"arlog/backend/handlers"
+	"arlog/backend/middleware"
 
 	"github.com/gorilla/mux"
 	"github.com/joho/godotenv"
@@ -57,6 +59,16 @@ func main() {
 		}
 	}
 
+	// Start archiving the logs of opted-in namespaces (only when ARCHIVE_DIR is set)
+	if err := handlers.StartLogArchive(context.Background()); err != nil {
+		log.Fatalf("❌ Failed to start log archive: %v", err)
+	}
+
+	// Start evaluating the alert rules of the connected cluster
+	if err := handlers.StartAlertWatcher(context.Background()); err != nil {
+		log.Fatalf("❌ Failed to start alert watcher: %v", err)
+	}
+
 	// Initialize router
 	router := setupRouter()
 
@@ -86,9 +98,27 @@ func setupRouter() *mux.Router {
 	apiRouter := router.PathPrefix("/api").Subrouter()
 	apiRouter.HandleFunc("/user/permissions", handlers.GetUserPermissions).Methods("GET")
 	apiRouter.HandleFunc("/pods", handlers.GetPods).Methods("GET")
+	apiRouter.Handle("/logs/stream", middleware.AuthMiddleware(http.HandlerFunc(handlers.StreamLogsSSE))).Methods("GET")
+	apiRouter.Handle("/logs/download", middleware.AuthMiddleware(http.HandlerFunc(handlers.DownloadLogs))).Methods("GET")
+	apiRouter.Handle("/logs/export", middleware.AuthMiddleware(http.HandlerFunc(handlers.ExportLogs))).Methods("GET")
+	apiRouter.Handle("/logs/stats", middleware.AuthMiddleware(http.HandlerFunc(handlers.GetLogStats))).Methods("GET")
+	apiRouter.Handle("/logs/search", middleware.AuthMiddleware(http.HandlerFunc(handlers.SearchLogs))).Methods("GET")
+	apiRouter.Handle("/archive/pods", middleware.AuthMiddleware(http.HandlerFunc(handlers.GetArchivedPods))).Methods("GET")
+	apiRouter.Handle("/archive/search", middleware.AuthMiddleware(http.HandlerFunc(handlers.SearchArchive))).Methods("GET")
+	apiRouter.Handle("/archive/namespaces", middleware.AuthMiddleware(http.HandlerFunc(handlers.SetNamespaceArchiving))).Methods("PUT")
+	apiRouter.Handle("/admin/archive/usage", middleware.AuthMiddleware(http.HandlerFunc(handlers.GetArchiveUsage))).Methods("GET")
+	apiRouter.Handle("/admin/archive/compact", middleware.AuthMiddleware(http.HandlerFunc(handlers.CompactArchive))).Methods("POST")
+	apiRouter.Handle("/admin/teams/retention", middleware.AuthMiddleware(http.HandlerFunc(handlers.SetTeamRetention))).Methods("PUT")
+	apiRouter.Handle("/alerts", middleware.AuthMiddleware(http.HandlerFunc(handlers.ListAlertRules))).Methods("GET")
+	apiRouter.Handle("/alerts", middleware.AuthMiddleware(http.HandlerFunc(handlers.CreateAlertRule))).Methods("POST")
+	apiRouter.Handle("/alerts", middleware.AuthMiddleware(http.HandlerFunc(handlers.UpdateAlertRule))).Methods("PUT")
+	apiRouter.Handle("/alerts", middleware.AuthMiddleware(http.HandlerFunc(handlers.DeleteAlertRule))).Methods("DELETE")
+	apiRouter.Handle("/alerts/test", middleware.AuthMiddleware(http.HandlerFunc(handlers.TestAlertRule))).Methods("POST")
+	apiRouter.Handle("/streams/usage", middleware.AuthMiddleware(http.HandlerFunc(handlers.GetStreamUsage))).Methods("GET")
+	apiRouter.Handle("/streams/ticket", middleware.AuthMiddleware(http.HandlerFunc(handlers.IssueStreamTicket))).Methods("POST")
 
 	// WebSocket routes
-	router.HandleFunc("/ws/logs", handlers.StreamLogs)
+	router.Handle("/ws/logs", middleware.AuthMiddleware(http.HandlerFunc(handlers.StreamLogs)))
 
 	// Health check endpoint
 	router.HandleFunc("/health", handlers.HealthCheck).Methods("GET")
@@ -6,6 +6,7 @@ import (
 	"net/http"
 	"os"
 	"strings"
+	"time"
 
 	"github.com/golang-jwt/jwt/v5"
 )
@@ -45,6 +46,20 @@ func AuthMiddleware(next http.Handler) http.Handler {
 
 		// Get Authorization header
 		authHeader := r.Header.Get("Authorization")
+		if authHeader == "" && isStreamingRequest(r) {
+			// Browsers cannot set headers on WebSocket handshakes or EventSource requests,
+			// so these take a single-use stream ticket in the query instead
+			if ticket := r.URL.Query().Get("ticket"); ticket != "" {
+				userInfo, ok := streamTickets.redeem(ticket, time.Now())
+				if !ok {
+					respondWithError(w, http.StatusUnauthorized, "Invalid or expired stream ticket")
+					return
+				}
+				ctx := context.WithValue(r.Context(), UserContextKey, userInfo)
+				next.ServeHTTP(w, r.WithContext(ctx))
+				return
+			}
+		}
 		if authHeader == "" {
 			respondWithError(w, http.StatusUnauthorized, "Authorization header required")
 			return
@@ -127,6 +142,12 @@ func OptionalAuthMiddleware(next http.Handler) http.Handler {
 	})
 }
 
+// isStreamingRequest reports whether the request is a WebSocket handshake or asks for an event stream
+func isStreamingRequest(r *http.Request) bool {
+	return strings.EqualFold(r.Header.Get("Upgrade"), "websocket") ||
+		strings.Contains(r.Header.Get("Accept"), "text/event-stream")
+}
+
 // GetUserFromContext retrieves user information from the request context
 func GetUserFromContext(ctx context.Context) (*UserInfo, bool) {
 	user, ok := ctx.Value(UserContextKey).(*UserInfo)
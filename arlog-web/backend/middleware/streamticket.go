@@ -0,0 +1,71 @@
+package middleware
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// streamTicketTTL is how long a stream ticket may be redeemed after it was issued
+const streamTicketTTL = 30 * time.Second
+
+// streamTickets holds the stream tickets issued and not redeemed yet
+var streamTickets = &ticketStore{tickets: make(map[string]streamTicket)}
+
+// streamTicket authenticates its user on one streaming request until it expires
+type streamTicket struct {
+	user    *UserInfo
+	expires time.Time
+}
+
+// ticketStore is a concurrency-safe set of stream tickets
+type ticketStore struct {
+	mu      sync.Mutex
+	tickets map[string]streamTicket
+}
+
+// IssueStreamTicket returns a ticket that authenticates user on a single streaming request within
+// streamTicketTTL, and when it expires
+// Browsers cannot set headers on WebSocket handshakes or EventSource requests, so streams take such a
+// ticket in their query rather than the long-lived JWT, which would then end up in URLs and logs
+func IssueStreamTicket(user *UserInfo) (string, time.Time, error) {
+	return streamTickets.issue(user, time.Now())
+}
+
+func (s *ticketStore) issue(user *UserInfo, now time.Time) (string, time.Time, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", time.Time{}, fmt.Errorf("failed to generate stream ticket: %w", err)
+	}
+	ticket := hex.EncodeToString(b)
+	expires := now.Add(streamTicketTTL)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	// Tickets that were never redeemed are forgotten as new ones are issued
+	for key, issued := range s.tickets {
+		if !now.Before(issued.expires) {
+			delete(s.tickets, key)
+		}
+	}
+	s.tickets[ticket] = streamTicket{user: user, expires: expires}
+	return ticket, expires, nil
+}
+
+// redeem returns the user of a ticket that has not expired, and forgets the ticket
+func (s *ticketStore) redeem(ticket string, now time.Time) (*UserInfo, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	issued, exists := s.tickets[ticket]
+	if !exists {
+		return nil, false
+	}
+	delete(s.tickets, ticket)
+	if !now.Before(issued.expires) {
+		return nil, false
+	}
+	return issued.user, true
+}
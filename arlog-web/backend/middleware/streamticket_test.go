@@ -0,0 +1,110 @@
+package middleware
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestTicketStoreRedeem(t *testing.T) {
+	issuedAt := time.Date(2024, 1, 2, 15, 4, 5, 0, time.UTC)
+	user := &UserInfo{Sub: "user-1"}
+
+	tests := []struct {
+		name string
+		// redeemAt are the times the ticket is redeemed at; only the last redemption is checked
+		redeemAt []time.Time
+		ticket   func(issued string) string
+		want     bool
+	}{
+		{name: "valid", redeemAt: []time.Time{issuedAt.Add(time.Second)}, want: true},
+		{name: "spent", redeemAt: []time.Time{issuedAt.Add(time.Second), issuedAt.Add(2 * time.Second)}},
+		{name: "expired", redeemAt: []time.Time{issuedAt.Add(streamTicketTTL)}},
+		{name: "unknown", redeemAt: []time.Time{issuedAt}, ticket: func(issued string) string { return issued + "0" }},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			store := &ticketStore{tickets: make(map[string]streamTicket)}
+			ticket, expires, err := store.issue(user, issuedAt)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !expires.Equal(issuedAt.Add(streamTicketTTL)) {
+				t.Errorf("ticket expires at %s, want %s", expires, issuedAt.Add(streamTicketTTL))
+			}
+			if tt.ticket != nil {
+				ticket = tt.ticket(ticket)
+			}
+
+			var got *UserInfo
+			var ok bool
+			for _, at := range tt.redeemAt {
+				got, ok = store.redeem(ticket, at)
+			}
+			if ok != tt.want || (ok && got != user) {
+				t.Errorf("redeem = %v, %v; want %v", got, ok, tt.want)
+			}
+		})
+	}
+}
+
+func TestTicketStoreSweepsExpired(t *testing.T) {
+	issuedAt := time.Date(2024, 1, 2, 15, 4, 5, 0, time.UTC)
+	store := &ticketStore{tickets: make(map[string]streamTicket)}
+	if _, _, err := store.issue(&UserInfo{}, issuedAt); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := store.issue(&UserInfo{}, issuedAt.Add(streamTicketTTL)); err != nil {
+		t.Fatal(err)
+	}
+	if len(store.tickets) != 1 {
+		t.Errorf("store holds %d tickets, want only the one not expired", len(store.tickets))
+	}
+}
+
+// TestAuthMiddlewareStreamTicket checks that the query authenticates only streaming requests, and only
+// with a stream ticket
+func TestAuthMiddlewareStreamTicket(t *testing.T) {
+	t.Setenv("AUTH_MODE", "okta")
+	user := &UserInfo{Sub: "user-1"}
+
+	tests := []struct {
+		name   string
+		query  func(ticket string) string
+		accept string
+		want   int
+	}{
+		{name: "event stream", query: func(ticket string) string { return "ticket=" + ticket }, accept: "text/event-stream", want: http.StatusOK},
+		{name: "not streaming", query: func(ticket string) string { return "ticket=" + ticket }, want: http.StatusUnauthorized},
+		{name: "invalid ticket", query: func(string) string { return "ticket=invalid" }, accept: "text/event-stream", want: http.StatusUnauthorized},
+		{name: "access token", query: func(string) string { return "access_token=token" }, accept: "text/event-stream", want: http.StatusUnauthorized},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ticket, _, err := IssueStreamTicket(user)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var got *UserInfo
+			handler := AuthMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				got, _ = GetUserFromContext(r.Context())
+			}))
+
+			req := httptest.NewRequest(http.MethodGet, "/api/logs/stream?"+tt.query(ticket), nil)
+			if tt.accept != "" {
+				req.Header.Set("Accept", tt.accept)
+			}
+			rec := httptest.NewRecorder()
+			handler.ServeHTTP(rec, req)
+			if rec.Code != tt.want {
+				t.Errorf("status = %d, want %d", rec.Code, tt.want)
+			}
+			if tt.want == http.StatusOK && got != user {
+				t.Errorf("request authenticated as %v, want the ticket's user", got)
+			}
+		})
+	}
+}
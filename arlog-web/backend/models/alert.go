@@ -0,0 +1,38 @@
+package models
+
+import (
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// AlertRule represents a team's alert on the logs of a namespace
+// The rule fires when Query matches at least Threshold lines within WindowSeconds, and then stays silent
+// for CooldownSeconds. Firings are posted to WebhookURL as JSON signed with WebhookSecret
+type AlertRule struct {
+	ID              uint           `gorm:"primaryKey" json:"id"`
+	TeamID          uint           `gorm:"not null;index" json:"teamId"`
+	Team            *Team          `gorm:"foreignKey:TeamID" json:"team,omitempty"`
+	Name            string         `gorm:"type:varchar(255);not null" json:"name"`
+	ClusterName     string         `gorm:"type:varchar(255);not null;index" json:"clusterName"`
+	Namespace       string         `gorm:"type:varchar(255);not null" json:"namespace"`
+	Selector        string         `gorm:"type:text;not null;default:''" json:"selector"`
+	Container       string         `gorm:"type:varchar(255);not null;default:''" json:"container"`
+	Query           string         `gorm:"type:text;not null" json:"query"`
+	Threshold       int            `gorm:"not null" json:"threshold"`
+	WindowSeconds   int            `gorm:"not null" json:"windowSeconds"`
+	CooldownSeconds int            `gorm:"not null" json:"cooldownSeconds"`
+	WebhookURL      string         `gorm:"type:text;not null" json:"webhookUrl"`
+	WebhookSecret   string         `gorm:"type:varchar(255);not null" json:"-"` // Hidden from JSON for security
+	Enabled         bool           `gorm:"not null" json:"enabled"`
+	LastFiredAt     *time.Time     `json:"lastFiredAt,omitempty"`
+	LastError       string         `gorm:"type:text;not null;default:''" json:"lastError,omitempty"` // Last webhook delivery error
+	CreatedAt       time.Time      `json:"createdAt"`
+	UpdatedAt       time.Time      `json:"updatedAt"`
+	DeletedAt       gorm.DeletedAt `gorm:"index" json:"-"`
+}
+
+// TableName specifies the table name for the AlertRule model
+func (AlertRule) TableName() string {
+	return "alert_rules"
+}
@@ -0,0 +1,31 @@
+package models
+
+import (
+	"time"
+)
+
+// ArchiveSegment represents one compressed file of archived log lines of a container
+// Segments cover a time partition of a container's log and are looked up by cluster, namespace,
+// pod, container and time. A downsampled segment only kept the lines of warning level and above
+type ArchiveSegment struct {
+	ID            uint      `gorm:"primaryKey" json:"id"`
+	TeamID        uint      `gorm:"not null;index:idx_archive_segments_team_end,priority:1" json:"teamId"`
+	ClusterName   string    `gorm:"type:varchar(255);not null;index:idx_archive_segments_lookup,priority:1" json:"clusterName"`
+	Namespace     string    `gorm:"type:varchar(255);not null;index:idx_archive_segments_lookup,priority:2" json:"namespace"`
+	PodName       string    `gorm:"type:varchar(255);not null;index:idx_archive_segments_lookup,priority:3" json:"podName"`
+	ContainerName string    `gorm:"type:varchar(255);not null;index:idx_archive_segments_lookup,priority:4" json:"containerName"`
+	StartTime     time.Time `gorm:"not null;index:idx_archive_segments_lookup,priority:5" json:"startTime"`
+	EndTime       time.Time `gorm:"not null;index:idx_archive_segments_team_end,priority:2" json:"endTime"`
+	Path          string    `gorm:"type:text;not null" json:"-"` // Local file path, not exposed
+	Lines         int64     `gorm:"not null" json:"lines"`
+	Bytes         int64     `gorm:"not null" json:"bytes"`    // Compressed size on disk
+	RawBytes      int64     `gorm:"not null" json:"rawBytes"` // Uncompressed size of the lines
+	Downsampled   bool      `gorm:"not null;default:false" json:"downsampled"`
+	GramFilter    []byte    `json:"-"` // Bloom filter of the trigrams of the lines, empty for older segments
+	CreatedAt     time.Time `json:"createdAt"`
+}
+
+// TableName specifies the table name for the ArchiveSegment model
+func (ArchiveSegment) TableName() string {
+	return "archive_segments"
+}
@@ -8,6 +8,7 @@ import (
 
 // Permission represents the access control mapping between a team and a Kubernetes namespace
 // Each permission grants a team access to a specific namespace in a specific cluster
+// ArchiveLogs opts the namespace into the log archive, which keeps its logs after pods are gone
 type Permission struct {
 	ID                  uint           `gorm:"primaryKey" json:"id"`
 	TeamID              uint           `gorm:"not null;index" json:"teamId"`
@@ -15,6 +16,7 @@ type Permission struct {
 	ClusterName         string         `gorm:"type:varchar(255);not null" json:"clusterName"`
 	Namespace           string         `gorm:"type:varchar(255);not null" json:"namespace"`
 	ServiceAccountToken string         `gorm:"type:text;not null" json:"-"` // Hidden from JSON for security
+	ArchiveLogs         bool           `gorm:"not null;default:false" json:"archiveLogs"`
 	CreatedAt           time.Time      `json:"createdAt"`
 	UpdatedAt           time.Time      `json:"updatedAt"`
 	DeletedAt           gorm.DeletedAt `gorm:"index" json:"-"`
@@ -31,6 +33,7 @@ type PermissionDTO struct {
 	TeamID      uint   `json:"teamId"`
 	ClusterName string `json:"clusterName"`
 	Namespace   string `json:"namespace"`
+	ArchiveLogs bool   `json:"archiveLogs"`
 }
 
 // ToDTO converts a Permission to a PermissionDTO (without sensitive fields)
@@ -40,6 +43,7 @@ func (p *Permission) ToDTO() PermissionDTO {
 		TeamID:      p.TeamID,
 		ClusterName: p.ClusterName,
 		Namespace:   p.Namespace,
+		ArchiveLogs: p.ArchiveLogs,
 	}
 }
 
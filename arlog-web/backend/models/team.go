@@ -8,14 +8,19 @@ import (
 
 // Team represents a team/group that has access to specific Kubernetes namespaces
 // Each team is mapped to an Okta group for authentication
+// The retention fields govern the team's archived logs: 0 uses the server default, -1 lifts the limit,
+// and LegalHold suspends deleting and downsampling them
 type Team struct {
-	ID           uint           `gorm:"primaryKey" json:"id"`
-	TeamName     string         `gorm:"type:varchar(255);not null;unique" json:"teamName"`
-	OktaGroupID  string         `gorm:"type:varchar(255);not null;unique" json:"oktaGroupId"`
-	Permissions  []Permission   `gorm:"foreignKey:TeamID;constraint:OnDelete:CASCADE" json:"permissions,omitempty"`
-	CreatedAt    time.Time      `json:"createdAt"`
-	UpdatedAt    time.Time      `json:"updatedAt"`
-	DeletedAt    gorm.DeletedAt `gorm:"index" json:"-"`
+	ID                uint           `gorm:"primaryKey" json:"id"`
+	TeamName          string         `gorm:"type:varchar(255);not null;unique" json:"teamName"`
+	OktaGroupID       string         `gorm:"type:varchar(255);not null;unique" json:"oktaGroupId"`
+	Permissions       []Permission   `gorm:"foreignKey:TeamID;constraint:OnDelete:CASCADE" json:"permissions,omitempty"`
+	RetentionDays     int            `gorm:"not null;default:0" json:"retentionDays"`
+	RetentionMaxBytes int64          `gorm:"not null;default:0" json:"retentionMaxBytes"`
+	LegalHold         bool           `gorm:"not null;default:false" json:"legalHold"`
+	CreatedAt         time.Time      `json:"createdAt"`
+	UpdatedAt         time.Time      `json:"updatedAt"`
+	DeletedAt         gorm.DeletedAt `gorm:"index" json:"-"`
 }
 
 // TableName specifies the table name for the Team model
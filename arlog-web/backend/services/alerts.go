@@ -0,0 +1,689 @@
+package services
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+)
+
+// Alert defaults and limits
+const (
+	// DefaultAlertRefreshInterval is how often the watcher reloads the rules
+	DefaultAlertRefreshInterval = time.Minute
+	// DefaultAlertMaxStreams caps the container streams the watcher opens for one rule
+	DefaultAlertMaxStreams = 100
+	// DefaultWebhookTimeout bounds each webhook delivery attempt
+	DefaultWebhookTimeout = 10 * time.Second
+	// DefaultAlertWindow and DefaultAlertCooldown are used for rules created without them
+	DefaultAlertWindow   = 5 * time.Minute
+	DefaultAlertCooldown = 15 * time.Minute
+
+	// MinAlertWindow and MaxAlertWindow bound the window a rule counts matches over
+	MinAlertWindow = 10 * time.Second
+	MaxAlertWindow = 24 * time.Hour
+	// MaxAlertCooldown is the longest a rule may stay silent after firing
+	MaxAlertCooldown = 7 * 24 * time.Hour
+	// MaxAlertThreshold is the largest number of matches a rule may wait for
+	MaxAlertThreshold = 100000
+
+	// alertSampleLines is the number of recent matching lines sent with a notification
+	alertSampleLines = 5
+	// alertSampleBytes truncates the sample lines
+	alertSampleBytes = 1024
+	// webhookAttempts is the number of times a notification is sent before giving up
+	webhookAttempts = 3
+)
+
+// Webhook request headers
+// The signature is the hex-encoded HMAC-SHA256, keyed with the rule's secret, of the timestamp header,
+// a dot and the body; receivers should also reject old timestamps to prevent replays
+const (
+	WebhookEventHeader     = "X-Arlog-Event"
+	WebhookTimestampHeader = "X-Arlog-Timestamp"
+	WebhookSignatureHeader = "X-Arlog-Signature"
+)
+
+// AlertRule is a compiled alert rule
+// The rule fires when Query matches at least Threshold lines of its scope within Window, and then stays
+// silent for Cooldown. Its scope is the pods of Namespace matching Selector (every pod if empty), and only
+// containers named Container if it is set
+type AlertRule struct {
+	ID            uint
+	TeamName      string
+	Name          string
+	Namespace     string
+	Selector      string
+	Container     string
+	Query         *LogQuery
+	Threshold     int
+	Window        time.Duration
+	Cooldown      time.Duration
+	WebhookURL    string
+	WebhookSecret string
+	// LastFired is when the rule last fired, so a cooldown outlasts restarts
+	LastFired time.Time
+	// Version changes whenever the rule is edited; the watcher then restarts its evaluation
+	Version time.Time
+}
+
+// Validate checks the rule against the server-enforced limits
+func (r AlertRule) Validate() error {
+	if r.Name == "" {
+		return fmt.Errorf("a name is required")
+	}
+	if r.Namespace == "" {
+		return fmt.Errorf("a namespace is required")
+	}
+	if r.Query == nil {
+		return fmt.Errorf("a query is required")
+	}
+	if _, err := labels.Parse(r.Selector); err != nil {
+		return fmt.Errorf("invalid label selector: %w", err)
+	}
+	if r.Threshold < 1 || r.Threshold > MaxAlertThreshold {
+		return fmt.Errorf("threshold must be between 1 and %d", MaxAlertThreshold)
+	}
+	if r.Window < MinAlertWindow || r.Window > MaxAlertWindow {
+		return fmt.Errorf("window must be between %d and %d seconds", int(MinAlertWindow/time.Second), int(MaxAlertWindow/time.Second))
+	}
+	if r.Cooldown < 0 || r.Cooldown > MaxAlertCooldown {
+		return fmt.Errorf("cooldown must be between 0 and %d seconds", int(MaxAlertCooldown/time.Second))
+	}
+	return nil
+}
+
+// AlertNotification is the JSON body of a webhook sent when a rule fires
+// Matches is the number of matching lines in the window when the rule fired
+type AlertNotification struct {
+	RuleID        uint          `json:"ruleId"`
+	Rule          string        `json:"rule"`
+	Team          string        `json:"team"`
+	Cluster       string        `json:"cluster"`
+	Namespace     string        `json:"namespace"`
+	Selector      string        `json:"selector,omitempty"`
+	Container     string        `json:"container,omitempty"`
+	Query         string        `json:"query"`
+	Threshold     int           `json:"threshold"`
+	WindowSeconds int           `json:"windowSeconds"`
+	Matches       int           `json:"matches"`
+	FiredAt       time.Time     `json:"firedAt"`
+	Samples       []AlertSample `json:"samples"`
+}
+
+// AlertSample is one of the last matching lines before a rule fired
+type AlertSample struct {
+	Pod       string    `json:"pod"`
+	Container string    `json:"container"`
+	Timestamp time.Time `json:"timestamp"`
+	Line      string    `json:"line"`
+}
+
+// AlertStore loads the alert rules and records their firings
+type AlertStore interface {
+	// AlertRules returns the enabled rules of cluster whose team still has a permission for their namespace
+	AlertRules(cluster string) ([]AlertRule, error)
+	// RecordFiring records that a rule fired, along with the error delivering its webhook, if any
+	RecordFiring(ruleID uint, firedAt time.Time, deliveryErr error) error
+}
+
+// AlertConfig configures an AlertWatcher; zero values take the defaults
+type AlertConfig struct {
+	Cluster         string
+	RefreshInterval time.Duration
+	MaxStreams      int
+	// Client sends the webhooks; by default, the client of NewWebhookClient
+	Client *http.Client
+}
+
+// AlertWatcher evaluates alert rules against the live logs of their scopes and sends a signed webhook
+// whenever one fires
+type AlertWatcher struct {
+	config AlertConfig
+	store  AlertStore
+}
+
+// NewAlertWatcher creates a watcher for the rules of store
+func NewAlertWatcher(config AlertConfig, store AlertStore) *AlertWatcher {
+	if config.RefreshInterval <= 0 {
+		config.RefreshInterval = DefaultAlertRefreshInterval
+	}
+	if config.MaxStreams <= 0 {
+		config.MaxStreams = DefaultAlertMaxStreams
+	}
+	if config.Client == nil {
+		config.Client = NewWebhookClient()
+	}
+	return &AlertWatcher{config: config, store: store}
+}
+
+// Run evaluates the rules until ctx is cancelled
+// The rules are reloaded every RefreshInterval; a rule that was edited or whose evaluation failed is
+// restarted then, and a rule that was deleted or disabled is stopped
+func (w *AlertWatcher) Run(ctx context.Context, k *KubernetesService) {
+	watches := make(map[uint]*ruleWatch)
+	defer func() {
+		for _, watch := range watches {
+			watch.stop()
+		}
+	}()
+
+	refresh := time.NewTicker(w.config.RefreshInterval)
+	defer refresh.Stop()
+
+	w.refresh(ctx, k, watches)
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-refresh.C:
+			w.refresh(ctx, k, watches)
+		}
+	}
+}
+
+// refresh starts, restarts and stops rule evaluations to match the stored rules
+func (w *AlertWatcher) refresh(ctx context.Context, k *KubernetesService, watches map[uint]*ruleWatch) {
+	rules, err := w.store.AlertRules(w.config.Cluster)
+	if err != nil {
+		log.Printf("Error loading alert rules: %v", err)
+		return
+	}
+	current := make(map[uint]AlertRule, len(rules))
+	for _, rule := range rules {
+		current[rule.ID] = rule
+	}
+
+	for id, watch := range watches {
+		rule, exists := current[id]
+		if !exists || !rule.Version.Equal(watch.version) || watch.finished() {
+			watch.stop()
+			delete(watches, id)
+		}
+	}
+	for id, rule := range current {
+		if _, running := watches[id]; !running {
+			watches[id] = w.startWatch(ctx, k, rule)
+		}
+	}
+}
+
+// ruleWatch is the running evaluation of one rule
+type ruleWatch struct {
+	version time.Time
+	cancel  context.CancelFunc
+	done    chan struct{}
+}
+
+func (w *AlertWatcher) startWatch(ctx context.Context, k *KubernetesService, rule AlertRule) *ruleWatch {
+	ctx, cancel := context.WithCancel(ctx)
+	watch := &ruleWatch{version: rule.Version, cancel: cancel, done: make(chan struct{})}
+	go func() {
+		defer close(watch.done)
+		if err := w.Watch(ctx, k, rule); err != nil && ctx.Err() == nil {
+			log.Printf("Error evaluating alert rule %q: %v", rule.Name, err)
+		}
+	}()
+	return watch
+}
+
+func (r *ruleWatch) finished() bool {
+	select {
+	case <-r.done:
+		return true
+	default:
+		return false
+	}
+}
+
+func (r *ruleWatch) stop() {
+	r.cancel()
+	<-r.done
+}
+
+// Watch evaluates one rule against the logs its scope writes from now on, until ctx is cancelled
+// Pods are attached as they appear. Each firing is recorded in the store and sent to the rule's webhook
+// in the background
+func (w *AlertWatcher) Watch(ctx context.Context, k *KubernetesService, rule AlertRule) error {
+	if err := rule.Validate(); err != nil {
+		return err
+	}
+
+	start := time.Now()
+	sink := &alertSink{
+		watcher: w,
+		ctx:     ctx,
+		window:  newAlertWindow(rule, w.config.Cluster),
+	}
+	tailer := newPodTailer(k, rule.Namespace, rule.Container, LogOptions{Follow: true, Timestamps: true, SinceTime: &start}, sink)
+	tailer.maxStreams = w.config.MaxStreams
+	err := tailer.run(ctx, metav1.ListOptions{LabelSelector: rule.Selector})
+	sink.wg.Wait()
+	return err
+}
+
+// alertSink matches the lines of a rule's scope and fires the rule when its threshold is reached
+type alertSink struct {
+	watcher *AlertWatcher
+	ctx     context.Context
+
+	mu     sync.Mutex
+	window *alertWindow
+	// wg tracks the webhooks being sent
+	wg sync.WaitGroup
+}
+
+// WriteLine implements LogSink
+func (s *alertSink) WriteLine(line LogLine) error {
+	rule := s.window.rule
+	var parsed *ParsedLine
+	if rule.Query.NeedsParse() {
+		_, content := SplitTimestamp(line.Content)
+		parsed = ParseLine(content, FormatAuto)
+	}
+	if !rule.Query.Match(line, parsed) {
+		return nil
+	}
+
+	s.mu.Lock()
+	notification := s.window.add(line, time.Now())
+	s.mu.Unlock()
+	if notification != nil {
+		s.wg.Add(1)
+		go func() {
+			defer s.wg.Done()
+			s.watcher.fire(s.ctx, rule, notification)
+		}()
+	}
+	return nil
+}
+
+// WriteEvent implements LogSink
+func (s *alertSink) WriteEvent(event StreamEvent) error {
+	if event.Type == StreamEventSkipped {
+		log.Printf("Not evaluating alert rule %q on %s/%s/%s: %s", s.window.rule.Name, event.Namespace, event.Pod, event.Container, event.Message)
+	}
+	return nil
+}
+
+// fire records a firing and sends its webhook
+func (w *AlertWatcher) fire(ctx context.Context, rule AlertRule, notification *AlertNotification) {
+	err := w.deliver(ctx, rule, notification)
+	if err != nil {
+		log.Printf("Error sending alert %q to its webhook: %v", rule.Name, err)
+	}
+	if recordErr := w.store.RecordFiring(rule.ID, notification.FiredAt, err); recordErr != nil {
+		log.Printf("Error recording the firing of alert %q: %v", rule.Name, recordErr)
+	}
+}
+
+// deliver posts a notification to the rule's webhook, retrying with backoff on errors and non-2xx responses
+func (w *AlertWatcher) deliver(ctx context.Context, rule AlertRule, notification *AlertNotification) error {
+	body, err := json.Marshal(notification)
+	if err != nil {
+		return fmt.Errorf("failed to encode notification: %w", err)
+	}
+
+	backoff := time.Second
+	for attempt := 1; ; attempt++ {
+		err = w.post(ctx, rule, body)
+		if err == nil || attempt == webhookAttempts {
+			return err
+		}
+		select {
+		case <-ctx.Done():
+			return err
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+	}
+}
+
+// post sends one signed webhook request
+func (w *AlertWatcher) post(ctx context.Context, rule AlertRule, body []byte) error {
+	request, err := http.NewRequestWithContext(ctx, http.MethodPost, rule.WebhookURL, bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("invalid webhook: %w", err)
+	}
+	timestamp := time.Now().Unix()
+	request.Header.Set("Content-Type", "application/json")
+	request.Header.Set(WebhookEventHeader, "alert")
+	request.Header.Set(WebhookTimestampHeader, strconv.FormatInt(timestamp, 10))
+	request.Header.Set(WebhookSignatureHeader, SignWebhook(rule.WebhookSecret, timestamp, body))
+
+	response, err := w.config.Client.Do(request)
+	if err != nil {
+		return fmt.Errorf("webhook request failed: %w", err)
+	}
+	defer response.Body.Close()
+	if response.StatusCode < 200 || response.StatusCode > 299 {
+		return fmt.Errorf("webhook responded with status %d", response.StatusCode)
+	}
+	return nil
+}
+
+// ErrWebhookAddress is returned for webhooks on an address the server does not post to
+var ErrWebhookAddress = errors.New("webhooks may not be sent to loopback, link-local or private addresses")
+
+// sharedAddressSpace is the carrier-grade NAT range, which clusters commonly use for pods and services
+var sharedAddressSpace = &net.IPNet{IP: net.IPv4(100, 64, 0, 0), Mask: net.CIDRMask(10, 32)}
+
+// webhookIPAllowed reports whether webhooks may be posted to ip
+// Internal addresses are refused so a rule cannot make the server call the API server, the cloud
+// metadata service or other services of the cluster network
+func webhookIPAllowed(ip net.IP) bool {
+	return !(ip.IsLoopback() || ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() || ip.IsPrivate() ||
+		ip.IsUnspecified() || ip.IsMulticast() || sharedAddressSpace.Contains(ip))
+}
+
+// ValidateWebhookHost checks the host of a webhook URL without resolving it
+// Names are checked again when the webhook is sent, against every address they resolve to
+func ValidateWebhookHost(host string) error {
+	host = strings.TrimSuffix(strings.ToLower(host), ".")
+	if host == "localhost" || strings.HasSuffix(host, ".localhost") {
+		return ErrWebhookAddress
+	}
+	if ip := net.ParseIP(host); ip != nil && !webhookIPAllowed(ip) {
+		return ErrWebhookAddress
+	}
+	return nil
+}
+
+// NewWebhookClient creates the client webhooks are sent with
+// It only connects to public addresses: the address is checked when the connection is made, so a name
+// that resolves differently later cannot get around it. Proxies are not used and redirects are not
+// followed; a redirect response counts as a failed delivery
+func NewWebhookClient() *http.Client {
+	dialer := &net.Dialer{
+		Timeout: DefaultWebhookTimeout,
+		Control: func(network, address string, _ syscall.RawConn) error {
+			host, _, err := net.SplitHostPort(address)
+			if err != nil {
+				return err
+			}
+			if ip := net.ParseIP(host); ip == nil || !webhookIPAllowed(ip) {
+				return fmt.Errorf("%w: %s", ErrWebhookAddress, host)
+			}
+			return nil
+		},
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.Proxy = nil
+	transport.DialContext = dialer.DialContext
+
+	return &http.Client{
+		Timeout:   DefaultWebhookTimeout,
+		Transport: transport,
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+}
+
+// GenerateWebhookSecret generates a random secret for signing a rule's webhooks
+func GenerateWebhookSecret() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// SignWebhook returns the signature header value of a webhook body sent at timestamp, in Unix seconds
+func SignWebhook(secret string, timestamp int64, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(strconv.FormatInt(timestamp, 10) + "."))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// alertWindow counts the matches of a rule over its sliding window
+// Matches are placed by the timestamps of their lines, or by when they were seen for lines without one,
+// so lines of several containers that arrive slightly out of order are still counted in the right window.
+// They are counted per second, so a window holds at most one bucket per second of it whatever the rate
+type alertWindow struct {
+	rule    AlertRule
+	cluster string
+	// buckets count the matches of each second in the window, oldest first; matches is their total
+	buckets []alertBucket
+	matches int
+	// newest is the time of the newest match, which ends the window
+	newest time.Time
+	// samples is a ring of the last alertSampleLines matches, starting at sampleStart
+	samples     []AlertSample
+	sampleStart int
+	lastFired   time.Time
+}
+
+// alertBucket counts the matches of one second, in Unix time
+type alertBucket struct {
+	second int64
+	count  int
+}
+
+func newAlertWindow(rule AlertRule, cluster string) *alertWindow {
+	return &alertWindow{
+		rule:      rule,
+		cluster:   cluster,
+		samples:   make([]AlertSample, 0, alertSampleLines),
+		lastFired: rule.LastFired,
+	}
+}
+
+// add counts a matching line seen at now, and returns the notification to send if the rule fires
+func (w *alertWindow) add(line LogLine, now time.Time) *AlertNotification {
+	at := line.Timestamp
+	if at.IsZero() {
+		at = now
+	}
+	sample := newAlertSample(line, at)
+	return w.count(at, &sample)
+}
+
+// count counts a match at the given time, keeping sample for the notifications if it is set
+func (w *alertWindow) count(at time.Time, sample *AlertSample) *AlertNotification {
+	position := sort.Search(len(w.buckets), func(i int) bool { return w.buckets[i].second >= at.Unix() })
+	if position == len(w.buckets) || w.buckets[position].second != at.Unix() {
+		w.buckets = append(w.buckets, alertBucket{})
+		copy(w.buckets[position+1:], w.buckets[position:])
+		w.buckets[position] = alertBucket{second: at.Unix()}
+	}
+	w.buckets[position].count++
+	w.matches++
+	if at.After(w.newest) {
+		w.newest = at
+	}
+
+	// The window ends at the second of the newest match
+	start := w.newest.Unix() - int64(w.rule.Window/time.Second)
+	expired := sort.Search(len(w.buckets), func(i int) bool { return w.buckets[i].second > start })
+	for _, bucket := range w.buckets[:expired] {
+		w.matches -= bucket.count
+	}
+	w.buckets = w.buckets[expired:]
+
+	if sample != nil {
+		if len(w.samples) < cap(w.samples) {
+			w.samples = append(w.samples, *sample)
+		} else {
+			w.samples[w.sampleStart] = *sample
+			w.sampleStart = (w.sampleStart + 1) % len(w.samples)
+		}
+	}
+
+	if w.matches < w.rule.Threshold {
+		return nil
+	}
+	if !w.lastFired.IsZero() && w.newest.Before(w.lastFired.Add(w.rule.Cooldown)) {
+		return nil
+	}
+	w.lastFired = w.newest
+	return w.notification(w.newest)
+}
+
+// newAlertSample returns the sample of a matching line placed at at, cut to alertSampleBytes
+func newAlertSample(line LogLine, at time.Time) AlertSample {
+	_, content := SplitTimestamp(line.Content)
+	content = bytes.TrimRight(content, "\r\n")
+	if len(content) > alertSampleBytes {
+		content = content[:alertSampleBytes]
+	}
+	return AlertSample{Pod: line.Pod, Container: line.Container, Timestamp: at, Line: string(content)}
+}
+
+// notification describes the rule firing at firedAt with the matches currently in the window
+// Only the sample lines that fall in the window are sent
+func (w *alertWindow) notification(firedAt time.Time) *AlertNotification {
+	samples := make([]AlertSample, 0, len(w.samples))
+	for i := range w.samples {
+		sample := w.samples[(w.sampleStart+i)%len(w.samples)]
+		if sample.Timestamp.Unix() >= w.buckets[0].second {
+			samples = append(samples, sample)
+		}
+	}
+	return &AlertNotification{
+		RuleID:        w.rule.ID,
+		Rule:          w.rule.Name,
+		Team:          w.rule.TeamName,
+		Cluster:       w.cluster,
+		Namespace:     w.rule.Namespace,
+		Selector:      w.rule.Selector,
+		Container:     w.rule.Container,
+		Query:         w.rule.Query.String(),
+		Threshold:     w.rule.Threshold,
+		WindowSeconds: int(w.rule.Window / time.Second),
+		Matches:       w.matches,
+		FiredAt:       firedAt,
+		Samples:       samples,
+	}
+}
+
+// AlertEvaluation is the outcome of replaying a window of logs through a rule
+type AlertEvaluation struct {
+	Since time.Time `json:"since"`
+	Until time.Time `json:"until"`
+	// Matches is the number of matching lines in the whole window
+	Matches int `json:"matches"`
+	// Firings are the notifications the rule would have sent, cooldown included
+	Firings []AlertNotification `json:"firings"`
+	// Partial is set when the replay ran out of time; later firings may then be missing
+	Partial    bool               `json:"partial,omitempty"`
+	Containers []ScannedContainer `json:"containers"`
+}
+
+// EvaluateAlertRule replays the logs of the rule's scope between since and until through the rule, in
+// timestamp order, and returns the notifications the watcher would have sent. Nothing is sent or recorded
+// The rule's last firing is ignored, so the replay starts out of cooldown. If ctx expires, the
+// evaluation of the lines read so far is returned with Partial set
+func (k *KubernetesService) EvaluateAlertRule(ctx context.Context, cluster string, rule AlertRule, since, until time.Time) (*AlertEvaluation, error) {
+	if err := rule.Validate(); err != nil {
+		return nil, err
+	}
+	if !until.After(since) {
+		return nil, fmt.Errorf("the end of the window must be after its start")
+	}
+
+	pods, err := k.ListExportPods(ctx, rule.Namespace, ExportOptions{Selector: rule.Selector})
+	if err != nil {
+		return nil, err
+	}
+	targets := ScanTargets(pods, rule.Container)
+
+	sinks := make([]*alertMatchSink, len(targets))
+	containers := k.scanLogs(ctx, rule.Namespace, targets, since, until, DefaultScanConcurrency, func(index int) LogSink {
+		sinks[index] = &alertMatchSink{query: rule.Query}
+		return sinks[index]
+	})
+	partial := false
+	if err := ctx.Err(); err != nil {
+		if !errors.Is(err, context.DeadlineExceeded) {
+			return nil, err
+		}
+		partial = true
+	}
+
+	// Only the last matches of each container come with a sample
+	var matches []alertMatch
+	for _, sink := range sinks {
+		if sink == nil {
+			continue
+		}
+		sampled := len(sink.times) - len(sink.samples)
+		for i, at := range sink.times {
+			match := alertMatch{at: at}
+			if i >= sampled {
+				match.sample = &sink.samples[i-sampled]
+			}
+			matches = append(matches, match)
+		}
+	}
+	sort.SliceStable(matches, func(i, j int) bool { return matches[i].at.Before(matches[j].at) })
+
+	evaluation := &AlertEvaluation{
+		Since:      since,
+		Until:      until,
+		Matches:    len(matches),
+		Firings:    []AlertNotification{},
+		Partial:    partial,
+		Containers: containers,
+	}
+	rule.LastFired = time.Time{}
+	window := newAlertWindow(rule, cluster)
+	for _, match := range matches {
+		if notification := window.count(match.at, match.sample); notification != nil {
+			evaluation.Firings = append(evaluation.Firings, *notification)
+		}
+	}
+	return evaluation, nil
+}
+
+// alertMatchSink records when the lines of one container log matched a query
+// Only the last alertSampleLines matches are kept whole, as samples
+type alertMatchSink struct {
+	query   *LogQuery
+	times   []time.Time
+	samples []AlertSample
+}
+
+// alertMatch is a match replayed through a rule, with its sample if it was kept
+type alertMatch struct {
+	at     time.Time
+	sample *AlertSample
+}
+
+func (s *alertMatchSink) WriteLine(line LogLine) error {
+	var parsed *ParsedLine
+	if s.query.NeedsParse() {
+		_, content := SplitTimestamp(line.Content)
+		parsed = ParseLine(content, FormatAuto)
+	}
+	if s.query.Match(line, parsed) {
+		s.times = append(s.times, line.Timestamp)
+		if len(s.samples) == alertSampleLines {
+			s.samples = s.samples[1:]
+		}
+		s.samples = append(s.samples, newAlertSample(line, line.Timestamp))
+	}
+	return nil
+}
+
+func (s *alertMatchSink) WriteEvent(event StreamEvent) error {
+	return nil
+}
@@ -0,0 +1,423 @@
+package services
+
+import (
+	"context"
+	"crypto/hmac"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+// mustParseQuery compiles a query or fails the test
+func mustParseQuery(t *testing.T, source string) *LogQuery {
+	t.Helper()
+	query, err := ParseLogQuery(source)
+	if err != nil {
+		t.Fatalf("ParseLogQuery(%q): %v", source, err)
+	}
+	return query
+}
+
+func TestAlertWindow(t *testing.T) {
+	start := time.Date(2024, 1, 2, 15, 0, 0, 0, time.UTC)
+
+	type match struct {
+		container string
+		at        time.Duration
+		// fires is the number of matches reported if the line fires the rule, or 0 if it must not
+		fires int
+	}
+	tests := []struct {
+		name      string
+		threshold int
+		window    time.Duration
+		cooldown  time.Duration
+		lastFired time.Duration
+		matches   []match
+	}{
+		{
+			name:      "threshold within the window",
+			threshold: 3, window: time.Minute,
+			matches: []match{{"api", 0, 0}, {"api", 10 * time.Second, 0}, {"api", 20 * time.Second, 3}},
+		},
+		{
+			name:      "matches expire from the window",
+			threshold: 3, window: time.Minute,
+			matches: []match{{"api", 0, 0}, {"api", 50 * time.Second, 0}, {"api", 2 * time.Minute, 0}, {"api", 2*time.Minute + 30*time.Second, 0}},
+		},
+		{
+			name:      "cooldown suppresses firings",
+			threshold: 1, window: time.Minute, cooldown: 10 * time.Minute,
+			matches: []match{{"api", 0, 1}, {"api", 5 * time.Minute, 0}, {"api", 11 * time.Minute, 1}},
+		},
+		{
+			name:      "cooldown carried over from the last firing",
+			threshold: 1, window: time.Minute, cooldown: 10 * time.Minute, lastFired: -time.Minute,
+			matches: []match{{"api", 0, 0}, {"api", 8 * time.Minute, 0}, {"api", 9 * time.Minute, 1}},
+		},
+		{
+			name:      "out of order lines from several containers",
+			threshold: 3, window: time.Minute,
+			matches: []match{{"api", 30 * time.Second, 0}, {"worker", 0, 0}, {"sidecar", 65 * time.Second, 0}, {"worker", 40 * time.Second, 3}},
+		},
+		{
+			name:      "late line inside the window",
+			threshold: 3, window: time.Minute,
+			matches: []match{{"api", 20 * time.Second, 0}, {"worker", 10 * time.Second, 0}, {"sidecar", 0, 3}},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rule := AlertRule{
+				Name:      "errors",
+				Query:     mustParseQuery(t, "error"),
+				Threshold: tt.threshold,
+				Window:    tt.window,
+				Cooldown:  tt.cooldown,
+			}
+			if tt.lastFired != 0 {
+				rule.LastFired = start.Add(tt.lastFired)
+			}
+			window := newAlertWindow(rule, "test")
+
+			for i, m := range tt.matches {
+				line := LogLine{Pod: "app-0", Container: m.container, Timestamp: start.Add(m.at), Content: []byte("error " + strconv.Itoa(i))}
+				notification := window.add(line, start.Add(time.Hour))
+				switch {
+				case m.fires == 0 && notification != nil:
+					t.Fatalf("match %d fired with %d matches, want no firing", i, notification.Matches)
+				case m.fires != 0 && notification == nil:
+					t.Fatalf("match %d did not fire", i)
+				case notification != nil:
+					if notification.Matches != m.fires {
+						t.Errorf("match %d fired with %d matches, want %d", i, notification.Matches, m.fires)
+					}
+					if len(notification.Samples) != m.fires {
+						t.Errorf("match %d fired with %d samples, want the %d in the window", i, len(notification.Samples), m.fires)
+					}
+				}
+			}
+		})
+	}
+}
+
+// TestAlertWindowBounded checks that a window keeps one bucket per second, however many lines match
+func TestAlertWindowBounded(t *testing.T) {
+	start := time.Date(2024, 1, 2, 15, 0, 0, 0, time.UTC)
+	rule := AlertRule{Name: "errors", Query: mustParseQuery(t, "error"), Threshold: 50000, Window: 10 * time.Second, Cooldown: time.Hour}
+	window := newAlertWindow(rule, "test")
+
+	// 20 seconds of 10000 matches a second
+	fired := 0
+	for i := 0; i < 200000; i++ {
+		at := start.Add(time.Duration(i) * 100 * time.Microsecond)
+		if notification := window.add(LogLine{Pod: "app-0", Container: "api", Timestamp: at, Content: []byte("error")}, at); notification != nil {
+			fired++
+			if notification.Matches != 50000 {
+				t.Errorf("fired with %d matches, want 50000", notification.Matches)
+			}
+		}
+	}
+	if fired != 1 {
+		t.Errorf("fired %d times, want once", fired)
+	}
+	if len(window.buckets) != 10 || window.matches != 100000 {
+		t.Errorf("window holds %d buckets and %d matches, want the last 10 seconds: 10 and 100000", len(window.buckets), window.matches)
+	}
+}
+
+func TestAlertMatchSink(t *testing.T) {
+	start := time.Date(2024, 1, 2, 15, 0, 0, 0, time.UTC)
+	sink := &alertMatchSink{query: mustParseQuery(t, "error")}
+	for i := 0; i < 8; i++ {
+		for _, text := range []string{"error " + strconv.Itoa(i), "ok"} {
+			line := LogLine{Pod: "app-0", Container: "api", Timestamp: start.Add(time.Duration(i) * time.Second), Content: []byte(text)}
+			if err := sink.WriteLine(line); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	if len(sink.times) != 8 {
+		t.Errorf("recorded %d matches, want 8", len(sink.times))
+	}
+	var samples []string
+	for _, sample := range sink.samples {
+		samples = append(samples, sample.Line)
+	}
+	if want := "error 3,error 4,error 5,error 6,error 7"; strings.Join(samples, ",") != want {
+		t.Errorf("samples = %q, want the last %d matches %s", samples, alertSampleLines, want)
+	}
+}
+
+// fakeAlertStore records the firings of the watched rules
+type fakeAlertStore struct {
+	mu      sync.Mutex
+	firings []error
+}
+
+func (s *fakeAlertStore) AlertRules(cluster string) ([]AlertRule, error) {
+	return nil, nil
+}
+
+func (s *fakeAlertStore) RecordFiring(ruleID uint, firedAt time.Time, deliveryErr error) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.firings = append(s.firings, deliveryErr)
+	return nil
+}
+
+// webhookReceiver accepts notifications whose signature verifies against the body and timestamp
+type webhookReceiver struct {
+	t      *testing.T
+	secret string
+
+	mu            sync.Mutex
+	notifications []AlertNotification
+}
+
+func (r *webhookReceiver) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	body, err := io.ReadAll(req.Body)
+	if err != nil {
+		r.t.Errorf("reading webhook body: %v", err)
+		return
+	}
+	timestamp, err := strconv.ParseInt(req.Header.Get(WebhookTimestampHeader), 10, 64)
+	if err != nil {
+		r.t.Errorf("invalid %s header %q", WebhookTimestampHeader, req.Header.Get(WebhookTimestampHeader))
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	if age := time.Since(time.Unix(timestamp, 0)); age < -time.Second || age > time.Minute {
+		r.t.Errorf("webhook timestamp is %s old", age)
+	}
+	expected := SignWebhook(r.secret, timestamp, body)
+	if signature := req.Header.Get(WebhookSignatureHeader); !hmac.Equal([]byte(signature), []byte(expected)) {
+		r.t.Errorf("webhook signature %q does not verify, want %q", signature, expected)
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	if event := req.Header.Get(WebhookEventHeader); event != "alert" {
+		r.t.Errorf("%s header is %q, want alert", WebhookEventHeader, event)
+	}
+
+	var notification AlertNotification
+	if err := json.Unmarshal(body, &notification); err != nil {
+		r.t.Errorf("decoding notification: %v", err)
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	r.mu.Lock()
+	r.notifications = append(r.notifications, notification)
+	r.mu.Unlock()
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// runningPod builds a pod whose containers are all running
+func runningPod(name string, labels map[string]string, containers ...string) *corev1.Pod {
+	pod := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: "shop", Labels: labels},
+		Status:     corev1.PodStatus{Phase: corev1.PodRunning},
+	}
+	for _, container := range containers {
+		pod.Spec.Containers = append(pod.Spec.Containers, corev1.Container{Name: container})
+		pod.Status.ContainerStatuses = append(pod.Status.ContainerStatuses, corev1.ContainerStatus{
+			Name:        container,
+			ContainerID: "containerd://" + name + "-" + container,
+			State:       corev1.ContainerState{Running: &corev1.ContainerStateRunning{}},
+		})
+	}
+	return pod
+}
+
+// TestAlertWatcherWatch evaluates rules against a fake clientset, whose containers all log "fake logs"
+// every time their stream is (re)opened, about twice a second
+func TestAlertWatcherWatch(t *testing.T) {
+	clientset := fake.NewSimpleClientset(
+		runningPod("api-0", map[string]string{"app": "api"}, "api", "sidecar"),
+		runningPod("api-1", map[string]string{"app": "api"}, "api"),
+		runningPod("worker-0", map[string]string{"app": "worker"}, "worker"),
+	)
+	k := NewKubernetesServiceForClient(clientset)
+
+	tests := []struct {
+		name      string
+		selector  string
+		container string
+		threshold int
+		lastFired time.Duration
+		// want lists the containers sampled by the single expected firing, or nil if the rule must not fire
+		want []string
+	}{
+		{
+			name:      "whole namespace",
+			threshold: 4,
+			want:      []string{"api-0/api", "api-0/sidecar", "api-1/api", "worker-0/worker"},
+		},
+		{
+			name:      "selector and container scope",
+			selector:  "app=api",
+			container: "api",
+			threshold: 3,
+			want:      []string{"api-0/api", "api-1/api"},
+		},
+		{
+			name:      "selector scope",
+			selector:  "app=worker",
+			threshold: 2,
+			want:      []string{"worker-0/worker"},
+		},
+		{
+			name:      "cooldown carried over from the last firing",
+			selector:  "app=api",
+			threshold: 1,
+			lastFired: -time.Minute,
+		},
+		{
+			name:      "cooldown over since the last firing",
+			selector:  "app=api",
+			container: "sidecar",
+			threshold: 1,
+			lastFired: -2 * time.Hour,
+			want:      []string{"api-0/sidecar"},
+		},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			receiver := &webhookReceiver{t: t, secret: "s3cret"}
+			server := httptest.NewServer(receiver)
+			defer server.Close()
+
+			store := &fakeAlertStore{}
+			watcher := NewAlertWatcher(AlertConfig{Cluster: "test", Client: server.Client()}, store)
+			rule := AlertRule{
+				ID:            7,
+				TeamName:      "payments",
+				Name:          "fake logs",
+				Namespace:     "shop",
+				Selector:      tt.selector,
+				Container:     tt.container,
+				Query:         mustParseQuery(t, `"fake logs"`),
+				Threshold:     tt.threshold,
+				Window:        time.Minute,
+				Cooldown:      time.Hour,
+				WebhookURL:    server.URL,
+				WebhookSecret: receiver.secret,
+			}
+			if tt.lastFired != 0 {
+				rule.LastFired = time.Now().Add(tt.lastFired)
+			}
+
+			ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+			defer cancel()
+			if err := watcher.Watch(ctx, k, rule); err != nil && !errors.Is(err, context.DeadlineExceeded) {
+				t.Fatalf("Watch: %v", err)
+			}
+
+			receiver.mu.Lock()
+			defer receiver.mu.Unlock()
+			if tt.want == nil {
+				if len(receiver.notifications) != 0 {
+					t.Fatalf("received %d notifications, want none", len(receiver.notifications))
+				}
+				return
+			}
+			if len(receiver.notifications) != 1 {
+				t.Fatalf("received %d notifications, want 1 within the cooldown", len(receiver.notifications))
+			}
+			if len(store.firings) != 1 || store.firings[0] != nil {
+				t.Errorf("recorded firings %v, want one delivered firing", store.firings)
+			}
+
+			notification := receiver.notifications[0]
+			if notification.RuleID != rule.ID || notification.Team != "payments" || notification.Cluster != "test" {
+				t.Errorf("notification identifies rule %d of team %q on %q", notification.RuleID, notification.Team, notification.Cluster)
+			}
+			if notification.Matches < tt.threshold {
+				t.Errorf("fired with %d matches, want at least %d", notification.Matches, tt.threshold)
+			}
+			sampled := make(map[string]bool)
+			for _, sample := range notification.Samples {
+				sampled[sample.Pod+"/"+sample.Container] = true
+			}
+			var got []string
+			for container := range sampled {
+				got = append(got, container)
+			}
+			sort.Strings(got)
+			if fmt.Sprint(got) != fmt.Sprint(tt.want) {
+				t.Errorf("sampled containers %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestValidateWebhookHost(t *testing.T) {
+	tests := []struct {
+		host    string
+		allowed bool
+	}{
+		{"hooks.example.com", true},
+		{"203.0.113.10", true},
+		{"2001:db8::1", true},
+		{"localhost", false},
+		{"api.localhost.", false},
+		{"127.0.0.1", false},
+		{"::1", false},
+		{"169.254.169.254", false},
+		{"fe80::1", false},
+		{"10.96.0.1", false},
+		{"192.168.1.20", false},
+		{"100.64.3.4", false},
+		{"fd00::1", false},
+		{"0.0.0.0", false},
+	}
+	for _, tt := range tests {
+		err := ValidateWebhookHost(tt.host)
+		if tt.allowed && err != nil {
+			t.Errorf("ValidateWebhookHost(%q) = %v, want allowed", tt.host, err)
+		}
+		if !tt.allowed && !errors.Is(err, ErrWebhookAddress) {
+			t.Errorf("ValidateWebhookHost(%q) = %v, want ErrWebhookAddress", tt.host, err)
+		}
+	}
+}
+
+func TestWebhookClientRefusesInternalAddresses(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t.Error("webhook reached a loopback address")
+	}))
+	defer server.Close()
+
+	client := NewWebhookClient()
+	response, err := client.Post(server.URL, "application/json", nil)
+	if err == nil {
+		response.Body.Close()
+		t.Fatal("posting to a loopback address succeeded")
+	}
+	if !errors.Is(err, ErrWebhookAddress) {
+		t.Errorf("posting to a loopback address failed with %v, want ErrWebhookAddress", err)
+	}
+
+	if err := client.CheckRedirect(nil, nil); !errors.Is(err, http.ErrUseLastResponse) {
+		t.Errorf("CheckRedirect = %v, want redirects to be returned rather than followed", err)
+	}
+}
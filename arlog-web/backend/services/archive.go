@@ -0,0 +1,364 @@
+package services
+
+import (
+	"bufio"
+	"compress/gzip"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"arlog/backend/models"
+)
+
+// Archive defaults, used for zero ArchiveConfig values
+const (
+	// DefaultArchiveSegmentDuration is the time partition a segment covers; segments are closed at its end
+	DefaultArchiveSegmentDuration = 10 * time.Minute
+	// DefaultArchiveSegmentBytes caps the uncompressed size of a segment; a full segment is closed early
+	DefaultArchiveSegmentBytes int64 = 16 * 1024 * 1024
+	// DefaultArchiveRefreshInterval is how often the opted-in namespaces are reloaded
+	DefaultArchiveRefreshInterval = time.Minute
+	// DefaultArchiveMaxStreams caps the container streams the collector keeps open per namespace
+	DefaultArchiveMaxStreams = 100
+	// DefaultCompactionInterval is how often retention policies are enforced
+	DefaultCompactionInterval = time.Hour
+)
+
+// Segment file names: the start time of the segment, a counter if that name is taken, and a suffix
+// Segments being written carry archivePartialSuffix until they are closed and indexed
+const (
+	archiveTimeLayout    = "20060102T150405.000000000Z"
+	archiveSegmentSuffix = ".log.gz"
+	archivePartialSuffix = ".partial"
+)
+
+// ErrNotArchived is returned when the archive holds no logs of a container
+var ErrNotArchived = errors.New("no archived logs found")
+
+// ArchiveNamespace is a namespace opted into the archive and the team that owns its segments
+type ArchiveNamespace struct {
+	Namespace string
+	TeamID    uint
+}
+
+// ArchivedContainer summarises the archived logs of one container
+type ArchivedContainer struct {
+	Pod       string    `json:"pod"`
+	Container string    `json:"container"`
+	Since     time.Time `json:"since"`
+	Until     time.Time `json:"until"`
+	Segments  int64     `json:"segments"`
+	Lines     int64     `json:"lines"`
+	Bytes     int64     `json:"bytes"`
+}
+
+// ArchiveIndex records the archived segments and the namespaces to archive
+type ArchiveIndex interface {
+	// ArchiveNamespaces lists the namespaces of cluster that are opted into the archive
+	ArchiveNamespaces(cluster string) ([]ArchiveNamespace, error)
+	// AddSegment records a closed segment
+	AddSegment(segment *models.ArchiveSegment) error
+	// FindSegments returns the segments of a pod, or only of container if it is set, by start time
+	FindSegments(cluster, namespace, podName, container string) ([]models.ArchiveSegment, error)
+	// LastArchived returns the time of the last archived line of a container, or the zero time
+	LastArchived(cluster, namespace, podName, container string) (time.Time, error)
+	// ArchivedContainers summarises the archived containers of a namespace
+	ArchivedContainers(cluster, namespace string) ([]ArchivedContainer, error)
+	// WindowSegments returns the segments selected by window, by start time
+	WindowSegments(window SegmentWindow) ([]models.ArchiveSegment, error)
+
+	// RetentionPolicies returns the retention settings of every team, as stored
+	RetentionPolicies() ([]RetentionPolicy, error)
+	// TeamUsage returns the size of a team's segments in cluster
+	TeamUsage(cluster string, teamID uint) (ArchiveUsage, error)
+	// OldestSegments returns the segments selected by query, oldest end time first
+	OldestSegments(query SegmentQuery) ([]models.ArchiveSegment, error)
+	// UpdateSegment records the new size of a rewritten segment
+	UpdateSegment(segment *models.ArchiveSegment) error
+	// DeleteSegment forgets a segment whose file was removed
+	DeleteSegment(segment *models.ArchiveSegment) error
+}
+
+// ArchiveConfig configures a LogArchive; zero values take the defaults
+// RetentionDays and RetentionMaxBytes apply to teams without their own setting; 0 means no limit
+type ArchiveConfig struct {
+	Dir                string
+	Cluster            string
+	SegmentDuration    time.Duration
+	SegmentBytes       int64
+	RefreshInterval    time.Duration
+	MaxStreams         int
+	CompactionInterval time.Duration
+	RetentionDays      int
+	RetentionMaxBytes  int64
+}
+
+// LogArchive keeps container logs in gzip-compressed, time-partitioned segment files under a directory,
+// indexed by an ArchiveIndex, so they can still be read once their pods are gone
+// Segment files are laid out as <dir>/<cluster>/<namespace>/<pod>/<container>/<start>.log.gz and hold
+// the raw lines with their RFC3339 timestamps, with a full-text index alongside in <start>.idx
+type LogArchive struct {
+	config ArchiveConfig
+	index  ArchiveIndex
+
+	// indexes caches the full-text indexes of recently searched segments
+	indexes *indexCache
+
+	// compactMu serialises compaction runs
+	compactMu sync.Mutex
+
+	mu             sync.Mutex
+	lastCompaction *CompactionReport
+}
+
+// NewLogArchive creates the archive directory if needed and removes the segments a previous run left open
+// Their lines are read again from the cluster when the collector resumes containers that still exist
+func NewLogArchive(config ArchiveConfig, index ArchiveIndex) (*LogArchive, error) {
+	if config.Dir == "" {
+		return nil, fmt.Errorf("an archive directory is required")
+	}
+	if config.SegmentDuration <= 0 {
+		config.SegmentDuration = DefaultArchiveSegmentDuration
+	}
+	if config.SegmentBytes <= 0 {
+		config.SegmentBytes = DefaultArchiveSegmentBytes
+	}
+	if config.RefreshInterval <= 0 {
+		config.RefreshInterval = DefaultArchiveRefreshInterval
+	}
+	if config.MaxStreams <= 0 {
+		config.MaxStreams = DefaultArchiveMaxStreams
+	}
+	if config.CompactionInterval <= 0 {
+		config.CompactionInterval = DefaultCompactionInterval
+	}
+
+	if err := os.MkdirAll(config.Dir, 0o750); err != nil {
+		return nil, fmt.Errorf("failed to create archive directory: %w", err)
+	}
+	err := filepath.WalkDir(config.Dir, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if !entry.IsDir() && strings.HasSuffix(path, archivePartialSuffix) {
+			return os.Remove(path)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to clean up archive directory: %w", err)
+	}
+
+	return &LogArchive{config: config, index: index, indexes: newIndexCache(archiveIndexCacheSize)}, nil
+}
+
+// Cluster returns the name of the cluster whose logs are archived
+func (a *LogArchive) Cluster() string {
+	return a.config.Cluster
+}
+
+// ArchivedContainers summarises the archived containers of a namespace
+func (a *LogArchive) ArchivedContainers(namespace string) ([]ArchivedContainer, error) {
+	return a.index.ArchivedContainers(a.config.Cluster, namespace)
+}
+
+// ReadLogs writes the archived lines of a container to sink, like GetPodLogs does for a live container
+// An empty container selects the container with the most archived lines. Previous is ignored, since the
+// archive holds every instance of a container in order, and a tail may come up short when since or until
+// cut into its segments. A StreamEventArchived event is written before the lines
+// It returns the name of the container read, or ErrNotArchived if the archive holds nothing of it
+func (a *LogArchive) ReadLogs(ctx context.Context, namespace, podName, container string, opts LogOptions, until *time.Time, sink LogSink) (string, error) {
+	opts.Follow = false
+	opts.PreviousTail = nil
+	if err := opts.Validate(); err != nil {
+		return "", fmt.Errorf("invalid log options: %w", err)
+	}
+
+	segments, err := a.index.FindSegments(a.config.Cluster, namespace, podName, container)
+	if err != nil {
+		return container, fmt.Errorf("failed to find archived logs: %w", err)
+	}
+	if len(segments) == 0 {
+		return container, ErrNotArchived
+	}
+	if container == "" {
+		container = busiestContainer(segments)
+	}
+
+	var since time.Time
+	switch {
+	case opts.SinceSeconds != nil:
+		since = time.Now().Add(-time.Duration(*opts.SinceSeconds) * time.Second)
+	case opts.SinceTime != nil:
+		since = *opts.SinceTime
+	}
+
+	// Only the container's segments that overlap the window are read
+	var selected []models.ArchiveSegment
+	for _, segment := range segments {
+		if segment.ContainerName != container || segment.EndTime.Before(since) {
+			continue
+		}
+		if until != nil && segment.StartTime.After(*until) {
+			continue
+		}
+		selected = append(selected, segment)
+	}
+
+	reader := &archiveReader{
+		namespace: namespace,
+		podName:   podName,
+		container: container,
+		opts:      opts,
+		since:     since,
+		until:     until,
+		sink:      sink,
+	}
+	if opts.TailLines != nil {
+		// Skip the segments before those holding the tail, keeping one more in case the window cuts into them
+		var lines int64
+		start := len(selected)
+		for start > 0 && lines < *opts.TailLines {
+			start--
+			lines += selected[start].Lines
+		}
+		if start > 0 {
+			start--
+		}
+		selected = selected[start:]
+		reader.tail = make([]LogLine, 0, *opts.TailLines)
+	}
+
+	if err := sink.WriteEvent(StreamEvent{
+		Type:      StreamEventArchived,
+		Namespace: namespace,
+		Pod:       podName,
+		Container: container,
+		Message:   "pod no longer exists; showing archived logs",
+	}); err != nil {
+		return container, sinkError{err}
+	}
+
+	for _, segment := range selected {
+		if err := ctx.Err(); err != nil {
+			return container, err
+		}
+		done, err := reader.readSegment(segment.Path)
+		if err != nil {
+			return container, err
+		}
+		if done {
+			break
+		}
+	}
+	return container, reader.flushTail()
+}
+
+// busiestContainer returns the container with the most lines in segments
+func busiestContainer(segments []models.ArchiveSegment) string {
+	lines := make(map[string]int64)
+	busiest := ""
+	for _, segment := range segments {
+		lines[segment.ContainerName] += segment.Lines
+		if busiest == "" || lines[segment.ContainerName] > lines[busiest] {
+			busiest = segment.ContainerName
+		}
+	}
+	return busiest
+}
+
+// archiveReader writes the lines of archived segments that fall in a window to a sink
+type archiveReader struct {
+	namespace string
+	podName   string
+	container string
+	opts      LogOptions
+	since     time.Time
+	until     *time.Time
+	sink      LogSink
+
+	// tail is a ring of the last opts.TailLines lines read, starting at tailStart; flushTail writes them
+	tail      []LogLine
+	tailStart int
+	written   int64
+}
+
+// readSegment reads one segment file; it reports done once the end of the window or the byte limit is reached
+func (r *archiveReader) readSegment(path string) (bool, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return false, fmt.Errorf("failed to open archive segment: %w", err)
+	}
+	defer file.Close()
+
+	gz, err := gzip.NewReader(file)
+	if err != nil {
+		return false, fmt.Errorf("failed to read archive segment %s: %w", filepath.Base(path), err)
+	}
+	defer gz.Close()
+
+	reader := bufio.NewReader(gz)
+	for {
+		raw, err := reader.ReadBytes('\n')
+		if len(raw) > 0 {
+			line := newLogLine(r.namespace, r.podName, r.container, raw, r.opts.Timestamps)
+			if r.until != nil && line.Timestamp.After(*r.until) {
+				return true, nil
+			}
+			if !line.Timestamp.Before(r.since) {
+				if done, writeErr := r.add(line); done || writeErr != nil {
+					return done, writeErr
+				}
+			}
+		}
+		if err != nil {
+			if err == io.EOF {
+				return false, nil
+			}
+			return false, fmt.Errorf("failed to read archive segment %s: %w", filepath.Base(path), err)
+		}
+	}
+}
+
+// add keeps a line for the tail, or writes it straight away when no tail was requested
+func (r *archiveReader) add(line LogLine) (bool, error) {
+	if r.opts.TailLines == nil {
+		return r.write(line)
+	}
+	if len(r.tail) < cap(r.tail) {
+		r.tail = append(r.tail, line)
+	} else if len(r.tail) > 0 {
+		r.tail[r.tailStart] = line
+		r.tailStart = (r.tailStart + 1) % len(r.tail)
+	}
+	return false, nil
+}
+
+// flushTail writes the kept tail lines, oldest first
+func (r *archiveReader) flushTail() error {
+	for i := range r.tail {
+		if done, err := r.write(r.tail[(r.tailStart+i)%len(r.tail)]); done || err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// write sends a line to the sink; it reports done once the next line would exceed opts.LimitBytes
+func (r *archiveReader) write(line LogLine) (bool, error) {
+	if r.opts.LimitBytes != nil && r.written+int64(len(line.Content)) > *r.opts.LimitBytes {
+		return true, nil
+	}
+	r.written += int64(len(line.Content))
+	if err := r.sink.WriteLine(line); err != nil {
+		return true, sinkError{err}
+	}
+	return false, nil
+}
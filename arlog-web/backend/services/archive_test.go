@@ -0,0 +1,174 @@
+package services
+
+import (
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	"arlog/backend/models"
+)
+
+// fakeArchiveIndex is an in-memory ArchiveIndex
+// Like Postgres, it keeps times to the microsecond
+type fakeArchiveIndex struct {
+	mu         sync.Mutex
+	namespaces []ArchiveNamespace
+	policies   []RetentionPolicy
+	segments   []models.ArchiveSegment
+	nextID     uint
+	// lookupErr, if set, is returned by LastArchived
+	lookupErr error
+}
+
+func (f *fakeArchiveIndex) ArchiveNamespaces(cluster string) ([]ArchiveNamespace, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]ArchiveNamespace(nil), f.namespaces...), nil
+}
+
+func (f *fakeArchiveIndex) AddSegment(segment *models.ArchiveSegment) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.nextID++
+	segment.ID = f.nextID
+	segment.StartTime = segment.StartTime.Round(time.Microsecond)
+	segment.EndTime = segment.EndTime.Round(time.Microsecond)
+	f.segments = append(f.segments, *segment)
+	return nil
+}
+
+// selectSegments returns the segments for which keep reports true, ordered by less or by start time
+func (f *fakeArchiveIndex) selectSegments(keep func(*models.ArchiveSegment) bool, less func(a, b *models.ArchiveSegment) bool) []models.ArchiveSegment {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var selected []models.ArchiveSegment
+	for i := range f.segments {
+		if keep(&f.segments[i]) {
+			selected = append(selected, f.segments[i])
+		}
+	}
+	if less == nil {
+		less = func(a, b *models.ArchiveSegment) bool { return a.StartTime.Before(b.StartTime) }
+	}
+	sort.SliceStable(selected, func(i, j int) bool { return less(&selected[i], &selected[j]) })
+	return selected
+}
+
+func (f *fakeArchiveIndex) FindSegments(cluster, namespace, podName, container string) ([]models.ArchiveSegment, error) {
+	return f.selectSegments(func(s *models.ArchiveSegment) bool {
+		return s.ClusterName == cluster && s.Namespace == namespace && s.PodName == podName &&
+			(container == "" || s.ContainerName == container)
+	}, nil), nil
+}
+
+func (f *fakeArchiveIndex) LastArchived(cluster, namespace, podName, container string) (time.Time, error) {
+	if f.lookupErr != nil {
+		return time.Time{}, f.lookupErr
+	}
+	segments, _ := f.FindSegments(cluster, namespace, podName, container)
+	var last time.Time
+	for _, segment := range segments {
+		if segment.EndTime.After(last) {
+			last = segment.EndTime
+		}
+	}
+	return last, nil
+}
+
+func (f *fakeArchiveIndex) ArchivedContainers(cluster, namespace string) ([]ArchivedContainer, error) {
+	return nil, nil
+}
+
+func (f *fakeArchiveIndex) WindowSegments(window SegmentWindow) ([]models.ArchiveSegment, error) {
+	namespaces := make(map[string]bool)
+	for _, namespace := range window.Namespaces {
+		namespaces[namespace] = true
+	}
+	return f.selectSegments(func(s *models.ArchiveSegment) bool {
+		return s.ClusterName == window.Cluster && namespaces[s.Namespace] &&
+			!s.EndTime.Before(window.Since) && !s.StartTime.After(window.Until) &&
+			(window.PodName == "" || s.PodName == window.PodName) &&
+			(window.Container == "" || s.ContainerName == window.Container)
+	}, nil), nil
+}
+
+func (f *fakeArchiveIndex) RetentionPolicies() ([]RetentionPolicy, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]RetentionPolicy(nil), f.policies...), nil
+}
+
+func (f *fakeArchiveIndex) TeamUsage(cluster string, teamID uint) (ArchiveUsage, error) {
+	var usage ArchiveUsage
+	for _, segment := range f.selectSegments(func(s *models.ArchiveSegment) bool {
+		return s.ClusterName == cluster && s.TeamID == teamID
+	}, nil) {
+		usage.Segments++
+		usage.Bytes += segment.Bytes
+		usage.RawBytes += segment.RawBytes
+		if usage.Oldest == nil || segment.StartTime.Before(*usage.Oldest) {
+			start := segment.StartTime
+			usage.Oldest = &start
+		}
+	}
+	return usage, nil
+}
+
+func (f *fakeArchiveIndex) OldestSegments(query SegmentQuery) ([]models.ArchiveSegment, error) {
+	segments := f.selectSegments(func(s *models.ArchiveSegment) bool {
+		return s.ClusterName == query.Cluster && s.TeamID == query.TeamID &&
+			(query.EndedBefore.IsZero() || s.EndTime.Before(query.EndedBefore)) &&
+			(!query.SkipDownsampled || !s.Downsampled)
+	}, func(a, b *models.ArchiveSegment) bool {
+		if !a.EndTime.Equal(b.EndTime) {
+			return a.EndTime.Before(b.EndTime)
+		}
+		return a.ID < b.ID
+	})
+	if len(segments) > query.Limit {
+		segments = segments[:query.Limit]
+	}
+	return segments, nil
+}
+
+func (f *fakeArchiveIndex) UpdateSegment(segment *models.ArchiveSegment) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for i := range f.segments {
+		if f.segments[i].ID == segment.ID {
+			f.segments[i] = *segment
+		}
+	}
+	return nil
+}
+
+func (f *fakeArchiveIndex) DeleteSegment(segment *models.ArchiveSegment) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for i := range f.segments {
+		if f.segments[i].ID == segment.ID {
+			f.segments = append(f.segments[:i], f.segments[i+1:]...)
+			break
+		}
+	}
+	return nil
+}
+
+// all returns every recorded segment, by start time
+func (f *fakeArchiveIndex) all() []models.ArchiveSegment {
+	return f.selectSegments(func(*models.ArchiveSegment) bool { return true }, nil)
+}
+
+// newTestArchive creates an archive of cluster test in a temporary directory
+func newTestArchive(t *testing.T, config ArchiveConfig) (*LogArchive, *fakeArchiveIndex) {
+	t.Helper()
+	index := &fakeArchiveIndex{}
+	config.Dir = t.TempDir()
+	config.Cluster = "test"
+	archive, err := NewLogArchive(config, index)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return archive, index
+}
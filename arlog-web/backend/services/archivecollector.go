@@ -0,0 +1,519 @@
+package services
+
+import (
+	"bufio"
+	"compress/gzip"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"arlog/backend/models"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// archiveRollInterval is how often the collector closes segments whose time partition has ended
+const archiveRollInterval = 15 * time.Second
+
+// Collect archives the logs of every pod in the opted-in namespaces until ctx is cancelled
+// The namespaces are reloaded every RefreshInterval; a namespace whose stream failed is restarted then.
+// Whole container logs are requested, and each container resumes after its last archived line
+func (a *LogArchive) Collect(ctx context.Context, k *KubernetesService) {
+	collectors := make(map[string]*namespaceCollector)
+	defer func() {
+		for _, collector := range collectors {
+			collector.stop()
+		}
+	}()
+
+	refresh := time.NewTicker(a.config.RefreshInterval)
+	defer refresh.Stop()
+	roll := time.NewTicker(archiveRollInterval)
+	defer roll.Stop()
+
+	a.refresh(ctx, k, collectors)
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-refresh.C:
+			a.refresh(ctx, k, collectors)
+		case now := <-roll.C:
+			for _, collector := range collectors {
+				collector.sink.rollExpired(now)
+			}
+		}
+	}
+}
+
+// refresh starts collectors for newly opted-in namespaces and stops those of namespaces that opted out
+// Collectors that have finished are restarted
+func (a *LogArchive) refresh(ctx context.Context, k *KubernetesService, collectors map[string]*namespaceCollector) {
+	namespaces, err := a.index.ArchiveNamespaces(a.config.Cluster)
+	if err != nil {
+		log.Printf("Error loading archived namespaces: %v", err)
+		return
+	}
+	owners := make(map[string]uint, len(namespaces))
+	for _, namespace := range namespaces {
+		owners[namespace.Namespace] = namespace.TeamID
+	}
+
+	for namespace, collector := range collectors {
+		teamID, wanted := owners[namespace]
+		if !wanted || collector.finished() {
+			collector.stop()
+			delete(collectors, namespace)
+			continue
+		}
+		collector.sink.setTeam(teamID)
+	}
+	for namespace, teamID := range owners {
+		if _, running := collectors[namespace]; !running {
+			collectors[namespace] = a.startCollector(ctx, k, namespace, teamID)
+		}
+	}
+}
+
+// namespaceCollector tails every pod of one namespace into the archive
+type namespaceCollector struct {
+	sink   *archiveSink
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+// startCollector starts tailing namespace, attaching pods as they appear
+func (a *LogArchive) startCollector(ctx context.Context, k *KubernetesService, namespace string, teamID uint) *namespaceCollector {
+	ctx, cancel := context.WithCancel(ctx)
+	collector := &namespaceCollector{
+		sink: &archiveSink{
+			archive:   a,
+			namespace: namespace,
+			teamID:    teamID,
+			writers:   make(map[string]*segmentWriter),
+		},
+		cancel: cancel,
+		done:   make(chan struct{}),
+	}
+
+	go func() {
+		defer close(collector.done)
+		tailer := newPodTailer(k, namespace, "", LogOptions{Follow: true, Timestamps: true}, collector.sink)
+		tailer.maxStreams = a.config.MaxStreams
+		if err := tailer.run(ctx, metav1.ListOptions{}); err != nil && ctx.Err() == nil {
+			log.Printf("Error archiving logs of namespace %s: %v", namespace, err)
+		}
+	}()
+	return collector
+}
+
+// finished reports whether the collector's streams have ended
+func (c *namespaceCollector) finished() bool {
+	select {
+	case <-c.done:
+		return true
+	default:
+		return false
+	}
+}
+
+// stop ends the collector's streams and closes its open segments
+func (c *namespaceCollector) stop() {
+	c.cancel()
+	<-c.done
+	c.sink.closeAll()
+}
+
+// archiveSink writes the lines of a namespace's containers to their open segments
+// Each container has its own segment writer with its own lock, so a slow write only holds up the lines
+// of its container. s.mu only guards the team and the set of writers, and is never held while writing
+type archiveSink struct {
+	archive   *LogArchive
+	namespace string
+
+	mu      sync.Mutex
+	teamID  uint
+	writers map[string]*segmentWriter
+}
+
+// setTeam changes the team that owns the segments opened from now on
+func (s *archiveSink) setTeam(teamID uint) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.teamID = teamID
+}
+
+// team returns the team that owns the segments opened now
+func (s *archiveSink) team() uint {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.teamID
+}
+
+// WriteLine implements LogSink
+// A line is dropped, and the failure logged, while the last archived lines of its container cannot be
+// looked up; the lookup is tried again with the next line
+func (s *archiveSink) WriteLine(line LogLine) error {
+	writer := s.writer(line.Pod, line.Container)
+	writer.mu.Lock()
+	for writer.closed {
+		// The writer was closed after it was looked up; the next lookup creates a new one
+		writer.mu.Unlock()
+		writer = s.writer(line.Pod, line.Container)
+		writer.mu.Lock()
+	}
+	defer writer.mu.Unlock()
+
+	if !writer.resumed {
+		resume, err := s.resumePoint(line.Pod, line.Container)
+		if err != nil {
+			if !writer.lookupFailed {
+				log.Printf("Error looking up archived logs of %s/%s/%s, not archiving until it succeeds: %v", s.namespace, line.Pod, line.Container, err)
+				writer.lookupFailed = true
+			}
+			return nil
+		}
+		writer.resume, writer.resumed, writer.lookupFailed = resume, true, false
+		if resume != nil {
+			writer.last = resume.last
+		}
+	}
+	return writer.write(line)
+}
+
+// resumePoint returns where the archive of a container left off, or nil if nothing of it was archived
+// The stream of a container starts over at its first line, so the lines up to the last archived one are
+// dropped. The returned state expects each archived line with the time of the last one to come again
+func (s *archiveSink) resumePoint(pod, container string) (*streamResume, error) {
+	cluster := s.archive.config.Cluster
+	last, err := s.archive.index.LastArchived(cluster, s.namespace, pod, container)
+	if err != nil || last.IsZero() {
+		return nil, err
+	}
+	segments, err := s.archive.index.FindSegments(cluster, s.namespace, pod, container)
+	if err != nil {
+		return nil, err
+	}
+
+	// The index may store times with less precision than the lines, so the segment files are read for
+	// the exact time of the last line. If they are gone, the stored time is the best there is
+	resume := &streamResume{boundary: make(map[string]int)}
+	for i := range segments {
+		if !segments[i].EndTime.Equal(last) {
+			continue
+		}
+		if err := s.archive.readBoundary(&segments[i], last, resume); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return nil, err
+		}
+	}
+	if resume.last.IsZero() {
+		resume.last = last
+	}
+	resume.reconnecting()
+	return resume, nil
+}
+
+// writer returns the segment writer of a container, creating it if needed
+func (s *archiveSink) writer(pod, container string) *segmentWriter {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	key := pod + "/" + container
+	writer, exists := s.writers[key]
+	if !exists {
+		writer = &segmentWriter{sink: s, pod: pod, container: container}
+		s.writers[key] = writer
+	}
+	return writer
+}
+
+// close closes a writer removed from the sink, closing its open segment
+func (s *archiveSink) close(key string, writer *segmentWriter) {
+	writer.mu.Lock()
+	defer writer.mu.Unlock()
+
+	writer.closed = true
+	if err := writer.roll(); err != nil {
+		log.Printf("Error archiving logs of %s/%s: %v", s.namespace, key, err)
+	}
+}
+
+// WriteEvent implements LogSink
+// A container whose stream ended, usually because it exited or its pod was deleted, has its segment
+// closed straight away so its logs can be read from the archive
+func (s *archiveSink) WriteEvent(event StreamEvent) error {
+	switch event.Type {
+	case StreamEventDetached:
+		key := event.Pod + "/" + event.Container
+		s.mu.Lock()
+		writer, exists := s.writers[key]
+		delete(s.writers, key)
+		s.mu.Unlock()
+
+		if exists {
+			s.close(key, writer)
+		}
+	case StreamEventSkipped:
+		log.Printf("Not archiving logs of %s/%s/%s: %s", s.namespace, event.Pod, event.Container, event.Message)
+	}
+	return nil
+}
+
+// rollExpired closes the segments whose time partition ended before now
+func (s *archiveSink) rollExpired(now time.Time) {
+	s.mu.Lock()
+	writers := make(map[string]*segmentWriter, len(s.writers))
+	for key, writer := range s.writers {
+		writers[key] = writer
+	}
+	s.mu.Unlock()
+
+	for key, writer := range writers {
+		writer.mu.Lock()
+		if writer.file != nil && !now.Before(writer.partitionEnd) {
+			if err := writer.roll(); err != nil {
+				log.Printf("Error archiving logs of %s/%s: %v", s.namespace, key, err)
+			}
+		}
+		writer.mu.Unlock()
+	}
+}
+
+// closeAll closes every open segment
+func (s *archiveSink) closeAll() {
+	s.mu.Lock()
+	writers := s.writers
+	s.writers = make(map[string]*segmentWriter)
+	s.mu.Unlock()
+
+	for key, writer := range writers {
+		s.close(key, writer)
+	}
+}
+
+// segmentWriter appends the lines of one container to its open segment
+// It is only used with its lock held, which may be taken before the lock of its sink but not after
+type segmentWriter struct {
+	sink      *archiveSink
+	pod       string
+	container string
+
+	mu sync.Mutex
+	// resumed is set once the resume point was looked up; lookupFailed once a failed lookup was logged
+	resumed      bool
+	lookupFailed bool
+	// resume deduplicates the lines with the time of the last line archived before the stream started,
+	// until a later line arrives
+	resume *streamResume
+	// closed is set once the writer was removed from its sink
+	closed bool
+	// last is the time of the last archived line; older lines were archived before and are dropped
+	last time.Time
+	// skipping is set while the lines read were archived before; lines without a timestamp follow it
+	skipping bool
+
+	file         *os.File
+	encoder      *segmentEncoder
+	segment      models.ArchiveSegment
+	partitionEnd time.Time
+}
+
+// write appends a line, closing the open segment first if the line falls after its partition or it is full
+func (w *segmentWriter) write(line LogLine) error {
+	if w.archivedBefore(line) {
+		return nil
+	}
+	timestamp := line.Timestamp
+	if timestamp.IsZero() {
+		// A line without a timestamp is kept in order after the previous one
+		timestamp = w.last
+	}
+
+	config := w.sink.archive.config
+	if w.file != nil && (!timestamp.Before(w.partitionEnd) || w.segment.RawBytes >= config.SegmentBytes) {
+		if err := w.roll(); err != nil {
+			return err
+		}
+	}
+	if w.file == nil {
+		if err := w.open(timestamp); err != nil {
+			return err
+		}
+	}
+
+	content := line.Content
+	if len(content) == 0 || content[len(content)-1] != '\n' {
+		content = append(content, '\n')
+	}
+	if err := w.encoder.write(content); err != nil {
+		return fmt.Errorf("failed to write archive segment: %w", err)
+	}
+
+	w.segment.Lines++
+	w.segment.RawBytes += int64(len(content))
+	w.segment.EndTime = timestamp
+	w.last = timestamp
+	return nil
+}
+
+// archivedBefore reports whether a line was archived before, as the lines older than the last archived
+// one and the replayed lines with its time are. Lines sharing a timestamp, such as the lines of a stack
+// trace written at once, are all kept
+func (w *segmentWriter) archivedBefore(line LogLine) bool {
+	switch {
+	case line.Timestamp.IsZero():
+		return w.skipping
+	case line.Timestamp.Before(w.last):
+		w.skipping = true
+	case w.resume == nil:
+		w.skipping = false
+	case line.Timestamp.After(w.resume.last):
+		w.resume, w.skipping = nil, false
+	default:
+		w.skipping = !w.resume.deliver(line.Timestamp, trimNewline(line.Content))
+	}
+	return w.skipping
+}
+
+// open starts a segment for lines from start on, in the time partition start falls in
+func (w *segmentWriter) open(start time.Time) error {
+	config := w.sink.archive.config
+	dir := filepath.Join(config.Dir, config.Cluster, w.sink.namespace, w.pod, w.container)
+	if err := os.MkdirAll(dir, 0o750); err != nil {
+		return fmt.Errorf("failed to create archive directory: %w", err)
+	}
+
+	// A restarted collector or a full segment may start a segment at the time of an existing one
+	name := start.UTC().Format(archiveTimeLayout)
+	var path string
+	for attempt := 0; w.file == nil; attempt++ {
+		path = filepath.Join(dir, name+archiveSegmentSuffix)
+		if attempt > 0 {
+			path = filepath.Join(dir, fmt.Sprintf("%s-%d%s", name, attempt, archiveSegmentSuffix))
+		}
+		if _, err := os.Stat(path); err == nil {
+			continue
+		}
+		file, err := os.OpenFile(path+archivePartialSuffix, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o640)
+		if errors.Is(err, fs.ErrExist) {
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("failed to create archive segment: %w", err)
+		}
+		w.file = file
+	}
+
+	w.encoder = newSegmentEncoder(w.file)
+	w.segment = models.ArchiveSegment{
+		TeamID:        w.sink.team(),
+		ClusterName:   config.Cluster,
+		Namespace:     w.sink.namespace,
+		PodName:       w.pod,
+		ContainerName: w.container,
+		StartTime:     start,
+		EndTime:       start,
+		Path:          path,
+	}
+	w.partitionEnd = start.Truncate(config.SegmentDuration).Add(config.SegmentDuration)
+	return nil
+}
+
+// roll closes the open segment, moves it into place, records it in the index and saves its full-text index
+// A segment that cannot be recorded is removed, so the archive holds no files the index does not know.
+// A full-text index that cannot be saved is rebuilt by the first search of the segment
+func (w *segmentWriter) roll() error {
+	if w.file == nil {
+		return nil
+	}
+	file, encoder, segment := w.file, w.encoder, w.segment
+	w.file, w.encoder = nil, nil
+
+	index, err := encoder.close()
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(file.Name(), segment.Path)
+	}
+	if err == nil {
+		var info os.FileInfo
+		if info, err = os.Stat(segment.Path); err == nil {
+			segment.Bytes = info.Size()
+			segment.GramFilter = index.filter()
+			err = w.sink.archive.index.AddSegment(&segment)
+		}
+	}
+	if err != nil {
+		os.Remove(file.Name())
+		os.Remove(segment.Path)
+		return fmt.Errorf("failed to close archive segment %s: %w", filepath.Base(segment.Path), err)
+	}
+	if err := writeSegmentIndex(segment.Path, index); err != nil {
+		log.Printf("Error indexing archive segment %s: %v", filepath.Base(segment.Path), err)
+	}
+	return nil
+}
+
+// readBoundary reads the last lines of a segment into resume: resume.last becomes the time of the last
+// line, unless resume holds a later one, and resume.boundary counts the lines with that time
+// Only the blocks that may hold lines from last on are read, give or take the precision the index stores
+// times with
+func (a *LogArchive) readBoundary(segment *models.ArchiveSegment, last time.Time, resume *streamResume) error {
+	index, err := a.loadIndex(segment)
+	if err != nil {
+		return err
+	}
+	since := last.Add(-time.Microsecond)
+	offset := int64(-1)
+	for _, block := range index.Blocks {
+		if block.End.IsZero() || !block.End.Before(since) {
+			offset = block.Offset
+			break
+		}
+	}
+	if offset < 0 {
+		return nil
+	}
+
+	file, err := os.Open(segment.Path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	if _, err := file.Seek(offset, io.SeekStart); err != nil {
+		return err
+	}
+	gz, err := gzip.NewReader(bufio.NewReader(file))
+	if err != nil {
+		return fmt.Errorf("failed to read archive segment %s: %w", filepath.Base(segment.Path), err)
+	}
+	defer gz.Close()
+
+	reader := bufio.NewReader(gz)
+	for {
+		raw, err := reader.ReadBytes('\n')
+		if timestamp, _ := SplitTimestamp(raw); !timestamp.IsZero() {
+			switch {
+			case timestamp.After(resume.last):
+				resume.last = timestamp
+				resume.boundary = map[string]int{string(trimNewline(raw)): 1}
+			case timestamp.Equal(resume.last):
+				resume.boundary[string(trimNewline(raw))]++
+			}
+		}
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("failed to read archive segment %s: %w", filepath.Base(segment.Path), err)
+		}
+	}
+}
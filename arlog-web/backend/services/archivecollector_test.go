@@ -0,0 +1,121 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+)
+
+// testArchiveSink returns a sink archiving the namespace shop for team 1
+func testArchiveSink(archive *LogArchive) *archiveSink {
+	return &archiveSink{archive: archive, namespace: "shop", teamID: 1, writers: map[string]*segmentWriter{}}
+}
+
+// writeArchiveLines writes raw lines, each prefixed with a timestamp, of the container api/app to sink
+func writeArchiveLines(t *testing.T, sink *archiveSink, raws []string) {
+	t.Helper()
+	for _, raw := range raws {
+		if err := sink.WriteLine(newLogLine("shop", "api", "app", []byte(raw+"\n"), true)); err != nil {
+			t.Fatalf("WriteLine(%q): %v", raw, err)
+		}
+	}
+}
+
+// readArchiveLines returns the archived lines of the container api/app
+func readArchiveLines(t *testing.T, archive *LogArchive) []string {
+	t.Helper()
+	sink := &recordingSink{}
+	if _, err := archive.ReadLogs(context.Background(), "shop", "api", "app", LogOptions{Timestamps: true}, nil, sink); err != nil {
+		t.Fatalf("ReadLogs: %v", err)
+	}
+	var lines []string
+	for _, line := range sink.recorded() {
+		lines = append(lines, strings.TrimSuffix(string(line.Content), "\n"))
+	}
+	return lines
+}
+
+func TestArchiveSinkResume(t *testing.T) {
+	const (
+		t1 = "2024-01-02T15:04:05.000000001Z "
+		t2 = "2024-01-02T15:04:06.123456789Z "
+		t3 = "2024-01-02T15:04:07.000000500Z "
+		t4 = "2024-01-02T15:04:08Z "
+	)
+	first := []string{
+		t1 + "starting",
+		t2 + "panic: runtime error",
+		t2 + "goroutine 1 [running]:",
+		t2 + "\tmain.go:12",
+		t2 + "\tmain.go:12",
+	}
+
+	tests := []struct {
+		name string
+		// restarted is written by a second sink, after the first one archived first
+		restarted []string
+		want      []string
+	}{
+		{
+			name: "no restart",
+			want: first,
+		},
+		{
+			name:      "replayed from the start",
+			restarted: append(append([]string(nil), first...), t3+"next", t4+"after"),
+			want:      append(append([]string(nil), first...), t3+"next", t4+"after"),
+		},
+		{
+			name:      "replayed from the last timestamp",
+			restarted: []string{t2 + "panic: runtime error", t2 + "goroutine 1 [running]:", t2 + "\tmain.go:12", t2 + "\tmain.go:12", t2 + "\tmain.go:12", t3 + "next"},
+			want:      append(append([]string(nil), first...), t2+"\tmain.go:12", t3+"next"),
+		},
+		{
+			name:      "resumed after the last timestamp",
+			restarted: []string{t3 + "next", t3 + "next"},
+			want:      append(append([]string(nil), first...), t3+"next", t3+"next"),
+		},
+		{
+			name:      "older lines without a timestamp",
+			restarted: []string{t1 + "starting", "  continued", t3 + "next", "  continued"},
+			want:      append(append([]string(nil), first...), t3+"next", "  continued"),
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			archive, _ := newTestArchive(t, ArchiveConfig{})
+			sink := testArchiveSink(archive)
+			writeArchiveLines(t, sink, first)
+			sink.closeAll()
+
+			if tt.restarted != nil {
+				sink = testArchiveSink(archive)
+				writeArchiveLines(t, sink, tt.restarted)
+				sink.closeAll()
+			}
+
+			got := readArchiveLines(t, archive)
+			if strings.Join(got, "\n") != strings.Join(tt.want, "\n") {
+				t.Errorf("archived lines =\n%s\nwant\n%s", strings.Join(got, "\n"), strings.Join(tt.want, "\n"))
+			}
+		})
+	}
+}
+
+func TestArchiveSinkLookupFailure(t *testing.T) {
+	archive, index := newTestArchive(t, ArchiveConfig{})
+	index.lookupErr = errors.New("database is down")
+	sink := testArchiveSink(archive)
+	writeArchiveLines(t, sink, []string{"2024-01-02T15:04:05Z dropped"})
+
+	index.lookupErr = nil
+	writeArchiveLines(t, sink, []string{"2024-01-02T15:04:06Z kept"})
+	sink.closeAll()
+
+	got := readArchiveLines(t, archive)
+	if strings.Join(got, "\n") != "2024-01-02T15:04:06Z kept" {
+		t.Errorf("archived lines = %q, want only the line written after the lookup succeeded", got)
+	}
+}
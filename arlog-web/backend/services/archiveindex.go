@@ -0,0 +1,531 @@
+package services
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"container/list"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"arlog/backend/models"
+)
+
+const (
+	// archiveBlockBytes is the uncompressed size after which a segment starts a new block
+	archiveBlockBytes = 64 * 1024
+	// archiveIndexSuffix replaces archiveSegmentSuffix in the name of a segment's index file
+	archiveIndexSuffix = ".idx"
+	// archiveIndexCacheSize is the number of segment indexes kept in memory
+	archiveIndexCacheSize = 256
+	// gramFilterBitsPerGram, gramFilterMinBytes and gramFilterMaxBytes size a segment's trigram filter;
+	// each trigram sets gramFilterHashes bits
+	gramFilterBitsPerGram = 8
+	gramFilterMinBytes    = 64
+	gramFilterMaxBytes    = 64 * 1024
+	gramFilterHashes      = 3
+)
+
+// segmentIndex is the full-text index of a segment file
+// A segment is a sequence of gzip members, called blocks, each holding about archiveBlockBytes of lines.
+// The index maps every trigram of the lower-cased lines to the blocks containing it, so a search only
+// decompresses the blocks that may hold a match
+type segmentIndex struct {
+	// Size is the size of the segment file the index was built from
+	Size   int64
+	Blocks []indexBlock
+	// Grams are the trigrams in ascending order; the blocks of Grams[i] are Postings[Starts[i]:Starts[i+1]]
+	Grams    []uint32
+	Starts   []uint32
+	Postings []uint32
+}
+
+// indexBlock locates a block in its segment file and records the time range of its lines
+type indexBlock struct {
+	Offset int64
+	Lines  int64
+	Start  time.Time
+	End    time.Time
+}
+
+// candidates returns which blocks may hold lines matching node
+// Only words and phrases are looked up; regular expressions, fields and negations rule out no block
+func (x *segmentIndex) candidates(node queryNode) []bool {
+	switch node := node.(type) {
+	case andNode:
+		result := x.allBlocks(true)
+		for _, child := range node {
+			for i, candidate := range x.candidates(child) {
+				result[i] = result[i] && candidate
+			}
+		}
+		return result
+	case orNode:
+		result := x.allBlocks(false)
+		for _, child := range node {
+			for i, candidate := range x.candidates(child) {
+				result[i] = result[i] || candidate
+			}
+		}
+		return result
+	case textNode:
+		return x.textCandidates(node.lower)
+	}
+	return x.allBlocks(true)
+}
+
+// textCandidates returns the blocks holding every trigram of text, which was lower-cased
+// Text shorter than a trigram cannot be looked up and rules out no block
+func (x *segmentIndex) textCandidates(text []byte) []bool {
+	if len(text) < 3 {
+		return x.allBlocks(true)
+	}
+
+	grams := make(map[uint32]struct{})
+	forEachGram(text, func(gram uint32) {
+		grams[gram] = struct{}{}
+	})
+	counts := make([]int, len(x.Blocks))
+	for gram := range grams {
+		i := sort.Search(len(x.Grams), func(i int) bool { return x.Grams[i] >= gram })
+		if i == len(x.Grams) || x.Grams[i] != gram {
+			return x.allBlocks(false)
+		}
+		for _, block := range x.Postings[x.Starts[i]:x.Starts[i+1]] {
+			counts[block]++
+		}
+	}
+
+	result := make([]bool, len(x.Blocks))
+	for i, count := range counts {
+		result[i] = count == len(grams)
+	}
+	return result
+}
+
+func (x *segmentIndex) allBlocks(value bool) []bool {
+	result := make([]bool, len(x.Blocks))
+	if value {
+		for i := range result {
+			result[i] = true
+		}
+	}
+	return result
+}
+
+// gramFilter is a Bloom filter of the trigrams of a segment, kept with its index entry
+// A search checks it before loading the segment's index, so segments that cannot hold a match are skipped
+// without opening a file. Its size is a power of two
+type gramFilter []byte
+
+// filter returns the trigram filter of the segment
+func (x *segmentIndex) filter() gramFilter {
+	size := gramFilterMinBytes
+	for size*8 < len(x.Grams)*gramFilterBitsPerGram && size < gramFilterMaxBytes {
+		size *= 2
+	}
+	filter := make(gramFilter, size)
+	for _, gram := range x.Grams {
+		filter.forEachBit(gram, func(bit uint32) {
+			filter[bit/8] |= 1 << (bit % 8)
+		})
+	}
+	return filter
+}
+
+// forEachBit calls fn with each bit of the filter that stands for gram, by double hashing
+func (f gramFilter) forEachBit(gram uint32, fn func(bit uint32)) {
+	mask := uint32(len(f)*8 - 1)
+	h1 := mixGram(gram)
+	h2 := mixGram(h1) | 1
+	for i := uint32(0); i < gramFilterHashes; i++ {
+		fn((h1 + i*h2) & mask)
+	}
+}
+
+// mixGram is the 32-bit finalizer of MurmurHash3, which spreads the bits of a trigram
+func mixGram(h uint32) uint32 {
+	h ^= h >> 16
+	h *= 0x85ebca6b
+	h ^= h >> 13
+	h *= 0xc2b2ae35
+	h ^= h >> 16
+	return h
+}
+
+// mayMatch reports whether a segment whose trigrams went into the filter may hold lines matching node
+// It looks up what segmentIndex.candidates does. An empty filter rules out nothing
+func (f gramFilter) mayMatch(node queryNode) bool {
+	if len(f) == 0 {
+		return true
+	}
+	switch node := node.(type) {
+	case andNode:
+		for _, child := range node {
+			if !f.mayMatch(child) {
+				return false
+			}
+		}
+		return true
+	case orNode:
+		for _, child := range node {
+			if f.mayMatch(child) {
+				return true
+			}
+		}
+		return false
+	case textNode:
+		found := true
+		forEachGram(node.lower, func(gram uint32) {
+			f.forEachBit(gram, func(bit uint32) {
+				found = found && f[bit/8]&(1<<(bit%8)) != 0
+			})
+		})
+		return found
+	}
+	return true
+}
+
+// forEachGram calls fn with every trigram of text
+func forEachGram(text []byte, fn func(gram uint32)) {
+	for i := 0; i+3 <= len(text); i++ {
+		fn(uint32(text[i])<<16 | uint32(text[i+1])<<8 | uint32(text[i+2]))
+	}
+}
+
+// segmentIndexBuilder builds the index of a segment as its blocks are written or read
+type segmentIndexBuilder struct {
+	blocks   []indexBlock
+	postings map[uint32][]uint32
+}
+
+func newSegmentIndexBuilder() *segmentIndexBuilder {
+	return &segmentIndexBuilder{postings: make(map[uint32][]uint32)}
+}
+
+// startBlock begins a block at offset in the segment file
+func (b *segmentIndexBuilder) startBlock(offset int64) {
+	b.blocks = append(b.blocks, indexBlock{Offset: offset})
+}
+
+// addLine indexes a line of the current block; the line carries its timestamp prefix
+func (b *segmentIndexBuilder) addLine(raw []byte) {
+	timestamp, content := SplitTimestamp(raw)
+	number := uint32(len(b.blocks) - 1)
+	block := &b.blocks[number]
+	block.Lines++
+	if !timestamp.IsZero() {
+		if block.Start.IsZero() {
+			block.Start = timestamp
+		}
+		block.End = timestamp
+	}
+
+	// Lines are matched without their line ending, so the index leaves it out too
+	forEachGram(bytes.ToLower(bytes.TrimRight(content, "\r\n")), func(gram uint32) {
+		blocks := b.postings[gram]
+		if n := len(blocks); n == 0 || blocks[n-1] != number {
+			b.postings[gram] = append(blocks, number)
+		}
+	})
+}
+
+// finish returns the index of a segment file of size bytes
+func (b *segmentIndexBuilder) finish(size int64) *segmentIndex {
+	index := &segmentIndex{
+		Size:   size,
+		Blocks: b.blocks,
+		Grams:  make([]uint32, 0, len(b.postings)),
+		Starts: make([]uint32, 0, len(b.postings)+1),
+	}
+	for gram := range b.postings {
+		index.Grams = append(index.Grams, gram)
+	}
+	sort.Slice(index.Grams, func(i, j int) bool { return index.Grams[i] < index.Grams[j] })
+	for _, gram := range index.Grams {
+		index.Starts = append(index.Starts, uint32(len(index.Postings)))
+		index.Postings = append(index.Postings, b.postings[gram]...)
+	}
+	index.Starts = append(index.Starts, uint32(len(index.Postings)))
+	return index
+}
+
+// segmentEncoder writes lines to a segment file as gzip blocks and indexes them
+// Readers that ignore the blocks see an ordinary multi-member gzip file
+type segmentEncoder struct {
+	out        *countingWriter
+	gz         *gzip.Writer
+	blockOpen  bool
+	blockBytes int
+	index      *segmentIndexBuilder
+}
+
+func newSegmentEncoder(w io.Writer) *segmentEncoder {
+	return &segmentEncoder{out: &countingWriter{w: w}, index: newSegmentIndexBuilder()}
+}
+
+// write appends a line, which must end with a newline, starting a new block when the current one is full
+func (e *segmentEncoder) write(raw []byte) error {
+	if !e.blockOpen {
+		e.index.startBlock(e.out.n)
+		if e.gz == nil {
+			e.gz = gzip.NewWriter(e.out)
+		} else {
+			e.gz.Reset(e.out)
+		}
+		e.blockOpen = true
+		e.blockBytes = 0
+	}
+
+	if _, err := e.gz.Write(raw); err != nil {
+		return err
+	}
+	e.index.addLine(raw)
+	e.blockBytes += len(raw)
+	if e.blockBytes >= archiveBlockBytes {
+		e.blockOpen = false
+		return e.gz.Close()
+	}
+	return nil
+}
+
+// close ends the last block and returns the index of the segment
+func (e *segmentEncoder) close() (*segmentIndex, error) {
+	if e.blockOpen {
+		e.blockOpen = false
+		if err := e.gz.Close(); err != nil {
+			return nil, err
+		}
+	}
+	return e.index.finish(e.out.n), nil
+}
+
+// countingWriter counts the bytes written through it
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// countingReader counts the bytes read through it
+// It is a byte reader, so gzip reads exactly up to the end of each member and the count gives the offset
+// of the next one
+type countingReader struct {
+	r *bufio.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
+
+func (c *countingReader) ReadByte() (byte, error) {
+	b, err := c.r.ReadByte()
+	if err == nil {
+		c.n++
+	}
+	return b, err
+}
+
+// indexPath returns the path of the index file of a segment
+func indexPath(segmentPath string) string {
+	return strings.TrimSuffix(segmentPath, archiveSegmentSuffix) + archiveIndexSuffix
+}
+
+// writeSegmentIndex saves the index of a segment next to it
+// The index is written to a temporary file carrying the partial suffix and moved into place
+func writeSegmentIndex(segmentPath string, index *segmentIndex) error {
+	path := indexPath(segmentPath)
+	temp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*"+archivePartialSuffix)
+	if err != nil {
+		return fmt.Errorf("failed to create segment index: %w", err)
+	}
+	defer os.Remove(temp.Name())
+	defer temp.Close()
+
+	gz := gzip.NewWriter(temp)
+	err = gob.NewEncoder(gz).Encode(index)
+	if err == nil {
+		err = gz.Close()
+	}
+	if err == nil {
+		err = temp.Close()
+	}
+	if err == nil {
+		err = os.Rename(temp.Name(), path)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to write segment index: %w", err)
+	}
+	return nil
+}
+
+// readSegmentIndex loads the index file of a segment
+func readSegmentIndex(segmentPath string) (*segmentIndex, error) {
+	file, err := os.Open(indexPath(segmentPath))
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	gz, err := gzip.NewReader(file)
+	if err != nil {
+		return nil, err
+	}
+	defer gz.Close()
+
+	var index segmentIndex
+	if err := gob.NewDecoder(gz).Decode(&index); err != nil {
+		return nil, err
+	}
+	return &index, nil
+}
+
+// buildSegmentIndex indexes a segment file by reading it, taking each of its gzip members as a block
+// Segments written before they were indexed are a single member, and so a single block
+func buildSegmentIndex(segmentPath string) (*segmentIndex, error) {
+	file, err := os.Open(segmentPath)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	counter := &countingReader{r: bufio.NewReader(file)}
+	gz, err := gzip.NewReader(counter)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read archive segment %s: %w", filepath.Base(segmentPath), err)
+	}
+	defer gz.Close()
+
+	builder := newSegmentIndexBuilder()
+	var offset int64
+	for {
+		gz.Multistream(false)
+		builder.startBlock(offset)
+		reader := bufio.NewReader(gz)
+		for {
+			raw, err := reader.ReadBytes('\n')
+			if len(raw) > 0 {
+				builder.addLine(raw)
+			}
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				return nil, fmt.Errorf("failed to read archive segment %s: %w", filepath.Base(segmentPath), err)
+			}
+		}
+
+		offset = counter.n
+		if err := gz.Reset(counter); err == io.EOF {
+			return builder.finish(offset), nil
+		} else if err != nil {
+			return nil, fmt.Errorf("failed to read archive segment %s: %w", filepath.Base(segmentPath), err)
+		}
+	}
+}
+
+// loadIndex returns the index of a segment from the cache or its index file
+// An index that is missing or was built from an earlier version of the segment, before it was downsampled
+// for instance, is rebuilt from the segment and saved
+func (a *LogArchive) loadIndex(segment *models.ArchiveSegment) (*segmentIndex, error) {
+	if index := a.indexes.get(segment.Path); index != nil && index.Size == segment.Bytes {
+		return index, nil
+	}
+
+	index, err := readSegmentIndex(segment.Path)
+	if err != nil || index.Size != segment.Bytes {
+		if index, err = buildSegmentIndex(segment.Path); err != nil {
+			return nil, err
+		}
+		if err := writeSegmentIndex(segment.Path, index); err != nil {
+			// The index still serves this search, and is built again for the next
+			log.Printf("Error saving the index of archive segment %s: %v", filepath.Base(segment.Path), err)
+		}
+	}
+	a.indexes.put(segment.Path, index)
+	return index, nil
+}
+
+// removeIndex deletes the index file of a segment and forgets its cached index
+func (a *LogArchive) removeIndex(segmentPath string) error {
+	a.indexes.remove(segmentPath)
+	if err := os.Remove(indexPath(segmentPath)); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	return nil
+}
+
+// indexCache keeps the most recently used segment indexes in memory
+type indexCache struct {
+	mu      sync.Mutex
+	size    int
+	order   *list.List
+	entries map[string]*list.Element
+}
+
+// indexCacheEntry is an element of indexCache.order, most recently used first
+type indexCacheEntry struct {
+	path  string
+	index *segmentIndex
+}
+
+func newIndexCache(size int) *indexCache {
+	return &indexCache{size: size, order: list.New(), entries: make(map[string]*list.Element)}
+}
+
+func (c *indexCache) get(path string) *segmentIndex {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	element, exists := c.entries[path]
+	if !exists {
+		return nil
+	}
+	c.order.MoveToFront(element)
+	return element.Value.(*indexCacheEntry).index
+}
+
+func (c *indexCache) put(path string, index *segmentIndex) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if element, exists := c.entries[path]; exists {
+		element.Value.(*indexCacheEntry).index = index
+		c.order.MoveToFront(element)
+		return
+	}
+	c.entries[path] = c.order.PushFront(&indexCacheEntry{path: path, index: index})
+	if c.order.Len() > c.size {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.entries, oldest.Value.(*indexCacheEntry).path)
+	}
+}
+
+func (c *indexCache) remove(path string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if element, exists := c.entries[path]; exists {
+		c.order.Remove(element)
+		delete(c.entries, path)
+	}
+}
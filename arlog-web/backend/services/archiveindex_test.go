@@ -0,0 +1,228 @@
+package services
+
+import (
+	"fmt"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// testSegmentIndex indexes blocks of lines, each prefixed with a timestamp
+func testSegmentIndex(blocks [][]string) *segmentIndex {
+	builder := newSegmentIndexBuilder()
+	for i, block := range blocks {
+		builder.startBlock(int64(i))
+		for _, text := range block {
+			builder.addLine([]byte("2024-01-02T15:04:05Z " + text + "\n"))
+		}
+	}
+	return builder.finish(int64(len(blocks)))
+}
+
+func TestSegmentIndexCandidates(t *testing.T) {
+	blocks := [][]string{
+		{"GET /api/orders 200", "payment accepted"},
+		{"ERROR payment failed: connection reset", "retrying"},
+		{"WARN disk almost full", "level=error msg=timeout"},
+		{"a b", "ok"},
+	}
+	index := testSegmentIndex(blocks)
+
+	tests := []struct {
+		query string
+		// want lists the candidate blocks
+		want string
+	}{
+		{"payment", "0,1"},
+		{"PAYMENT", "0,1"},
+		{`"payment failed"`, "1"},
+		{`"failed payment"`, ""},
+		{"nowhere", ""},
+		{"payment disk", ""},
+		{"payment OR disk", "0,1,2"},
+		{"nowhere OR disk", "2"},
+		{"(payment OR disk) error", "1,2"},
+		// Negations rule out nothing on their own, and only narrow nothing inside AND
+		{"NOT payment", "0,1,2,3"},
+		{"-payment", "0,1,2,3"},
+		{"payment -failed", "0,1"},
+		{"-(payment OR disk)", "0,1,2,3"},
+		{"nowhere OR NOT disk", "0,1,2,3"},
+		// Words shorter than a trigram cannot be looked up
+		{"ok", "0,1,2,3"},
+		{"a", "0,1,2,3"},
+		{"ok payment", "0,1"},
+		{"ok OR nowhere", "0,1,2,3"},
+		// Regular expressions and fields cannot be looked up either
+		{"/pay.*failed/", "0,1,2,3"},
+		{"level:error", "0,1,2,3"},
+		{"level:error timeout", "2"},
+		// The timestamp prefix is not indexed
+		{"2024", ""},
+	}
+
+	for _, tt := range tests {
+		query, err := ParseLogQuery(tt.query)
+		if err != nil {
+			t.Fatalf("ParseLogQuery(%q): %v", tt.query, err)
+		}
+		candidates := index.candidates(query.root)
+
+		var got []string
+		for i, candidate := range candidates {
+			if candidate {
+				got = append(got, fmt.Sprint(i))
+			}
+		}
+		if strings.Join(got, ",") != tt.want {
+			t.Errorf("candidates of %q = [%s], want [%s]", tt.query, strings.Join(got, ","), tt.want)
+		}
+
+		// A block holding a matching line must never be ruled out
+		for i, block := range blocks {
+			for _, text := range block {
+				if queryMatches(query, text) && !candidates[i] {
+					t.Errorf("%q rules out block %d, which holds the match %q", tt.query, i, text)
+				}
+			}
+		}
+	}
+}
+
+func TestGramFilterMayMatch(t *testing.T) {
+	blocks := [][]string{
+		{"GET /api/orders 200", "payment accepted"},
+		{"ERROR payment failed: connection reset", "WARN disk almost full"},
+	}
+	filter := testSegmentIndex(blocks).filter()
+
+	tests := []struct {
+		query string
+		want  bool
+	}{
+		{"payment", true},
+		{"PAYMENT", true},
+		{`"payment failed"`, true},
+		{"nowhere", false},
+		{"payment nowhere", false},
+		{"payment OR nowhere", true},
+		{"nowhere OR elsewhere", false},
+		// Across blocks: the filter holds the trigrams of the whole segment
+		{"orders disk", true},
+		// Negations, short words, regular expressions and fields rule out nothing
+		{"NOT payment", true},
+		{"-nowhere", true},
+		{"ok", true},
+		{"/nowhere/", true},
+		{"level:error", true},
+		{"level:error nowhere", false},
+	}
+
+	for _, tt := range tests {
+		query, err := ParseLogQuery(tt.query)
+		if err != nil {
+			t.Fatalf("ParseLogQuery(%q): %v", tt.query, err)
+		}
+		if got := filter.mayMatch(query.root); got != tt.want {
+			t.Errorf("mayMatch(%q) = %v, want %v", tt.query, got, tt.want)
+		}
+	}
+
+	// A segment without a filter is never ruled out
+	query, _ := ParseLogQuery("nowhere")
+	if !gramFilter(nil).mayMatch(query.root) {
+		t.Errorf("an empty filter rules out %q", "nowhere")
+	}
+}
+
+// benchmarkSegment writes a segment of about rawBytes of varied log lines to dir and returns its path
+// and index
+func benchmarkSegment(b *testing.B, dir string, rawBytes int) (string, *segmentIndex) {
+	b.Helper()
+	path := filepath.Join(dir, "segment"+archiveSegmentSuffix)
+	file, err := os.Create(path)
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer file.Close()
+
+	random := rand.New(rand.NewSource(1))
+	paths := []string{"orders", "payments", "users", "carts", "inventory", "search", "sessions"}
+	levels := []string{"debug", "info", "info", "info", "warn", "error"}
+	encoder := newSegmentEncoder(file)
+	for written := 0; written < rawBytes; {
+		line := fmt.Sprintf("2024-01-02T15:%02d:%02d.%06dZ level=%s msg=\"request done\" method=GET path=/api/%s/%d status=%d duration=%dms trace=%016x\n",
+			written/1e6%60, written/1e4%60, random.Intn(1e6), levels[random.Intn(len(levels))],
+			paths[random.Intn(len(paths))], random.Intn(1e6), 200+100*random.Intn(4), random.Intn(2000), random.Uint64())
+		if err := encoder.write([]byte(line)); err != nil {
+			b.Fatal(err)
+		}
+		written += len(line)
+	}
+	index, err := encoder.close()
+	if err != nil {
+		b.Fatal(err)
+	}
+	if err := writeSegmentIndex(path, index); err != nil {
+		b.Fatal(err)
+	}
+	return path, index
+}
+
+// BenchmarkSegmentIndexCandidates looks up queries in the index of a full 16MB segment
+func BenchmarkSegmentIndexCandidates(b *testing.B) {
+	_, index := benchmarkSegment(b, b.TempDir(), int(DefaultArchiveSegmentBytes))
+	for _, source := range []string{
+		"payments",
+		`"status=500" payments`,
+		"deadbeefcafe",
+		"payments OR inventory OR sessions",
+		"NOT payments",
+		"ok",
+		"level:error",
+	} {
+		query, err := ParseLogQuery(source)
+		if err != nil {
+			b.Fatal(err)
+		}
+		b.Run(source, func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				index.candidates(query.root)
+			}
+		})
+	}
+}
+
+// BenchmarkGramFilterMayMatch looks up queries in the trigram filter of a full 16MB segment
+func BenchmarkGramFilterMayMatch(b *testing.B) {
+	_, index := benchmarkSegment(b, b.TempDir(), int(DefaultArchiveSegmentBytes))
+	filter := index.filter()
+	for _, source := range []string{"payments", "deadbeefcafe", "payments OR inventory OR sessions"} {
+		query, err := ParseLogQuery(source)
+		if err != nil {
+			b.Fatal(err)
+		}
+		b.Run(source, func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				filter.mayMatch(query.root)
+			}
+		})
+	}
+}
+
+// BenchmarkReadSegmentIndex loads the index file of a segment, as a search does on an index cache miss
+func BenchmarkReadSegmentIndex(b *testing.B) {
+	for _, mb := range []int{1, 16} {
+		b.Run(fmt.Sprintf("%dMB", mb), func(b *testing.B) {
+			path, _ := benchmarkSegment(b, b.TempDir(), mb*1024*1024)
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if _, err := readSegmentIndex(path); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
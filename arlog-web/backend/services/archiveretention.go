@@ -0,0 +1,410 @@
+package services
+
+import (
+	"bufio"
+	"compress/gzip"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+
+	"arlog/backend/models"
+)
+
+// compactionBatchSize is the number of segments loaded at a time while enforcing a policy
+const compactionBatchSize = 500
+
+// RetentionUnlimited is the MaxAgeDays or MaxBytes of a team that opted out of the limit
+const RetentionUnlimited = -1
+
+// RetentionPolicy limits the archived logs a team keeps
+type RetentionPolicy struct {
+	TeamID   uint   `json:"teamId"`
+	TeamName string `json:"teamName"`
+	// MaxAgeDays is how many days a segment is kept after its last line; 0 uses the server default and
+	// RetentionUnlimited keeps segments regardless of age
+	MaxAgeDays int `json:"maxAgeDays"`
+	// MaxBytes caps the compressed size of the team's segments; 0 uses the server default and
+	// RetentionUnlimited means no cap
+	MaxBytes int64 `json:"maxBytes"`
+	// LegalHold keeps every segment of the team regardless of the limits
+	LegalHold bool `json:"legalHold"`
+}
+
+// ArchiveUsage is the size of a team's archived logs
+type ArchiveUsage struct {
+	Segments int64      `json:"segments"`
+	Bytes    int64      `json:"bytes"`
+	RawBytes int64      `json:"rawBytes"`
+	Oldest   *time.Time `json:"oldest,omitempty"`
+}
+
+// SegmentQuery selects the segments of a team to compact
+type SegmentQuery struct {
+	Cluster string
+	TeamID  uint
+	// EndedBefore, if set, only selects segments whose last line is older
+	EndedBefore time.Time
+	// SkipDownsampled leaves out segments that were downsampled already
+	SkipDownsampled bool
+	Limit           int
+}
+
+// TeamArchiveUsage is a team's retention policy, with the server defaults applied, and its archived logs
+type TeamArchiveUsage struct {
+	Policy RetentionPolicy `json:"policy"`
+	Usage  ArchiveUsage    `json:"usage"`
+}
+
+// TeamCompaction reports what a compaction run did with a team's segments; Usage is taken after the run
+type TeamCompaction struct {
+	TeamArchiveUsage
+	DeletedSegments     int64  `json:"deletedSegments"`
+	DownsampledSegments int64  `json:"downsampledSegments"`
+	ReclaimedBytes      int64  `json:"reclaimedBytes"`
+	Error               string `json:"error,omitempty"`
+}
+
+// CompactionReport is the outcome of a compaction run
+type CompactionReport struct {
+	StartedAt      time.Time        `json:"startedAt"`
+	FinishedAt     time.Time        `json:"finishedAt"`
+	ReclaimedBytes int64            `json:"reclaimedBytes"`
+	Teams          []TeamCompaction `json:"teams"`
+}
+
+// RunCompaction enforces the retention policies every CompactionInterval until ctx is cancelled
+func (a *LogArchive) RunCompaction(ctx context.Context) {
+	ticker := time.NewTicker(a.config.CompactionInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			report, err := a.Compact(ctx)
+			if err != nil {
+				log.Printf("Error compacting the log archive: %v", err)
+				continue
+			}
+			if report.ReclaimedBytes > 0 {
+				log.Printf("Log archive compaction reclaimed %d bytes", report.ReclaimedBytes)
+			}
+		}
+	}
+}
+
+// Compact enforces every team's retention policy once
+// Segments older than the policy's maximum age are deleted. A team over its size cap has its oldest
+// segments downsampled to the lines of warning level and above and, if it is still over, deleted oldest
+// first. Teams under legal hold are left alone. An error with one team is recorded in its report and
+// does not stop the others
+func (a *LogArchive) Compact(ctx context.Context) (*CompactionReport, error) {
+	a.compactMu.Lock()
+	defer a.compactMu.Unlock()
+
+	policies, err := a.policies()
+	if err != nil {
+		return nil, err
+	}
+
+	report := &CompactionReport{StartedAt: time.Now().UTC(), Teams: make([]TeamCompaction, 0, len(policies))}
+	for _, policy := range policies {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		team := a.compactTeam(ctx, policy, report.StartedAt)
+		report.ReclaimedBytes += team.ReclaimedBytes
+		report.Teams = append(report.Teams, team)
+	}
+	report.FinishedAt = time.Now().UTC()
+
+	a.mu.Lock()
+	a.lastCompaction = report
+	a.mu.Unlock()
+	return report, nil
+}
+
+// LastCompaction returns the report of the last compaction run, or nil if none has run yet
+func (a *LogArchive) LastCompaction() *CompactionReport {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.lastCompaction
+}
+
+// Usage returns every team's retention policy and the archived logs it holds
+func (a *LogArchive) Usage() ([]TeamArchiveUsage, error) {
+	policies, err := a.policies()
+	if err != nil {
+		return nil, err
+	}
+
+	teams := make([]TeamArchiveUsage, 0, len(policies))
+	for _, policy := range policies {
+		usage, err := a.index.TeamUsage(a.config.Cluster, policy.TeamID)
+		if err != nil {
+			return nil, fmt.Errorf("failed to measure the archive of team %s: %w", policy.TeamName, err)
+		}
+		teams = append(teams, TeamArchiveUsage{Policy: policy, Usage: usage})
+	}
+	return teams, nil
+}
+
+// policies returns the teams' retention policies with the server defaults applied
+// A limit left at 0 takes the server default, and becomes RetentionUnlimited if the default is no limit
+func (a *LogArchive) policies() ([]RetentionPolicy, error) {
+	policies, err := a.index.RetentionPolicies()
+	if err != nil {
+		return nil, fmt.Errorf("failed to load retention policies: %w", err)
+	}
+	for i := range policies {
+		if policies[i].MaxAgeDays == 0 {
+			policies[i].MaxAgeDays = a.config.RetentionDays
+		}
+		if policies[i].MaxAgeDays <= 0 {
+			policies[i].MaxAgeDays = RetentionUnlimited
+		}
+		if policies[i].MaxBytes == 0 {
+			policies[i].MaxBytes = a.config.RetentionMaxBytes
+		}
+		if policies[i].MaxBytes <= 0 {
+			policies[i].MaxBytes = RetentionUnlimited
+		}
+	}
+	return policies, nil
+}
+
+// Retention returns how far back the archive may hold logs, or 0 if some team keeps them regardless of age
+// Segments are deleted by the first compaction after their last line ages out, so a segment and a
+// compaction interval are added to the longest age limit of any team
+func (a *LogArchive) Retention() (time.Duration, error) {
+	policies, err := a.policies()
+	if err != nil {
+		return 0, err
+	}
+	longest := 0
+	for _, policy := range policies {
+		if policy.LegalHold || policy.MaxAgeDays == RetentionUnlimited {
+			return 0, nil
+		}
+		if policy.MaxAgeDays > longest {
+			longest = policy.MaxAgeDays
+		}
+	}
+	return time.Duration(longest)*24*time.Hour + a.config.SegmentDuration + a.config.CompactionInterval, nil
+}
+
+// compactTeam enforces one team's policy and reports the outcome
+func (a *LogArchive) compactTeam(ctx context.Context, policy RetentionPolicy, now time.Time) TeamCompaction {
+	result := TeamCompaction{TeamArchiveUsage: TeamArchiveUsage{Policy: policy}}
+
+	err := a.enforce(ctx, policy, now, &result)
+	usage, usageErr := a.index.TeamUsage(a.config.Cluster, policy.TeamID)
+	if err == nil {
+		err = usageErr
+	}
+	result.Usage = usage
+	if err != nil {
+		log.Printf("Error enforcing the archive retention of team %s: %v", policy.TeamName, err)
+		result.Error = err.Error()
+	}
+	return result
+}
+
+// enforce applies the age limit and then the size cap of policy, recording what it did in result
+func (a *LogArchive) enforce(ctx context.Context, policy RetentionPolicy, now time.Time, result *TeamCompaction) error {
+	if policy.LegalHold {
+		return nil
+	}
+
+	if policy.MaxAgeDays > 0 {
+		expired := SegmentQuery{
+			Cluster:     a.config.Cluster,
+			TeamID:      policy.TeamID,
+			EndedBefore: now.AddDate(0, 0, -policy.MaxAgeDays),
+			Limit:       compactionBatchSize,
+		}
+		if err := a.deleteOldest(ctx, expired, result, func() bool { return true }); err != nil {
+			return err
+		}
+	}
+
+	if policy.MaxBytes <= 0 {
+		return nil
+	}
+	usage, err := a.index.TeamUsage(a.config.Cluster, policy.TeamID)
+	if err != nil {
+		return err
+	}
+	if usage.Bytes <= policy.MaxBytes {
+		return nil
+	}
+	// The cap is met once this much has been reclaimed in total
+	target := result.ReclaimedBytes + usage.Bytes - policy.MaxBytes
+	over := func() bool { return result.ReclaimedBytes < target }
+
+	full := SegmentQuery{Cluster: a.config.Cluster, TeamID: policy.TeamID, SkipDownsampled: true, Limit: compactionBatchSize}
+	for over() {
+		segments, err := a.index.OldestSegments(full)
+		if err != nil {
+			return err
+		}
+		for i := 0; i < len(segments) && over(); i++ {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+			reclaimed, deleted, err := a.downsample(&segments[i])
+			if err != nil {
+				return err
+			}
+			result.ReclaimedBytes += reclaimed
+			if deleted {
+				result.DeletedSegments++
+			} else {
+				result.DownsampledSegments++
+			}
+		}
+		if len(segments) < full.Limit {
+			break
+		}
+	}
+
+	oldest := SegmentQuery{Cluster: a.config.Cluster, TeamID: policy.TeamID, Limit: compactionBatchSize}
+	return a.deleteOldest(ctx, oldest, result, over)
+}
+
+// deleteOldest deletes the segments selected by query, oldest first, as long as more reports true
+func (a *LogArchive) deleteOldest(ctx context.Context, query SegmentQuery, result *TeamCompaction, more func() bool) error {
+	for more() {
+		segments, err := a.index.OldestSegments(query)
+		if err != nil {
+			return err
+		}
+		for i := 0; i < len(segments) && more(); i++ {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+			if err := a.deleteSegment(&segments[i]); err != nil {
+				return err
+			}
+			result.DeletedSegments++
+			result.ReclaimedBytes += segments[i].Bytes
+		}
+		if len(segments) < query.Limit {
+			return nil
+		}
+	}
+	return nil
+}
+
+// deleteSegment removes a segment's file and full-text index, and then its index entry
+// A file that is already gone is not an error, so an entry left behind by a failed run is cleaned up
+func (a *LogArchive) deleteSegment(segment *models.ArchiveSegment) error {
+	if err := os.Remove(segment.Path); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return fmt.Errorf("failed to delete archive segment: %w", err)
+	}
+	if err := a.removeIndex(segment.Path); err != nil {
+		return fmt.Errorf("failed to delete archive segment: %w", err)
+	}
+	if err := a.index.DeleteSegment(segment); err != nil {
+		return fmt.Errorf("failed to delete archive segment: %w", err)
+	}
+	return nil
+}
+
+// downsample rewrites a segment with only its lines of warning level and above, along with the lines
+// without a level that follow them, such as stack traces. A segment left without lines is deleted
+// It returns the bytes reclaimed and whether the segment was deleted
+func (a *LogArchive) downsample(segment *models.ArchiveSegment) (int64, bool, error) {
+	source, err := os.Open(segment.Path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return segment.Bytes, true, a.deleteSegment(segment)
+	}
+	if err != nil {
+		return 0, false, fmt.Errorf("failed to open archive segment: %w", err)
+	}
+	defer source.Close()
+
+	gzr, err := gzip.NewReader(source)
+	if err != nil {
+		return 0, false, fmt.Errorf("failed to read archive segment %s: %w", filepath.Base(segment.Path), err)
+	}
+	defer gzr.Close()
+
+	// The temporary file carries the partial suffix, so one left behind is removed on the next start
+	temp, err := os.CreateTemp(filepath.Dir(segment.Path), filepath.Base(segment.Path)+".*"+archivePartialSuffix)
+	if err != nil {
+		return 0, false, fmt.Errorf("failed to create archive segment: %w", err)
+	}
+	defer os.Remove(temp.Name())
+	defer temp.Close()
+
+	encoder := newSegmentEncoder(temp)
+	var lines, rawBytes int64
+	keep := false
+	reader := bufio.NewReader(gzr)
+	for {
+		raw, readErr := reader.ReadBytes('\n')
+		if len(raw) > 0 {
+			switch level := DetectLevel(raw); {
+			case level >= LevelWarn:
+				keep = true
+			case level != LevelUnknown:
+				keep = false
+			}
+			if keep {
+				if err := encoder.write(raw); err != nil {
+					return 0, false, fmt.Errorf("failed to write archive segment: %w", err)
+				}
+				lines++
+				rawBytes += int64(len(raw))
+			}
+		}
+		if readErr == io.EOF {
+			break
+		}
+		if readErr != nil {
+			return 0, false, fmt.Errorf("failed to read archive segment %s: %w", filepath.Base(segment.Path), readErr)
+		}
+	}
+	index, err := encoder.close()
+	if err != nil {
+		return 0, false, fmt.Errorf("failed to write archive segment: %w", err)
+	}
+	if err := temp.Close(); err != nil {
+		return 0, false, fmt.Errorf("failed to write archive segment: %w", err)
+	}
+
+	if lines == 0 {
+		return segment.Bytes, true, a.deleteSegment(segment)
+	}
+
+	info, err := os.Stat(temp.Name())
+	if err != nil {
+		return 0, false, fmt.Errorf("failed to write archive segment: %w", err)
+	}
+	if err := os.Rename(temp.Name(), segment.Path); err != nil {
+		return 0, false, fmt.Errorf("failed to replace archive segment: %w", err)
+	}
+	// The index of the previous file no longer matches its size, so a search rebuilds it if this fails
+	if err := writeSegmentIndex(segment.Path, index); err != nil {
+		log.Printf("Error indexing archive segment %s: %v", filepath.Base(segment.Path), err)
+	}
+
+	reclaimed := segment.Bytes - info.Size()
+	segment.Lines = lines
+	segment.RawBytes = rawBytes
+	segment.Bytes = info.Size()
+	segment.Downsampled = true
+	segment.GramFilter = index.filter()
+	if err := a.index.UpdateSegment(segment); err != nil {
+		return 0, false, fmt.Errorf("failed to update archive segment: %w", err)
+	}
+	return reclaimed, false, nil
+}
@@ -0,0 +1,314 @@
+package services
+
+import (
+	"compress/gzip"
+	"context"
+	"io"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"arlog/backend/models"
+)
+
+func TestLogArchiveRetention(t *testing.T) {
+	day := 24 * time.Hour
+	slack := DefaultArchiveSegmentDuration + DefaultCompactionInterval
+	tests := []struct {
+		name          string
+		retentionDays int
+		policies      []RetentionPolicy
+		want          time.Duration
+	}{
+		{
+			name:          "server default",
+			retentionDays: 30,
+			policies:      []RetentionPolicy{{TeamID: 1}, {TeamID: 2, MaxAgeDays: 7}},
+			want:          30*day + slack,
+		},
+		{
+			name:          "longer team limit",
+			retentionDays: 30,
+			policies:      []RetentionPolicy{{TeamID: 1}, {TeamID: 2, MaxAgeDays: 90}},
+			want:          90*day + slack,
+		},
+		{
+			name:     "no server default",
+			policies: []RetentionPolicy{{TeamID: 1, MaxAgeDays: 7}, {TeamID: 2}},
+		},
+		{
+			name:          "team without limit",
+			retentionDays: 30,
+			policies:      []RetentionPolicy{{TeamID: 1, MaxAgeDays: RetentionUnlimited}},
+		},
+		{
+			name:          "legal hold",
+			retentionDays: 30,
+			policies:      []RetentionPolicy{{TeamID: 1, LegalHold: true}},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			archive, index := newTestArchive(t, ArchiveConfig{RetentionDays: tt.retentionDays})
+			index.policies = tt.policies
+			got, err := archive.Retention()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tt.want {
+				t.Errorf("Retention() = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+// retentionTestSegments archives one segment for each pod of team, holding its lines, and returns the
+// segments by pod
+func retentionTestSegments(t *testing.T, archive *LogArchive, index *fakeArchiveIndex, teamID uint, pods map[string][]string) map[string]models.ArchiveSegment {
+	t.Helper()
+	sink := testArchiveSink(archive)
+	sink.setTeam(teamID)
+	for pod, raws := range pods {
+		for _, raw := range raws {
+			if err := sink.WriteLine(newLogLine("shop", pod, "app", []byte(raw+"\n"), true)); err != nil {
+				t.Fatalf("WriteLine(%q): %v", raw, err)
+			}
+		}
+	}
+	sink.closeAll()
+
+	segments := make(map[string]models.ArchiveSegment)
+	for _, segment := range index.all() {
+		if segment.TeamID == teamID {
+			segments[segment.PodName] = segment
+		}
+	}
+	if len(segments) != len(pods) {
+		t.Fatalf("archived %d segments, want %d", len(segments), len(pods))
+	}
+	return segments
+}
+
+// segmentLines returns the lines of a segment file
+func segmentLines(t *testing.T, path string) []string {
+	t.Helper()
+	file, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	gzr, err := gzip.NewReader(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	content, err := io.ReadAll(gzr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return strings.Split(strings.TrimSuffix(string(content), "\n"), "\n")
+}
+
+func TestLogArchiveEnforce(t *testing.T) {
+	now := time.Date(2024, 1, 11, 0, 0, 0, 0, time.UTC)
+	filler := strings.Repeat(" request served in 12ms with status 200 for client 10.0.0.1", 4)
+	pods := map[string][]string{
+		// old only has lines below warning level, so downsampling leaves nothing
+		"api-old": {
+			"2024-01-01T10:00:00Z INFO starting" + filler,
+			"2024-01-01T10:00:01Z INFO ready" + filler,
+		},
+		// mid keeps its error and the stack trace after it
+		"api-mid": {
+			"2024-01-06T10:00:00Z INFO handling" + filler,
+			"2024-01-06T10:00:01Z ERROR payment failed",
+			"2024-01-06T10:00:01Z \tat main.go:12",
+			"2024-01-06T10:00:02Z INFO retrying" + filler,
+		},
+		// new only has warnings, so downsampling keeps all of it
+		"api-new": {
+			"2024-01-10T10:00:00Z WARN slow response",
+			"2024-01-10T10:00:01Z WARN slow response again",
+		},
+	}
+	midDownsampled := []string{"2024-01-06T10:00:01Z ERROR payment failed", "2024-01-06T10:00:01Z \tat main.go:12"}
+
+	tests := []struct {
+		name   string
+		policy RetentionPolicy
+		// maxBytes, if set, gives the size cap from the sizes of the archived segments
+		maxBytes func(segments map[string]models.ArchiveSegment) int64
+		// want maps the pods whose segments remain to their lines, nil if they are left as archived
+		want        map[string][]string
+		deleted     int64
+		downsampled int64
+	}{
+		{
+			name:   "unlimited",
+			policy: RetentionPolicy{MaxAgeDays: RetentionUnlimited, MaxBytes: RetentionUnlimited},
+			want:   map[string][]string{"api-old": nil, "api-mid": nil, "api-new": nil},
+		},
+		{
+			name:    "age limit",
+			policy:  RetentionPolicy{MaxAgeDays: 7, MaxBytes: RetentionUnlimited},
+			want:    map[string][]string{"api-mid": nil, "api-new": nil},
+			deleted: 1,
+		},
+		{
+			name:   "legal hold",
+			policy: RetentionPolicy{MaxAgeDays: 1, MaxBytes: 1, LegalHold: true},
+			want:   map[string][]string{"api-old": nil, "api-mid": nil, "api-new": nil},
+		},
+		{
+			name:   "size cap met by deleting an emptied segment",
+			policy: RetentionPolicy{MaxAgeDays: RetentionUnlimited},
+			maxBytes: func(segments map[string]models.ArchiveSegment) int64 {
+				return segments["api-old"].Bytes + segments["api-mid"].Bytes + segments["api-new"].Bytes - 1
+			},
+			want:    map[string][]string{"api-mid": nil, "api-new": nil},
+			deleted: 1,
+		},
+		{
+			name:   "size cap met by downsampling",
+			policy: RetentionPolicy{MaxAgeDays: RetentionUnlimited},
+			maxBytes: func(segments map[string]models.ArchiveSegment) int64 {
+				return segments["api-mid"].Bytes + segments["api-new"].Bytes - 1
+			},
+			want:        map[string][]string{"api-mid": midDownsampled, "api-new": nil},
+			deleted:     1,
+			downsampled: 1,
+		},
+		{
+			name:   "size cap met by deleting downsampled segments",
+			policy: RetentionPolicy{MaxAgeDays: RetentionUnlimited},
+			maxBytes: func(segments map[string]models.ArchiveSegment) int64 {
+				return segments["api-new"].Bytes
+			},
+			want:        map[string][]string{"api-new": pods["api-new"]},
+			deleted:     2,
+			downsampled: 2,
+		},
+		{
+			name:   "age limit before size cap",
+			policy: RetentionPolicy{MaxAgeDays: 7},
+			maxBytes: func(segments map[string]models.ArchiveSegment) int64 {
+				return segments["api-mid"].Bytes + segments["api-new"].Bytes - 1
+			},
+			want:        map[string][]string{"api-mid": midDownsampled, "api-new": nil},
+			deleted:     1,
+			downsampled: 1,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			archive, index := newTestArchive(t, ArchiveConfig{})
+			segments := retentionTestSegments(t, archive, index, 1, pods)
+			// Another team's segments are never touched
+			other := retentionTestSegments(t, archive, index, 2, map[string][]string{"web-old": pods["api-old"]})
+			before, _ := index.TeamUsage("test", 1)
+
+			policy := tt.policy
+			policy.TeamID = 1
+			if tt.maxBytes != nil {
+				policy.MaxBytes = tt.maxBytes(segments)
+			}
+			var result TeamCompaction
+			if err := archive.enforce(context.Background(), policy, now, &result); err != nil {
+				t.Fatalf("enforce: %v", err)
+			}
+
+			remaining := make(map[string]models.ArchiveSegment)
+			for _, segment := range index.all() {
+				if segment.TeamID == 1 {
+					remaining[segment.PodName] = segment
+				}
+			}
+			for pod := range pods {
+				lines, kept := tt.want[pod]
+				segment, remains := remaining[pod]
+				if remains != kept {
+					t.Errorf("segment of %s remains = %v, want %v", pod, remains, kept)
+					continue
+				}
+				if _, err := os.Stat(segments[pod].Path); (err == nil) != kept {
+					t.Errorf("file of %s exists = %v, want %v", pod, err == nil, kept)
+				}
+				if !kept {
+					continue
+				}
+				if segment.Downsampled != (lines != nil) {
+					t.Errorf("segment of %s downsampled = %v, want %v", pod, segment.Downsampled, lines != nil)
+				}
+				if lines == nil {
+					lines = pods[pod]
+				}
+				if got := segmentLines(t, segment.Path); !reflect.DeepEqual(got, lines) {
+					t.Errorf("segment of %s holds %q, want %q", pod, got, lines)
+				}
+			}
+			if len(index.all()) != len(remaining)+len(other) {
+				t.Errorf("other team has %d segments, want %d", len(index.all())-len(remaining), len(other))
+			}
+
+			after, _ := index.TeamUsage("test", 1)
+			if result.DeletedSegments != tt.deleted || result.DownsampledSegments != tt.downsampled || result.ReclaimedBytes != before.Bytes-after.Bytes {
+				t.Errorf("deleted %d, downsampled %d and reclaimed %d bytes; want %d, %d and %d",
+					result.DeletedSegments, result.DownsampledSegments, result.ReclaimedBytes, tt.deleted, tt.downsampled, before.Bytes-after.Bytes)
+			}
+			if !policy.LegalHold && policy.MaxBytes > 0 && after.Bytes > policy.MaxBytes {
+				t.Errorf("team keeps %d bytes, over its cap of %d", after.Bytes, policy.MaxBytes)
+			}
+		})
+	}
+}
+
+// TestLogArchiveCompactDefaults checks that a limit left at 0 takes the server default, and that a
+// negative limit or no default keeps segments regardless
+func TestLogArchiveCompactDefaults(t *testing.T) {
+	raws := []string{"2024-01-01T10:00:00Z INFO starting"}
+
+	tests := []struct {
+		name              string
+		retentionDays     int
+		retentionMaxBytes int64
+		policy            RetentionPolicy
+		wantAge           int
+		wantBytes         int64
+		wantKept          bool
+	}{
+		{name: "server age limit", retentionDays: 7, policy: RetentionPolicy{}, wantAge: 7, wantBytes: RetentionUnlimited},
+		{name: "team age limit", retentionDays: 7, policy: RetentionPolicy{MaxAgeDays: 3650}, wantAge: 3650, wantBytes: RetentionUnlimited, wantKept: true},
+		{name: "team without age limit", retentionDays: 7, policy: RetentionPolicy{MaxAgeDays: RetentionUnlimited}, wantAge: RetentionUnlimited, wantBytes: RetentionUnlimited, wantKept: true},
+		{name: "no server age limit", policy: RetentionPolicy{}, wantAge: RetentionUnlimited, wantBytes: RetentionUnlimited, wantKept: true},
+		{name: "server size cap", retentionMaxBytes: 1, policy: RetentionPolicy{}, wantAge: RetentionUnlimited, wantBytes: 1},
+		{name: "team without size cap", retentionMaxBytes: 1, policy: RetentionPolicy{MaxBytes: RetentionUnlimited}, wantAge: RetentionUnlimited, wantBytes: RetentionUnlimited, wantKept: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			archive, index := newTestArchive(t, ArchiveConfig{RetentionDays: tt.retentionDays, RetentionMaxBytes: tt.retentionMaxBytes})
+			retentionTestSegments(t, archive, index, 1, map[string][]string{"api-0": raws})
+			policy := tt.policy
+			policy.TeamID = 1
+			index.policies = []RetentionPolicy{policy}
+
+			report, err := archive.Compact(context.Background())
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(report.Teams) != 1 {
+				t.Fatalf("report has %d teams, want 1", len(report.Teams))
+			}
+			team := report.Teams[0]
+			if team.Policy.MaxAgeDays != tt.wantAge || team.Policy.MaxBytes != tt.wantBytes {
+				t.Errorf("policy has MaxAgeDays %d and MaxBytes %d, want %d and %d", team.Policy.MaxAgeDays, team.Policy.MaxBytes, tt.wantAge, tt.wantBytes)
+			}
+			if kept := team.Usage.Segments == 1; kept != tt.wantKept {
+				t.Errorf("segment kept = %v, want %v", kept, tt.wantKept)
+			}
+		})
+	}
+}
@@ -0,0 +1,261 @@
+package services
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"arlog/backend/models"
+)
+
+// SegmentWindow selects the segments of some namespaces that overlap a time window
+// PodName and Container narrow the selection when set
+type SegmentWindow struct {
+	Cluster    string
+	Namespaces []string
+	PodName    string
+	Container  string
+	Since      time.Time
+	Until      time.Time
+}
+
+// ArchiveSearchOptions describes a search over archived logs
+type ArchiveSearchOptions struct {
+	Query     *LogQuery
+	Since     time.Time
+	Until     time.Time
+	PodName   string
+	Container string
+	Offset    int
+	Limit     int
+}
+
+// Validate checks the options against the server-enforced limits, which are those of a live search
+func (o ArchiveSearchOptions) Validate() error {
+	return SearchOptions{Query: o.Query, Since: o.Since, Until: o.Until, Offset: o.Offset, Limit: o.Limit}.Validate()
+}
+
+// ArchiveSearchResult is one page of archive search matches, in timestamp order
+type ArchiveSearchResult struct {
+	Namespaces []string      `json:"namespaces"`
+	Query      string        `json:"query"`
+	Since      time.Time     `json:"since"`
+	Until      time.Time     `json:"until"`
+	Offset     int           `json:"offset"`
+	Limit      int           `json:"limit"`
+	Matches    []SearchMatch `json:"matches"`
+	// NextOffset is the offset of the next page, if there are more matches
+	NextOffset *int `json:"nextOffset,omitempty"`
+	// Partial is set when the search ran out of time; the page may then miss matches
+	Partial bool               `json:"partial,omitempty"`
+	Stats   ArchiveSearchStats `json:"stats"`
+}
+
+// ArchiveSearchStats reports how much of the archive a search had to read
+type ArchiveSearchStats struct {
+	// Segments is the number of segments overlapping the window
+	Segments int `json:"segments"`
+	// SegmentsSkipped were ruled out by their trigram filter, without reading their index
+	SegmentsSkipped int `json:"segmentsSkipped"`
+	// SegmentsSearched is the number of segments whose index was consulted before the page was full
+	SegmentsSearched int `json:"segmentsSearched"`
+	// Blocks is the number of blocks of the searched segments; BlocksRead were decompressed and scanned
+	Blocks       int   `json:"blocks"`
+	BlocksRead   int   `json:"blocksRead"`
+	LinesScanned int64 `json:"linesScanned"`
+}
+
+// Search finds the archived lines of namespaces between opts.Since and opts.Until that match opts.Query
+// The trigram filter stored with each segment's entry rules out the segments that cannot hold a match
+// before their index file is read, and the index of the rest rules out blocks, so only the remaining
+// blocks are decompressed. Segments are searched by start time, and the search stops once no later
+// segment can hold a match on the requested page. If ctx expires, the matches found so far are returned
+// with Partial set
+// The caller is responsible for checking that the user may read every namespace
+func (a *LogArchive) Search(ctx context.Context, namespaces []string, opts ArchiveSearchOptions) (*ArchiveSearchResult, error) {
+	if err := opts.Validate(); err != nil {
+		return nil, err
+	}
+
+	result := &ArchiveSearchResult{
+		Namespaces: namespaces,
+		Query:      opts.Query.String(),
+		Since:      opts.Since,
+		Until:      opts.Until,
+		Offset:     opts.Offset,
+		Limit:      opts.Limit,
+		Matches:    []SearchMatch{},
+	}
+	if len(namespaces) == 0 {
+		return result, nil
+	}
+
+	segments, err := a.index.WindowSegments(SegmentWindow{
+		Cluster:    a.config.Cluster,
+		Namespaces: namespaces,
+		PodName:    opts.PodName,
+		Container:  opts.Container,
+		Since:      opts.Since,
+		Until:      opts.Until,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to find archived logs: %w", err)
+	}
+	result.Stats.Segments = len(segments)
+
+	// One match past the page tells whether there is a next page
+	quota := opts.Offset + opts.Limit + 1
+	var matches []SearchMatch
+	for i := range segments {
+		if ctx.Err() != nil {
+			break
+		}
+		if len(matches) >= quota {
+			sortMatches(matches)
+			matches = matches[:quota]
+			if segments[i].StartTime.After(matches[quota-1].Timestamp) {
+				break
+			}
+		}
+
+		if !gramFilter(segments[i].GramFilter).mayMatch(opts.Query.root) {
+			result.Stats.SegmentsSkipped++
+			continue
+		}
+
+		found, err := a.searchSegment(ctx, &segments[i], opts, quota, &result.Stats)
+		if errors.Is(err, fs.ErrNotExist) {
+			// The segment was removed by compaction since it was looked up
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		matches = append(matches, found...)
+	}
+
+	if err := ctx.Err(); err != nil {
+		if !errors.Is(err, context.DeadlineExceeded) {
+			return nil, err
+		}
+		result.Partial = true
+	}
+
+	sortMatches(matches)
+	if len(matches) > opts.Offset+opts.Limit {
+		next := opts.Offset + opts.Limit
+		result.NextOffset = &next
+		matches = matches[:next]
+	}
+	if opts.Offset < len(matches) {
+		result.Matches = matches[opts.Offset:]
+	}
+	return result, nil
+}
+
+// sortMatches orders matches by timestamp; ties keep segment order
+func sortMatches(matches []SearchMatch) {
+	sort.SliceStable(matches, func(i, j int) bool {
+		return matches[i].Timestamp.Before(matches[j].Timestamp)
+	})
+}
+
+// searchSegment returns up to quota matches from the blocks of a segment its index does not rule out
+func (a *LogArchive) searchSegment(ctx context.Context, segment *models.ArchiveSegment, opts ArchiveSearchOptions, quota int, stats *ArchiveSearchStats) ([]SearchMatch, error) {
+	index, err := a.loadIndex(segment)
+	if err != nil {
+		return nil, err
+	}
+	stats.SegmentsSearched++
+	stats.Blocks += len(index.Blocks)
+
+	candidates := index.candidates(opts.Query.root)
+	file, err := os.Open(segment.Path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var matches []SearchMatch
+	for i, block := range index.Blocks {
+		if !candidates[i] || (!block.End.IsZero() && block.End.Before(opts.Since)) {
+			continue
+		}
+		if !block.Start.IsZero() && block.Start.After(opts.Until) {
+			break
+		}
+		if err := ctx.Err(); err != nil {
+			return matches, nil
+		}
+
+		stats.BlocksRead++
+		done, err := searchBlock(file, block.Offset, segment, opts, func(match SearchMatch) bool {
+			matches = append(matches, match)
+			return len(matches) >= quota
+		}, stats)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read archive segment %s: %w", filepath.Base(segment.Path), err)
+		}
+		if done {
+			break
+		}
+	}
+	return matches, nil
+}
+
+// searchBlock scans the block of a segment file at offset, passing each match to add until it reports
+// that no more are needed. It reports done when add did so or the block goes past the window
+func searchBlock(file *os.File, offset int64, segment *models.ArchiveSegment, opts ArchiveSearchOptions, add func(SearchMatch) bool, stats *ArchiveSearchStats) (bool, error) {
+	if _, err := file.Seek(offset, io.SeekStart); err != nil {
+		return false, err
+	}
+	gz, err := gzip.NewReader(bufio.NewReader(file))
+	if err != nil {
+		return false, err
+	}
+	defer gz.Close()
+	gz.Multistream(false)
+
+	reader := bufio.NewReader(gz)
+	for {
+		raw, err := reader.ReadBytes('\n')
+		if len(raw) > 0 {
+			line := newLogLine(segment.Namespace, segment.PodName, segment.ContainerName, raw, true)
+			if line.Timestamp.After(opts.Until) {
+				return true, nil
+			}
+			if !line.Timestamp.Before(opts.Since) {
+				stats.LinesScanned++
+				_, content := SplitTimestamp(raw)
+				var parsed *ParsedLine
+				if opts.Query.NeedsParse() {
+					parsed = ParseLine(content, FormatAuto)
+				}
+				if opts.Query.Match(line, parsed) && add(SearchMatch{
+					Namespace: segment.Namespace,
+					Pod:       segment.PodName,
+					Container: segment.ContainerName,
+					Timestamp: line.Timestamp,
+					Line:      string(bytes.TrimRight(content, "\r\n")),
+				}) {
+					return true, nil
+				}
+			}
+		}
+		if err == io.EOF {
+			return false, nil
+		}
+		if err != nil {
+			return false, err
+		}
+	}
+}
@@ -0,0 +1,59 @@
+package services
+
+import (
+	"context"
+	"os"
+	"testing"
+	"time"
+)
+
+// TestLogArchiveSearchSkipsSegments checks that segments whose trigram filter rules out the query are
+// skipped without reading their index, and that segments without a filter are still searched
+func TestLogArchiveSearchSkipsSegments(t *testing.T) {
+	archive, index := newTestArchive(t, ArchiveConfig{})
+	sink := testArchiveSink(archive)
+	for container, text := range map[string]string{"api": "payment accepted", "worker": "queue drained", "cron": "payment job done"} {
+		line := newLogLine("shop", "api-0", container, []byte("2024-01-02T15:04:05Z "+text+"\n"), true)
+		if err := sink.WriteLine(line); err != nil {
+			t.Fatal(err)
+		}
+	}
+	sink.closeAll()
+
+	// A segment archived before filters were kept
+	index.mu.Lock()
+	for i := range index.segments {
+		if index.segments[i].ContainerName == "cron" {
+			index.segments[i].GramFilter = nil
+		}
+	}
+	index.mu.Unlock()
+	// A skipped segment must not be read at all
+	for _, segment := range index.all() {
+		if segment.ContainerName == "worker" {
+			os.Remove(segment.Path)
+			os.Remove(indexPath(segment.Path))
+		}
+	}
+
+	query, err := ParseLogQuery("payment")
+	if err != nil {
+		t.Fatal(err)
+	}
+	since := time.Date(2024, 1, 2, 15, 0, 0, 0, time.UTC)
+	result, err := archive.Search(context.Background(), []string{"shop"}, ArchiveSearchOptions{
+		Query: query,
+		Since: since,
+		Until: since.Add(time.Hour),
+		Limit: 10,
+	})
+	if err != nil {
+		t.Fatalf("Search: %v", err)
+	}
+	if len(result.Matches) != 2 {
+		t.Errorf("found %d matches, want 2", len(result.Matches))
+	}
+	if result.Stats.Segments != 3 || result.Stats.SegmentsSkipped != 1 || result.Stats.SegmentsSearched != 2 {
+		t.Errorf("stats = %+v, want 3 segments of which 1 skipped and 2 searched", result.Stats)
+	}
+}
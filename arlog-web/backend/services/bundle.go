@@ -0,0 +1,87 @@
+package services
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"time"
+)
+
+// Supported bundle archive formats
+const (
+	BundleFormatTarGz = "tar.gz"
+	BundleFormatZip   = "zip"
+)
+
+// BundleWriter adds files to an archive written as a stream
+type BundleWriter interface {
+	// AddFile adds a file of exactly size bytes read from r
+	AddFile(name string, modTime time.Time, size int64, r io.Reader) error
+	// Close finishes the archive; it does not close the underlying writer
+	Close() error
+}
+
+// NewBundleWriter creates a writer for the given archive format
+func NewBundleWriter(format string, w io.Writer) (BundleWriter, error) {
+	switch format {
+	case BundleFormatTarGz:
+		gz := gzip.NewWriter(w)
+		return &tarGzBundle{gz: gz, tar: tar.NewWriter(gz)}, nil
+	case BundleFormatZip:
+		return &zipBundle{zip: zip.NewWriter(w)}, nil
+	default:
+		return nil, fmt.Errorf("unsupported bundle format: %q (expected %s or %s)", format, BundleFormatTarGz, BundleFormatZip)
+	}
+}
+
+// tarGzBundle writes a gzip-compressed tar archive
+type tarGzBundle struct {
+	gz  *gzip.Writer
+	tar *tar.Writer
+}
+
+func (b *tarGzBundle) AddFile(name string, modTime time.Time, size int64, r io.Reader) error {
+	header := &tar.Header{
+		Name:     name,
+		Mode:     0644,
+		Size:     size,
+		ModTime:  modTime,
+		Typeflag: tar.TypeReg,
+	}
+	if err := b.tar.WriteHeader(header); err != nil {
+		return err
+	}
+	_, err := io.CopyN(b.tar, r, size)
+	return err
+}
+
+func (b *tarGzBundle) Close() error {
+	if err := b.tar.Close(); err != nil {
+		return err
+	}
+	return b.gz.Close()
+}
+
+// zipBundle writes a zip archive with deflated entries
+type zipBundle struct {
+	zip *zip.Writer
+}
+
+func (b *zipBundle) AddFile(name string, modTime time.Time, size int64, r io.Reader) error {
+	entry, err := b.zip.CreateHeader(&zip.FileHeader{
+		Name:     name,
+		Method:   zip.Deflate,
+		Modified: modTime,
+	})
+	if err != nil {
+		return err
+	}
+	_, err = io.CopyN(entry, r, size)
+	return err
+}
+
+func (b *zipBundle) Close() error {
+	return b.zip.Close()
+}
@@ -0,0 +1,385 @@
+package services
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// Export limits
+const (
+	// DefaultExportConcurrency is the number of container logs fetched at the same time
+	DefaultExportConcurrency = 4
+	// DefaultExportMaxBytes caps the uncompressed size of the logs in a bundle (256 MiB)
+	DefaultExportMaxBytes int64 = 256 * 1024 * 1024
+	// MaxExportPods is the largest number of pods a single bundle may cover
+	MaxExportPods = 200
+)
+
+// errExportSizeCap stops a container log once the bundle has reached its size cap
+var errExportSizeCap = errors.New("bundle size cap reached")
+
+// ExportOptions describes which logs go into a bundle
+// Pods are selected by Selector or Workload; with neither, every pod of the namespace is exported
+type ExportOptions struct {
+	Selector string
+	Workload *WorkloadRef
+	// Previous also exports the logs of the previous instance of restarted containers
+	Previous bool
+	Logs     LogOptions
+	Until    *time.Time
+	// MaxBytes caps the total size of the exported logs; the remaining logs are left out
+	MaxBytes    int64
+	Concurrency int
+}
+
+// ExportManifest describes the contents of a bundle; it is added to the bundle as manifest.json
+type ExportManifest struct {
+	Namespace   string       `json:"namespace"`
+	Selector    string       `json:"selector,omitempty"`
+	Workload    string       `json:"workload,omitempty"`
+	GeneratedAt time.Time    `json:"generatedAt"`
+	Window      ExportWindow `json:"window"`
+	Previous    bool         `json:"previous"`
+	MaxBytes    int64        `json:"maxBytes"`
+	TotalBytes  int64        `json:"totalBytes"`
+	// Truncated is set when the size cap left logs out of the bundle
+	Truncated bool        `json:"truncated"`
+	Pods      []ExportPod `json:"pods"`
+}
+
+// ExportWindow is the time window of the exported logs
+type ExportWindow struct {
+	TailLines    *int64     `json:"tailLines,omitempty"`
+	SinceSeconds *int64     `json:"sinceSeconds,omitempty"`
+	Since        *time.Time `json:"since,omitempty"`
+	Until        *time.Time `json:"until,omitempty"`
+}
+
+// ExportPod describes an exported pod
+type ExportPod struct {
+	Name      string            `json:"name"`
+	Phase     string            `json:"phase"`
+	Node      string            `json:"node,omitempty"`
+	Labels    map[string]string `json:"labels,omitempty"`
+	StartTime *time.Time        `json:"startTime,omitempty"`
+	Deleted   bool              `json:"deleted,omitempty"`
+	// Containers holds init, regular and ephemeral containers
+	Containers []ExportContainer `json:"containers"`
+}
+
+// ExportContainer describes an exported container and the files holding its logs
+type ExportContainer struct {
+	Name         string       `json:"name"`
+	Image        string       `json:"image,omitempty"`
+	Ready        bool         `json:"ready"`
+	RestartCount int32        `json:"restartCount"`
+	State        string       `json:"state"`
+	Reason       string       `json:"reason,omitempty"`
+	ExitCode     *int32       `json:"exitCode,omitempty"`
+	Files        []ExportFile `json:"files"`
+}
+
+// ExportFile is one log file of a bundle
+// A file that could not be exported has no path and the reason in Error
+type ExportFile struct {
+	Path      string `json:"path,omitempty"`
+	Previous  bool   `json:"previous,omitempty"`
+	Bytes     int64  `json:"bytes"`
+	Truncated bool   `json:"truncated,omitempty"`
+	Error     string `json:"error,omitempty"`
+}
+
+// exportJob is one container log to fetch
+type exportJob struct {
+	pod       int
+	container int
+	file      int
+	name      string
+	podName   string
+	previous  bool
+}
+
+// exportResult is a fetched container log, spooled to a temporary file
+type exportResult struct {
+	job  exportJob
+	temp *os.File
+	size int64
+	err  error
+}
+
+// ListExportPods returns the pods selected by opts, sorted by name
+func (k *KubernetesService) ListExportPods(ctx context.Context, namespace string, opts ExportOptions) ([]corev1.Pod, error) {
+	listOptions := metav1.ListOptions{LabelSelector: opts.Selector}
+	var owner *workloadOwner
+	if opts.Workload != nil {
+		selector, workloadOwner, err := k.resolveWorkload(ctx, namespace, *opts.Workload)
+		if err != nil {
+			return nil, err
+		}
+		listOptions.LabelSelector, owner = selector, workloadOwner
+	}
+
+	list, err := k.clientset.CoreV1().Pods(namespace).List(ctx, listOptions)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list pods: %w", err)
+	}
+
+	pods := make([]corev1.Pod, 0, len(list.Items))
+	for i := range list.Items {
+		if owner == nil || owner.owns(&list.Items[i]) {
+			pods = append(pods, list.Items[i])
+		}
+	}
+	if len(pods) > MaxExportPods {
+		return nil, fmt.Errorf("%d pods match; a bundle may cover at most %d", len(pods), MaxExportPods)
+	}
+
+	sort.Slice(pods, func(i, j int) bool { return pods[i].Name < pods[j].Name })
+	return pods, nil
+}
+
+// ExportLogs writes the logs of every container of pods to bundle, followed by manifest.json
+// Logs are fetched opts.Concurrency at a time into temporary files and added to the bundle as they
+// complete. Once opts.MaxBytes have been exported, the log being fetched is cut short and the rest
+// are left out; the manifest records which. Errors fetching a container are recorded in the
+// manifest rather than failing the export; only bundle write errors are returned
+func (k *KubernetesService) ExportLogs(ctx context.Context, namespace string, pods []corev1.Pod, opts ExportOptions, root string, bundle BundleWriter) (*ExportManifest, error) {
+	if opts.Concurrency < 1 {
+		opts.Concurrency = DefaultExportConcurrency
+	}
+	if opts.MaxBytes <= 0 {
+		opts.MaxBytes = DefaultExportMaxBytes
+	}
+	opts.Logs.Follow = false
+	opts.Logs.Previous = false
+	if err := opts.Logs.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid log options: %w", err)
+	}
+
+	manifest, jobs := newExportManifest(namespace, pods, opts)
+
+	// ctx is cancelled early if writing the bundle fails
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var total atomic.Int64
+	jobCh := make(chan exportJob)
+	results := make(chan exportResult)
+
+	var workers sync.WaitGroup
+	for i := 0; i < opts.Concurrency; i++ {
+		workers.Add(1)
+		go func() {
+			defer workers.Done()
+			for job := range jobCh {
+				results <- k.fetchExportLog(ctx, namespace, job, opts, &total)
+			}
+		}()
+	}
+	go func() {
+		defer close(jobCh)
+		for _, job := range jobs {
+			select {
+			case jobCh <- job:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	go func() {
+		workers.Wait()
+		close(results)
+	}()
+
+	var writeErr error
+	for result := range results {
+		file := &manifest.Pods[result.job.pod].Containers[result.job.container].Files[result.job.file]
+		if writeErr == nil {
+			writeErr = addExportResult(bundle, root, result, file, manifest)
+			if writeErr != nil {
+				cancel()
+			}
+		}
+		if result.temp != nil {
+			result.temp.Close()
+			os.Remove(result.temp.Name())
+		}
+	}
+	if writeErr != nil {
+		return nil, writeErr
+	}
+
+	data, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	if err := bundle.AddFile(path.Join(root, "manifest.json"), manifest.GeneratedAt, int64(len(data)), bytes.NewReader(data)); err != nil {
+		return nil, err
+	}
+	return manifest, nil
+}
+
+// newExportManifest describes pods and lists the container logs to fetch for them
+func newExportManifest(namespace string, pods []corev1.Pod, opts ExportOptions) (*ExportManifest, []exportJob) {
+	manifest := &ExportManifest{
+		Namespace:   namespace,
+		Selector:    opts.Selector,
+		GeneratedAt: time.Now().UTC(),
+		Window: ExportWindow{
+			TailLines:    opts.Logs.TailLines,
+			SinceSeconds: opts.Logs.SinceSeconds,
+			Since:        opts.Logs.SinceTime,
+			Until:        opts.Until,
+		},
+		Previous: opts.Previous,
+		MaxBytes: opts.MaxBytes,
+		Pods:     make([]ExportPod, 0, len(pods)),
+	}
+	if opts.Workload != nil {
+		manifest.Workload = opts.Workload.String()
+	}
+
+	var jobs []exportJob
+	for i := range pods {
+		pod := &pods[i]
+		exported := ExportPod{
+			Name:    pod.Name,
+			Phase:   string(pod.Status.Phase),
+			Node:    pod.Spec.NodeName,
+			Labels:  pod.Labels,
+			Deleted: pod.DeletionTimestamp != nil,
+		}
+		if pod.Status.StartTime != nil {
+			startTime := pod.Status.StartTime.Time
+			exported.StartTime = &startTime
+		}
+
+		for _, status := range containerStatuses(pod) {
+			container := ExportContainer{
+				Name:         status.Name,
+				Image:        status.Image,
+				Ready:        status.Ready,
+				RestartCount: status.RestartCount,
+			}
+			switch {
+			case status.State.Running != nil:
+				container.State = "running"
+			case status.State.Terminated != nil:
+				container.State = "terminated"
+				container.Reason = status.State.Terminated.Reason
+				exitCode := status.State.Terminated.ExitCode
+				container.ExitCode = &exitCode
+			case status.State.Waiting != nil:
+				container.State = "waiting"
+				container.Reason = status.State.Waiting.Reason
+			}
+
+			current := exportJob{pod: i, container: len(exported.Containers), podName: pod.Name, name: status.Name}
+			if opts.Previous && status.LastTerminationState.Terminated != nil {
+				previous := current
+				previous.previous = true
+				previous.file = len(container.Files)
+				container.Files = append(container.Files, ExportFile{Previous: true})
+				jobs = append(jobs, previous)
+			}
+			current.file = len(container.Files)
+			container.Files = append(container.Files, ExportFile{})
+			jobs = append(jobs, current)
+
+			exported.Containers = append(exported.Containers, container)
+		}
+		manifest.Pods = append(manifest.Pods, exported)
+	}
+	return manifest, jobs
+}
+
+// fetchExportLog spools one container log to a temporary file, counting its bytes against the cap
+func (k *KubernetesService) fetchExportLog(ctx context.Context, namespace string, job exportJob, opts ExportOptions, total *atomic.Int64) exportResult {
+	result := exportResult{job: job}
+	if total.Load() >= opts.MaxBytes {
+		result.err = errExportSizeCap
+		return result
+	}
+
+	temp, err := os.CreateTemp("", "arlog-export-*.log")
+	if err != nil {
+		result.err = err
+		return result
+	}
+	result.temp = temp
+
+	logOptions := opts.Logs
+	logOptions.Previous = job.previous
+	sink := &exportSink{w: temp, total: total, max: opts.MaxBytes}
+	_, result.err = k.GetPodLogs(ctx, namespace, job.podName, job.name, logOptions, opts.Until, sink)
+	result.size = sink.size
+	if errors.Is(result.err, errExportSizeCap) {
+		result.err = errExportSizeCap
+	}
+	return result
+}
+
+// addExportResult adds a fetched log to the bundle and records it in the manifest
+func addExportResult(bundle BundleWriter, root string, result exportResult, file *ExportFile, manifest *ExportManifest) error {
+	file.Bytes = result.size
+	manifest.TotalBytes += result.size
+	if result.err != nil {
+		file.Error = result.err.Error()
+		if errors.Is(result.err, errExportSizeCap) {
+			file.Truncated = true
+			manifest.Truncated = true
+		}
+	}
+	if result.temp == nil || (result.size == 0 && result.err != nil) {
+		return nil
+	}
+
+	name := result.job.name + ".log"
+	if result.job.previous {
+		name = result.job.name + ".previous.log"
+	}
+	file.Path = path.Join(result.job.podName, name)
+
+	if _, err := result.temp.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	return bundle.AddFile(path.Join(root, file.Path), manifest.GeneratedAt, result.size, result.temp)
+}
+
+// exportSink writes raw log lines to a file until the bundle's size cap is reached
+type exportSink struct {
+	w     io.Writer
+	total *atomic.Int64
+	max   int64
+	size  int64
+}
+
+func (s *exportSink) WriteLine(line LogLine) error {
+	content := line.Content
+	if len(content) == 0 || content[len(content)-1] != '\n' {
+		content = append(content, '\n')
+	}
+	if s.total.Add(int64(len(content))) > s.max {
+		return errExportSizeCap
+	}
+	n, err := s.w.Write(content)
+	s.size += int64(n)
+	return err
+}
+
+func (s *exportSink) WriteEvent(event StreamEvent) error {
+	return nil
+}
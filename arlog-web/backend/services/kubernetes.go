@@ -3,6 +3,7 @@ package services
 import (
 	"bufio"
 	"context"
+	"errors"
 	"fmt"
 	"io"
 	"os"
@@ -17,7 +18,7 @@ import (
 
 // KubernetesService provides methods to interact with the Kubernetes API
 type KubernetesService struct {
-	clientset *kubernetes.Clientset
+	clientset kubernetes.Interface
 	config    *rest.Config
 }
 
@@ -96,6 +97,12 @@ func NewKubernetesServiceWithToken(token string, apiServerURL string) (*Kubernet
 	}, nil
 }
 
+// NewKubernetesServiceForClient creates a Kubernetes service around an existing clientset
+// This is used to evaluate log processing, such as alert rules, against a fake clientset
+func NewKubernetesServiceForClient(clientset kubernetes.Interface) *KubernetesService {
+	return &KubernetesService{clientset: clientset}
+}
+
 // ListPods returns a list of pods in the specified namespace
 func (k *KubernetesService) ListPods(namespace string) ([]PodInfo, error) {
 	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
@@ -122,11 +129,10 @@ func (k *KubernetesService) ListPods(namespace string) ([]PodInfo, error) {
 	return podInfos, nil
 }
 
-// StreamLogs streams logs from a pod to the provided writer
-// This function follows the logs in real-time
-func (k *KubernetesService) StreamLogs(namespace, podName, container string, writer io.Writer) error {
-	ctx := context.Background()
-
+// StreamLogs streams logs from a single container of a pod to the provided sink
+// When opts.Follow is set, this function follows the logs in real-time until ctx is cancelled,
+// carrying on across container restarts until the container is not going to be restarted again
+func (k *KubernetesService) StreamLogs(ctx context.Context, namespace, podName, container string, opts LogOptions, sink LogSink) error {
 	// Get pod to check if container name is needed
 	pod, err := k.clientset.CoreV1().Pods(namespace).Get(ctx, podName, metav1.GetOptions{})
 	if err != nil {
@@ -140,62 +146,280 @@ func (k *KubernetesService) StreamLogs(namespace, podName, container string, wri
 		}
 	}
 
-	// Configure log options
-	tailLines := int64(100)
+	// Validate log options before hitting the API server
+	if err := opts.Validate(); err != nil {
+		return fmt.Errorf("invalid log options: %w", err)
+	}
+
+	// Remember which instance is streamed so a reconnect does not silently switch to a restarted one
+	status, _ := findContainerStatus(pod, container)
+
+	// Show how the previous instance ended before the current one's logs
+	if opts.PreviousTail != nil && *opts.PreviousTail > 0 && !opts.Previous && status.RestartCount > 0 {
+		if err := k.streamPreviousTail(ctx, namespace, podName, status, *opts.PreviousTail, opts.Timestamps, sink); err != nil {
+			return err
+		}
+	}
+
+	if opts.Follow && !opts.Previous {
+		return k.followRestarts(ctx, namespace, podName, container, status.ContainerID, opts, sink)
+	}
+	return k.streamContainerLogs(ctx, namespace, podName, container, status.ContainerID, opts, sink)
+}
+
+// streamContainerLogs opens a log stream for one container and writes each line to sink
+// Timestamps are always requested from the API server so every line carries its time; they are
+// only kept in the line content when opts.Timestamps is set
+//
+// When following, a stream that drops while the container instance is still running (log rotation,
+// API server restarts, network errors) is reopened with exponential backoff from the last delivered
+// timestamp. Reconnecting and reconnected events are sent to sink meanwhile
+func (k *KubernetesService) streamContainerLogs(ctx context.Context, namespace, podName, container, containerID string, opts LogOptions, sink LogSink) error {
+	resume := &streamResume{}
+	backoff := reconnectInitialBackoff
+	attempts := 0
+	opened := false
+
+	for {
+		req := k.clientset.CoreV1().Pods(namespace).GetLogs(podName, resume.podLogOptions(opts, container))
+		stream, err := req.Stream(ctx)
+		if err != nil && !opened {
+			return fmt.Errorf("failed to get log stream: %w", err)
+		}
+
+		cause := err
+		if err == nil {
+			opened = true
+			if attempts > 0 {
+				if err := sink.WriteEvent(StreamEvent{Type: StreamEventReconnected, Namespace: namespace, Pod: podName, Container: container}); err != nil {
+					stream.Close()
+					return fmt.Errorf("error writing log line: %w", err)
+				}
+			}
+
+			delivered, readErr := k.readLogStream(stream, namespace, podName, container, opts, resume, sink)
+			stream.Close()
+			var sinkErr sinkError
+			if errors.As(readErr, &sinkErr) {
+				return readErr
+			}
+			// A cancelled context closes the stream; report the cancellation rather than the read error
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			if !opts.Follow {
+				if readErr != nil {
+					return fmt.Errorf("error reading log stream: %w", readErr)
+				}
+				return nil
+			}
+
+			// The stream stops at limitBytes, which a reopened stream would go past
+			if resume.limitReached(opts) {
+				return nil
+			}
+			if delivered > 0 {
+				attempts, backoff = 0, reconnectInitialBackoff
+			}
+			cause = readErr
+		}
+
+		// The stream ending is expected once the container exits; only resume a running instance
+		running, checkErr := k.containerRunning(ctx, namespace, podName, container, containerID)
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if checkErr == nil && !running {
+			return nil
+		}
+
+		attempts++
+		if attempts > maxReconnectAttempts {
+			if cause == nil {
+				cause = checkErr
+			}
+			return fmt.Errorf("log stream lost after %d reconnect attempts: %v", maxReconnectAttempts, cause)
+		}
+
+		message := fmt.Sprintf("log stream ended; reconnecting in %s", backoff)
+		if cause != nil {
+			message = fmt.Sprintf("log stream interrupted (%v); reconnecting in %s", cause, backoff)
+		}
+		if err := sink.WriteEvent(StreamEvent{Type: StreamEventReconnecting, Namespace: namespace, Pod: podName, Container: container, Message: message}); err != nil {
+			return fmt.Errorf("error writing log line: %w", err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(backoff):
+		}
+
+		backoff *= 2
+		if backoff > reconnectMaxBackoff {
+			backoff = reconnectMaxBackoff
+		}
+		resume.reconnecting()
+	}
+}
+
+// sinkError marks an error returned by a LogSink, which ends a stream instead of triggering a reconnect
+type sinkError struct {
+	err error
+}
+
+func (e sinkError) Error() string {
+	return "error writing log line: " + e.err.Error()
+}
+
+func (e sinkError) Unwrap() error {
+	return e.err
+}
+
+// readLogStream writes the lines of an open log stream to sink until it ends
+// It returns the number of lines delivered and the read error (nil at EOF) or a sinkError
+func (k *KubernetesService) readLogStream(stream io.Reader, namespace, podName, container string, opts LogOptions, resume *streamResume, sink LogSink) (int, error) {
+	delivered := 0
+	reader := bufio.NewReader(stream)
+	for {
+		raw, err := reader.ReadBytes('\n')
+		if len(raw) > 0 {
+			line := newLogLine(namespace, podName, container, raw, opts.Timestamps)
+			if resume.deliver(line.Timestamp, raw) {
+				if writeErr := sink.WriteLine(line); writeErr != nil {
+					return delivered, sinkError{writeErr}
+				}
+				delivered++
+			}
+		}
+		if err != nil {
+			if err == io.EOF {
+				return delivered, nil
+			}
+			return delivered, err
+		}
+	}
+}
+
+// FetchLogsBefore returns up to maxLines lines of a container that were logged before the given time
+// Only the last MaxTailLines lines of the container log are searched
+func (k *KubernetesService) FetchLogsBefore(ctx context.Context, namespace, podName, container string, before time.Time, maxLines int, opts LogOptions) ([]LogLine, error) {
+	if maxLines < 1 || int64(maxLines) > MaxTailLines {
+		return nil, fmt.Errorf("lines must be between 1 and %d", MaxTailLines)
+	}
+
+	tailLines := MaxTailLines
 	logOptions := &corev1.PodLogOptions{
 		Container:  container,
-		Follow:     true,
+		Previous:   opts.Previous,
 		Timestamps: true,
 		TailLines:  &tailLines,
 	}
 
-	// Get log stream
 	req := k.clientset.CoreV1().Pods(namespace).GetLogs(podName, logOptions)
 	stream, err := req.Stream(ctx)
 	if err != nil {
-		return fmt.Errorf("failed to get log stream: %w", err)
+		return nil, fmt.Errorf("failed to get pod logs: %w", err)
 	}
 	defer stream.Close()
 
-	// Stream logs to writer
-	reader := bufio.NewReader(stream)
-	for {
-		line, err := reader.ReadBytes('\n')
-		if err != nil {
-			if err == io.EOF {
-				break
-			}
-			return fmt.Errorf("error reading log stream: %w", err)
+	// Keep a sliding window of the last maxLines lines older than before
+	lines := make([]LogLine, 0, maxLines)
+	scanner := bufio.NewScanner(stream)
+	scanner.Buffer(make([]byte, 64*1024), maxLogLineSize)
+	for scanner.Scan() {
+		// Copy the line out of the scanner buffer, restoring the newline the scanner strips
+		raw := make([]byte, len(scanner.Bytes())+1)
+		copy(raw, scanner.Bytes())
+		raw[len(raw)-1] = '\n'
+		line := newLogLine(namespace, podName, container, raw, opts.Timestamps)
+		if !line.Timestamp.Before(before) {
+			break
 		}
-
-		// Write log line to the provided writer
-		_, writeErr := writer.Write(line)
-		if writeErr != nil {
-			return fmt.Errorf("error writing log line: %w", writeErr)
+		if len(lines) == maxLines {
+			lines = lines[1:]
 		}
+		lines = append(lines, line)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("error reading pod logs: %w", err)
 	}
 
-	return nil
+	return lines, nil
 }
 
-// GetPodLogs retrieves logs from a pod (non-streaming, for historical logs)
-func (k *KubernetesService) GetPodLogs(namespace, podName, container string, tailLines int64) (string, error) {
-	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
-	defer cancel()
+// GetPodLogs reads the logs of a container without following them, writing each line to sink as it
+// arrives so that large logs are never held in memory. An empty container selects the pod's first
+// container. When until is set, reading stops at the first line logged after it
+// It returns the name of the container read
+func (k *KubernetesService) GetPodLogs(ctx context.Context, namespace, podName, container string, opts LogOptions, until *time.Time, sink LogSink) (string, error) {
+	if container == "" {
+		pod, err := k.clientset.CoreV1().Pods(namespace).Get(ctx, podName, metav1.GetOptions{})
+		if err != nil {
+			return "", fmt.Errorf("failed to get pod: %w", err)
+		}
+		if len(pod.Spec.Containers) > 0 {
+			container = pod.Spec.Containers[0].Name
+		}
+	}
 
-	logOptions := &corev1.PodLogOptions{
-		Container:  container,
-		Timestamps: true,
-		TailLines:  &tailLines,
+	opts.Follow = false
+	opts.PreviousTail = nil
+	if err := opts.Validate(); err != nil {
+		return "", fmt.Errorf("invalid log options: %w", err)
 	}
 
+	// Timestamps are always requested so lines can be checked against until
+	logOptions := opts.PodLogOptions(container)
+	logOptions.Timestamps = true
+
 	req := k.clientset.CoreV1().Pods(namespace).GetLogs(podName, logOptions)
-	logs, err := req.DoRaw(ctx)
+	stream, err := req.Stream(ctx)
 	if err != nil {
 		return "", fmt.Errorf("failed to get pod logs: %w", err)
 	}
+	defer stream.Close()
+
+	reader := bufio.NewReader(stream)
+	for {
+		raw, err := reader.ReadBytes('\n')
+		if len(raw) > 0 {
+			line := newLogLine(namespace, podName, container, raw, opts.Timestamps)
+			if until != nil && line.Timestamp.After(*until) {
+				return container, nil
+			}
+			if writeErr := sink.WriteLine(line); writeErr != nil {
+				return container, sinkError{writeErr}
+			}
+		}
+		if err != nil {
+			if err == io.EOF {
+				return container, nil
+			}
+			return container, fmt.Errorf("error reading pod logs: %w", err)
+		}
+	}
+}
+
+// GetPodContainerNames returns the names of all containers of a pod, including init and ephemeral containers
+func (k *KubernetesService) GetPodContainerNames(ctx context.Context, namespace, podName string) ([]string, error) {
+	pod, err := k.clientset.CoreV1().Pods(namespace).Get(ctx, podName, metav1.GetOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("failed to get pod: %w", err)
+	}
+
+	names := make([]string, 0, len(pod.Spec.InitContainers)+len(pod.Spec.Containers)+len(pod.Spec.EphemeralContainers))
+	for _, container := range pod.Spec.InitContainers {
+		names = append(names, container.Name)
+	}
+	for _, container := range pod.Spec.Containers {
+		names = append(names, container.Name)
+	}
+	for _, container := range pod.Spec.EphemeralContainers {
+		names = append(names, container.Name)
+	}
 
-	return string(logs), nil
+	return names, nil
 }
 
 // getPodReadyStatus returns the ready status of a pod (e.g., "2/3" meaning 2 out of 3 containers are ready)
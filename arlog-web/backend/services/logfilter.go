@@ -0,0 +1,322 @@
+package services
+
+import (
+	"bytes"
+	"fmt"
+	"regexp"
+	"sync"
+	"time"
+)
+
+// Server-enforced limits for log filters
+const (
+	// MaxFilterPatterns is the largest number of include, exclude or contains patterns of each kind
+	MaxFilterPatterns = 20
+	// MaxFilterPatternLength is the longest pattern accepted
+	MaxFilterPatternLength = 1024
+	// MaxFilterContextLines is the largest number of context lines around a match
+	MaxFilterContextLines = 100
+)
+
+// suppressedReportInterval is the minimum time between two suppressed-lines events
+const suppressedReportInterval = time.Second
+
+// LogFilterConfig describes which log lines a filter keeps
+// A line is kept when it matches at least one Include pattern (if any are given), contains every
+// Contains substring, matches no Exclude pattern and has a detected level of at least MinLevel
+type LogFilterConfig struct {
+	Include  []string
+	Exclude  []string
+	Contains []string
+	MinLevel LogLevel
+	// Before and After are the numbers of context lines emitted around each match
+	Before int
+	After  int
+}
+
+// LogFilter is a compiled LogFilterConfig
+type LogFilter struct {
+	config   LogFilterConfig
+	include  []*regexp.Regexp
+	exclude  []*regexp.Regexp
+	contains [][]byte
+}
+
+// NewLogFilter validates and compiles a filter configuration
+func NewLogFilter(config LogFilterConfig) (*LogFilter, error) {
+	for name, patterns := range map[string][]string{
+		"include":  config.Include,
+		"exclude":  config.Exclude,
+		"contains": config.Contains,
+	} {
+		if len(patterns) > MaxFilterPatterns {
+			return nil, fmt.Errorf("at most %d %s patterns are allowed", MaxFilterPatterns, name)
+		}
+		for _, pattern := range patterns {
+			if len(pattern) > MaxFilterPatternLength {
+				return nil, fmt.Errorf("%s patterns must not exceed %d characters", name, MaxFilterPatternLength)
+			}
+		}
+	}
+
+	if config.Before < 0 || config.Before > MaxFilterContextLines || config.After < 0 || config.After > MaxFilterContextLines {
+		return nil, fmt.Errorf("context lines must be between 0 and %d", MaxFilterContextLines)
+	}
+
+	filter := &LogFilter{config: config}
+
+	for _, pattern := range config.Include {
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			return nil, fmt.Errorf("invalid include pattern %q: %w", pattern, err)
+		}
+		filter.include = append(filter.include, re)
+	}
+
+	for _, pattern := range config.Exclude {
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			return nil, fmt.Errorf("invalid exclude pattern %q: %w", pattern, err)
+		}
+		filter.exclude = append(filter.exclude, re)
+	}
+
+	for _, substring := range config.Contains {
+		filter.contains = append(filter.contains, []byte(substring))
+	}
+
+	return filter, nil
+}
+
+// Config returns the configuration the filter was built from
+func (f *LogFilter) Config() LogFilterConfig {
+	return f.config
+}
+
+// IsEmpty reports whether the filter keeps every line
+func (f *LogFilter) IsEmpty() bool {
+	return len(f.include) == 0 && len(f.exclude) == 0 && len(f.contains) == 0 && f.config.MinLevel == LevelUnknown
+}
+
+// Match reports whether a line passes the filter
+// The Kubernetes timestamp prefix, if present, is ignored
+func (f *LogFilter) Match(content []byte) bool {
+	_, content = SplitTimestamp(content)
+
+	if len(f.include) > 0 {
+		included := false
+		for _, re := range f.include {
+			if re.Match(content) {
+				included = true
+				break
+			}
+		}
+		if !included {
+			return false
+		}
+	}
+
+	for _, substring := range f.contains {
+		if !bytes.Contains(content, substring) {
+			return false
+		}
+	}
+
+	for _, re := range f.exclude {
+		if re.Match(content) {
+			return false
+		}
+	}
+
+	if f.config.MinLevel != LevelUnknown && DetectLevel(content) < f.config.MinLevel {
+		return false
+	}
+
+	return true
+}
+
+// FilterSink applies a LogFilter to the lines passing through it before handing them to the next sink
+// Context lines are tracked per container, and a running count of suppressed lines is reported
+// through StreamEventSuppressed events, at most once per second. A count that changed is sent by a timer
+// even if no line follows; call Flush when the stream ends to send the final count. A nil filter keeps
+// every line
+type FilterSink struct {
+	next LogSink
+
+	mu         sync.Mutex
+	filter     *LogFilter
+	sources    map[string]*filterSource
+	suppressed int64
+	reported   int64
+	lastReport time.Time
+	// timer sends a change of the counter made within the report interval
+	timer *time.Timer
+	// err is the first error from a report sent by the timer, returned by the next write
+	err error
+}
+
+// filterSource holds the context state of one container
+type filterSource struct {
+	before []LogLine
+	after  int
+}
+
+// NewFilterSink creates a sink that filters lines before writing them to next
+func NewFilterSink(filter *LogFilter, next LogSink) *FilterSink {
+	return &FilterSink{
+		next:    next,
+		filter:  filter,
+		sources: make(map[string]*filterSource),
+	}
+}
+
+// Filter returns the current filter, which may be nil
+func (s *FilterSink) Filter() *LogFilter {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.filter
+}
+
+// SetFilter replaces the filter of a running stream and resets the context state
+func (s *FilterSink) SetFilter(filter *LogFilter) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.filter = filter
+	s.sources = make(map[string]*filterSource)
+}
+
+// Suppressed returns the number of lines dropped by the filter so far
+func (s *FilterSink) Suppressed() int64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.suppressed
+}
+
+// WriteLine implements LogSink
+func (s *FilterSink) WriteLine(line LogLine) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.err != nil {
+		return s.err
+	}
+	if s.filter == nil || s.filter.IsEmpty() {
+		return s.next.WriteLine(line)
+	}
+
+	key := line.Namespace + "/" + line.Pod + "/" + line.Container
+	source, ok := s.sources[key]
+	if !ok {
+		source = &filterSource{}
+		s.sources[key] = source
+	}
+
+	config := s.filter.config
+
+	switch {
+	case s.filter.Match(line.Content):
+		// Flush the lines leading up to the match, then the match itself
+		for _, contextLine := range source.before {
+			contextLine.Context = true
+			if err := s.next.WriteLine(contextLine); err != nil {
+				return err
+			}
+		}
+		source.before = source.before[:0]
+		source.after = config.After
+		if err := s.next.WriteLine(line); err != nil {
+			return err
+		}
+
+	case source.after > 0:
+		source.after--
+		line.Context = true
+		if err := s.next.WriteLine(line); err != nil {
+			return err
+		}
+
+	case config.Before > 0:
+		// Keep the line around in case the next lines match; it only counts as suppressed once evicted
+		if len(source.before) == config.Before {
+			source.before = source.before[1:]
+			s.suppressed++
+		}
+		source.before = append(source.before, line)
+
+	default:
+		s.suppressed++
+	}
+
+	return s.reportSuppressed()
+}
+
+// WriteEvent implements LogSink
+func (s *FilterSink) WriteEvent(event StreamEvent) error {
+	return s.next.WriteEvent(event)
+}
+
+// Flush counts the context lines still held back, which no match will show now, as suppressed and sends
+// the counter if it changed
+func (s *FilterSink) Flush() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, source := range s.sources {
+		s.suppressed += int64(len(source.before))
+	}
+	s.sources = make(map[string]*filterSource)
+	if s.timer != nil {
+		s.timer.Stop()
+		s.timer = nil
+	}
+	if err := s.sendSuppressed(); err != nil {
+		return err
+	}
+	return s.err
+}
+
+// reportSuppressed sends the suppressed-lines counter if it changed and the report interval has passed
+// Otherwise a change is sent by a timer once the interval has passed
+// The caller must hold s.mu
+func (s *FilterSink) reportSuppressed() error {
+	if s.suppressed == s.reported || s.timer != nil {
+		return nil
+	}
+
+	wait := suppressedReportInterval - time.Since(s.lastReport)
+	if wait <= 0 {
+		return s.sendSuppressed()
+	}
+	var timer *time.Timer
+	timer = time.AfterFunc(wait, func() {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		// The timer may have been stopped by Flush since it fired
+		if s.timer != timer {
+			return
+		}
+		s.timer = nil
+		if err := s.sendSuppressed(); err != nil && s.err == nil {
+			s.err = err
+		}
+	})
+	s.timer = timer
+	return nil
+}
+
+// sendSuppressed sends the suppressed-lines counter if it changed
+// The caller must hold s.mu
+func (s *FilterSink) sendSuppressed() error {
+	if s.suppressed == s.reported {
+		return nil
+	}
+
+	s.reported = s.suppressed
+	s.lastReport = time.Now()
+	return s.next.WriteEvent(StreamEvent{
+		Type:    StreamEventSuppressed,
+		Count:   s.suppressed,
+		Message: fmt.Sprintf("%d lines suppressed by filter", s.suppressed),
+	})
+}
@@ -0,0 +1,107 @@
+package services
+
+import (
+	"testing"
+	"time"
+)
+
+// filterLine is a line of container api
+func filterLine(text string) LogLine {
+	return LogLine{Namespace: "shop", Pod: "api-0", Container: "api", Content: []byte(text + "\n")}
+}
+
+// suppressedCounts returns the counts of the suppressed-lines events written to sink
+func suppressedCounts(sink *recordingSink) []int64 {
+	var counts []int64
+	for _, event := range sink.recordedEvents() {
+		if event.Type == StreamEventSuppressed {
+			counts = append(counts, event.Count)
+		}
+	}
+	return counts
+}
+
+// TestFilterSinkReportsQuietStreams checks that the last suppressed-lines count is sent once the report
+// interval has passed, even though no line follows
+func TestFilterSinkReportsQuietStreams(t *testing.T) {
+	filter, err := NewLogFilter(LogFilterConfig{Include: []string{"keep"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	next := &recordingSink{}
+	sink := NewFilterSink(filter, next)
+
+	for _, text := range []string{"drop", "keep", "drop", "drop"} {
+		if err := sink.WriteLine(filterLine(text)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// The first count is sent at once; the rest waits for the end of the interval
+	if counts := suppressedCounts(next); len(counts) != 1 || counts[0] != 1 {
+		t.Fatalf("suppressed counts = %v, want [1]", counts)
+	}
+
+	deadline := time.Now().Add(suppressedReportInterval + 5*time.Second)
+	for len(suppressedCounts(next)) < 2 {
+		if time.Now().After(deadline) {
+			t.Fatal("the final count of a quiet stream was never sent")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if counts := suppressedCounts(next); len(counts) != 2 || counts[1] != 3 {
+		t.Errorf("suppressed counts = %v, want [1 3]", counts)
+	}
+}
+
+func TestFilterSinkFlush(t *testing.T) {
+	filter, err := NewLogFilter(LogFilterConfig{Include: []string{"keep"}, Before: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	next := &recordingSink{}
+	sink := NewFilterSink(filter, next)
+	if err := sink.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if counts := suppressedCounts(next); len(counts) != 0 {
+		t.Fatalf("Flush of an unfiltered stream sent counts %v", counts)
+	}
+
+	// Three lines of context kept for a match that never comes: one is evicted and reported at once,
+	// the other two are only suppressed once the stream ends
+	for _, text := range []string{"keep", "drop", "drop", "drop"} {
+		if err := sink.WriteLine(filterLine(text)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if counts := suppressedCounts(next); len(counts) != 1 || counts[0] != 1 {
+		t.Fatalf("suppressed counts = %v, want [1]", counts)
+	}
+
+	if err := sink.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if counts := suppressedCounts(next); len(counts) != 2 || counts[1] != 3 {
+		t.Fatalf("suppressed counts after Flush = %v, want [1 3]", counts)
+	}
+	if got := sink.Suppressed(); got != 3 {
+		t.Errorf("Suppressed() = %d, want 3", got)
+	}
+
+	// An eviction within the interval waits for the timer; Flush sends it at once and the timer nothing more
+	for _, text := range []string{"drop", "drop", "drop"} {
+		if err := sink.WriteLine(filterLine(text)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if counts := suppressedCounts(next); len(counts) != 2 {
+		t.Fatalf("suppressed counts = %v, want [1 3] until the interval has passed", counts)
+	}
+	if err := sink.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(suppressedReportInterval + 100*time.Millisecond)
+	if counts := suppressedCounts(next); len(counts) != 3 || counts[2] != 6 {
+		t.Errorf("suppressed counts = %v, want [1 3 6]", counts)
+	}
+}
@@ -0,0 +1,377 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// hubSubscriberBuffer is the number of messages buffered for a subscriber that falls behind
+// Beyond it the subscriber's HubOverflow applies, so one slow viewer never stalls the others
+const hubSubscriberBuffer = 10000
+
+// HubOverflow is what the hub does with a subscriber that falls hubSubscriberBuffer messages behind
+type HubOverflow int
+
+const (
+	// HubDropOldest drops the subscriber's oldest messages and tells it how many were lost
+	HubDropOldest HubOverflow = iota
+	// HubDisconnect ends the subscriber's stream with ErrSubscriberBehind
+	HubDisconnect
+	// HubBlock moves the subscriber to an upstream of its own, resumed after its last line, which
+	// waits for it instead of running ahead
+	HubBlock
+)
+
+// ErrSubscriberBehind ends the stream of a HubDisconnect subscriber that fell behind
+var ErrSubscriberBehind = errors.New("subscriber fell too far behind the shared log stream")
+
+// HubKey identifies a shared upstream stream
+type HubKey struct {
+	Cluster   string
+	Namespace string
+	Pod       string
+	Container string
+	Options   string
+}
+
+// LogHub multiplexes followed container log streams: all subscribers asking for the same container
+// with the same options share one upstream GetLogs stream. The upstream is opened by the first
+// subscriber and closed when the last one leaves. Subscribers joining a running stream first get
+// the lines it has already tailed. Only streams with a tailLines are shared: the history of a since
+// window or of the whole log cannot be rebuilt from the tailed lines for a late subscriber
+//
+// The hub does not check permissions; callers must authorize every subscriber
+type LogHub struct {
+	mu        sync.Mutex
+	upstreams map[HubKey]*hubUpstream
+}
+
+// NewLogHub creates an empty hub
+func NewLogHub() *LogHub {
+	return &LogHub{upstreams: make(map[HubKey]*hubUpstream)}
+}
+
+// hubMessage is a line or an event on its way to a subscriber
+type hubMessage struct {
+	line  *LogLine
+	event *StreamEvent
+}
+
+// hubUpstream is one shared upstream stream and its subscribers
+type hubUpstream struct {
+	key    HubKey
+	cancel context.CancelFunc
+	done   chan struct{}
+
+	mu          sync.Mutex
+	subscribers map[*hubSubscriber]struct{}
+	recent      []LogLine
+	recentLimit int
+	err         error
+}
+
+// hubSubscriber buffers messages for one subscriber
+type hubSubscriber struct {
+	overflow HubOverflow
+	// resume tracks the lines delivered to a HubBlock subscriber, so its own upstream can pick up after them
+	resume *streamResume
+
+	mu      sync.Mutex
+	queue   []hubMessage
+	dropped int64
+	// behind is set once the buffer overflowed under HubDisconnect or HubBlock; later messages are ignored
+	behind bool
+	wake   chan struct{}
+}
+
+// Subscribers returns the number of subscribers of each running upstream
+func (h *LogHub) Subscribers() map[HubKey]int {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	counts := make(map[HubKey]int, len(h.upstreams))
+	for key, upstream := range h.upstreams {
+		upstream.mu.Lock()
+		counts[key] = len(upstream.subscribers)
+		upstream.mu.Unlock()
+	}
+	return counts
+}
+
+// StreamLogs follows a container like KubernetesService.StreamLogs, sharing the upstream stream
+// with every other subscriber of the same cluster, container and options
+// It blocks until ctx is cancelled or the upstream ends, and returns the upstream's error
+// Streams without opts.TailLines get their own upstream, so every viewer receives the same history
+// it would get alone. overflow applies once the subscriber falls behind the shared upstream
+func (h *LogHub) StreamLogs(ctx context.Context, k *KubernetesService, cluster, namespace, podName, container string, opts LogOptions, overflow HubOverflow, sink LogSink) error {
+	if err := opts.Validate(); err != nil {
+		return fmt.Errorf("invalid log options: %w", err)
+	}
+	if opts.TailLines == nil {
+		return k.StreamLogs(ctx, namespace, podName, container, opts, sink)
+	}
+
+	// The key names the container streamed, so subscribers that leave it out share the upstream of
+	// those that name it
+	if container == "" {
+		pod, err := k.clientset.CoreV1().Pods(namespace).Get(ctx, podName, metav1.GetOptions{})
+		if err != nil {
+			return fmt.Errorf("failed to get pod: %w", err)
+		}
+		if len(pod.Spec.Containers) > 0 {
+			container = pod.Spec.Containers[0].Name
+		}
+	}
+
+	key := HubKey{Cluster: cluster, Namespace: namespace, Pod: podName, Container: container, Options: opts.key()}
+	upstream, sub := h.subscribe(k, key, opts, overflow)
+	defer h.unsubscribe(upstream, sub)
+
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-sub.wake:
+			if err := sub.deliver(sink); err != nil {
+				return fmt.Errorf("error writing log line: %w", err)
+			}
+			if sub.isBehind() {
+				h.unsubscribe(upstream, sub)
+				if overflow == HubDisconnect {
+					return ErrSubscriberBehind
+				}
+				return k.StreamLogs(ctx, namespace, podName, container, sub.resumedOptions(opts), &resumedSink{resume: sub.resume, sink: sink})
+			}
+		case <-upstream.done:
+			// Deliver what the upstream sent before it ended
+			if err := sub.deliver(sink); err != nil {
+				return fmt.Errorf("error writing log line: %w", err)
+			}
+			upstream.mu.Lock()
+			defer upstream.mu.Unlock()
+			return upstream.err
+		}
+	}
+}
+
+// subscribe adds a subscriber to the upstream for key, starting the upstream if needed
+func (h *LogHub) subscribe(k *KubernetesService, key HubKey, opts LogOptions, overflow HubOverflow) (*hubUpstream, *hubSubscriber) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	// An upstream that has ended but not yet been removed is replaced
+	upstream, exists := h.upstreams[key]
+	if !exists || upstream.finished() {
+		ctx, cancel := context.WithCancel(context.Background())
+		upstream = &hubUpstream{
+			key:         key,
+			cancel:      cancel,
+			done:        make(chan struct{}),
+			subscribers: make(map[*hubSubscriber]struct{}),
+			recentLimit: int(*opts.TailLines),
+		}
+		h.upstreams[key] = upstream
+
+		go func() {
+			err := k.StreamLogs(ctx, key.Namespace, key.Pod, key.Container, opts, upstream)
+			upstream.finish(err)
+
+			h.mu.Lock()
+			if h.upstreams[key] == upstream {
+				delete(h.upstreams, key)
+			}
+			h.mu.Unlock()
+		}()
+	}
+
+	sub := &hubSubscriber{overflow: overflow, wake: make(chan struct{}, 1)}
+	if overflow == HubBlock {
+		sub.resume = &streamResume{}
+	}
+
+	upstream.mu.Lock()
+	for i := range upstream.recent {
+		line := upstream.recent[i]
+		sub.queue = append(sub.queue, hubMessage{line: &line})
+	}
+	upstream.subscribers[sub] = struct{}{}
+	upstream.mu.Unlock()
+
+	// Deliver the lines tailed before this subscriber joined
+	sub.signal()
+	return upstream, sub
+}
+
+// unsubscribe removes a subscriber and stops the upstream when it was the last one
+// Removing a subscriber that was already removed does nothing
+func (h *LogHub) unsubscribe(upstream *hubUpstream, sub *hubSubscriber) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	upstream.mu.Lock()
+	_, subscribed := upstream.subscribers[sub]
+	delete(upstream.subscribers, sub)
+	empty := len(upstream.subscribers) == 0
+	upstream.mu.Unlock()
+
+	if subscribed && empty {
+		upstream.cancel()
+		if h.upstreams[upstream.key] == upstream {
+			delete(h.upstreams, upstream.key)
+		}
+	}
+}
+
+// WriteLine implements LogSink for the upstream stream
+func (u *hubUpstream) WriteLine(line LogLine) error {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	if u.recentLimit > 0 {
+		if len(u.recent) == u.recentLimit {
+			u.recent = u.recent[1:]
+		}
+		u.recent = append(u.recent, line)
+	}
+
+	for sub := range u.subscribers {
+		sub.push(hubMessage{line: &line})
+	}
+	return nil
+}
+
+// WriteEvent implements LogSink for the upstream stream
+func (u *hubUpstream) WriteEvent(event StreamEvent) error {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	for sub := range u.subscribers {
+		sub.push(hubMessage{event: &event})
+	}
+	return nil
+}
+
+// finish records the upstream's result and releases its subscribers
+func (u *hubUpstream) finish(err error) {
+	if err != nil && err != context.Canceled {
+		log.Printf("Shared log stream for %s/%s/%s ended: %v", u.key.Namespace, u.key.Pod, u.key.Container, err)
+	}
+
+	u.mu.Lock()
+	u.err = err
+	u.mu.Unlock()
+	close(u.done)
+}
+
+// finished reports whether the upstream stream has ended
+func (u *hubUpstream) finished() bool {
+	select {
+	case <-u.done:
+		return true
+	default:
+		return false
+	}
+}
+
+// push queues a message, applying the subscriber's overflow policy when the buffer is full
+func (s *hubSubscriber) push(message hubMessage) {
+	s.mu.Lock()
+	switch {
+	case s.behind:
+	case len(s.queue) < hubSubscriberBuffer:
+		s.queue = append(s.queue, message)
+	case s.overflow == HubDropOldest:
+		s.queue[0] = hubMessage{}
+		s.queue = append(s.queue[1:], message)
+		s.dropped++
+	default:
+		s.behind = true
+	}
+	s.mu.Unlock()
+
+	s.signal()
+}
+
+// isBehind reports whether the subscriber fell behind and has to leave the shared upstream
+func (s *hubSubscriber) isBehind() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.behind
+}
+
+// resumedOptions returns the options of a HubBlock subscriber's own upstream, which starts from the
+// time of the last line delivered from the shared one
+func (s *hubSubscriber) resumedOptions(opts LogOptions) LogOptions {
+	opts.PreviousTail = nil
+	if !s.resume.last.IsZero() {
+		since := s.resume.last
+		opts.SinceTime = &since
+		opts.TailLines, opts.SinceSeconds = nil, nil
+	}
+	s.resume.reconnecting()
+	return opts
+}
+
+// signal wakes the subscriber without blocking
+func (s *hubSubscriber) signal() {
+	select {
+	case s.wake <- struct{}{}:
+	default:
+	}
+}
+
+// deliver writes the buffered messages to sink, preceded by a notice if any were dropped
+func (s *hubSubscriber) deliver(sink LogSink) error {
+	s.mu.Lock()
+	queue, dropped := s.queue, s.dropped
+	s.queue, s.dropped = nil, 0
+	s.mu.Unlock()
+
+	if dropped > 0 {
+		if err := sink.WriteEvent(StreamEvent{
+			Type:    StreamEventDropped,
+			Count:   dropped,
+			Message: fmt.Sprintf("%d lines dropped", dropped),
+		}); err != nil {
+			return err
+		}
+	}
+
+	for _, message := range queue {
+		var err error
+		if message.line != nil {
+			if s.resume != nil {
+				s.resume.deliver(message.line.Timestamp, message.line.Content)
+			}
+			err = sink.WriteLine(*message.line)
+		} else {
+			err = sink.WriteEvent(*message.event)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// resumedSink passes on the lines of a resumed stream that resume has not seen delivered yet
+type resumedSink struct {
+	resume *streamResume
+	sink   LogSink
+}
+
+func (s *resumedSink) WriteLine(line LogLine) error {
+	if !s.resume.deliver(line.Timestamp, line.Content) {
+		return nil
+	}
+	return s.sink.WriteLine(line)
+}
+
+func (s *resumedSink) WriteEvent(event StreamEvent) error {
+	return s.sink.WriteEvent(event)
+}
@@ -0,0 +1,115 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func TestHubSubscriberOverflow(t *testing.T) {
+	tests := []struct {
+		name     string
+		overflow HubOverflow
+		// queued and dropped are the messages buffered and reported lost once the buffer overflowed
+		queued  int
+		dropped int64
+		behind  bool
+	}{
+		{name: "drop oldest", overflow: HubDropOldest, queued: hubSubscriberBuffer, dropped: 5},
+		{name: "disconnect", overflow: HubDisconnect, queued: hubSubscriberBuffer, behind: true},
+		{name: "block", overflow: HubBlock, queued: hubSubscriberBuffer, behind: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sub := &hubSubscriber{overflow: tt.overflow, wake: make(chan struct{}, 1)}
+			for i := 0; i < hubSubscriberBuffer+5; i++ {
+				sub.push(hubMessage{line: &LogLine{Content: []byte("line")}})
+			}
+			if len(sub.queue) != tt.queued || sub.dropped != tt.dropped || sub.isBehind() != tt.behind {
+				t.Errorf("queued %d, dropped %d, behind %v; want %d, %d, %v",
+					len(sub.queue), sub.dropped, sub.isBehind(), tt.queued, tt.dropped, tt.behind)
+			}
+		})
+	}
+}
+
+func TestHubSubscriberResumedOptions(t *testing.T) {
+	tailLines, previousTail := int64(100), int64(20)
+	opts := LogOptions{Follow: true, TailLines: &tailLines, PreviousTail: &previousTail}
+	sub := &hubSubscriber{overflow: HubBlock, resume: &streamResume{}, wake: make(chan struct{}, 1)}
+	for _, raw := range []string{"2024-01-02T15:04:05.1Z a\n", "2024-01-02T15:04:05.5Z b\n"} {
+		sub.push(hubMessage{line: &LogLine{Timestamp: mustTimestamp(t, raw), Content: []byte(raw)}})
+	}
+	if err := sub.deliver(&recordingSink{}); err != nil {
+		t.Fatal(err)
+	}
+
+	resumed := sub.resumedOptions(opts)
+	if resumed.TailLines != nil || resumed.PreviousTail != nil || resumed.SinceTime == nil || !resumed.SinceTime.Equal(mustTimestamp(t, "2024-01-02T15:04:05.5Z b")) {
+		t.Errorf("resumed options = %s, want to start at the last delivered line", resumed.key())
+	}
+
+	// The resumed upstream replays the second of the last line; only the lines after it get through
+	sink := &recordingSink{}
+	resumedSink := &resumedSink{resume: sub.resume, sink: sink}
+	for _, raw := range []string{"2024-01-02T15:04:05.1Z a\n", "2024-01-02T15:04:05.5Z b\n", "2024-01-02T15:04:06Z c\n"} {
+		resumedSink.WriteLine(LogLine{Timestamp: mustTimestamp(t, raw), Content: []byte(raw)})
+	}
+	if lines := sink.recorded(); len(lines) != 1 || string(lines[0].Content) != "2024-01-02T15:04:06Z c\n" {
+		t.Errorf("resumed stream delivered %d lines, want only the line after the shared stream's last", len(lines))
+	}
+}
+
+// mustTimestamp returns the timestamp prefix of raw
+func mustTimestamp(t *testing.T, raw string) time.Time {
+	t.Helper()
+	timestamp, _ := SplitTimestamp([]byte(raw))
+	if timestamp.IsZero() {
+		t.Fatalf("no timestamp in %q", raw)
+	}
+	return timestamp
+}
+
+// TestLogHubDefaultContainer checks that a subscriber leaving out the container shares the upstream of
+// one naming the pod's first container
+func TestLogHubDefaultContainer(t *testing.T) {
+	k := NewKubernetesServiceForClient(fake.NewSimpleClientset(runningPod("api-0", nil, "app", "sidecar")))
+	hub := NewLogHub()
+	tailLines := int64(10)
+	opts := LogOptions{Follow: true, TailLines: &tailLines}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	results := make(chan error, 2)
+	for _, container := range []string{"", "app"} {
+		go func(container string) {
+			results <- hub.StreamLogs(ctx, k, "test", "shop", "api-0", container, opts, HubDropOldest, &recordingSink{})
+		}(container)
+	}
+
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		subscribers := hub.Subscribers()
+		if len(subscribers) == 1 {
+			for key, count := range subscribers {
+				if key.Container == "app" && count == 2 {
+					cancel()
+					for i := 0; i < 2; i++ {
+						if err := <-results; !errors.Is(err, context.Canceled) {
+							t.Errorf("StreamLogs = %v, want it to end with the context", err)
+						}
+					}
+					return
+				}
+			}
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("upstreams = %v, want one for container app with 2 subscribers", subscribers)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
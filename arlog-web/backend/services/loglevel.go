@@ -0,0 +1,133 @@
+package services
+
+import (
+	"bytes"
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// LogLevel is the severity of a log line, ordered from least to most severe
+type LogLevel int
+
+const (
+	LevelUnknown LogLevel = iota
+	LevelTrace
+	LevelDebug
+	LevelInfo
+	LevelWarn
+	LevelError
+	LevelFatal
+)
+
+// levelNames maps level names, as they commonly appear in logs, to levels
+var levelNames = map[string]LogLevel{
+	"trace":    LevelTrace,
+	"debug":    LevelDebug,
+	"dbg":      LevelDebug,
+	"info":     LevelInfo,
+	"inf":      LevelInfo,
+	"notice":   LevelInfo,
+	"warn":     LevelWarn,
+	"warning":  LevelWarn,
+	"wrn":      LevelWarn,
+	"error":    LevelError,
+	"err":      LevelError,
+	"fatal":    LevelFatal,
+	"panic":    LevelFatal,
+	"critical": LevelFatal,
+	"crit":     LevelFatal,
+}
+
+// String returns the canonical lower-case name of the level
+func (l LogLevel) String() string {
+	switch l {
+	case LevelTrace:
+		return "trace"
+	case LevelDebug:
+		return "debug"
+	case LevelInfo:
+		return "info"
+	case LevelWarn:
+		return "warn"
+	case LevelError:
+		return "error"
+	case LevelFatal:
+		return "fatal"
+	default:
+		return "unknown"
+	}
+}
+
+// ParseLogLevel parses a level name such as "warn" or "ERROR"
+func ParseLogLevel(name string) (LogLevel, error) {
+	if level, ok := levelNames[strings.ToLower(name)]; ok {
+		return level, nil
+	}
+	return LevelUnknown, fmt.Errorf("unknown log level: %q", name)
+}
+
+// levelScanLimit is how many bytes at the start of a line are searched for a level
+const levelScanLimit = 256
+
+var (
+	// structuredLevelPattern matches "level":"error" (JSON) and level=error (logfmt) style fields
+	structuredLevelPattern = regexp.MustCompile(`(?i)(?:"(?:level|severity|lvl|loglevel)"\s*:\s*"|\b(?:level|severity|lvl|loglevel)=["']?)([a-z]+)`)
+	// bareLevelPattern matches upper-case level words such as ERROR or [WARN]
+	bareLevelPattern = regexp.MustCompile(`\b(TRACE|DEBUG|DBG|INFO|NOTICE|WARN|WARNING|ERROR|ERR|FATAL|PANIC|CRITICAL|CRIT)\b`)
+	// klogPattern matches the klog header, e.g. "E0102 15:04:05.000000"
+	klogPattern = regexp.MustCompile(`^([IWEF])\d{4} \d{2}:\d{2}:\d{2}`)
+)
+
+// klogLevels maps klog severity letters to levels
+var klogLevels = map[byte]LogLevel{
+	'I': LevelInfo,
+	'W': LevelWarn,
+	'E': LevelError,
+	'F': LevelFatal,
+}
+
+// DetectLevel guesses the level of a log line from its first bytes
+// It understands JSON and logfmt level fields, klog headers and upper-case level words
+func DetectLevel(content []byte) LogLevel {
+	_, content = SplitTimestamp(content)
+	if len(content) > levelScanLimit {
+		content = content[:levelScanLimit]
+	}
+
+	if match := structuredLevelPattern.FindSubmatch(content); match != nil {
+		if level, ok := levelNames[strings.ToLower(string(match[1]))]; ok {
+			return level
+		}
+	}
+
+	if match := klogPattern.FindSubmatch(content); match != nil {
+		return klogLevels[match[1][0]]
+	}
+
+	if match := bareLevelPattern.FindSubmatch(content); match != nil {
+		return levelNames[strings.ToLower(string(match[1]))]
+	}
+
+	return LevelUnknown
+}
+
+// SplitTimestamp separates the RFC3339 timestamp Kubernetes prefixes to lines when timestamps are
+// requested. If the line has no such prefix, a zero time and the unchanged line are returned
+func SplitTimestamp(content []byte) (time.Time, []byte) {
+	if len(content) == 0 || content[0] < '0' || content[0] > '9' {
+		return time.Time{}, content
+	}
+
+	space := bytes.IndexByte(content, ' ')
+	if space < 0 {
+		return time.Time{}, content
+	}
+
+	timestamp, err := time.Parse(time.RFC3339Nano, string(content[:space]))
+	if err != nil {
+		return time.Time{}, content
+	}
+	return timestamp, content[space+1:]
+}
@@ -0,0 +1,137 @@
+package services
+
+import (
+	"fmt"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// Server-enforced limits for log requests
+const (
+	// DefaultTailLines is used when neither tailLines nor a since option is given
+	DefaultTailLines int64 = 100
+	// MaxTailLines is the largest tailLines value a client may request
+	MaxTailLines int64 = 10000
+	// MaxSinceSeconds limits how far back a client may look (7 days)
+	MaxSinceSeconds int64 = 7 * 24 * 60 * 60
+	// MaxLimitBytes is the largest limitBytes value a client may request (50 MiB)
+	MaxLimitBytes int64 = 50 * 1024 * 1024
+)
+
+// LogOptions holds the client-controllable options of a log request
+// It mirrors corev1.PodLogOptions, minus the container name
+type LogOptions struct {
+	Follow       bool
+	TailLines    *int64
+	SinceSeconds *int64
+	SinceTime    *time.Time
+	LimitBytes   *int64
+	Previous     bool
+	Timestamps   bool
+	// PreviousTail, if set, sends this many lines of the previous instance of a restarted container
+	// before the current instance's logs. It is not part of PodLogOptions
+	PreviousTail *int64
+}
+
+// DefaultLogOptions returns the options used when a client does not specify any
+func DefaultLogOptions() LogOptions {
+	tailLines := DefaultTailLines
+	return LogOptions{
+		Follow:     true,
+		TailLines:  &tailLines,
+		Timestamps: true,
+	}
+}
+
+// Validate checks the options against the server-enforced limits
+func (o LogOptions) Validate() error {
+	if o.TailLines != nil {
+		if *o.TailLines < 0 {
+			return fmt.Errorf("tailLines must not be negative")
+		}
+		if *o.TailLines > MaxTailLines {
+			return fmt.Errorf("tailLines must not exceed %d", MaxTailLines)
+		}
+	}
+
+	if o.SinceSeconds != nil && o.SinceTime != nil {
+		return fmt.Errorf("only one of sinceSeconds and sinceTime may be specified")
+	}
+
+	if o.SinceSeconds != nil {
+		if *o.SinceSeconds < 1 {
+			return fmt.Errorf("sinceSeconds must be at least 1")
+		}
+		if *o.SinceSeconds > MaxSinceSeconds {
+			return fmt.Errorf("sinceSeconds must not exceed %d", MaxSinceSeconds)
+		}
+	}
+
+	if o.SinceTime != nil {
+		if o.SinceTime.After(time.Now()) {
+			return fmt.Errorf("sinceTime must not be in the future")
+		}
+		if time.Since(*o.SinceTime) > time.Duration(MaxSinceSeconds)*time.Second {
+			return fmt.Errorf("sinceTime must not be more than %d seconds ago", MaxSinceSeconds)
+		}
+	}
+
+	if o.PreviousTail != nil {
+		if *o.PreviousTail < 0 || *o.PreviousTail > MaxTailLines {
+			return fmt.Errorf("previousTail must be between 0 and %d", MaxTailLines)
+		}
+		if o.Previous {
+			return fmt.Errorf("previousTail cannot be combined with previous")
+		}
+	}
+
+	if o.LimitBytes != nil {
+		if *o.LimitBytes < 1 {
+			return fmt.Errorf("limitBytes must be at least 1")
+		}
+		if *o.LimitBytes > MaxLimitBytes {
+			return fmt.Errorf("limitBytes must not exceed %d", MaxLimitBytes)
+		}
+	}
+
+	return nil
+}
+
+// PodLogOptions converts the options into the Kubernetes API representation for a container
+func (o LogOptions) PodLogOptions(container string) *corev1.PodLogOptions {
+	logOptions := &corev1.PodLogOptions{
+		Container:    container,
+		Follow:       o.Follow,
+		Previous:     o.Previous,
+		Timestamps:   o.Timestamps,
+		TailLines:    o.TailLines,
+		SinceSeconds: o.SinceSeconds,
+		LimitBytes:   o.LimitBytes,
+	}
+
+	if o.SinceTime != nil {
+		sinceTime := metav1.NewTime(*o.SinceTime)
+		logOptions.SinceTime = &sinceTime
+	}
+
+	return logOptions
+}
+
+// key returns a canonical representation of the options, equal for options that request the same logs
+func (o LogOptions) key() string {
+	format := func(v *int64) string {
+		if v == nil {
+			return "-"
+		}
+		return fmt.Sprint(*v)
+	}
+	sinceTime := "-"
+	if o.SinceTime != nil {
+		sinceTime = o.SinceTime.UTC().Format(time.RFC3339Nano)
+	}
+	return fmt.Sprintf("follow=%t tail=%s since=%s sinceTime=%s limit=%s previous=%t timestamps=%t previousTail=%s",
+		o.Follow, format(o.TailLines), format(o.SinceSeconds), sinceTime, format(o.LimitBytes),
+		o.Previous, o.Timestamps, format(o.PreviousTail))
+}
@@ -0,0 +1,302 @@
+package services
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// LogFormat is the structure of a log line
+type LogFormat string
+
+const (
+	// FormatAuto detects the format of each line
+	FormatAuto LogFormat = "auto"
+	// FormatJSON is one JSON object per line
+	FormatJSON LogFormat = "json"
+	// FormatLogfmt is key=value pairs, as written by logrus, go-kit and slog's text handler
+	FormatLogfmt LogFormat = "logfmt"
+	// FormatKlog is the Kubernetes klog format, e.g. `I0102 15:04:05.000000 1 main.go:10] msg`
+	FormatKlog LogFormat = "klog"
+	// FormatPlain is unstructured text; lines with this hint are not parsed
+	FormatPlain LogFormat = "plain"
+)
+
+// ParseLogFormat parses a format name
+func ParseLogFormat(name string) (LogFormat, error) {
+	switch format := LogFormat(strings.ToLower(name)); format {
+	case FormatAuto, FormatJSON, FormatLogfmt, FormatKlog, FormatPlain:
+		return format, nil
+	}
+	return "", fmt.Errorf("unknown log format: %q (expected auto, json, logfmt, klog or plain)", name)
+}
+
+// FormatHints maps container names to the format their lines are parsed as, skipping detection
+// The empty name sets the format of containers without a hint of their own
+type FormatHints map[string]LogFormat
+
+// For returns the format to parse a container's lines as
+func (h FormatHints) For(container string) LogFormat {
+	if format, ok := h[container]; ok {
+		return format
+	}
+	if format, ok := h[""]; ok {
+		return format
+	}
+	return FormatAuto
+}
+
+// ParsedLine holds the fields extracted from a structured log line
+// The standard fields are lifted out of Fields under their common names
+type ParsedLine struct {
+	Format  LogFormat              `json:"format"`
+	Level   string                 `json:"level,omitempty"`
+	Message string                 `json:"message,omitempty"`
+	Time    *time.Time             `json:"time,omitempty"`
+	Logger  string                 `json:"logger,omitempty"`
+	TraceID string                 `json:"traceId,omitempty"`
+	Fields  map[string]interface{} `json:"fields,omitempty"`
+}
+
+// Keys under which the standard fields commonly appear, in order of preference
+var (
+	levelKeys   = []string{"level", "lvl", "severity", "loglevel", "log.level"}
+	messageKeys = []string{"msg", "message", "@message"}
+	timeKeys    = []string{"time", "ts", "timestamp", "@timestamp", "t"}
+	loggerKeys  = []string{"logger", "logger_name", "log.logger", "component"}
+	traceKeys   = []string{"trace_id", "traceId", "traceID", "trace.id", "dd.trace_id", "logging.googleapis.com/trace"}
+)
+
+// ParseLine parses a log line in the given format, detecting it with FormatAuto
+// It returns nil for lines that are not structured, or do not parse as the given format
+func ParseLine(content []byte, format LogFormat) *ParsedLine {
+	_, content = SplitTimestamp(content)
+	content = bytes.TrimRight(content, "\r\n")
+	if len(content) == 0 || !utf8.Valid(content) {
+		return nil
+	}
+
+	switch format {
+	case FormatJSON:
+		return parseJSONLine(content)
+	case FormatLogfmt:
+		return parseLogfmtLine(content)
+	case FormatKlog:
+		return parseKlogLine(content)
+	case FormatPlain:
+		return nil
+	}
+
+	// Detect the format from the first byte, which rules out all but one candidate
+	switch {
+	case content[0] == '{':
+		return parseJSONLine(content)
+	case klogPattern.Match(content):
+		return parseKlogLine(content)
+	default:
+		return parseLogfmtLine(content)
+	}
+}
+
+// parseJSONLine parses a line holding a single JSON object
+func parseJSONLine(content []byte) *ParsedLine {
+	decoder := json.NewDecoder(bytes.NewReader(content))
+	decoder.UseNumber()
+
+	fields := make(map[string]interface{})
+	if err := decoder.Decode(&fields); err != nil || decoder.More() {
+		return nil
+	}
+	return newParsedLine(FormatJSON, fields)
+}
+
+// parseLogfmtLine parses a line of key=value pairs
+// Lines with fewer than two pairs are treated as unstructured, so prose containing a stray "=" is not
+// mistaken for logfmt
+func parseLogfmtLine(content []byte) *ParsedLine {
+	fields, ok := parseLogfmt(string(content))
+	if !ok || len(fields) < 2 {
+		return nil
+	}
+	return newParsedLine(FormatLogfmt, fields)
+}
+
+// parseLogfmt splits s into key=value pairs; values may be double-quoted with Go escapes
+// It fails if s is not entirely made of pairs
+func parseLogfmt(s string) (map[string]interface{}, bool) {
+	fields := make(map[string]interface{})
+	for {
+		s = strings.TrimLeft(s, " \t")
+		if s == "" {
+			return fields, true
+		}
+
+		end := strings.IndexAny(s, "= \t")
+		if end <= 0 || s[end] != '=' || strings.ContainsRune(s[:end], '"') {
+			return nil, false
+		}
+		key := s[:end]
+		s = s[end+1:]
+
+		if strings.HasPrefix(s, `"`) {
+			quoted, err := strconv.QuotedPrefix(s)
+			if err != nil {
+				return nil, false
+			}
+			value, err := strconv.Unquote(quoted)
+			if err != nil {
+				return nil, false
+			}
+			fields[key] = value
+			s = s[len(quoted):]
+			continue
+		}
+
+		valueEnd := strings.IndexAny(s, " \t")
+		if valueEnd < 0 {
+			valueEnd = len(s)
+		}
+		fields[key] = s[:valueEnd]
+		s = s[valueEnd:]
+	}
+}
+
+// parseKlogLine parses a klog line: `Lmmdd hh:mm:ss.uuuuuu threadid file:line] msg`
+// Structured klog (`] "msg" key="value"`) also yields the key/value pairs
+func parseKlogLine(content []byte) *ParsedLine {
+	line := string(content)
+	header, message, found := strings.Cut(line, "] ")
+	if !found || !klogPattern.MatchString(header) {
+		return nil
+	}
+
+	// Header fields: severity+date, time, thread ID, source location
+	parts := strings.Fields(header)
+	if len(parts) < 4 {
+		return nil
+	}
+
+	fields := map[string]interface{}{
+		"thread": parts[2],
+		"caller": parts[3],
+	}
+	if len(message) > 0 && message[0] == '"' {
+		if quoted, err := strconv.QuotedPrefix(message); err == nil {
+			if pairs, ok := parseLogfmt(message[len(quoted):]); ok {
+				for key, value := range pairs {
+					fields[key] = value
+				}
+				message, _ = strconv.Unquote(quoted)
+			}
+		}
+	}
+
+	parsed := newParsedLine(FormatKlog, fields)
+	parsed.Level = klogLevels[header[0]].String()
+	parsed.Message = message
+
+	// klog omits the year; assume the most recent matching date
+	if timestamp, err := time.Parse("0102 15:04:05.000000", parts[0][1:]+" "+parts[1]); err == nil {
+		now := time.Now().UTC()
+		timestamp = timestamp.AddDate(now.Year(), 0, 0)
+		if timestamp.After(now.Add(24 * time.Hour)) {
+			timestamp = timestamp.AddDate(-1, 0, 0)
+		}
+		parsed.Time = &timestamp
+	}
+	return parsed
+}
+
+// newParsedLine lifts the standard fields out of fields
+func newParsedLine(format LogFormat, fields map[string]interface{}) *ParsedLine {
+	parsed := &ParsedLine{Format: format}
+
+	if value, ok := takeString(fields, levelKeys); ok {
+		if level, known := levelNames[strings.ToLower(value)]; known {
+			parsed.Level = level.String()
+		} else {
+			parsed.Level = strings.ToLower(value)
+		}
+	}
+	parsed.Message, _ = takeString(fields, messageKeys)
+	parsed.Logger, _ = takeString(fields, loggerKeys)
+	parsed.TraceID, _ = takeString(fields, traceKeys)
+
+	for _, key := range timeKeys {
+		if value, ok := fields[key]; ok {
+			if timestamp, ok := parseFieldTime(value); ok {
+				parsed.Time = &timestamp
+				delete(fields, key)
+				break
+			}
+		}
+	}
+
+	if len(fields) > 0 {
+		parsed.Fields = fields
+	}
+	return parsed
+}
+
+// takeString removes and returns the first of keys holding a string or number
+func takeString(fields map[string]interface{}, keys []string) (string, bool) {
+	for _, key := range keys {
+		switch value := fields[key].(type) {
+		case string:
+			delete(fields, key)
+			return value, true
+		case json.Number:
+			delete(fields, key)
+			return value.String(), true
+		}
+	}
+	return "", false
+}
+
+// parseFieldTime parses an RFC3339 time or a Unix timestamp in seconds, as written by zap
+func parseFieldTime(value interface{}) (time.Time, bool) {
+	var text string
+	switch value := value.(type) {
+	case string:
+		text = value
+	case json.Number:
+		text = value.String()
+	default:
+		return time.Time{}, false
+	}
+
+	if timestamp, err := time.Parse(time.RFC3339Nano, text); err == nil {
+		return timestamp, true
+	}
+	if seconds, err := strconv.ParseFloat(text, 64); err == nil && seconds > 0 {
+		whole := int64(seconds)
+		return time.Unix(whole, int64((seconds-float64(whole))*1e9)).UTC(), true
+	}
+	return time.Time{}, false
+}
+
+// ParseSink parses each line with its container's format before passing it on
+type ParseSink struct {
+	hints FormatHints
+	next  LogSink
+}
+
+// NewParseSink creates a sink that sets LogLine.Parsed on the lines written to next
+func NewParseSink(hints FormatHints, next LogSink) *ParseSink {
+	return &ParseSink{hints: hints, next: next}
+}
+
+// WriteLine implements LogSink
+func (s *ParseSink) WriteLine(line LogLine) error {
+	line.Parsed = ParseLine(line.Content, s.hints.For(line.Container))
+	return s.next.WriteLine(line)
+}
+
+// WriteEvent implements LogSink
+func (s *ParseSink) WriteEvent(event StreamEvent) error {
+	return s.next.WriteEvent(event)
+}
@@ -0,0 +1,248 @@
+package services
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// parseCase is a line and the fields it parses to; a nil want means the line is not structured
+type parseCase struct {
+	name string
+	line string
+	want *ParsedLine
+}
+
+// checkParse parses each case in format and compares the result
+// timeLayout formats the parsed times compared with the wanted ones
+func checkParse(t *testing.T, format LogFormat, timeLayout string, tests []parseCase) {
+	t.Helper()
+	for _, tt := range tests {
+		got := ParseLine([]byte(tt.line), format)
+		if tt.want == nil {
+			if got != nil {
+				t.Errorf("%s: ParseLine(%q, %s) = %+v, want nil", tt.name, tt.line, format, got)
+			}
+			continue
+		}
+		if got == nil {
+			t.Errorf("%s: ParseLine(%q, %s) = nil, want %+v", tt.name, tt.line, format, tt.want)
+			continue
+		}
+
+		gotTime, wantTime := "", ""
+		if got.Time != nil {
+			gotTime = got.Time.Format(timeLayout)
+		}
+		if tt.want.Time != nil {
+			wantTime = tt.want.Time.Format(timeLayout)
+		}
+		if gotTime != wantTime {
+			t.Errorf("%s: time = %q, want %q", tt.name, gotTime, wantTime)
+		}
+		gotFields, wantFields := *got, *tt.want
+		gotFields.Time, wantFields.Time = nil, nil
+		if !reflect.DeepEqual(gotFields, wantFields) {
+			t.Errorf("%s: ParseLine(%q, %s) = %+v, want %+v", tt.name, tt.line, format, gotFields, wantFields)
+		}
+	}
+}
+
+// at returns a pointer to a time, for wanted ParsedLines
+func at(t time.Time) *time.Time {
+	return &t
+}
+
+func TestParseJSONLine(t *testing.T) {
+	checkParse(t, FormatJSON, time.RFC3339Nano, []parseCase{
+		{
+			name: "standard fields",
+			line: `{"level":"WARN","msg":"disk almost full","time":"2024-01-02T15:04:05.5Z","logger":"storage","trace_id":"4bf92f","free":0.05}`,
+			want: &ParsedLine{
+				Format: FormatJSON, Level: "warn", Message: "disk almost full", Logger: "storage", TraceID: "4bf92f",
+				Time:   at(time.Date(2024, 1, 2, 15, 4, 5, 5e8, time.UTC)),
+				Fields: map[string]interface{}{"free": json.Number("0.05")},
+			},
+		},
+		{
+			name: "zap keys and Unix time",
+			line: `{"severity":"error","message":"request failed","ts":1704207845.25,"component":"http","status":503}`,
+			want: &ParsedLine{
+				Format: FormatJSON, Level: "error", Message: "request failed", Logger: "http",
+				Time:   at(time.Date(2024, 1, 2, 15, 4, 5, 25e7, time.UTC)),
+				Fields: map[string]interface{}{"status": json.Number("503")},
+			},
+		},
+		{
+			name: "unknown level and nested fields",
+			line: `{"level":"Audit","message":"login","user":{"id":7,"roles":["admin"]},"ok":true}`,
+			want: &ParsedLine{
+				Format: FormatJSON, Level: "audit", Message: "login",
+				Fields: map[string]interface{}{
+					"user": map[string]interface{}{"id": json.Number("7"), "roles": []interface{}{"admin"}},
+					"ok":   true,
+				},
+			},
+		},
+		{
+			name: "unparsable time stays a field",
+			line: `{"msg":"tick","time":"yesterday"}`,
+			want: &ParsedLine{Format: FormatJSON, Message: "tick", Fields: map[string]interface{}{"time": "yesterday"}},
+		},
+		{
+			name: "timestamp prefix and trailing newline",
+			line: "2024-01-02T15:04:05.000000000Z {\"msg\":\"hi\"}\r\n",
+			want: &ParsedLine{Format: FormatJSON, Message: "hi"},
+		},
+		{name: "truncated object", line: `{"msg":"hi"`},
+		{name: "trailing data", line: `{"msg":"hi"} {"msg":"again"}`},
+		{name: "array", line: `["msg","hi"]`},
+		{name: "plain text", line: "starting server"},
+		{name: "invalid UTF-8", line: "{\"msg\":\"\xff\"}"},
+		{name: "empty", line: ""},
+	})
+}
+
+func TestParseLogfmtLine(t *testing.T) {
+	checkParse(t, FormatLogfmt, time.RFC3339Nano, []parseCase{
+		{
+			name: "standard fields",
+			line: `time=2024-01-02T15:04:05Z level=info msg="request done" path=/api status=200`,
+			want: &ParsedLine{
+				Format: FormatLogfmt, Level: "info", Message: "request done",
+				Time:   at(time.Date(2024, 1, 2, 15, 4, 5, 0, time.UTC)),
+				Fields: map[string]interface{}{"path": "/api", "status": "200"},
+			},
+		},
+		{
+			name: "escaped quotes and tabs",
+			line: "lvl=WRN msg=\"said \\\"no\\\"\\tthen left\"\tuser=\"bob smith\"",
+			want: &ParsedLine{
+				Format: FormatLogfmt, Level: "warn", Message: "said \"no\"\tthen left",
+				Fields: map[string]interface{}{"user": "bob smith"},
+			},
+		},
+		{
+			name: "empty and quoted empty values",
+			line: `a= b="" c=3`,
+			want: &ParsedLine{Format: FormatLogfmt, Fields: map[string]interface{}{"a": "", "b": "", "c": "3"}},
+		},
+		{
+			name: "value containing an equals sign",
+			line: `query=a=b level=debug`,
+			want: &ParsedLine{Format: FormatLogfmt, Level: "debug", Fields: map[string]interface{}{"query": "a=b"}},
+		},
+		{name: "single pair", line: `msg=hello`},
+		{name: "unterminated quote", line: `level=info msg="never closed`},
+		{name: "bad escape", line: `level=info msg="bad \q escape"`},
+		{name: "spaces around equals", line: `level = info msg = hi`},
+		{name: "quoted key", line: `level=info "msg"=hi`},
+		{name: "prose", line: `the value x=1 was too large`},
+		{name: "empty key", line: `=1 b=2`},
+	})
+}
+
+func TestParseKlogLine(t *testing.T) {
+	// klog omits the year, so only the rest of the time is compared
+	const layout = "01-02 15:04:05.000000"
+	checkParse(t, FormatKlog, layout, []parseCase{
+		{
+			name: "info",
+			line: "I0102 15:04:05.123456 1 main.go:10] starting server",
+			want: &ParsedLine{
+				Format: FormatKlog, Level: "info", Message: "starting server",
+				Time:   at(time.Date(2024, 1, 2, 15, 4, 5, 123456000, time.UTC)),
+				Fields: map[string]interface{}{"thread": "1", "caller": "main.go:10"},
+			},
+		},
+		{
+			name: "padded thread ID",
+			line: "W1231 23:59:59.000001   12345 reflector.go:424] watch closed",
+			want: &ParsedLine{
+				Format: FormatKlog, Level: "warn", Message: "watch closed",
+				Time:   at(time.Date(2023, 12, 31, 23, 59, 59, 1000, time.UTC)),
+				Fields: map[string]interface{}{"thread": "12345", "caller": "reflector.go:424"},
+			},
+		},
+		{
+			name: "structured",
+			line: `E0102 15:04:05.000000 7 controller.go:42] "Reconcile failed" pod="shop/api-0" err="context deadline exceeded" attempt=3`,
+			want: &ParsedLine{
+				Format: FormatKlog, Level: "error", Message: "Reconcile failed",
+				Time: at(time.Date(2024, 1, 2, 15, 4, 5, 0, time.UTC)),
+				Fields: map[string]interface{}{
+					"thread": "7", "caller": "controller.go:42",
+					"pod": "shop/api-0", "err": "context deadline exceeded", "attempt": "3",
+				},
+			},
+		},
+		{
+			name: "quoted message that is not structured",
+			line: `F0102 15:04:05.000000 1 main.go:5] "quoted" and then prose`,
+			want: &ParsedLine{
+				Format: FormatKlog, Level: "fatal", Message: `"quoted" and then prose`,
+				Time:   at(time.Date(2024, 1, 2, 15, 4, 5, 0, time.UTC)),
+				Fields: map[string]interface{}{"thread": "1", "caller": "main.go:5"},
+			},
+		},
+		{
+			name: "no fractional seconds",
+			line: "I0102 15:04:05 1 main.go:10] coarse clock",
+			want: &ParsedLine{
+				Format: FormatKlog, Level: "info", Message: "coarse clock",
+				Fields: map[string]interface{}{"thread": "1", "caller": "main.go:10"},
+			},
+		},
+		{name: "unknown severity", line: "D0102 15:04:05.000000 1 main.go:10] debug"},
+		{name: "missing caller", line: "I0102 15:04:05.000000 main.go:10] message"},
+		{name: "no closing bracket", line: "I0102 15:04:05.000000 1 main.go:10 message"},
+		{name: "plain text", line: "Info: server started"},
+	})
+}
+
+func TestParseLineDetection(t *testing.T) {
+	tests := []struct {
+		line string
+		want LogFormat
+	}{
+		{`{"msg":"hi","level":"info"}`, FormatJSON},
+		{`  {"msg":"hi"}`, ""},
+		{"I0102 15:04:05.000000 1 main.go:10] hi", FormatKlog},
+		{"level=info msg=hi", FormatLogfmt},
+		{"2024-01-02T15:04:05Z level=info msg=hi", FormatLogfmt},
+		{`{"msg": broken`, ""},
+		{"GET /healthz 200", ""},
+		{"INFO starting", ""},
+	}
+	for _, tt := range tests {
+		parsed := ParseLine([]byte(tt.line), FormatAuto)
+		got := LogFormat("")
+		if parsed != nil {
+			got = parsed.Format
+		}
+		if got != tt.want {
+			t.Errorf("ParseLine(%q, auto) detected %q, want %q", tt.line, got, tt.want)
+		}
+	}
+
+	// A plain hint skips parsing, and a hint for another format does not fall back to detection
+	if parsed := ParseLine([]byte(`{"msg":"hi"}`), FormatPlain); parsed != nil {
+		t.Errorf("ParseLine with the plain hint = %+v, want nil", parsed)
+	}
+	if parsed := ParseLine([]byte(`level=info msg=hi`), FormatJSON); parsed != nil {
+		t.Errorf("ParseLine of logfmt with the json hint = %+v, want nil", parsed)
+	}
+}
+
+func TestFormatHints(t *testing.T) {
+	hints := FormatHints{"": FormatLogfmt, "proxy": FormatPlain}
+	for container, want := range map[string]LogFormat{"proxy": FormatPlain, "api": FormatLogfmt} {
+		if got := hints.For(container); got != want {
+			t.Errorf("For(%q) = %s, want %s", container, got, want)
+		}
+	}
+	if got := (FormatHints{}).For("api"); got != FormatAuto {
+		t.Errorf("For without hints = %s, want auto", got)
+	}
+}
@@ -0,0 +1,507 @@
+package services
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strings"
+	"unicode"
+)
+
+// Server-enforced limits for search queries
+const (
+	// MaxQueryLength is the longest query accepted
+	MaxQueryLength = 4096
+	// MaxQueryTerms is the largest number of terms in a query
+	MaxQueryTerms = 50
+)
+
+// LogQuery is a compiled search query
+//
+// The language is made of terms combined with boolean operators:
+//   - word: lines containing the word, ignoring case
+//   - "a phrase": lines containing the phrase, ignoring case
+//   - /regex/: lines matching the regular expression
+//   - field:value, field:"a phrase", field:/regex/: lines whose field equals the value (ignoring case,
+//     with * as a wildcard), contains the phrase or matches the regular expression
+//   - a b, a AND b: both; a OR b: either; NOT a, -a: not a; (...) groups
+//
+// AND binds tighter than OR. Fields are level (the parsed level, or the detected one), message, logger,
+// traceId, pod, container, namespace and any field of a parsed JSON, logfmt or klog line, with dots
+// separating nested keys
+type LogQuery struct {
+	source string
+	root   queryNode
+	// parse is set when a term needs the parsed fields of a line
+	parse bool
+}
+
+// ParseLogQuery compiles a query
+func ParseLogQuery(source string) (*LogQuery, error) {
+	if strings.TrimSpace(source) == "" {
+		return nil, fmt.Errorf("query must not be empty")
+	}
+	if len(source) > MaxQueryLength {
+		return nil, fmt.Errorf("query must not exceed %d characters", MaxQueryLength)
+	}
+
+	tokens, err := tokenizeQuery(source)
+	if err != nil {
+		return nil, err
+	}
+	parser := &queryParser{tokens: tokens}
+	root, err := parser.parseOr()
+	if err != nil {
+		return nil, err
+	}
+	if parser.pos < len(parser.tokens) {
+		return nil, fmt.Errorf("unexpected %s at position %d", parser.tokens[parser.pos], parser.tokens[parser.pos].pos+1)
+	}
+	if parser.terms > MaxQueryTerms {
+		return nil, fmt.Errorf("queries may have at most %d terms", MaxQueryTerms)
+	}
+	return &LogQuery{source: source, root: root, parse: parser.fields}, nil
+}
+
+// String returns the query as it was written
+func (q *LogQuery) String() string {
+	return q.source
+}
+
+// Match reports whether a line matches the query
+// parsed is the line's structured fields, which are only needed if NeedsParse is set
+func (q *LogQuery) Match(line LogLine, parsed *ParsedLine) bool {
+	_, content := SplitTimestamp(line.Content)
+	subject := &querySubject{line: line, content: bytes.TrimRight(content, "\r\n"), parsed: parsed}
+	return q.root.match(subject)
+}
+
+// NeedsParse reports whether the query refers to parsed fields
+func (q *LogQuery) NeedsParse() bool {
+	return q.parse
+}
+
+// querySubject is a line being matched, with its lower-cased content computed on first use
+type querySubject struct {
+	line    LogLine
+	content []byte
+	lower   []byte
+	parsed  *ParsedLine
+}
+
+func (s *querySubject) lowerContent() []byte {
+	if s.lower == nil {
+		s.lower = bytes.ToLower(s.content)
+	}
+	return s.lower
+}
+
+// field returns the value of a field as a string, and whether the line has it
+func (s *querySubject) field(name string) (string, bool) {
+	switch strings.ToLower(name) {
+	case "pod":
+		return s.line.Pod, true
+	case "container":
+		return s.line.Container, true
+	case "namespace":
+		return s.line.Namespace, true
+	case "level":
+		if s.parsed != nil && s.parsed.Level != "" {
+			return s.parsed.Level, true
+		}
+		level := DetectLevel(s.content)
+		return level.String(), level != LevelUnknown
+	}
+
+	if s.parsed == nil {
+		return "", false
+	}
+	switch strings.ToLower(name) {
+	case "message", "msg":
+		return s.parsed.Message, s.parsed.Message != ""
+	case "logger":
+		return s.parsed.Logger, s.parsed.Logger != ""
+	case "traceid", "trace_id":
+		return s.parsed.TraceID, s.parsed.TraceID != ""
+	case "format":
+		return string(s.parsed.Format), true
+	}
+	return lookupField(s.parsed.Fields, name)
+}
+
+// lookupField finds a field by name, or by a dotted path into nested JSON objects
+func lookupField(fields map[string]interface{}, name string) (string, bool) {
+	if value, ok := fields[name]; ok {
+		return fieldString(value)
+	}
+	head, rest, found := strings.Cut(name, ".")
+	if !found {
+		return "", false
+	}
+	nested, ok := fields[head].(map[string]interface{})
+	if !ok {
+		return "", false
+	}
+	return lookupField(nested, rest)
+}
+
+// fieldString formats a field value for matching; objects and arrays are matched as JSON
+func fieldString(value interface{}) (string, bool) {
+	switch value := value.(type) {
+	case nil:
+		return "", false
+	case string:
+		return value, true
+	case json.Number:
+		return value.String(), true
+	case bool:
+		return fmt.Sprint(value), true
+	default:
+		data, err := json.Marshal(value)
+		return string(data), err == nil
+	}
+}
+
+// queryNode is a node of a compiled query
+type queryNode interface {
+	match(s *querySubject) bool
+}
+
+type andNode []queryNode
+
+func (n andNode) match(s *querySubject) bool {
+	for _, child := range n {
+		if !child.match(s) {
+			return false
+		}
+	}
+	return true
+}
+
+type orNode []queryNode
+
+func (n orNode) match(s *querySubject) bool {
+	for _, child := range n {
+		if child.match(s) {
+			return true
+		}
+	}
+	return false
+}
+
+type notNode struct {
+	child queryNode
+}
+
+func (n notNode) match(s *querySubject) bool {
+	return !n.child.match(s)
+}
+
+// textNode matches a word or phrase anywhere in the line, ignoring case
+type textNode struct {
+	lower []byte
+}
+
+func (n textNode) match(s *querySubject) bool {
+	return bytes.Contains(s.lowerContent(), n.lower)
+}
+
+// regexNode matches a regular expression against the line
+type regexNode struct {
+	re *regexp.Regexp
+}
+
+func (n regexNode) match(s *querySubject) bool {
+	return n.re.Match(s.content)
+}
+
+// fieldNode matches a field with a value pattern, a phrase or a regular expression
+type fieldNode struct {
+	name string
+	// exact is an anchored, case-insensitive pattern built from a value with * wildcards
+	exact  *regexp.Regexp
+	phrase string
+	re     *regexp.Regexp
+}
+
+func (n fieldNode) match(s *querySubject) bool {
+	value, ok := s.field(n.name)
+	if !ok {
+		return false
+	}
+	switch {
+	case n.re != nil:
+		return n.re.MatchString(value)
+	case n.exact != nil:
+		return n.exact.MatchString(value)
+	default:
+		return strings.Contains(strings.ToLower(value), n.phrase)
+	}
+}
+
+// queryTokenKind identifies the kind of a query token
+type queryTokenKind int
+
+const (
+	tokenWord queryTokenKind = iota
+	tokenPhrase
+	tokenRegex
+	tokenOpen
+	tokenClose
+	tokenNot
+)
+
+// queryToken is a lexical token of a query; field is set for field:value terms
+type queryToken struct {
+	kind  queryTokenKind
+	text  string
+	field string
+	pos   int
+}
+
+func (t queryToken) String() string {
+	switch t.kind {
+	case tokenOpen:
+		return `"("`
+	case tokenClose:
+		return `")"`
+	case tokenNot:
+		return `"-"`
+	}
+	return fmt.Sprintf("%q", t.text)
+}
+
+// fieldNamePattern matches the names accepted before a colon in field:value terms
+var fieldNamePattern = regexp.MustCompile(`^[A-Za-z_@][\w.@-]*$`)
+
+// tokenizeQuery splits a query into tokens
+func tokenizeQuery(source string) ([]queryToken, error) {
+	var tokens []queryToken
+	i := 0
+	for i < len(source) {
+		c := source[i]
+		switch {
+		case unicode.IsSpace(rune(c)):
+			i++
+
+		case c == '(' || c == ')':
+			kind := tokenOpen
+			if c == ')' {
+				kind = tokenClose
+			}
+			tokens = append(tokens, queryToken{kind: kind, pos: i})
+			i++
+
+		case c == '-' && i+1 < len(source) && !unicode.IsSpace(rune(source[i+1])) &&
+			(i == 0 || unicode.IsSpace(rune(source[i-1])) || source[i-1] == '('):
+			tokens = append(tokens, queryToken{kind: tokenNot, pos: i})
+			i++
+
+		default:
+			token, next, err := readQueryTerm(source, i, "")
+			if err != nil {
+				return nil, err
+			}
+			tokens = append(tokens, token)
+			i = next
+		}
+	}
+	return tokens, nil
+}
+
+// readQueryTerm reads a word, phrase or regular expression starting at i, with an optional field prefix
+func readQueryTerm(source string, i int, field string) (queryToken, int, error) {
+	start := i
+	switch source[i] {
+	case '"':
+		text, next, err := readDelimited(source, i, '"')
+		if err != nil {
+			return queryToken{}, 0, err
+		}
+		return queryToken{kind: tokenPhrase, text: text, field: field, pos: start}, next, nil
+
+	case '/':
+		text, next, err := readDelimited(source, i, '/')
+		if err != nil {
+			return queryToken{}, 0, err
+		}
+		return queryToken{kind: tokenRegex, text: text, field: field, pos: start}, next, nil
+	}
+
+	for i < len(source) && !unicode.IsSpace(rune(source[i])) && source[i] != '(' && source[i] != ')' {
+		// A URL such as http://host is a word, not a field with an empty regular expression
+		if source[i] == ':' && field == "" && fieldNamePattern.MatchString(source[start:i]) && i+1 < len(source) &&
+			!unicode.IsSpace(rune(source[i+1])) && !strings.HasPrefix(source[i+1:], "//") {
+			return readQueryTerm(source, i+1, source[start:i])
+		}
+		i++
+	}
+	return queryToken{kind: tokenWord, text: source[start:i], field: field, pos: start}, i, nil
+}
+
+// readDelimited reads text between two delimiters starting at i; a backslash escapes the delimiter
+func readDelimited(source string, i int, delimiter byte) (string, int, error) {
+	var text strings.Builder
+	for j := i + 1; j < len(source); j++ {
+		switch {
+		case source[j] == '\\' && j+1 < len(source) && source[j+1] == delimiter:
+			text.WriteByte(delimiter)
+			j++
+		case source[j] == delimiter:
+			return text.String(), j + 1, nil
+		default:
+			text.WriteByte(source[j])
+		}
+	}
+	return "", 0, fmt.Errorf("unterminated %c at position %d", delimiter, i+1)
+}
+
+// queryParser builds a query tree from tokens by recursive descent
+type queryParser struct {
+	tokens []queryToken
+	pos    int
+	terms  int
+	fields bool
+}
+
+func (p *queryParser) peek() *queryToken {
+	if p.pos < len(p.tokens) {
+		return &p.tokens[p.pos]
+	}
+	return nil
+}
+
+// isOperator reports whether the next token is the bare word op, such as OR
+func (p *queryParser) isOperator(op string) bool {
+	token := p.peek()
+	return token != nil && token.kind == tokenWord && token.field == "" && token.text == op
+}
+
+func (p *queryParser) parseOr() (queryNode, error) {
+	var children orNode
+	for {
+		child, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		children = append(children, child)
+		if !p.isOperator("OR") {
+			break
+		}
+		p.pos++
+	}
+	if len(children) == 1 {
+		return children[0], nil
+	}
+	return children, nil
+}
+
+func (p *queryParser) parseAnd() (queryNode, error) {
+	var children andNode
+	for {
+		if p.isOperator("AND") {
+			if len(children) == 0 {
+				return nil, fmt.Errorf("AND at position %d has no left operand", p.peek().pos+1)
+			}
+			p.pos++
+		}
+		child, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		children = append(children, child)
+
+		next := p.peek()
+		if next == nil || next.kind == tokenClose || p.isOperator("OR") {
+			break
+		}
+	}
+	if len(children) == 1 {
+		return children[0], nil
+	}
+	return children, nil
+}
+
+func (p *queryParser) parseUnary() (queryNode, error) {
+	token := p.peek()
+	if token == nil {
+		return nil, fmt.Errorf("query ends where a term was expected")
+	}
+	if token.kind == tokenNot || p.isOperator("NOT") {
+		p.pos++
+		child, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		return notNode{child}, nil
+	}
+	return p.parsePrimary()
+}
+
+func (p *queryParser) parsePrimary() (queryNode, error) {
+	token := p.peek()
+	switch {
+	case token.kind == tokenOpen:
+		p.pos++
+		node, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		if next := p.peek(); next == nil || next.kind != tokenClose {
+			return nil, fmt.Errorf("unclosed ( at position %d", token.pos+1)
+		}
+		p.pos++
+		return node, nil
+
+	case token.kind == tokenClose:
+		return nil, fmt.Errorf("unexpected ) at position %d", token.pos+1)
+
+	case p.isOperator("OR") || p.isOperator("AND"):
+		return nil, fmt.Errorf("%s at position %d has no left operand", token.text, token.pos+1)
+	}
+
+	p.pos++
+	p.terms++
+	return p.compileTerm(*token)
+}
+
+// compileTerm builds the node matching a single term
+func (p *queryParser) compileTerm(token queryToken) (queryNode, error) {
+	switch strings.ToLower(token.field) {
+	case "", "pod", "container", "namespace":
+	default:
+		p.fields = true
+	}
+
+	switch token.kind {
+	case tokenRegex:
+		if len(token.text) > MaxFilterPatternLength {
+			return nil, fmt.Errorf("regular expressions must not exceed %d characters", MaxFilterPatternLength)
+		}
+		re, err := regexp.Compile(token.text)
+		if err != nil {
+			return nil, fmt.Errorf("invalid regular expression /%s/: %w", token.text, err)
+		}
+		if token.field != "" {
+			return fieldNode{name: token.field, re: re}, nil
+		}
+		return regexNode{re}, nil
+
+	case tokenPhrase:
+		if token.field != "" {
+			return fieldNode{name: token.field, phrase: strings.ToLower(token.text)}, nil
+		}
+		return textNode{[]byte(strings.ToLower(token.text))}, nil
+	}
+
+	if token.field != "" {
+		parts := strings.Split(token.text, "*")
+		for i, part := range parts {
+			parts[i] = regexp.QuoteMeta(part)
+		}
+		exact := regexp.MustCompile("(?i)^" + strings.Join(parts, ".*") + "$")
+		return fieldNode{name: token.field, exact: exact}, nil
+	}
+	return textNode{[]byte(strings.ToLower(token.text))}, nil
+}
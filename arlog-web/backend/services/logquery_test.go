@@ -0,0 +1,172 @@
+package services
+
+import (
+	"strings"
+	"testing"
+)
+
+// queryMatches reports whether a query matches a line of container api, parsing it if the query needs it
+func queryMatches(query *LogQuery, content string) bool {
+	line := LogLine{Namespace: "shop", Pod: "api-0", Container: "api", Content: []byte(content + "\n")}
+	var parsed *ParsedLine
+	if query.NeedsParse() {
+		parsed = ParseLine(line.Content, FormatAuto)
+	}
+	return query.Match(line, parsed)
+}
+
+func TestLogQueryMatch(t *testing.T) {
+	tests := []struct {
+		query string
+		line  string
+		want  bool
+	}{
+		// Words and phrases ignore case
+		{"timeout", "upstream TIMEOUT after 5s", true},
+		{`"connection reset"`, "read: Connection Reset by peer", true},
+		{`"connection reset"`, "connection was reset", false},
+		{`"say \"hi\""`, `they say "hi" twice`, true},
+
+		// AND binds tighter than OR
+		{"a b OR c", "c", true},
+		{"a b OR c", "a", false},
+		{"a b OR c", "b a", true},
+		{"a OR b c", "a", true},
+		{"a OR b c", "b", false},
+		{"a AND b OR c AND d", "c d", true},
+		{"a AND b OR c AND d", "a d", false},
+		{"(a OR b) c", "a", false},
+		{"(a OR b) c", "b c", true},
+
+		// NOT and - bind to the next term only
+		{"NOT a b", "b", true},
+		{"NOT a b", "a b", false},
+		{"-a OR b", "a b", true},
+		{"-a OR b", "a", false},
+		{"-(a OR b) c", "c", true},
+		{"-(a OR b) c", "b c", false},
+		{"NOT NOT a", "a", true},
+		{"well-known", "a well-known error", true},
+		{"a -b", "a -b", false},
+
+		// Regular expressions match case-sensitively
+		{`/status=5\d\d/`, "status=503 path=/", true},
+		{`/status=5\d\d/`, "status=404 path=/", false},
+		{`/a\/b/`, "path a/b", true},
+
+		// Fields
+		{"pod:api-*", "anything", true},
+		{"container:worker", "anything", false},
+		{"level:error", `{"level":"ERROR","msg":"boom"}`, true},
+		{"level:error", "E0102 15:04:05.000000 1 main.go:10] boom", true},
+		{"level:error", "plain text mentioning error", false},
+		{"status:5*", `{"msg":"done","status":503}`, true},
+		{"status:5*", `{"msg":"done","status":200}`, false},
+		{"status:5*", `{"msg":"done","status":150}`, false},
+		{`msg:"payment failed"`, "level=error msg=\"Payment failed for order 7\"", true},
+		{"http.method:post", `{"msg":"req","http":{"method":"POST"}}`, true},
+		{`user:/^adm/`, "level=info user=admin", true},
+		{"url:http://example.com", "level=info url=http://example.com", true},
+		{"http://example.com/a", "GET http://example.com/a", true},
+
+		// Wildcards only expand *; other characters are literal
+		{"file:app.go*", "level=info file=app.golang", true},
+		{"file:app.go*", "level=info file=appXgo", false},
+		{"op:a+b", "level=info op=a+b", true},
+		{"op:a+b", "level=info op=aab", false},
+		{"path:[x]", "level=info path=[x]", true},
+		{"path:*(x)", "level=info path=f(x)", true},
+	}
+
+	for _, tt := range tests {
+		query, err := ParseLogQuery(tt.query)
+		if err != nil {
+			t.Errorf("ParseLogQuery(%q): %v", tt.query, err)
+			continue
+		}
+		if got := queryMatches(query, tt.line); got != tt.want {
+			t.Errorf("%q matching %q = %t, want %t", tt.query, tt.line, got, tt.want)
+		}
+	}
+}
+
+func TestParseLogQueryErrors(t *testing.T) {
+	tests := []struct {
+		query string
+		err   string
+	}{
+		{"", "query must not be empty"},
+		{"   ", "query must not be empty"},
+		{"a OR", "query ends where a term was expected"},
+		{"NOT", "query ends where a term was expected"},
+		{"OR a", "OR at position 1 has no left operand"},
+		{"AND a", "AND at position 1 has no left operand"},
+		{"a OR AND b", "AND at position 6 has no left operand"},
+		{"(a b", "unclosed ( at position 1"},
+		{"a (b (c)", "unclosed ( at position 3"},
+		{"a )", `unexpected ")" at position 3`},
+		{"()", "unexpected ) at position 2"},
+		{`a "b`, "unterminated \" at position 3"},
+		{"error /b", "unterminated / at position 7"},
+		{"msg:/(/", "invalid regular expression /(/"},
+		{"/" + strings.Repeat("a", MaxFilterPatternLength+1) + "/", "regular expressions must not exceed"},
+		{strings.Repeat("a", MaxQueryLength+1), "query must not exceed"},
+	}
+
+	for _, tt := range tests {
+		_, err := ParseLogQuery(tt.query)
+		if err == nil {
+			t.Errorf("ParseLogQuery(%q) succeeded, want error %q", tt.query, tt.err)
+			continue
+		}
+		if !strings.Contains(err.Error(), tt.err) {
+			t.Errorf("ParseLogQuery(%q) = %q, want %q", tt.query, err, tt.err)
+		}
+	}
+}
+
+func TestParseLogQueryTermLimit(t *testing.T) {
+	terms := make([]string, MaxQueryTerms+1)
+	for i := range terms {
+		terms[i] = "t" + strings.Repeat("x", i%3)
+	}
+
+	if _, err := ParseLogQuery(strings.Join(terms[:MaxQueryTerms], " OR ")); err != nil {
+		t.Errorf("a query of %d terms failed: %v", MaxQueryTerms, err)
+	}
+	// Operators and groups do not count as terms
+	if _, err := ParseLogQuery("(" + strings.Join(terms[:MaxQueryTerms], " AND NOT ") + ")"); err != nil {
+		t.Errorf("a query of %d terms with operators failed: %v", MaxQueryTerms, err)
+	}
+	_, err := ParseLogQuery(strings.Join(terms, " "))
+	if err == nil || !strings.Contains(err.Error(), "at most") {
+		t.Errorf("a query of %d terms = %v, want the term limit error", len(terms), err)
+	}
+}
+
+func TestLogQueryNeedsParse(t *testing.T) {
+	tests := []struct {
+		query string
+		want  bool
+	}{
+		{"error", false},
+		{`"out of memory" OR /panic:/`, false},
+		{"pod:api-* container:web namespace:shop", false},
+		{"url:http://example.com", true},
+		{"http://example.com", false},
+		{"level:error", true},
+		{"error OR msg:timeout", true},
+		{"-traceId:abc", true},
+		{"Pod:api", false},
+	}
+	for _, tt := range tests {
+		query, err := ParseLogQuery(tt.query)
+		if err != nil {
+			t.Errorf("ParseLogQuery(%q): %v", tt.query, err)
+			continue
+		}
+		if got := query.NeedsParse(); got != tt.want {
+			t.Errorf("ParseLogQuery(%q).NeedsParse() = %t, want %t", tt.query, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,126 @@
+package services
+
+import (
+	"context"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// Upstream reconnect backoff for followed log streams
+const (
+	reconnectInitialBackoff = 500 * time.Millisecond
+	reconnectMaxBackoff     = 30 * time.Second
+	// maxReconnectAttempts is the number of consecutive reconnects without a delivered line after
+	// which a stream gives up
+	maxReconnectAttempts = 10
+)
+
+// streamResume remembers how far a container stream got, so a reconnect can pick up from there
+// The API server only accepts SinceTime with second precision, so a resumed stream replays part of
+// the last second; lines older than the last delivered one are skipped, and lines with the same
+// timestamp are skipped if they were already delivered
+type streamResume struct {
+	last time.Time
+	// boundary counts the raw lines delivered with timestamp last
+	boundary map[string]int
+	// pending counts the boundary lines still expected to be replayed after a reconnect
+	pending map[string]int
+	// bytes counts the raw bytes delivered; secondBytes those delivered since the second of last began,
+	// which a resumed stream reads again
+	bytes       int64
+	secondBytes int64
+}
+
+// podLogOptions returns the options for (re)opening the stream
+// Once lines have been delivered, the stream resumes from the last timestamp instead of tailing, and
+// limitBytes only allows what is left of it besides the replayed part of the last second
+func (r *streamResume) podLogOptions(opts LogOptions, container string) *corev1.PodLogOptions {
+	logOptions := opts.PodLogOptions(container)
+	logOptions.Timestamps = true
+
+	if !r.last.IsZero() {
+		since := metav1.NewTime(r.last)
+		logOptions.SinceTime = &since
+		logOptions.SinceSeconds = nil
+		logOptions.TailLines = nil
+		if opts.LimitBytes != nil {
+			limitBytes := *opts.LimitBytes - r.bytes + r.secondBytes
+			logOptions.LimitBytes = &limitBytes
+		}
+	}
+	return logOptions
+}
+
+// limitReached reports whether opts.LimitBytes were delivered, so the stream must not be reopened
+func (r *streamResume) limitReached(opts LogOptions) bool {
+	return opts.LimitBytes != nil && r.bytes >= *opts.LimitBytes
+}
+
+// reconnecting prepares deduplication of the lines the next stream will replay
+func (r *streamResume) reconnecting() {
+	r.pending = make(map[string]int, len(r.boundary))
+	for raw, count := range r.boundary {
+		r.pending[raw] = count
+	}
+}
+
+// deliver reports whether a line read from the stream is new, and records it if so
+func (r *streamResume) deliver(timestamp time.Time, raw []byte) bool {
+	switch {
+	case timestamp.IsZero():
+		// Lines without a timestamp cannot be placed; pass them through
+
+	case timestamp.Before(r.last):
+		return false
+
+	case timestamp.Equal(r.last):
+		if r.pending[string(raw)] > 0 {
+			r.pending[string(raw)]--
+			return false
+		}
+		r.boundary[string(raw)]++
+
+	default:
+		if !timestamp.Truncate(time.Second).Equal(r.last.Truncate(time.Second)) {
+			r.secondBytes = 0
+		}
+		r.last = timestamp
+		r.boundary = map[string]int{string(raw): 1}
+		r.pending = nil
+	}
+	r.bytes += int64(len(raw))
+	r.secondBytes += int64(len(raw))
+	return true
+}
+
+// containerRunning reports whether a container instance is still running, so a dropped stream
+// is worth resuming. An empty containerID matches any instance
+func (k *KubernetesService) containerRunning(ctx context.Context, namespace, podName, container, containerID string) (bool, error) {
+	pod, err := k.clientset.CoreV1().Pods(namespace).Get(ctx, podName, metav1.GetOptions{})
+	if err != nil {
+		if apierrors.IsNotFound(err) {
+			return false, nil
+		}
+		return false, err
+	}
+
+	for _, status := range containerStatuses(pod) {
+		if status.Name == container {
+			return status.State.Running != nil && (containerID == "" || status.ContainerID == containerID), nil
+		}
+	}
+	return false, nil
+}
+
+// containerStatuses returns the statuses of the init, regular and ephemeral containers of a pod
+func containerStatuses(pod *corev1.Pod) []corev1.ContainerStatus {
+	statuses := make([]corev1.ContainerStatus, 0,
+		len(pod.Status.InitContainerStatuses)+len(pod.Status.ContainerStatuses)+len(pod.Status.EphemeralContainerStatuses))
+	statuses = append(statuses, pod.Status.InitContainerStatuses...)
+	statuses = append(statuses, pod.Status.ContainerStatuses...)
+	statuses = append(statuses, pod.Status.EphemeralContainerStatuses...)
+	return statuses
+}
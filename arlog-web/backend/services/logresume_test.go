@@ -0,0 +1,174 @@
+package services
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+// TestStreamResumeDeduplicates feeds a stream that reconnects between batches, each replaying from the
+// second of the last delivered line as the API server does, and checks that every line is delivered once
+func TestStreamResumeDeduplicates(t *testing.T) {
+	tests := []struct {
+		name string
+		// batches are the raw lines read by each stream; a reconnect happens between batches
+		batches [][]string
+		want    []string
+	}{
+		{
+			name: "replayed second",
+			batches: [][]string{
+				{"15:04:04.1 a", "15:04:05.2 b", "15:04:05.7 c"},
+				{"15:04:05.2 b", "15:04:05.7 c", "15:04:06.0 d"},
+			},
+			want: []string{"a", "b", "c", "d"},
+		},
+		{
+			name: "identical timestamps",
+			batches: [][]string{
+				{"15:04:05.5 a", "15:04:05.5 b", "15:04:05.5 c"},
+				{"15:04:05.5 a", "15:04:05.5 b", "15:04:05.5 c", "15:04:05.5 d", "15:04:05.5 e"},
+				{"15:04:05.5 a", "15:04:05.5 b", "15:04:05.5 c", "15:04:05.5 d", "15:04:05.5 e", "15:04:07.0 f"},
+			},
+			want: []string{"a", "b", "c", "d", "e", "f"},
+		},
+		{
+			name: "identical lines with identical timestamps",
+			batches: [][]string{
+				{"15:04:05.5 retry", "15:04:05.5 retry"},
+				{"15:04:05.5 retry", "15:04:05.5 retry", "15:04:05.5 retry", "15:04:06.0 done"},
+			},
+			want: []string{"retry", "retry", "retry", "done"},
+		},
+		{
+			name: "replay shorter than what was delivered",
+			batches: [][]string{
+				{"15:04:05.5 a", "15:04:05.5 b"},
+				{"15:04:05.5 b", "15:04:05.5 c"},
+			},
+			want: []string{"a", "b", "c"},
+		},
+		{
+			name: "reconnects without new lines",
+			batches: [][]string{
+				{"15:04:05.5 a", "15:04:05.5 b"},
+				{"15:04:05.5 a", "15:04:05.5 b"},
+				{"15:04:05.5 a", "15:04:05.5 b", "15:04:05.5 c"},
+			},
+			want: []string{"a", "b", "c"},
+		},
+		{
+			name: "lines without a timestamp",
+			batches: [][]string{
+				{"- banner", "15:04:05.5 a", "- continued", "15:04:05.5 b"},
+				{"15:04:05.5 a", "15:04:05.5 b", "15:04:06.0 c"},
+			},
+			want: []string{"banner", "a", "continued", "b", "c"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resume := &streamResume{}
+			var delivered []string
+			for i, batch := range tt.batches {
+				if i > 0 {
+					resume.reconnecting()
+				}
+				for _, entry := range batch {
+					clock, text, _ := strings.Cut(entry, " ")
+					raw := []byte(text + "\n")
+					if clock != "-" {
+						raw = []byte("2024-01-02T" + clock + "Z " + text + "\n")
+					}
+					timestamp, _ := SplitTimestamp(raw)
+					if resume.deliver(timestamp, raw) {
+						delivered = append(delivered, text)
+					}
+				}
+			}
+
+			if strings.Join(delivered, " ") != strings.Join(tt.want, " ") {
+				t.Errorf("delivered %q, want %q", delivered, tt.want)
+			}
+		})
+	}
+}
+
+func TestStreamResumePodLogOptions(t *testing.T) {
+	tailLines, sinceSeconds := int64(50), int64(600)
+	opts := LogOptions{Follow: true, TailLines: &tailLines, SinceSeconds: &sinceSeconds}
+	resume := &streamResume{}
+
+	first := resume.podLogOptions(opts, "api")
+	if first.TailLines == nil || *first.TailLines != 50 || first.SinceTime != nil || !first.Timestamps {
+		t.Errorf("first stream options = %+v, want the requested tail with timestamps", first)
+	}
+
+	last := time.Date(2024, 1, 2, 15, 4, 5, 700000000, time.UTC)
+	resume.deliver(last, []byte("2024-01-02T15:04:05.7Z a\n"))
+	resumed := resume.podLogOptions(opts, "api")
+	if resumed.TailLines != nil || resumed.SinceSeconds != nil {
+		t.Errorf("resumed stream options = %+v, want neither tailLines nor sinceSeconds", resumed)
+	}
+	if resumed.SinceTime == nil || !resumed.SinceTime.Time.Equal(last) {
+		t.Errorf("resumed stream starts at %v, want %s", resumed.SinceTime, last)
+	}
+}
+
+func TestStreamResumeLimitBytes(t *testing.T) {
+	limitBytes := int64(100)
+	opts := LogOptions{Follow: true, LimitBytes: &limitBytes}
+	resume := &streamResume{}
+
+	if first := resume.podLogOptions(opts, "api"); first.LimitBytes == nil || *first.LimitBytes != 100 {
+		t.Errorf("first stream options = %+v, want limitBytes 100", first)
+	}
+
+	// 30 bytes in an earlier second, then 37 in the second the stream resumes from
+	for _, raw := range []string{
+		"2024-01-02T15:04:04.1Z aaaaaa\n",
+		"2024-01-02T15:04:05.2Z b\n",
+		"- continued\n",
+	} {
+		timestamp, _ := SplitTimestamp([]byte(raw))
+		resume.deliver(timestamp, []byte(raw))
+	}
+	resume.reconnecting()
+
+	// The resumed stream reads the last second again before anything new
+	resumed := resume.podLogOptions(opts, "api")
+	if resumed.LimitBytes == nil || *resumed.LimitBytes != 70 {
+		t.Errorf("resumed stream options = %+v, want limitBytes 70", resumed)
+	}
+	if resume.limitReached(opts) {
+		t.Errorf("limit reached after %d of %d bytes", resume.bytes, limitBytes)
+	}
+
+	raw := []byte("2024-01-02T15:04:06Z " + strings.Repeat("c", 48) + "\n")
+	timestamp, _ := SplitTimestamp(raw)
+	resume.deliver(timestamp, raw)
+	if !resume.limitReached(opts) {
+		t.Errorf("limit not reached after %d of %d bytes", resume.bytes, limitBytes)
+	}
+}
+
+// TestStreamContainerLogsLimitBytes follows a fake container, whose stream ends after logging "fake logs"
+// each time it is opened, and checks that the stream is not reopened once limitBytes were delivered
+func TestStreamContainerLogsLimitBytes(t *testing.T) {
+	k := NewKubernetesServiceForClient(fake.NewSimpleClientset(runningPod("api-0", nil, "app")))
+	limitBytes := int64(10)
+	sink := &recordingSink{}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := k.streamContainerLogs(ctx, "shop", "api-0", "app", "", LogOptions{Follow: true, LimitBytes: &limitBytes}, sink); err != nil {
+		t.Fatalf("streamContainerLogs = %v, want nil once limitBytes were delivered", err)
+	}
+	if lines := sink.recorded(); len(lines) != 2 {
+		t.Errorf("delivered %d lines, want 2 streams of 9 bytes", len(lines))
+	}
+}
@@ -0,0 +1,122 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+)
+
+// DefaultScanConcurrency is the number of container logs scanned at the same time
+const DefaultScanConcurrency = 4
+
+// errScanDone is returned by a scan sink that has read all it needs; the scan of its log ends without error
+var errScanDone = errors.New("scan done")
+
+// ScanTarget is one container log to scan; an empty Container scans the pod's first container
+type ScanTarget struct {
+	Pod       string
+	Container string
+}
+
+// ScannedContainer describes a scanned container log
+type ScannedContainer struct {
+	Pod       string `json:"pod"`
+	Container string `json:"container"`
+	Lines     int64  `json:"lines"`
+	// Truncated is set when the log was larger than MaxLimitBytes over the window and only its start was scanned
+	Truncated bool   `json:"truncated,omitempty"`
+	Error     string `json:"error,omitempty"`
+}
+
+// ScanTargets lists the containers of pods to scan; if container is set, only containers with that name
+func ScanTargets(pods []corev1.Pod, container string) []ScanTarget {
+	var targets []ScanTarget
+	for i := range pods {
+		for _, status := range containerStatuses(&pods[i]) {
+			if container == "" || status.Name == container {
+				targets = append(targets, ScanTarget{Pod: pods[i].Name, Container: status.Name})
+			}
+		}
+	}
+	return targets
+}
+
+// scanLogs reads the logs of targets between since and until, concurrency at a time, into the sink
+// newSink creates for each. Logs are never held in memory, and at most MaxLimitBytes of each are read.
+// A sink ends the scan of its log early by returning errScanDone. Errors reading a log are recorded in
+// its ScannedContainer; the scan stops taking new targets once ctx is done
+func (k *KubernetesService) scanLogs(ctx context.Context, namespace string, targets []ScanTarget, since, until time.Time, concurrency int, newSink func(index int) LogSink) []ScannedContainer {
+	if concurrency < 1 {
+		concurrency = DefaultScanConcurrency
+	}
+
+	// Lines keep their timestamp prefix so the bytes read can be compared with the limit
+	limitBytes := MaxLimitBytes
+	logOptions := LogOptions{SinceTime: &since, LimitBytes: &limitBytes, Timestamps: true}
+
+	scanned := make([]ScannedContainer, len(targets))
+	for i, target := range targets {
+		scanned[i] = ScannedContainer{Pod: target.Pod, Container: target.Container}
+	}
+
+	jobs := make(chan int)
+	var workers sync.WaitGroup
+	for i := 0; i < concurrency; i++ {
+		workers.Add(1)
+		go func() {
+			defer workers.Done()
+			for index := range jobs {
+				target := targets[index]
+				sink := &scanSink{next: newSink(index), since: since}
+				container, err := k.GetPodLogs(ctx, namespace, target.Pod, target.Container, logOptions, &until, sink)
+
+				info := &scanned[index]
+				if container != "" {
+					info.Container = container
+				}
+				info.Lines = sink.lines
+				info.Truncated = sink.bytes >= limitBytes
+				if err != nil && !errors.Is(err, errScanDone) {
+					info.Error = err.Error()
+				}
+			}
+		}()
+	}
+
+feed:
+	for i := range targets {
+		select {
+		case jobs <- i:
+		case <-ctx.Done():
+			break feed
+		}
+	}
+	close(jobs)
+	workers.Wait()
+	return scanned
+}
+
+// scanSink counts the lines and bytes of one container log, dropping lines from before the window
+type scanSink struct {
+	next  LogSink
+	since time.Time
+	lines int64
+	bytes int64
+}
+
+func (s *scanSink) WriteLine(line LogLine) error {
+	s.bytes += int64(len(line.Content))
+	// The API server's since is only precise to the second
+	if line.Timestamp.Before(s.since) {
+		return nil
+	}
+	s.lines++
+	return s.next.WriteLine(line)
+}
+
+func (s *scanSink) WriteEvent(event StreamEvent) error {
+	return s.next.WriteEvent(event)
+}
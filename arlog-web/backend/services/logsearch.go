@@ -0,0 +1,224 @@
+package services
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+)
+
+// Search limits
+const (
+	// DefaultSearchLimit is the number of matches in a page when none is given
+	DefaultSearchLimit = 100
+	// MaxSearchLimit is the largest page a client may request
+	MaxSearchLimit = 1000
+	// MaxSearchDepth caps offset+limit, since every page is found by scanning from the start of the window
+	MaxSearchDepth = 10000
+	// MaxSearchContextLines is the largest number of context lines around a match
+	MaxSearchContextLines = 20
+)
+
+// SearchOptions describes a search over container logs
+type SearchOptions struct {
+	Query  *LogQuery
+	Since  time.Time
+	Until  time.Time
+	Offset int
+	Limit  int
+	// Before and After are the numbers of context lines returned around each match
+	Before int
+	After  int
+	// FormatHints, when set, adds the parsed fields of each match to the results
+	FormatHints FormatHints
+	Concurrency int
+}
+
+// SearchResult is one page of search matches, in timestamp order
+type SearchResult struct {
+	Namespace string        `json:"namespace"`
+	Query     string        `json:"query"`
+	Since     time.Time     `json:"since"`
+	Until     time.Time     `json:"until"`
+	Offset    int           `json:"offset"`
+	Limit     int           `json:"limit"`
+	Matches   []SearchMatch `json:"matches"`
+	// NextOffset is the offset of the next page, if there are more matches
+	NextOffset *int `json:"nextOffset,omitempty"`
+	// Partial is set when the search ran out of time; the page may then miss matches
+	Partial    bool               `json:"partial,omitempty"`
+	Containers []ScannedContainer `json:"containers"`
+}
+
+// SearchMatch is a matching line with its context
+type SearchMatch struct {
+	// Namespace is only set by archive searches, which may span several namespaces
+	Namespace string              `json:"namespace,omitempty"`
+	Pod       string              `json:"pod"`
+	Container string              `json:"container"`
+	Timestamp time.Time           `json:"timestamp"`
+	Line      string              `json:"line"`
+	Parsed    *ParsedLine         `json:"parsed,omitempty"`
+	Before    []SearchContextLine `json:"before,omitempty"`
+	After     []SearchContextLine `json:"after,omitempty"`
+}
+
+// SearchContextLine is a line logged just before or after a match
+type SearchContextLine struct {
+	Timestamp time.Time `json:"timestamp"`
+	Line      string    `json:"line"`
+}
+
+// Validate checks the options against the server-enforced limits
+func (o SearchOptions) Validate() error {
+	if o.Query == nil {
+		return fmt.Errorf("a query is required")
+	}
+	if o.Limit < 1 || o.Limit > MaxSearchLimit {
+		return fmt.Errorf("limit must be between 1 and %d", MaxSearchLimit)
+	}
+	if o.Offset < 0 || o.Offset+o.Limit > MaxSearchDepth {
+		return fmt.Errorf("offset plus limit must not exceed %d", MaxSearchDepth)
+	}
+	if o.Before < 0 || o.Before > MaxSearchContextLines || o.After < 0 || o.After > MaxSearchContextLines {
+		return fmt.Errorf("context lines must be between 0 and %d", MaxSearchContextLines)
+	}
+	if !o.Until.After(o.Since) {
+		return fmt.Errorf("the end of the window must be after its start")
+	}
+	return nil
+}
+
+// SearchLogs scans the logs of targets between opts.Since and opts.Until for lines matching opts.Query
+// Logs are scanned opts.Concurrency at a time. Matches are ordered by timestamp, so each container's scan
+// stops once it has found enough matches to fill every page up to the requested one. If ctx expires,
+// the matches found so far are returned with Partial set
+func (k *KubernetesService) SearchLogs(ctx context.Context, namespace string, targets []ScanTarget, opts SearchOptions) (*SearchResult, error) {
+	if err := opts.Validate(); err != nil {
+		return nil, err
+	}
+
+	// One match past the page tells whether there is a next page
+	quota := opts.Offset + opts.Limit + 1
+	sinks := make([]*searchSink, len(targets))
+	containers := k.scanLogs(ctx, namespace, targets, opts.Since, opts.Until, opts.Concurrency, func(index int) LogSink {
+		sinks[index] = &searchSink{opts: opts, quota: quota}
+		return sinks[index]
+	})
+
+	result := &SearchResult{
+		Namespace:  namespace,
+		Query:      opts.Query.String(),
+		Since:      opts.Since,
+		Until:      opts.Until,
+		Offset:     opts.Offset,
+		Limit:      opts.Limit,
+		Matches:    []SearchMatch{},
+		Containers: containers,
+	}
+	if err := ctx.Err(); err != nil {
+		if !errors.Is(err, context.DeadlineExceeded) {
+			return nil, err
+		}
+		result.Partial = true
+	}
+
+	var matches []SearchMatch
+	for _, sink := range sinks {
+		if sink != nil {
+			matches = append(matches, sink.matches...)
+		}
+	}
+	// Matches of each container are already in order; ties across containers keep target order
+	sort.SliceStable(matches, func(i, j int) bool {
+		return matches[i].Timestamp.Before(matches[j].Timestamp)
+	})
+
+	result.page(matches)
+	return result, nil
+}
+
+// page sets the result's matches to its page of matches, which are in timestamp order and start at
+// offset 0, and sets NextOffset if matches go past the page
+func (r *SearchResult) page(matches []SearchMatch) {
+	if len(matches) > r.Offset+r.Limit {
+		next := r.Offset + r.Limit
+		r.NextOffset = &next
+		matches = matches[:next]
+	}
+	if r.Offset < len(matches) {
+		r.Matches = matches[r.Offset:]
+	}
+}
+
+// searchSink collects the matches of one container log with their context lines
+type searchSink struct {
+	opts  SearchOptions
+	quota int
+
+	matches []SearchMatch
+	before  []SearchContextLine
+	// waiting holds the indexes of matches still collecting lines after them
+	waiting []int
+}
+
+func (s *searchSink) WriteLine(line LogLine) error {
+	timestamp, content := SplitTimestamp(line.Content)
+	contextLine := SearchContextLine{Timestamp: timestamp, Line: string(bytes.TrimRight(content, "\r\n"))}
+
+	waiting := s.waiting[:0]
+	for _, index := range s.waiting {
+		match := &s.matches[index]
+		match.After = append(match.After, contextLine)
+		if len(match.After) < s.opts.After {
+			waiting = append(waiting, index)
+		}
+	}
+	s.waiting = waiting
+
+	if len(s.matches) < s.quota {
+		format := FormatAuto
+		if s.opts.FormatHints != nil {
+			format = s.opts.FormatHints.For(line.Container)
+		}
+		var parsed *ParsedLine
+		if s.opts.Query.NeedsParse() || s.opts.FormatHints != nil {
+			parsed = ParseLine(content, format)
+		}
+
+		if s.opts.Query.Match(line, parsed) {
+			match := SearchMatch{
+				Pod:       line.Pod,
+				Container: line.Container,
+				Timestamp: timestamp,
+				Line:      contextLine.Line,
+				Before:    append([]SearchContextLine(nil), s.before...),
+			}
+			if s.opts.FormatHints != nil {
+				match.Parsed = parsed
+			}
+			s.matches = append(s.matches, match)
+			if s.opts.After > 0 {
+				s.waiting = append(s.waiting, len(s.matches)-1)
+			}
+		}
+	}
+
+	if s.opts.Before > 0 {
+		if len(s.before) == s.opts.Before {
+			s.before = s.before[1:]
+		}
+		s.before = append(s.before, contextLine)
+	}
+
+	if len(s.matches) >= s.quota && len(s.waiting) == 0 {
+		return errScanDone
+	}
+	return nil
+}
+
+func (s *searchSink) WriteEvent(event StreamEvent) error {
+	return nil
+}
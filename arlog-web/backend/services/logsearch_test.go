@@ -0,0 +1,178 @@
+package services
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+)
+
+// searchLine is the nth line of a test log, logged n seconds after start
+func searchLine(start time.Time, n int, text string) LogLine {
+	timestamp := start.Add(time.Duration(n) * time.Second).Format(time.RFC3339Nano)
+	return LogLine{Pod: "api-0", Container: "api", Content: []byte(fmt.Sprintf("%s %s\n", timestamp, text))}
+}
+
+// contextText returns the text of context lines
+func contextText(lines []SearchContextLine) string {
+	texts := make([]string, len(lines))
+	for i, line := range lines {
+		texts[i] = line.Line
+	}
+	return strings.Join(texts, ",")
+}
+
+func TestSearchSinkContext(t *testing.T) {
+	start := time.Date(2024, 1, 2, 15, 0, 0, 0, time.UTC)
+	query, err := ParseLogQuery("match")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	type want struct {
+		line, before, after string
+	}
+	tests := []struct {
+		name          string
+		before, after int
+		quota         int
+		// lines are matches when they contain "match"
+		lines []string
+		want  []want
+		// stop is the index of the line at which the sink ends the scan, or -1 if it reads them all
+		stop int
+	}{
+		{
+			name:   "overlapping context",
+			before: 2, after: 2, quota: 10,
+			lines: []string{"l0", "l1", "match2", "l3", "match4", "l5", "l6", "l7", "match8", "l9"},
+			want: []want{
+				{"match2", "l0,l1", "l3,match4"},
+				{"match4", "match2,l3", "l5,l6"},
+				{"match8", "l6,l7", "l9"},
+			},
+			stop: -1,
+		},
+		{
+			name:   "context at the edges of the log",
+			before: 3, after: 3, quota: 10,
+			lines: []string{"match0", "l1", "match2"},
+			want: []want{
+				{"match0", "", "l1,match2"},
+				{"match2", "match0,l1", ""},
+			},
+			stop: -1,
+		},
+		{
+			name:  "no context",
+			quota: 10,
+			lines: []string{"l0", "match1", "l2"},
+			want:  []want{{"match1", "", ""}},
+			stop:  -1,
+		},
+		{
+			name:  "quota reached",
+			quota: 2,
+			lines: []string{"match0", "l1", "match2", "match3", "l4"},
+			want:  []want{{"match0", "", ""}, {"match2", "", ""}},
+			stop:  2,
+		},
+		{
+			name:   "quota reached waits for the context after the last match",
+			before: 1, after: 2, quota: 2,
+			lines: []string{"match0", "l1", "match2", "match3", "l4", "match5"},
+			want: []want{
+				{"match0", "", "l1,match2"},
+				{"match2", "l1", "match3,l4"},
+			},
+			stop: 4,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sink := &searchSink{
+				opts:  SearchOptions{Query: query, Before: tt.before, After: tt.after},
+				quota: tt.quota,
+			}
+			stop := -1
+			for i, text := range tt.lines {
+				err := sink.WriteLine(searchLine(start, i, text))
+				if errors.Is(err, errScanDone) {
+					stop = i
+					break
+				}
+				if err != nil {
+					t.Fatalf("WriteLine: %v", err)
+				}
+			}
+			if stop != tt.stop {
+				t.Errorf("the scan ended at line %d, want %d", stop, tt.stop)
+			}
+
+			if len(sink.matches) != len(tt.want) {
+				t.Fatalf("found %d matches, want %d", len(sink.matches), len(tt.want))
+			}
+			for i, match := range sink.matches {
+				got := want{match.Line, contextText(match.Before), contextText(match.After)}
+				if got != tt.want[i] {
+					t.Errorf("match %d = %+v, want %+v", i, got, tt.want[i])
+				}
+				if match.Timestamp.Before(start) || match.Pod != "api-0" {
+					t.Errorf("match %d is at %s in pod %q", i, match.Timestamp, match.Pod)
+				}
+			}
+		})
+	}
+}
+
+// TestSearchPaging checks that the per-container quota of offset+limit+1 matches is enough to page
+// through a log and to tell whether there is a next page
+func TestSearchPaging(t *testing.T) {
+	start := time.Date(2024, 1, 2, 15, 0, 0, 0, time.UTC)
+	query, err := ParseLogQuery("match")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		total, offset, limit int
+		first, count         int
+		next                 int
+	}{
+		{total: 5, offset: 0, limit: 5, first: 0, count: 5, next: -1},
+		{total: 6, offset: 0, limit: 5, first: 0, count: 5, next: 5},
+		{total: 6, offset: 5, limit: 5, first: 5, count: 1, next: -1},
+		{total: 10, offset: 5, limit: 5, first: 5, count: 5, next: -1},
+		{total: 11, offset: 5, limit: 5, first: 5, count: 5, next: 10},
+		{total: 3, offset: 5, limit: 5, count: 0, next: -1},
+		{total: 0, offset: 0, limit: 1, count: 0, next: -1},
+	}
+
+	for _, tt := range tests {
+		name := fmt.Sprintf("%d matches from %d by %d", tt.total, tt.offset, tt.limit)
+		opts := SearchOptions{Query: query, Offset: tt.offset, Limit: tt.limit}
+		sink := &searchSink{opts: opts, quota: tt.offset + tt.limit + 1}
+		for i := 0; i < tt.total; i++ {
+			if err := sink.WriteLine(searchLine(start, i, fmt.Sprintf("match%d", i))); errors.Is(err, errScanDone) {
+				break
+			}
+		}
+
+		result := &SearchResult{Offset: tt.offset, Limit: tt.limit, Matches: []SearchMatch{}}
+		result.page(sink.matches)
+
+		if len(result.Matches) != tt.count {
+			t.Errorf("%s: page has %d matches, want %d", name, len(result.Matches), tt.count)
+		} else if tt.count > 0 && result.Matches[0].Line != fmt.Sprintf("match%d", tt.first) {
+			t.Errorf("%s: page starts at %q, want match%d", name, result.Matches[0].Line, tt.first)
+		}
+		switch {
+		case tt.next < 0 && result.NextOffset != nil:
+			t.Errorf("%s: NextOffset = %d, want none", name, *result.NextOffset)
+		case tt.next >= 0 && (result.NextOffset == nil || *result.NextOffset != tt.next):
+			t.Errorf("%s: NextOffset = %v, want %d", name, result.NextOffset, tt.next)
+		}
+	}
+}
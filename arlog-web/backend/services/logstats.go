@@ -0,0 +1,274 @@
+package services
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+// Log statistics limits
+const (
+	// DefaultStatsWindow is the time window scanned when none is given
+	DefaultStatsWindow = time.Hour
+	// DefaultStatsInterval is the width of a histogram bucket when none is given
+	DefaultStatsInterval = 5 * time.Minute
+	// MaxStatsBuckets is the largest number of histogram buckets a scan may produce
+	MaxStatsBuckets = 1000
+	// DefaultStatsTopErrors is the number of recurring error messages returned when none is given
+	DefaultStatsTopErrors = 10
+	// MaxStatsTopErrors is the largest number of recurring error messages a client may request
+	MaxStatsTopErrors = 100
+)
+
+// maxStatsErrorGroups caps the distinct error messages tracked during a scan; errors with a new
+// message are still counted once it is reached, but not grouped
+const maxStatsErrorGroups = 10000
+
+// maxStatsMessageLength is the longest error message kept, in runes
+const maxStatsMessageLength = 300
+
+// Patterns replaced in error messages so recurring errors group together despite varying IDs and values
+var (
+	uuidPattern   = regexp.MustCompile(`[0-9a-fA-F]{8}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{12}`)
+	ipPattern     = regexp.MustCompile(`\b\d{1,3}(?:\.\d{1,3}){3}(?::\d+)?\b`)
+	hexPattern    = regexp.MustCompile(`\b0x[0-9a-fA-F]+\b|\b[0-9a-fA-F]{8,}\b`)
+	numberPattern = regexp.MustCompile(`\d+(?:\.\d+)?`)
+)
+
+// LogStatsOptions describes the window and shape of a statistics scan
+type LogStatsOptions struct {
+	Since    time.Time
+	Until    time.Time
+	Interval time.Duration
+	// TopErrors is the number of recurring error messages to return
+	TopErrors   int
+	Concurrency int
+}
+
+// LogStats holds the level counts of the logs of a set of containers over a time window
+type LogStats struct {
+	Namespace string    `json:"namespace"`
+	Since     time.Time `json:"since"`
+	Until     time.Time `json:"until"`
+	// Interval is the width of each bucket in seconds
+	Interval int64            `json:"interval"`
+	Total    int64            `json:"total"`
+	Levels   map[string]int64 `json:"levels"`
+	Buckets  []LogStatsBucket `json:"buckets"`
+	// PeakErrors is the start of the bucket with the most error and fatal lines, if there are any
+	PeakErrors *time.Time          `json:"peakErrors,omitempty"`
+	TopErrors  []ErrorMessageStats `json:"topErrors"`
+	Containers []ScannedContainer  `json:"containers"`
+}
+
+// LogStatsBucket holds the level counts of one histogram interval
+type LogStatsBucket struct {
+	Start  time.Time        `json:"start"`
+	Total  int64            `json:"total"`
+	Levels map[string]int64 `json:"levels"`
+}
+
+// ErrorMessageStats describes a recurring error message
+// Message has numbers, IDs and addresses replaced by placeholders; Example is one original occurrence
+type ErrorMessageStats struct {
+	Message   string    `json:"message"`
+	Example   string    `json:"example"`
+	Level     string    `json:"level"`
+	Count     int64     `json:"count"`
+	FirstSeen time.Time `json:"firstSeen"`
+	LastSeen  time.Time `json:"lastSeen"`
+}
+
+// ScanLogStats counts the lines of each level in the logs of targets between opts.Since and opts.Until
+// Levels are detected with DetectLevel, as for stream filters. Logs are scanned opts.Concurrency at a
+// time without being held in memory; errors scanning a container are recorded in its ScannedContainer
+func (k *KubernetesService) ScanLogStats(ctx context.Context, namespace string, targets []ScanTarget, opts LogStatsOptions) (*LogStats, error) {
+	if opts.Interval <= 0 {
+		opts.Interval = DefaultStatsInterval
+	}
+	if opts.TopErrors <= 0 {
+		opts.TopErrors = DefaultStatsTopErrors
+	}
+	if !opts.Until.After(opts.Since) {
+		return nil, fmt.Errorf("the end of the window must be after its start")
+	}
+	buckets := int((opts.Until.Sub(opts.Since) + opts.Interval - 1) / opts.Interval)
+	if buckets > MaxStatsBuckets {
+		return nil, fmt.Errorf("the window holds %d intervals; at most %d are allowed", buckets, MaxStatsBuckets)
+	}
+
+	collector := newStatsCollector(namespace, opts, buckets)
+	containers := k.scanLogs(ctx, namespace, targets, opts.Since, opts.Until, opts.Concurrency, func(int) LogSink {
+		return &statsSink{collector: collector}
+	})
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	stats := collector.finish()
+	stats.Containers = containers
+	return stats, nil
+}
+
+// statsCollector accumulates the statistics of concurrently scanned logs
+type statsCollector struct {
+	opts LogStatsOptions
+
+	mu     sync.Mutex
+	stats  *LogStats
+	errors map[string]*ErrorMessageStats
+}
+
+// newStatsCollector creates a collector with empty buckets covering the window
+func newStatsCollector(namespace string, opts LogStatsOptions, buckets int) *statsCollector {
+	stats := &LogStats{
+		Namespace: namespace,
+		Since:     opts.Since,
+		Until:     opts.Until,
+		Interval:  int64(opts.Interval / time.Second),
+		Levels:    make(map[string]int64),
+		Buckets:   make([]LogStatsBucket, buckets),
+	}
+	for i := range stats.Buckets {
+		stats.Buckets[i] = LogStatsBucket{
+			Start:  opts.Since.Add(time.Duration(i) * opts.Interval),
+			Levels: make(map[string]int64),
+		}
+	}
+	return &statsCollector{opts: opts, stats: stats, errors: make(map[string]*ErrorMessageStats)}
+}
+
+// add counts a line
+func (c *statsCollector) add(line LogLine) {
+	level := DetectLevel(line.Content)
+
+	var message, example string
+	if level >= LevelError {
+		message, example = errorMessage(line)
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	name := level.String()
+	c.stats.Total++
+	c.stats.Levels[name]++
+
+	index := int(line.Timestamp.Sub(c.opts.Since) / c.opts.Interval)
+	if index >= 0 && index < len(c.stats.Buckets) {
+		bucket := &c.stats.Buckets[index]
+		bucket.Total++
+		bucket.Levels[name]++
+	}
+
+	if message == "" {
+		return
+	}
+	group, ok := c.errors[message]
+	if !ok {
+		if len(c.errors) >= maxStatsErrorGroups {
+			return
+		}
+		group = &ErrorMessageStats{Message: message, Example: example, Level: name, FirstSeen: line.Timestamp}
+		c.errors[message] = group
+	}
+	group.Count++
+	if level > LevelError {
+		group.Level = name
+	}
+	if line.Timestamp.Before(group.FirstSeen) {
+		group.FirstSeen = line.Timestamp
+	}
+	if line.Timestamp.After(group.LastSeen) {
+		group.LastSeen = line.Timestamp
+	}
+}
+
+// finish ranks the error messages and finds the error peak
+func (c *statsCollector) finish() *LogStats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	stats := c.stats
+	var peak int64
+	for i := range stats.Buckets {
+		bucket := &stats.Buckets[i]
+		if errors := bucket.Levels[LevelError.String()] + bucket.Levels[LevelFatal.String()]; errors > peak {
+			peak = errors
+			start := bucket.Start
+			stats.PeakErrors = &start
+		}
+	}
+
+	stats.TopErrors = make([]ErrorMessageStats, 0, len(c.errors))
+	for _, group := range c.errors {
+		stats.TopErrors = append(stats.TopErrors, *group)
+	}
+	sort.Slice(stats.TopErrors, func(i, j int) bool {
+		a, b := stats.TopErrors[i], stats.TopErrors[j]
+		if a.Count != b.Count {
+			return a.Count > b.Count
+		}
+		return a.Message < b.Message
+	})
+	if len(stats.TopErrors) > c.opts.TopErrors {
+		stats.TopErrors = stats.TopErrors[:c.opts.TopErrors]
+	}
+	return stats
+}
+
+// errorMessage returns the grouping key and a display example for an error line
+// The message field of structured lines is used when there is one
+func errorMessage(line LogLine) (message, example string) {
+	_, content := SplitTimestamp(line.Content)
+	example = truncateRunes(string(bytes.TrimSpace(content)), maxStatsMessageLength)
+
+	message = example
+	if parsed := ParseLine(content, FormatAuto); parsed != nil && parsed.Message != "" {
+		message = truncateRunes(parsed.Message, maxStatsMessageLength)
+	}
+	return normalizeMessage(message), example
+}
+
+// normalizeMessage replaces UUIDs, IP addresses, hex IDs and numbers with placeholders
+func normalizeMessage(message string) string {
+	message = uuidPattern.ReplaceAllString(message, "<uuid>")
+	message = ipPattern.ReplaceAllString(message, "<ip>")
+	// Long words made only of hex letters, such as "deadbeef", are left alone
+	message = hexPattern.ReplaceAllStringFunc(message, func(match string) string {
+		if strings.HasPrefix(match, "0x") || strings.ContainsAny(match, "0123456789") {
+			return "<hex>"
+		}
+		return match
+	})
+	return numberPattern.ReplaceAllString(message, "<n>")
+}
+
+// truncateRunes cuts s to at most n runes, marking the cut with an ellipsis
+func truncateRunes(s string, n int) string {
+	if utf8.RuneCountInString(s) <= n {
+		return s
+	}
+	runes := []rune(s)
+	return strings.TrimSpace(string(runes[:n])) + "…"
+}
+
+// statsSink counts the lines of one container log into a collector
+type statsSink struct {
+	collector *statsCollector
+}
+
+func (s *statsSink) WriteLine(line LogLine) error {
+	s.collector.add(line)
+	return nil
+}
+
+func (s *statsSink) WriteEvent(event StreamEvent) error {
+	return nil
+}
@@ -0,0 +1,490 @@
+package services
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/watch"
+)
+
+// MaxStreamTargets caps the number of container streams a single aggregated stream may open
+const MaxStreamTargets = 50
+
+// Backoff before the pods of a followed stream are listed and watched again once their watch ended; it
+// doubles while watches end without an event
+const (
+	tailerWatchInitialBackoff = 500 * time.Millisecond
+	tailerWatchMaxBackoff     = 30 * time.Second
+)
+
+// maxLogLineSize is the longest line read when scanning logs line by line
+const maxLogLineSize = 1024 * 1024
+
+// LogLine is a single log line tagged with the container it came from
+type LogLine struct {
+	Namespace string
+	Pod       string
+	Container string
+	Timestamp time.Time
+	Content   []byte
+	// Context is set for lines emitted as context around a filter match
+	Context bool
+	// Parsed holds the structured fields of the line, when it was parsed and is structured
+	Parsed *ParsedLine
+	// Lines is the number of lines grouped into Content by a MultilineSink, or 0 if it was not grouped
+	Lines int
+}
+
+// newLogLine builds a LogLine from a raw line read with timestamps enabled
+// The timestamp prefix is removed from the content unless keepTimestamp is set
+func newLogLine(namespace, podName, container string, raw []byte, keepTimestamp bool) LogLine {
+	timestamp, content := SplitTimestamp(raw)
+	if keepTimestamp {
+		content = raw
+	}
+	return LogLine{
+		Namespace: namespace,
+		Pod:       podName,
+		Container: container,
+		Timestamp: timestamp,
+		Content:   content,
+	}
+}
+
+// StreamEventType identifies the kind of a stream event
+type StreamEventType string
+
+const (
+	// StreamEventAttached is sent when a container stream starts
+	StreamEventAttached StreamEventType = "attached"
+	// StreamEventDetached is sent when a container stream ends
+	StreamEventDetached StreamEventType = "detached"
+	// StreamEventSkipped is sent when a container is not streamed because the fan-out cap was reached
+	StreamEventSkipped StreamEventType = "skipped"
+	// StreamEventWaiting is sent when a container has not started yet; it is attached once it runs
+	StreamEventWaiting StreamEventType = "waiting"
+	// StreamEventSuppressed reports the running count of lines dropped by a filter
+	StreamEventSuppressed StreamEventType = "suppressed"
+	// StreamEventDropped reports lines the server discarded before they could be delivered
+	StreamEventDropped StreamEventType = "dropped"
+	// StreamEventReconnecting is sent when a container stream dropped and is about to be reopened
+	StreamEventReconnecting StreamEventType = "reconnecting"
+	// StreamEventReconnected is sent when a dropped container stream has been reopened
+	StreamEventReconnected StreamEventType = "reconnected"
+	// StreamEventRestarted is sent when a followed container has been restarted; Count holds the
+	// restart count, and ExitCode and Reason describe how the previous instance ended, when known
+	StreamEventRestarted StreamEventType = "restarted"
+	// StreamEventArchived is sent before logs that are read from the log archive rather than the cluster
+	StreamEventArchived StreamEventType = "archived"
+)
+
+// StreamEvent reports a change in the set of streamed containers
+type StreamEvent struct {
+	Type      StreamEventType
+	Namespace string
+	Pod       string
+	Container string
+	Message   string
+	Count     int64
+	ExitCode  *int32
+	Reason    string
+}
+
+// LogSink receives log lines and stream events
+// Lines from different containers are written concurrently, so implementations must be safe for concurrent use
+type LogSink interface {
+	WriteLine(line LogLine) error
+	WriteEvent(event StreamEvent) error
+}
+
+// StreamSelectorLogs tails every container of every pod in namespace matching selector
+// If container is set, only containers with that name are streamed
+// With opts.Follow, pods are attached as they appear through a watch and detached when they are deleted
+func (k *KubernetesService) StreamSelectorLogs(ctx context.Context, namespace, selector, container string, opts LogOptions, sink LogSink) error {
+	if err := opts.Validate(); err != nil {
+		return fmt.Errorf("invalid log options: %w", err)
+	}
+
+	if _, err := labels.Parse(selector); err != nil {
+		return fmt.Errorf("invalid label selector: %w", err)
+	}
+
+	tailer := newPodTailer(k, namespace, container, opts, sink)
+	return tailer.run(ctx, metav1.ListOptions{LabelSelector: selector})
+}
+
+// StreamAllContainerLogs tails every container of a pod, including init and ephemeral containers
+// Containers that have already finished are streamed to completion; containers that have not started
+// yet are attached once they run. With opts.Follow, the stream ends when the pod terminates or is deleted
+func (k *KubernetesService) StreamAllContainerLogs(ctx context.Context, namespace, podName string, opts LogOptions, sink LogSink) error {
+	if err := opts.Validate(); err != nil {
+		return fmt.Errorf("invalid log options: %w", err)
+	}
+
+	// Make sure the pod exists before waiting on it
+	if _, err := k.clientset.CoreV1().Pods(namespace).Get(ctx, podName, metav1.GetOptions{}); err != nil {
+		return fmt.Errorf("failed to get pod: %w", err)
+	}
+
+	tailer := newPodTailer(k, namespace, "", opts, sink)
+	tailer.podName = podName
+	return tailer.run(ctx, metav1.ListOptions{
+		FieldSelector: fields.OneTermEqualSelector("metadata.name", podName).String(),
+	})
+}
+
+// podTailer manages one log stream per (pod, container) for a changing set of pods
+type podTailer struct {
+	k          *KubernetesService
+	namespace  string
+	container  string
+	opts       LogOptions
+	sink       LogSink
+	maxStreams int
+
+	// owns optionally restricts the tailer to pods that pass an ownership check
+	owns func(pod *corev1.Pod) bool
+
+	// podName is set when tailing a single pod; the tailer then finishes once that pod is done
+	podName  string
+	podDone  bool
+	finished bool
+
+	ctx    context.Context
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+
+	mu      sync.Mutex
+	targets map[string]*tailTarget
+	active  int
+
+	errOnce sync.Once
+	err     error
+}
+
+// tailTarget tracks the stream of a single container instance
+type tailTarget struct {
+	pod         string
+	container   string
+	containerID string
+	cancel      context.CancelFunc
+	active      bool
+	skipped     bool
+	waiting     bool
+}
+
+// newPodTailer creates a tailer that writes all streams to sink
+func newPodTailer(k *KubernetesService, namespace, container string, opts LogOptions, sink LogSink) *podTailer {
+	return &podTailer{
+		k:          k,
+		namespace:  namespace,
+		container:  container,
+		opts:       opts,
+		sink:       sink,
+		maxStreams: MaxStreamTargets,
+		targets:    make(map[string]*tailTarget),
+	}
+}
+
+// run lists the matching pods, attaches to them and, when following, keeps the set up to date through a watch
+// It returns when ctx is cancelled, the sink fails, or (without follow) all streams have finished
+func (t *podTailer) run(ctx context.Context, listOptions metav1.ListOptions) error {
+	t.ctx, t.cancel = context.WithCancel(ctx)
+	defer t.wg.Wait()
+	defer t.cancel()
+
+	pods := t.k.clientset.CoreV1().Pods(t.namespace)
+	backoff := tailerWatchInitialBackoff
+
+	for {
+		podList, err := pods.List(t.ctx, listOptions)
+		if err != nil {
+			return t.result(fmt.Errorf("failed to list pods: %w", err))
+		}
+		t.sync(podList.Items)
+
+		if !t.opts.Follow {
+			t.wg.Wait()
+			return t.result(nil)
+		}
+
+		watchOptions := listOptions
+		watchOptions.ResourceVersion = podList.ResourceVersion
+		watcher, err := pods.Watch(t.ctx, watchOptions)
+		if err != nil {
+			return t.result(fmt.Errorf("failed to watch pods: %w", err))
+		}
+
+		if t.consume(watcher) > 0 {
+			backoff = tailerWatchInitialBackoff
+		}
+		watcher.Stop()
+
+		// The watch expired or failed; list again to resynchronise, backing off in case a proxy or an
+		// expired resource version keeps ending watches straight away
+		select {
+		case <-t.ctx.Done():
+		case <-time.After(backoff):
+		}
+		if t.isFinished() {
+			return t.result(nil)
+		}
+		if t.ctx.Err() != nil {
+			return t.result(t.ctx.Err())
+		}
+		backoff *= 2
+		if backoff > tailerWatchMaxBackoff {
+			backoff = tailerWatchMaxBackoff
+		}
+	}
+}
+
+// consume applies watch events until the watch ends, reports an error or the tailer is stopped
+// It returns the number of events applied
+func (t *podTailer) consume(watcher watch.Interface) int {
+	events := 0
+	for {
+		select {
+		case <-t.ctx.Done():
+			return events
+		case event, ok := <-watcher.ResultChan():
+			if !ok {
+				return events
+			}
+			switch event.Type {
+			case watch.Added, watch.Modified:
+				if pod, ok := event.Object.(*corev1.Pod); ok && (t.owns == nil || t.owns(pod)) {
+					t.attachPod(pod)
+				}
+			case watch.Deleted:
+				if pod, ok := event.Object.(*corev1.Pod); ok {
+					t.detachPod(pod.Name)
+				}
+			case watch.Error:
+				return events
+			}
+			events++
+		}
+	}
+}
+
+// sync attaches to all given pods and detaches from tracked pods that are no longer present
+func (t *podTailer) sync(pods []corev1.Pod) {
+	present := make(map[string]bool, len(pods))
+	for i := range pods {
+		if t.owns != nil && !t.owns(&pods[i]) {
+			continue
+		}
+		present[pods[i].Name] = true
+		t.attachPod(&pods[i])
+	}
+
+	t.mu.Lock()
+	var gone []string
+	for _, target := range t.targets {
+		if !present[target.pod] {
+			gone = append(gone, target.pod)
+		}
+	}
+	t.mu.Unlock()
+
+	for _, podName := range gone {
+		t.detachPod(podName)
+	}
+}
+
+// attachPod starts streams for containers of pod that have started and are not streamed yet
+// Init, regular and ephemeral containers are all considered
+func (t *podTailer) attachPod(pod *corev1.Pod) {
+	for _, status := range containerStatuses(pod) {
+		if t.container != "" && status.Name != t.container {
+			continue
+		}
+		// Containers that have not started yet have no logs; a later update will attach them
+		if status.State.Running == nil && status.State.Terminated == nil {
+			t.markWaiting(pod.Name, status.Name)
+			continue
+		}
+		t.attach(pod.Name, status)
+	}
+
+	if t.podName != "" && (pod.Status.Phase == corev1.PodSucceeded || pod.Status.Phase == corev1.PodFailed) {
+		t.mu.Lock()
+		t.podDone = true
+		t.checkDoneLocked()
+		t.mu.Unlock()
+	}
+}
+
+// markWaiting reports a container that has not started yet, once
+func (t *podTailer) markWaiting(podName, container string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	key := podName + "/" + container
+	if _, exists := t.targets[key]; exists {
+		return
+	}
+
+	t.targets[key] = &tailTarget{pod: podName, container: container, waiting: true}
+	t.WriteEvent(StreamEvent{
+		Type:      StreamEventWaiting,
+		Namespace: t.namespace,
+		Pod:       podName,
+		Container: container,
+		Message:   "container has not started yet",
+	})
+}
+
+// attach starts streaming a single container instance unless it is already being streamed
+// A new instance of a container that was streamed before is announced with a restarted event
+func (t *podTailer) attach(podName string, status corev1.ContainerStatus) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	container, containerID := status.Name, status.ContainerID
+
+	if t.ctx.Err() != nil {
+		return
+	}
+
+	key := podName + "/" + container
+	target, exists := t.targets[key]
+	if exists && (target.active || target.containerID == containerID) {
+		return
+	}
+	restarted := exists && target.containerID != ""
+
+	if t.active >= t.maxStreams {
+		if !exists || !target.skipped {
+			t.targets[key] = &tailTarget{pod: podName, container: container, skipped: true}
+			t.WriteEvent(StreamEvent{
+				Type:      StreamEventSkipped,
+				Namespace: t.namespace,
+				Pod:       podName,
+				Container: container,
+				Message:   fmt.Sprintf("stream limit of %d containers reached", t.maxStreams),
+			})
+		}
+		return
+	}
+
+	streamCtx, cancel := context.WithCancel(t.ctx)
+	target = &tailTarget{
+		pod:         podName,
+		container:   container,
+		containerID: containerID,
+		cancel:      cancel,
+		active:      true,
+	}
+	t.targets[key] = target
+	t.active++
+	t.wg.Add(1)
+
+	if restarted {
+		t.WriteEvent(restartEvent(t.namespace, podName, status))
+	}
+	t.WriteEvent(StreamEvent{Type: StreamEventAttached, Namespace: t.namespace, Pod: podName, Container: container})
+
+	go func() {
+		defer t.wg.Done()
+		defer cancel()
+
+		err := t.k.streamContainerLogs(streamCtx, t.namespace, podName, container, containerID, t.opts, t)
+
+		t.mu.Lock()
+		target.active = false
+		t.active--
+		t.checkDoneLocked()
+		t.mu.Unlock()
+
+		event := StreamEvent{Type: StreamEventDetached, Namespace: t.namespace, Pod: podName, Container: container}
+		if err != nil && streamCtx.Err() == nil {
+			log.Printf("Error streaming logs for %s/%s/%s: %v", t.namespace, podName, container, err)
+			event.Message = err.Error()
+		}
+		t.WriteEvent(event)
+	}()
+}
+
+// detachPod stops all streams of a pod and forgets it
+func (t *podTailer) detachPod(podName string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if podName == t.podName {
+		t.podDone = true
+		defer t.checkDoneLocked()
+	}
+
+	for key, target := range t.targets {
+		if target.pod != podName {
+			continue
+		}
+		if target.cancel != nil {
+			target.cancel()
+		}
+		delete(t.targets, key)
+	}
+}
+
+// checkDoneLocked stops a single-pod tailer once its pod is done and all streams have drained
+// The caller must hold t.mu
+func (t *podTailer) checkDoneLocked() {
+	if t.podName != "" && t.podDone && t.active == 0 && !t.finished {
+		t.finished = true
+		t.cancel()
+	}
+}
+
+// isFinished reports whether a single-pod tailer has finished
+func (t *podTailer) isFinished() bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.finished
+}
+
+// WriteLine forwards a line to the sink and stops all streams if the sink fails
+func (t *podTailer) WriteLine(line LogLine) error {
+	if err := t.sink.WriteLine(line); err != nil {
+		t.fail(err)
+		return err
+	}
+	return nil
+}
+
+// WriteEvent forwards an event to the sink and stops all streams if the sink fails
+func (t *podTailer) WriteEvent(event StreamEvent) error {
+	if err := t.sink.WriteEvent(event); err != nil {
+		t.fail(err)
+		return err
+	}
+	return nil
+}
+
+// fail records the first sink error and cancels all streams
+func (t *podTailer) fail(err error) {
+	t.cancel()
+
+	// fail may be called with t.mu held (from attach), so the error is recorded without locking it
+	t.errOnce.Do(func() {
+		t.err = err
+	})
+}
+
+// result stops all streams and returns the recorded sink error if there is one, otherwise err
+func (t *podTailer) result(err error) error {
+	t.cancel()
+	t.wg.Wait()
+	if t.err != nil {
+		return fmt.Errorf("error writing log line: %w", t.err)
+	}
+	return err
+}
@@ -0,0 +1,73 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+)
+
+// TestPodTailerWatchBackoff checks that a followed stream whose pod watches keep ending backs off before
+// watching again, and starts over from the initial backoff after a watch that delivered events
+func TestPodTailerWatchBackoff(t *testing.T) {
+	pending := &corev1.Pod{ObjectMeta: metav1.ObjectMeta{Name: "api-0", Namespace: "shop"}}
+
+	tests := []struct {
+		name string
+		// watch feeds each watcher opened by the tailer
+		watch func(w *watch.FakeWatcher)
+		// want is the number of watches opened in 1.25s: at 0, 0.5s and 1.5s when backing off, and at
+		// 0, 0.5s and 1s when each watch resets the backoff
+		want int32
+	}{
+		{
+			name:  "watch closed",
+			watch: func(w *watch.FakeWatcher) { w.Stop() },
+			want:  2,
+		},
+		{
+			name:  "resource version expired",
+			watch: func(w *watch.FakeWatcher) { w.Error(&metav1.Status{Reason: metav1.StatusReasonExpired, Code: 410}) },
+			want:  2,
+		},
+		{
+			name: "pod changed",
+			watch: func(w *watch.FakeWatcher) {
+				w.Modify(pending)
+				w.Stop()
+			},
+			want: 3,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var watches atomic.Int32
+			clientset := fake.NewSimpleClientset()
+			clientset.PrependWatchReactor("pods", func(k8stesting.Action) (bool, watch.Interface, error) {
+				watches.Add(1)
+				watcher := watch.NewFakeWithChanSize(2, false)
+				tt.watch(watcher)
+				return true, watcher, nil
+			})
+			k := NewKubernetesServiceForClient(clientset)
+
+			ctx, cancel := context.WithTimeout(context.Background(), 1250*time.Millisecond)
+			defer cancel()
+			err := k.StreamSelectorLogs(ctx, "shop", "app=api", "", LogOptions{Follow: true}, &recordingSink{})
+			if !errors.Is(err, context.DeadlineExceeded) {
+				t.Errorf("StreamSelectorLogs = %v, want it to run until the deadline", err)
+			}
+			if got := watches.Load(); got != tt.want {
+				t.Errorf("opened %d watches, want %d", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,285 @@
+package services
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Server-enforced limits for multiline grouping
+const (
+	// DefaultMultilineTimeout is how long an event is held waiting for more continuation lines
+	DefaultMultilineTimeout = time.Second
+	// MaxMultilineTimeout is the longest flush timeout accepted
+	MaxMultilineTimeout = 10 * time.Second
+	// MaxMultilineLines is the largest number of lines grouped into one event; longer events are split
+	MaxMultilineLines = 500
+)
+
+// Built-in multiline presets
+const (
+	// MultilineJava groups Java stack traces: "at" frames, "Caused by:", "... N more" and the exception line
+	MultilineJava = "java"
+	// MultilinePython groups Python tracebacks, including chained exceptions and the final exception line
+	MultilinePython = "python"
+	// MultilineGo groups Go panics and goroutine dumps
+	MultilineGo = "go"
+)
+
+// multilinePresets holds the continuation patterns of each preset
+// A line matching any of them is appended to the event before it
+var multilinePresets = map[string][]*regexp.Regexp{
+	MultilineJava: {
+		regexp.MustCompile(`^\s+at\s`),
+		regexp.MustCompile(`^\s+\.\.\. \d+ (?:more|common frames omitted)`),
+		regexp.MustCompile(`^\s*(?:Caused by|Suppressed): `),
+		regexp.MustCompile(`^(?:[a-zA-Z_$][\w$]*\.)+[\w$]*(?:Exception|Error|Throwable)(?::\s.*)?$`),
+	},
+	MultilinePython: {
+		regexp.MustCompile(`^Traceback \(most recent call last\):`),
+		regexp.MustCompile(`^\s+`),
+		regexp.MustCompile(`^\s*$`),
+		regexp.MustCompile(`^(?:During handling of the above exception|The above exception was the direct cause)`),
+		regexp.MustCompile(`^(?:[a-zA-Z_]\w*\.)*[A-Z]\w*(?:Error|Exception|Warning|Exit|Interrupt)(?::\s.*)?$`),
+	},
+	MultilineGo: {
+		regexp.MustCompile(`^\s+`),
+		regexp.MustCompile(`^\s*$`),
+		regexp.MustCompile(`^goroutine \d+ \[.*\]:$`),
+		regexp.MustCompile(`^[\w./-]+\.[\w.*()\[\],-]+\(.*\)$`),
+		regexp.MustCompile(`^created by \S+`),
+		regexp.MustCompile(`^\[(?:signal|recovered)\b`),
+		regexp.MustCompile(`^exit status \d+$`),
+	},
+}
+
+// MultilineConfig describes how consecutive lines of a container are grouped into events
+// With Start patterns, a line begins a new event only if it matches one of them; every other line
+// continues the current event. Presets add patterns for lines that always continue the current event.
+// An event is sent once the next one starts, or when no line has followed it for Timeout
+type MultilineConfig struct {
+	Presets []string
+	Start   []string
+	Timeout time.Duration
+}
+
+// Multiline is a compiled MultilineConfig
+type Multiline struct {
+	config       MultilineConfig
+	start        []*regexp.Regexp
+	continuation []*regexp.Regexp
+}
+
+// NewMultiline validates and compiles a multiline configuration
+func NewMultiline(config MultilineConfig) (*Multiline, error) {
+	if len(config.Start) > MaxFilterPatterns {
+		return nil, fmt.Errorf("at most %d start patterns are allowed", MaxFilterPatterns)
+	}
+	if config.Timeout == 0 {
+		config.Timeout = DefaultMultilineTimeout
+	}
+	if config.Timeout < 0 || config.Timeout > MaxMultilineTimeout {
+		return nil, fmt.Errorf("multiline timeout must be between 0 and %s", MaxMultilineTimeout)
+	}
+
+	multiline := &Multiline{config: config}
+
+	for _, name := range config.Presets {
+		patterns, ok := multilinePresets[strings.ToLower(name)]
+		if !ok {
+			return nil, fmt.Errorf("unknown multiline preset: %q (expected %s, %s or %s)", name, MultilineJava, MultilinePython, MultilineGo)
+		}
+		multiline.continuation = append(multiline.continuation, patterns...)
+	}
+
+	for _, pattern := range config.Start {
+		if len(pattern) > MaxFilterPatternLength {
+			return nil, fmt.Errorf("start patterns must not exceed %d characters", MaxFilterPatternLength)
+		}
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			return nil, fmt.Errorf("invalid start pattern %q: %w", pattern, err)
+		}
+		multiline.start = append(multiline.start, re)
+	}
+
+	return multiline, nil
+}
+
+// Config returns the configuration the grouping was built from
+func (m *Multiline) Config() MultilineConfig {
+	return m.config
+}
+
+// continues reports whether a line belongs to the event before it
+// The Kubernetes timestamp prefix, if present, is ignored
+func (m *Multiline) continues(content []byte) bool {
+	_, content = SplitTimestamp(content)
+	content = trimNewline(content)
+
+	for _, re := range m.continuation {
+		if re.Match(content) {
+			return true
+		}
+	}
+
+	if len(m.start) == 0 {
+		return false
+	}
+	for _, re := range m.start {
+		if re.Match(content) {
+			return false
+		}
+	}
+	return true
+}
+
+// Group groups the continuation lines of a slice of lines, such as fetched history, into events
+// Unlike MultilineSink, it never waits: the last event ends with the slice
+func (m *Multiline) Group(lines []LogLine) []LogLine {
+	grouped := make([]LogLine, 0, len(lines))
+	for _, line := range lines {
+		if n := len(grouped); n > 0 {
+			event := &grouped[n-1]
+			if event.Namespace == line.Namespace && event.Pod == line.Pod && event.Container == line.Container &&
+				m.continues(line.Content) && m.fits(*event, line) {
+				event.Content = append(event.Content, line.Content...)
+				event.Lines++
+				continue
+			}
+		}
+		line.Content = append([]byte(nil), line.Content...)
+		line.Lines = 1
+		grouped = append(grouped, line)
+	}
+	return grouped
+}
+
+// fits reports whether line can be added to event without exceeding the event size limits
+func (m *Multiline) fits(event LogLine, line LogLine) bool {
+	return event.Lines < MaxMultilineLines && len(event.Content)+len(line.Content) <= maxLogLineSize
+}
+
+// trimNewline removes the line terminator
+func trimNewline(content []byte) []byte {
+	for len(content) > 0 && (content[len(content)-1] == '\n' || content[len(content)-1] == '\r') {
+		content = content[:len(content)-1]
+	}
+	return content
+}
+
+// MultilineSink groups continuation lines into single events before handing them to the next sink
+// Events are tracked per container. A container's pending event is sent before any stream event about
+// that container (or its pod), so a detach or restart never overtakes its last lines. Call Flush when
+// the stream ends
+type MultilineSink struct {
+	multiline *Multiline
+	next      LogSink
+
+	mu      sync.Mutex
+	pending map[string]*multilineEvent
+	// err is the first error from a flush run by a timer, returned by the next write
+	err error
+}
+
+// multilineEvent is an event still waiting for continuation lines
+type multilineEvent struct {
+	line  LogLine
+	timer *time.Timer
+}
+
+// NewMultilineSink creates a sink that groups lines before writing them to next
+func NewMultilineSink(multiline *Multiline, next LogSink) *MultilineSink {
+	return &MultilineSink{
+		multiline: multiline,
+		next:      next,
+		pending:   make(map[string]*multilineEvent),
+	}
+}
+
+// WriteLine implements LogSink
+func (s *MultilineSink) WriteLine(line LogLine) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.err != nil {
+		return s.err
+	}
+
+	key := line.Namespace + "/" + line.Pod + "/" + line.Container
+	if event, ok := s.pending[key]; ok {
+		if s.multiline.continues(line.Content) && s.multiline.fits(event.line, line) {
+			event.line.Content = append(event.line.Content, line.Content...)
+			event.line.Lines++
+			event.timer.Reset(s.multiline.config.Timeout)
+			return nil
+		}
+		if err := s.flush(key); err != nil {
+			return err
+		}
+	}
+
+	// The content is extended in place, so it must not share the caller's buffer
+	line.Content = append([]byte(nil), line.Content...)
+	line.Lines = 1
+	event := &multilineEvent{line: line}
+	event.timer = time.AfterFunc(s.multiline.config.Timeout, func() {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		// The event may have been sent, or replaced by a newer one, since the timer fired
+		if s.pending[key] == event {
+			if err := s.flush(key); err != nil && s.err == nil {
+				s.err = err
+			}
+		}
+	})
+	s.pending[key] = event
+	return nil
+}
+
+// WriteEvent implements LogSink
+func (s *MultilineSink) WriteEvent(event StreamEvent) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if event.Pod != "" {
+		for key, pending := range s.pending {
+			line := pending.line
+			if line.Pod != event.Pod || (event.Namespace != "" && line.Namespace != event.Namespace) ||
+				(event.Container != "" && line.Container != event.Container) {
+				continue
+			}
+			if err := s.flush(key); err != nil {
+				return err
+			}
+		}
+	}
+	return s.next.WriteEvent(event)
+}
+
+// Flush sends every pending event
+func (s *MultilineSink) Flush() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for key := range s.pending {
+		if err := s.flush(key); err != nil {
+			return err
+		}
+	}
+	return s.err
+}
+
+// flush sends the pending event of a container, if any
+// The caller must hold s.mu
+func (s *MultilineSink) flush(key string) error {
+	event, ok := s.pending[key]
+	if !ok {
+		return nil
+	}
+	delete(s.pending, key)
+	event.timer.Stop()
+	return s.next.WriteLine(event.line)
+}
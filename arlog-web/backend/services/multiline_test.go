@@ -0,0 +1,353 @@
+package services
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// recordingSink records what is written to it
+type recordingSink struct {
+	mu     sync.Mutex
+	writes []string
+	lines  []LogLine
+	events []StreamEvent
+	err    error
+}
+
+func (s *recordingSink) WriteLine(line LogLine) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.lines = append(s.lines, line)
+	s.writes = append(s.writes, "line "+strings.TrimSuffix(string(line.Content), "\n"))
+	return s.err
+}
+
+func (s *recordingSink) WriteEvent(event StreamEvent) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.writes = append(s.writes, fmt.Sprintf("%s %s/%s", event.Type, event.Pod, event.Container))
+	s.events = append(s.events, event)
+	return s.err
+}
+
+// recorded returns the lines written so far
+func (s *recordingSink) recorded() []LogLine {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]LogLine(nil), s.lines...)
+}
+
+// recordedEvents returns the events written so far
+func (s *recordingSink) recordedEvents() []StreamEvent {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]StreamEvent(nil), s.events...)
+}
+
+// multilineInput splits an event list into the lines of container api, prefixed with timestamp if set
+func multilineInput(events [][]string, timestamp string) []LogLine {
+	var lines []LogLine
+	for _, event := range events {
+		for _, text := range event {
+			lines = append(lines, LogLine{Namespace: "shop", Pod: "api-0", Container: "api", Content: []byte(timestamp + text + "\n")})
+		}
+	}
+	return lines
+}
+
+// checkEvents compares grouped lines with the wanted events
+func checkEvents(t *testing.T, got []LogLine, want [][]string, timestamp string) {
+	t.Helper()
+	if len(got) != len(want) {
+		t.Fatalf("got %d events, want %d", len(got), len(want))
+	}
+	for i, event := range got {
+		var content strings.Builder
+		for _, text := range want[i] {
+			content.WriteString(timestamp + text + "\n")
+		}
+		if string(event.Content) != content.String() {
+			t.Errorf("event %d = %q, want %q", i, event.Content, content.String())
+		}
+		if event.Lines != len(want[i]) {
+			t.Errorf("event %d has Lines = %d, want %d", i, event.Lines, len(want[i]))
+		}
+	}
+}
+
+func TestMultilinePresets(t *testing.T) {
+	tests := []struct {
+		name   string
+		config MultilineConfig
+		// events are the wanted events; their lines, in order, are the input
+		events [][]string
+	}{
+		{
+			name:   "java",
+			config: MultilineConfig{Presets: []string{MultilineJava}},
+			events: [][]string{
+				{"2024-01-02 15:04:05 INFO starting"},
+				{
+					"2024-01-02 15:04:05 ERROR request failed",
+					"java.lang.IllegalStateException: connection pool exhausted",
+					"\tat com.example.db.Pool.acquire(Pool.java:88)",
+					"\tat com.example.api.Handler.handle(Handler.java:42)",
+					"Caused by: java.net.SocketTimeoutException: connect timed out",
+					"\tat java.base/java.net.Socket.connect(Socket.java:633)",
+					"\t... 12 more",
+					"\tSuppressed: java.io.IOException: close failed",
+					"\t\tat com.example.db.Conn.close(Conn.java:19)",
+					"\t\t... 3 common frames omitted",
+				},
+				{"2024-01-02 15:04:06 INFO retrying"},
+				{"Exception in thread \"main\" java.lang.NullPointerException", "\tat com.example.Main.main(Main.java:5)"},
+			},
+		},
+		{
+			name:   "python",
+			config: MultilineConfig{Presets: []string{MultilinePython}},
+			events: [][]string{
+				{
+					"ERROR:root:job failed",
+					"Traceback (most recent call last):",
+					"  File \"job.py\", line 12, in run",
+					"    value = int(raw)",
+					"ValueError: invalid literal for int() with base 10: 'x'",
+					"",
+					"During handling of the above exception, another exception occurred:",
+					"",
+					"Traceback (most recent call last):",
+					"  File \"job.py\", line 14, in run",
+					"    raise JobError(raw) from None",
+					"jobs.errors.JobError: x",
+				},
+				{"INFO:root:next job"},
+			},
+		},
+		{
+			name:   "go panic",
+			config: MultilineConfig{Presets: []string{MultilineGo}},
+			events: [][]string{
+				{"level=info msg=serving"},
+				{
+					"panic: runtime error: invalid memory address or nil pointer dereference",
+					"[signal SIGSEGV: segmentation violation code=0x1 addr=0x0 pc=0x4a2f1c]",
+					"",
+					"goroutine 1 [running]:",
+					"main.(*Server).handle(0x0, {0xc000012345, 0x3})",
+					"\t/app/server.go:42 +0x1c",
+					"main.main()",
+					"\t/app/main.go:12 +0x25",
+					"",
+					"goroutine 7 [chan receive, 2 minutes]:",
+					"net/http.(*conn).serve(0xc0001a2000)",
+					"\t/usr/local/go/src/net/http/server.go:2009 +0x5f4",
+					"created by net/http.(*Server).Serve in goroutine 1",
+					"\t/usr/local/go/src/net/http/server.go:3086 +0x5cb",
+					"exit status 2",
+				},
+				{"level=info msg=restarted"},
+			},
+		},
+		{
+			name:   "start pattern",
+			config: MultilineConfig{Start: []string{`^\d{4}-\d{2}-\d{2} `}},
+			events: [][]string{
+				{"2024-01-02 15:04:05 query plan:", "  seq scan on orders", "  filter: status = 'open'"},
+				{"2024-01-02 15:04:06 done"},
+			},
+		},
+		{
+			name:   "preset with start pattern",
+			config: MultilineConfig{Presets: []string{"JAVA"}, Start: []string{`^\[`}},
+			events: [][]string{
+				{"[main] failed", "java.lang.RuntimeException: boom", "\tat Main.main(Main.java:1)", "details follow"},
+				{"[main] recovered"},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		multiline, err := NewMultiline(tt.config)
+		if err != nil {
+			t.Fatalf("%s: NewMultiline: %v", tt.name, err)
+		}
+		// Patterns must ignore the Kubernetes timestamp prefix
+		for _, timestamp := range []string{"", "2024-01-02T15:04:05.123456789Z "} {
+			t.Run(fmt.Sprintf("%s/timestamp=%t", tt.name, timestamp != ""), func(t *testing.T) {
+				lines := multilineInput(tt.events, timestamp)
+				checkEvents(t, multiline.Group(lines), tt.events, timestamp)
+
+				next := &recordingSink{}
+				sink := NewMultilineSink(multiline, next)
+				for _, line := range lines {
+					if err := sink.WriteLine(line); err != nil {
+						t.Fatalf("WriteLine: %v", err)
+					}
+				}
+				if err := sink.Flush(); err != nil {
+					t.Fatalf("Flush: %v", err)
+				}
+				checkEvents(t, next.recorded(), tt.events, timestamp)
+			})
+		}
+	}
+}
+
+func TestMultilineSplitsLongEvents(t *testing.T) {
+	multiline, err := NewMultiline(MultilineConfig{Presets: []string{MultilineJava}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := []LogLine{{Pod: "api-0", Container: "api", Content: []byte("java.lang.Error: deep\n")}}
+	for i := 0; i < MaxMultilineLines+10; i++ {
+		lines = append(lines, LogLine{Pod: "api-0", Container: "api", Content: []byte("\tat Deep.call(Deep.java:1)\n")})
+	}
+
+	grouped := multiline.Group(lines)
+	if len(grouped) != 2 || grouped[0].Lines != MaxMultilineLines || grouped[1].Lines != 11 {
+		t.Fatalf("grouped %d lines into %d events, want events of %d and 11 lines", len(lines), len(grouped), MaxMultilineLines)
+	}
+}
+
+func TestMultilineSinkFlush(t *testing.T) {
+	multiline, err := NewMultiline(MultilineConfig{Presets: []string{MultilineJava}, Timeout: MaxMultilineTimeout})
+	if err != nil {
+		t.Fatal(err)
+	}
+	line := func(container, text string) LogLine {
+		return LogLine{Namespace: "shop", Pod: "api-0", Container: container, Content: []byte(text + "\n")}
+	}
+
+	next := &recordingSink{}
+	sink := NewMultilineSink(multiline, next)
+	if err := sink.Flush(); err != nil {
+		t.Fatalf("Flush without pending events: %v", err)
+	}
+
+	writes := []LogLine{
+		line("api", "request failed"),
+		line("sidecar", "proxy error"),
+		line("api", "\tat Handler.handle(Handler.java:1)"),
+	}
+	for _, write := range writes {
+		if err := sink.WriteLine(write); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if got := next.recorded(); len(got) != 0 {
+		t.Fatalf("%d events were sent before Flush", len(got))
+	}
+
+	if err := sink.Flush(); err != nil {
+		t.Fatalf("Flush: %v", err)
+	}
+	got := next.recorded()
+	if len(got) != 2 {
+		t.Fatalf("Flush sent %d events, want 2", len(got))
+	}
+	events := map[string]string{}
+	for _, event := range got {
+		events[event.Container] = string(event.Content)
+	}
+	if events["api"] != "request failed\n\tat Handler.handle(Handler.java:1)\n" || events["sidecar"] != "proxy error\n" {
+		t.Errorf("Flush sent %q", events)
+	}
+
+	// A continuation line after Flush cannot join the event already sent, so it starts a new one
+	if err := sink.WriteLine(line("api", "\tat Main.main(Main.java:1)")); err != nil {
+		t.Fatal(err)
+	}
+	if err := sink.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	got = next.recorded()
+	if len(got) != 3 || string(got[2].Content) != "\tat Main.main(Main.java:1)\n" || got[2].Lines != 1 {
+		t.Errorf("the continuation line after Flush was sent as %q", got[len(got)-1].Content)
+	}
+
+	// Flushing again sends nothing
+	if err := sink.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if n := len(next.recorded()); n != 3 {
+		t.Errorf("a second Flush sent %d more events", n-3)
+	}
+}
+
+func TestMultilineSinkEventsFlushTheirContainer(t *testing.T) {
+	multiline, err := NewMultiline(MultilineConfig{Presets: []string{MultilineJava}, Timeout: MaxMultilineTimeout})
+	if err != nil {
+		t.Fatal(err)
+	}
+	next := &recordingSink{}
+	sink := NewMultilineSink(multiline, next)
+	for _, line := range []LogLine{
+		{Pod: "api-0", Container: "api", Content: []byte("api line\n")},
+		{Pod: "api-0", Container: "sidecar", Content: []byte("sidecar line\n")},
+		{Pod: "api-1", Container: "api", Content: []byte("other pod line\n")},
+	} {
+		if err := sink.WriteLine(line); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// The detach of api-0/api sends only that container's event, and before the detach
+	if err := sink.WriteEvent(StreamEvent{Type: StreamEventDetached, Pod: "api-0", Container: "api"}); err != nil {
+		t.Fatal(err)
+	}
+	// A pod-wide event sends the events of every container of the pod
+	if err := sink.WriteEvent(StreamEvent{Type: StreamEventDetached, Pod: "api-0"}); err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"line api line", "detached api-0/api", "line sidecar line", "detached api-0/"}
+	if got := strings.Join(next.writes, "; "); got != strings.Join(want, "; ") {
+		t.Errorf("writes = %s, want %s", got, strings.Join(want, "; "))
+	}
+}
+
+func TestMultilineSinkTimeout(t *testing.T) {
+	multiline, err := NewMultiline(MultilineConfig{Presets: []string{MultilineJava}, Timeout: 20 * time.Millisecond})
+	if err != nil {
+		t.Fatal(err)
+	}
+	next := &recordingSink{}
+	sink := NewMultilineSink(multiline, next)
+	if err := sink.WriteLine(LogLine{Pod: "api-0", Container: "api", Content: []byte("request failed\n")}); err != nil {
+		t.Fatal(err)
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for len(next.recorded()) == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("the event was not sent after the timeout")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	// A failed write from the timer is returned by the next call
+	failed := errors.New("client gone")
+	next.mu.Lock()
+	next.err = failed
+	next.mu.Unlock()
+	if err := sink.WriteLine(LogLine{Pod: "api-0", Container: "api", Content: []byte("again\n")}); err != nil {
+		t.Fatal(err)
+	}
+	deadline = time.Now().Add(5 * time.Second)
+	for len(next.recorded()) < 2 {
+		if time.Now().After(deadline) {
+			t.Fatal("the second event was not sent after the timeout")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	if err := sink.WriteLine(LogLine{Pod: "api-0", Container: "api", Content: []byte("more\n")}); !errors.Is(err, failed) {
+		t.Errorf("WriteLine after a failed timed flush = %v, want %v", err, failed)
+	}
+	if err := sink.Flush(); !errors.Is(err, failed) {
+		t.Errorf("Flush after a failed timed flush = %v, want %v", err, failed)
+	}
+}
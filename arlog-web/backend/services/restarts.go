@@ -0,0 +1,191 @@
+package services
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/apimachinery/pkg/watch"
+)
+
+// restartWatchRetryInterval is how long to wait before re-checking a pod when its watch cannot be opened,
+// or ends without an event
+const restartWatchRetryInterval = 5 * time.Second
+
+// followRestarts streams a container and, once an instance ends, waits for the kubelet to start
+// the next one and carries on with its logs. A restarted event carrying the previous instance's
+// exit code and reason marks each switch. It returns once the container will not be restarted
+func (k *KubernetesService) followRestarts(ctx context.Context, namespace, podName, container, containerID string, opts LogOptions, sink LogSink) error {
+	for {
+		if err := k.streamContainerLogs(ctx, namespace, podName, container, containerID, opts, sink); err != nil {
+			return err
+		}
+
+		next, err := k.waitForRestart(ctx, namespace, podName, container, containerID, sink)
+		if err != nil || next == nil {
+			return err
+		}
+
+		if err := sink.WriteEvent(restartEvent(namespace, podName, *next)); err != nil {
+			return fmt.Errorf("error writing log line: %w", err)
+		}
+
+		// The new instance has just started; stream its whole log
+		containerID = next.ContainerID
+		opts.TailLines, opts.SinceSeconds, opts.SinceTime = nil, nil, nil
+	}
+}
+
+// streamPreviousTail sends the last lines of the previous instance of a restarted container,
+// followed by a restarted event describing how it ended
+func (k *KubernetesService) streamPreviousTail(ctx context.Context, namespace, podName string, status corev1.ContainerStatus, tailLines int64, timestamps bool, sink LogSink) error {
+	previous := LogOptions{Previous: true, TailLines: &tailLines, Timestamps: timestamps}
+	if err := k.streamContainerLogs(ctx, namespace, podName, status.Name, "", previous, sink); err != nil {
+		return err
+	}
+
+	if err := sink.WriteEvent(restartEvent(namespace, podName, status)); err != nil {
+		return fmt.Errorf("error writing log line: %w", err)
+	}
+	return nil
+}
+
+// waitForRestart waits until an instance other than containerID of the container has started
+// It returns the status of the new instance, or nil if the container is not going to be restarted
+// because the pod finished, was deleted or its restart policy rules it out
+func (k *KubernetesService) waitForRestart(ctx context.Context, namespace, podName, container, containerID string, sink LogSink) (*corev1.ContainerStatus, error) {
+	reported := false
+
+	for {
+		pod, err := k.clientset.CoreV1().Pods(namespace).Get(ctx, podName, metav1.GetOptions{})
+		if err != nil {
+			if apierrors.IsNotFound(err) {
+				return nil, nil
+			}
+			if ctx.Err() != nil {
+				return nil, ctx.Err()
+			}
+			return nil, fmt.Errorf("failed to get pod: %w", err)
+		}
+
+		status, found := findContainerStatus(pod, container)
+		if !found {
+			return nil, nil
+		}
+		if status.ContainerID != containerID && (status.State.Running != nil || status.State.Terminated != nil) {
+			return &status, nil
+		}
+		if !willRestart(pod, status) {
+			return nil, nil
+		}
+
+		// Crash-looping containers can wait minutes in back-off; let the client know why it is quiet
+		if !reported && status.State.Waiting != nil {
+			reported = true
+			message := "container exited; waiting for it to restart"
+			if reason := status.State.Waiting.Reason; reason != "" {
+				message += " (" + reason + ")"
+			}
+			if err := sink.WriteEvent(StreamEvent{Type: StreamEventWaiting, Namespace: namespace, Pod: podName, Container: container, Message: message}); err != nil {
+				return nil, fmt.Errorf("error writing log line: %w", err)
+			}
+		}
+
+		if err := k.waitForPodChange(ctx, pod); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// waitForPodChange blocks until the pod changes after the given version, or the watch ends
+// A watch that cannot be opened, or that ends without reporting a change, is only given up on after
+// restartWatchRetryInterval, so an expired resource version or a proxy closing watches does not make
+// the caller poll the pod in a tight loop
+func (k *KubernetesService) waitForPodChange(ctx context.Context, pod *corev1.Pod) error {
+	watcher, err := k.clientset.CoreV1().Pods(pod.Namespace).Watch(ctx, metav1.ListOptions{
+		FieldSelector:   fields.OneTermEqualSelector("metadata.name", pod.Name).String(),
+		ResourceVersion: pod.ResourceVersion,
+	})
+	if err != nil {
+		return waitWatchRetry(ctx)
+	}
+	defer watcher.Stop()
+
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case event, ok := <-watcher.ResultChan():
+		if ok && event.Type != watch.Error {
+			return nil
+		}
+	}
+	return waitWatchRetry(ctx)
+}
+
+// waitWatchRetry waits restartWatchRetryInterval before a watch is opened again
+func waitWatchRetry(ctx context.Context) error {
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-time.After(restartWatchRetryInterval):
+		return nil
+	}
+}
+
+// willRestart reports whether the kubelet is expected to start another instance of a container
+func willRestart(pod *corev1.Pod, status corev1.ContainerStatus) bool {
+	if pod.DeletionTimestamp != nil || pod.Status.Phase == corev1.PodSucceeded || pod.Status.Phase == corev1.PodFailed {
+		return false
+	}
+
+	switch pod.Spec.RestartPolicy {
+	case corev1.RestartPolicyNever:
+		return false
+	case corev1.RestartPolicyOnFailure:
+		terminated := status.State.Terminated
+		if terminated == nil {
+			terminated = status.LastTerminationState.Terminated
+		}
+		return terminated == nil || terminated.ExitCode != 0
+	default:
+		return true
+	}
+}
+
+// findContainerStatus returns the status of the named container
+func findContainerStatus(pod *corev1.Pod, container string) (corev1.ContainerStatus, bool) {
+	for _, status := range containerStatuses(pod) {
+		if status.Name == container {
+			return status, true
+		}
+	}
+	return corev1.ContainerStatus{}, false
+}
+
+// restartEvent describes a container restart from the status of its new instance
+func restartEvent(namespace, podName string, status corev1.ContainerStatus) StreamEvent {
+	event := StreamEvent{
+		Type:      StreamEventRestarted,
+		Namespace: namespace,
+		Pod:       podName,
+		Container: status.Name,
+		Count:     int64(status.RestartCount),
+		Message:   fmt.Sprintf("container restarted (restart %d)", status.RestartCount),
+	}
+
+	if terminated := status.LastTerminationState.Terminated; terminated != nil {
+		exitCode := terminated.ExitCode
+		event.ExitCode = &exitCode
+		event.Reason = terminated.Reason
+		event.Message = fmt.Sprintf("container restarted (restart %d) after exiting with code %d", status.RestartCount, exitCode)
+		if terminated.Reason != "" {
+			event.Message += ": " + terminated.Reason
+		}
+	}
+
+	return event
+}
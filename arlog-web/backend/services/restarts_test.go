@@ -0,0 +1,75 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+)
+
+// TestWaitForPodChange checks that a watch ending without a change backs off instead of returning at once
+func TestWaitForPodChange(t *testing.T) {
+	pod := &corev1.Pod{ObjectMeta: metav1.ObjectMeta{Name: "api-0", Namespace: "shop", ResourceVersion: "7"}}
+
+	tests := []struct {
+		name string
+		// watch feeds the watcher opened by waitForPodChange
+		watch func(w *watch.FakeWatcher)
+		// backoff is set when waitForPodChange must wait restartWatchRetryInterval
+		backoff bool
+	}{
+		{
+			name:  "pod changed",
+			watch: func(w *watch.FakeWatcher) { w.Modify(pod) },
+		},
+		{
+			name:    "watch closed",
+			watch:   func(w *watch.FakeWatcher) { w.Stop() },
+			backoff: true,
+		},
+		{
+			name:    "resource version expired",
+			watch:   func(w *watch.FakeWatcher) { w.Error(&metav1.Status{Reason: metav1.StatusReasonExpired, Code: 410}) },
+			backoff: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			clientset := fake.NewSimpleClientset()
+			clientset.PrependWatchReactor("pods", func(k8stesting.Action) (bool, watch.Interface, error) {
+				watcher := watch.NewFakeWithChanSize(1, false)
+				tt.watch(watcher)
+				return true, watcher, nil
+			})
+			k := NewKubernetesServiceForClient(clientset)
+
+			ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+			defer cancel()
+			err := k.waitForPodChange(ctx, pod)
+			if tt.backoff && !errors.Is(err, context.DeadlineExceeded) {
+				t.Errorf("waitForPodChange = %v before the retry interval, want it to wait", err)
+			}
+			if !tt.backoff && err != nil {
+				t.Errorf("waitForPodChange = %v, want nil", err)
+			}
+		})
+	}
+
+	// A watch that cannot be opened backs off too
+	clientset := fake.NewSimpleClientset()
+	clientset.PrependWatchReactor("pods", func(k8stesting.Action) (bool, watch.Interface, error) {
+		return true, nil, errors.New("proxy refused the watch")
+	})
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	if err := NewKubernetesServiceForClient(clientset).waitForPodChange(ctx, pod); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("waitForPodChange = %v after the watch failed, want it to wait", err)
+	}
+}
@@ -0,0 +1,224 @@
+package services
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+// Supported workload kinds
+const (
+	WorkloadDeployment  = "Deployment"
+	WorkloadStatefulSet = "StatefulSet"
+	WorkloadDaemonSet   = "DaemonSet"
+	WorkloadJob         = "Job"
+	WorkloadCronJob     = "CronJob"
+)
+
+// workloadKindAliases maps lower-case kind names and kubectl short names to workload kinds
+var workloadKindAliases = map[string]string{
+	"deployment":   WorkloadDeployment,
+	"deployments":  WorkloadDeployment,
+	"deploy":       WorkloadDeployment,
+	"statefulset":  WorkloadStatefulSet,
+	"statefulsets": WorkloadStatefulSet,
+	"sts":          WorkloadStatefulSet,
+	"daemonset":    WorkloadDaemonSet,
+	"daemonsets":   WorkloadDaemonSet,
+	"ds":           WorkloadDaemonSet,
+	"job":          WorkloadJob,
+	"jobs":         WorkloadJob,
+	"cronjob":      WorkloadCronJob,
+	"cronjobs":     WorkloadCronJob,
+	"cj":           WorkloadCronJob,
+}
+
+// jobNameLabel is set by the Job controller on every pod it creates
+const jobNameLabel = "job-name"
+
+// WorkloadRef identifies a workload by kind and name
+type WorkloadRef struct {
+	Kind string
+	Name string
+}
+
+// String returns the kubectl-style kind/name representation
+func (w WorkloadRef) String() string {
+	return strings.ToLower(w.Kind) + "/" + w.Name
+}
+
+// ParseWorkloadRef parses a kubectl-style "kind/name" reference such as "deployment/api"
+func ParseWorkloadRef(value string) (WorkloadRef, error) {
+	kind, name, found := strings.Cut(value, "/")
+	if !found || kind == "" || name == "" {
+		return WorkloadRef{}, fmt.Errorf("workload must be in the form kind/name")
+	}
+
+	resolvedKind, ok := workloadKindAliases[strings.ToLower(kind)]
+	if !ok {
+		return WorkloadRef{}, fmt.Errorf("unsupported workload kind: %q", kind)
+	}
+
+	return WorkloadRef{Kind: resolvedKind, Name: name}, nil
+}
+
+// StreamWorkloadLogs tails all pods belonging to a workload
+// Pods are resolved through the workload's selector and owner references, so with opts.Follow
+// the stream keeps up with rollouts: new ReplicaSets and Jobs are picked up as their pods start
+func (k *KubernetesService) StreamWorkloadLogs(ctx context.Context, namespace string, workload WorkloadRef, container string, opts LogOptions, sink LogSink) error {
+	if err := opts.Validate(); err != nil {
+		return fmt.Errorf("invalid log options: %w", err)
+	}
+
+	selector, owner, err := k.resolveWorkload(ctx, namespace, workload)
+	if err != nil {
+		return err
+	}
+
+	tailer := newPodTailer(k, namespace, container, opts, sink)
+	tailer.owns = owner.owns
+	return tailer.run(ctx, metav1.ListOptions{LabelSelector: selector})
+}
+
+// resolveWorkload returns the label selector that narrows down the workload's pods and the
+// owner check that confirms a pod actually belongs to it
+func (k *KubernetesService) resolveWorkload(ctx context.Context, namespace string, workload WorkloadRef) (string, *workloadOwner, error) {
+	var (
+		uid           types.UID
+		labelSelector *metav1.LabelSelector
+		err           error
+	)
+
+	switch workload.Kind {
+	case WorkloadDeployment:
+		deployment, getErr := k.clientset.AppsV1().Deployments(namespace).Get(ctx, workload.Name, metav1.GetOptions{})
+		err = getErr
+		if err == nil {
+			uid, labelSelector = deployment.UID, deployment.Spec.Selector
+		}
+	case WorkloadStatefulSet:
+		statefulSet, getErr := k.clientset.AppsV1().StatefulSets(namespace).Get(ctx, workload.Name, metav1.GetOptions{})
+		err = getErr
+		if err == nil {
+			uid, labelSelector = statefulSet.UID, statefulSet.Spec.Selector
+		}
+	case WorkloadDaemonSet:
+		daemonSet, getErr := k.clientset.AppsV1().DaemonSets(namespace).Get(ctx, workload.Name, metav1.GetOptions{})
+		err = getErr
+		if err == nil {
+			uid, labelSelector = daemonSet.UID, daemonSet.Spec.Selector
+		}
+	case WorkloadJob:
+		job, getErr := k.clientset.BatchV1().Jobs(namespace).Get(ctx, workload.Name, metav1.GetOptions{})
+		err = getErr
+		if err == nil {
+			uid, labelSelector = job.UID, job.Spec.Selector
+		}
+	case WorkloadCronJob:
+		cronJob, getErr := k.clientset.BatchV1().CronJobs(namespace).Get(ctx, workload.Name, metav1.GetOptions{})
+		err = getErr
+		if err == nil {
+			// Jobs created by a CronJob get their own generated selectors, so match every Job pod
+			// and rely on the owner chain to pick the right ones
+			uid, labelSelector = cronJob.UID, &metav1.LabelSelector{
+				MatchExpressions: []metav1.LabelSelectorRequirement{
+					{Key: jobNameLabel, Operator: metav1.LabelSelectorOpExists},
+				},
+			}
+		}
+	default:
+		return "", nil, fmt.Errorf("unsupported workload kind: %q", workload.Kind)
+	}
+
+	if err != nil {
+		return "", nil, fmt.Errorf("failed to get %s: %w", workload, err)
+	}
+
+	selector := labels.Everything()
+	if labelSelector != nil {
+		selector, err = metav1.LabelSelectorAsSelector(labelSelector)
+		if err != nil {
+			return "", nil, fmt.Errorf("invalid selector on %s: %w", workload, err)
+		}
+	}
+
+	owner := &workloadOwner{
+		k:         k,
+		ctx:       ctx,
+		namespace: namespace,
+		kind:      workload.Kind,
+		uid:       uid,
+		owned:     make(map[types.UID]bool),
+	}
+	return selector.String(), owner, nil
+}
+
+// workloadOwner decides whether a pod belongs to a workload by following controller references
+// Deployments own pods through ReplicaSets and CronJobs through Jobs; those intermediate owners
+// are looked up once and cached
+type workloadOwner struct {
+	k         *KubernetesService
+	ctx       context.Context
+	namespace string
+	kind      string
+	uid       types.UID
+
+	mu    sync.Mutex
+	owned map[types.UID]bool
+}
+
+// owns reports whether pod is controlled, directly or through an intermediate owner, by the workload
+func (o *workloadOwner) owns(pod *corev1.Pod) bool {
+	controller := metav1.GetControllerOf(pod)
+	if controller == nil {
+		return false
+	}
+
+	switch o.kind {
+	case WorkloadDeployment:
+		return controller.Kind == "ReplicaSet" && o.ownsIntermediate(controller)
+	case WorkloadCronJob:
+		return controller.Kind == "Job" && o.ownsIntermediate(controller)
+	default:
+		return controller.UID == o.uid
+	}
+}
+
+// ownsIntermediate reports whether the ReplicaSet or Job referenced by ref is controlled by the workload
+func (o *workloadOwner) ownsIntermediate(ref *metav1.OwnerReference) bool {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	if owned, cached := o.owned[ref.UID]; cached {
+		return owned
+	}
+
+	var meta metav1.Object
+	switch ref.Kind {
+	case "ReplicaSet":
+		replicaSet, err := o.k.clientset.AppsV1().ReplicaSets(o.namespace).Get(o.ctx, ref.Name, metav1.GetOptions{})
+		if err != nil {
+			return false
+		}
+		meta = replicaSet
+	case "Job":
+		job, err := o.k.clientset.BatchV1().Jobs(o.namespace).Get(o.ctx, ref.Name, metav1.GetOptions{})
+		if err != nil {
+			return false
+		}
+		meta = job
+	default:
+		return false
+	}
+
+	controller := metav1.GetControllerOfNoCopy(meta)
+	owned := controller != nil && controller.UID == o.uid
+	o.owned[ref.UID] = owned
+	return owned
+}